@@ -3,11 +3,14 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
 
+	"paytabs/internal/memds"
+	"paytabs/internal/scheduler"
 	"paytabs/internal/server"
 )
 
@@ -16,10 +19,37 @@ import (
 func printUsage() {
 	fmt.Println(`
 Usage:
-	bank <port> <datafile> [logfile]
+	bank [options] <port> <datafile> [logfile]
 	port     - port number for the REST service to listen to.
 	datafile - path to json file containing account details to initialize the in-memory datastore.
 	logfile  - optional path to server log file, when ommited stdout will be used.
+
+Options:
+	-journal <file>                - path to the write-ahead journal. Transfers are appended to this file
+	                                 and replayed on startup. When ommited transfers are not persisted.
+	-snapshot-dir <dir>            - directory for datastore snapshots. On startup the newest valid snapshot
+	                                 is loaded instead of <datafile>. When ommited snapshots are disabled.
+	-snapshot-interval <duration>  - interval between periodic snapshots, e.g. 15m. Zero disables periodic
+	                                 snapshots, they can still be taken using POST /admin/snapshot.
+	-default-currency <code>       - ISO 4217 currency for accounts without one in <datafile>, defaults to USD.
+	-fx-rates <file>               - json file with exchange rates for cross-currency transfers, reloaded
+	                                 when it changes. When ommited cross-currency transfers are rejected.
+	-rules <file>                  - json file with transfer limits and velocity rules, see internal/rules.
+	                                 When ommited transfers are limited only by the available funds.
+	-fees <file>                   - json file with the fee schedule of transfers, see internal/fees.
+	                                 When ommited transfers are free.
+	-interest <file>               - json file with the interest policy of savings accounts, see internal/interest.
+	                                 When ommited savings accounts cannot be created.
+	-approvals <file>              - json file with the approval thresholds of transfers, see internal/approvals.
+	                                 When ommited transfers never wait for approval.
+	-api-keys <file>               - json file with the sha256 hashes, scopes and accounts of the API keys, see
+	                                 internal/auth. When ommited requests are not authenticated.
+	-schedules <file>              - json file the scheduled transfers are kept in, rewritten on every change.
+	                                 When ommited scheduled transfers are lost on restart.
+	-idempotency-window <duration> - time an Idempotency-Key of a transfer is remembered, defaults to 24h.
+	                                 Keys survive restarts when -journal is given.
+	-hold-expiry <duration>        - time until a hold expires unless captured or voided, defaults to 168h.
+	                                 A hold request may ask for a different expiry, up to 720h.
 	`)
 }
 
@@ -27,14 +57,32 @@ Usage:
 //
 // Validates the commandline arguments and starts the in-memory datastore server.
 func main() {
+	// parse command line options
+	flag.Usage = printUsage
+	journal := flag.String("journal", "", "path to the write-ahead journal")
+	snapshotDir := flag.String("snapshot-dir", "", "directory for datastore snapshots")
+	snapshotInterval := flag.Duration("snapshot-interval", 0, "interval between periodic snapshots")
+	fxRates := flag.String("fx-rates", "", "json file with exchange rates")
+	rulesFile := flag.String("rules", "", "json file with transfer limits and velocity rules")
+	feesFile := flag.String("fees", "", "json file with the fee schedule of transfers")
+	interestFile := flag.String("interest", "", "json file with the interest policy of savings accounts")
+	approvalsFile := flag.String("approvals", "", "json file with the approval thresholds of transfers")
+	apiKeysFile := flag.String("api-keys", "", "json file with the API keys")
+	schedulesFile := flag.String("schedules", "", "json file the scheduled transfers are kept in")
+	defaultCurrency := flag.String("default-currency", "USD", "currency for accounts without one in the data file")
+	idempotencyWindow := flag.Duration("idempotency-window", memds.DefaultIdempotencyWindow, "time an idempotency key is remembered")
+	holdExpiry := flag.Duration("hold-expiry", memds.DefaultHoldExpiry, "time until a hold expires")
+	flag.Parse()
+	args := flag.Args()
+
 	// validate command line arguments
-	if len(os.Args) < 3 {
+	if len(args) < 2 {
 		printUsage()
 		os.Exit(1)
 	}
 
 	// get port number
-	port, err := strconv.Atoi(os.Args[1])
+	port, err := strconv.Atoi(args[0])
 	if err != nil {
 		fmt.Printf("ERROR: error getting bind port number from the command line argument - %v\n", err.Error())
 		os.Exit(1)
@@ -45,14 +93,14 @@ func main() {
 	}
 
 	// get path to data file
-	file := os.Args[2]
+	file := args[1]
 
 	// get path to server log file, if present
-	if len(os.Args) > 3 {
+	if len(args) > 2 {
 		// open the file for writing
-		fp, err := os.OpenFile(os.Args[3], os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		fp, err := os.OpenFile(args[2], os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 		if err != nil {
-			fmt.Printf("ERROR: error opening log file: %v - %v\n", os.Args[3], err.Error())
+			fmt.Printf("ERROR: error opening log file: %v - %v\n", args[2], err.Error())
 			os.Exit(1)
 		}
 
@@ -62,7 +110,26 @@ func main() {
 
 	// initialize server
 	fmt.Printf("Initializing in-memory datastore server using file %v\n", file)
-	srv, err := server.New(uint(port), file)
+	cfg := server.Config{
+		Port: uint(port),
+		Datastore: memds.Config{
+			DataFile:          file,
+			Journal:           *journal,
+			SnapshotDir:       *snapshotDir,
+			SnapshotInterval:  *snapshotInterval,
+			DefaultCurrency:   *defaultCurrency,
+			IdempotencyWindow: *idempotencyWindow,
+			HoldExpiry:        *holdExpiry,
+		},
+		Scheduler:     scheduler.Config{File: *schedulesFile},
+		FXRatesFile:   *fxRates,
+		RulesFile:     *rulesFile,
+		FeesFile:      *feesFile,
+		InterestFile:  *interestFile,
+		ApprovalsFile: *approvalsFile,
+		APIKeysFile:   *apiKeysFile,
+	}
+	srv, err := server.NewWithConfig(cfg)
 	if err != nil {
 		log.Fatalf("Failed to start server - %v\n", err.Error())
 	}
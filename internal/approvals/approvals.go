@@ -0,0 +1,113 @@
+// Implements the approval policy of large transfers, maker-checker.
+//
+// The policy is loaded from a json file:
+//
+//	{
+//	    "thresholds": {"USD": "10000.00", "EUR": "9000.00"},
+//	    "expiry": "72h"
+//	}
+//
+// A transfer requested through the REST API debiting an account in a currency
+// with a threshold, of an amount above the threshold, is not executed right
+// away. It waits for the approval of a principal other than the one who
+// requested it, its funds held meanwhile, and is rejected when it is not
+// approved before the expiry. Transfers in a currency without a threshold
+// never wait for approval. The expiry defaults to 72h.
+package approvals
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"paytabs/internal/money"
+)
+
+// default time a transfer waits for approval
+const DefaultExpiry = 72 * time.Hour
+
+// structure of the approval policy file contents
+type config struct {
+	Thresholds map[string]money.Money `json:"thresholds"` // largest amount transfered without approval, by currency
+	Expiry     string                 `json:"expiry"`     // time a transfer waits for approval, e.g. "72h"
+}
+
+// structure representing the approval policy in effect
+type Policy struct {
+	thresholds map[string]money.Money // thresholds by currency, in the minor units of the currency
+	expiry     time.Duration          // time a transfer waits for approval
+}
+
+// Load the approval policy from a json file.
+func Load(filename string) (*Policy, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	p, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid approvals file: %v - %v", filename, err)
+	}
+	return p, nil
+}
+
+// Parse and validate the approval policy in json.
+func Parse(data []byte) (*Policy, error) {
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	expiry := DefaultExpiry
+	if cfg.Expiry != "" {
+		d, err := time.ParseDuration(cfg.Expiry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry: %q - %v", cfg.Expiry, err)
+		}
+		expiry = d
+	}
+	return New(cfg.Thresholds, expiry)
+}
+
+// Construct an approval policy.
+//
+// Returns error if a threshold is given for an unknown currency, is negative
+// or has more decimals than the currency, or the expiry is not positive.
+func New(thresholds map[string]money.Money, expiry time.Duration) (*Policy, error) {
+	if expiry <= 0 {
+		return nil, fmt.Errorf("invalid expiry: %v, expecting a positive duration", expiry)
+	}
+	p := &Policy{thresholds: make(map[string]money.Money, len(thresholds)), expiry: expiry}
+	for currency, threshold := range thresholds {
+		c, err := money.LookupCurrency(currency)
+		if err != nil {
+			return nil, err
+		}
+		if threshold.Sign() < 0 {
+			return nil, fmt.Errorf("threshold of %v cannot be a negative value", c.Code)
+		}
+		t, err := threshold.Rescale(c.Exponent)
+		if err != nil {
+			return nil, fmt.Errorf("invalid threshold of %v - %v", c.Code, err)
+		}
+		p.thresholds[c.Code] = t
+	}
+	return p, nil
+}
+
+// Returns true if a transfer of the amount, in the currency of the account
+// debited, needs approval. A nil policy never requires approval.
+func (p *Policy) Requires(amount money.Money, currency string) bool {
+	if p == nil {
+		return false
+	}
+	threshold, ok := p.thresholds[currency]
+	return ok && amount.Cmp(threshold) > 0
+}
+
+// Returns the time a transfer waits for approval.
+func (p *Policy) Expiry() time.Duration {
+	return p.expiry
+}
+
+// end-of-file
@@ -0,0 +1,60 @@
+package approvals
+
+import (
+	"testing"
+	"time"
+
+	"paytabs/internal/money"
+)
+
+func TestParse(t *testing.T) {
+	p, err := Parse([]byte(`{"thresholds": {"usd": "1000", "JPY": "100000"}}`))
+	if err != nil {
+		t.Fatalf("Unexpected error - %v", err)
+	}
+	if p.Expiry() != DefaultExpiry {
+		t.Fatalf("Expecting the default expiry, received %v", p.Expiry())
+	}
+	if p, err := Parse([]byte(`{"expiry": "24h"}`)); err != nil || p.Expiry() != 24*time.Hour {
+		t.Fatalf("Expecting expiry 24h, received %v - %v", p, err)
+	}
+
+	invalid := []string{
+		`{"thresholds": {"XXX": "1"}}`,
+		`{"thresholds": {"USD": "-1"}}`,
+		`{"thresholds": {"USD": "1.001"}}`,
+		`{"expiry": "soon"}`,
+		`{"expiry": "-1h"}`,
+	}
+	for _, js := range invalid {
+		if _, err := Parse([]byte(js)); err == nil {
+			t.Fatalf("Expecting error for %v", js)
+		}
+	}
+}
+
+func TestRequires(t *testing.T) {
+	p, _ := New(map[string]money.Money{"USD": money.MustParse("1000")}, DefaultExpiry)
+	var tests = []struct {
+		amount   string
+		currency string
+		requires bool
+	}{
+		{"999.99", "USD", false},
+		{"1000.00", "USD", false},
+		{"1000.01", "USD", true},
+		{"1000000", "EUR", false},
+	}
+	for _, test := range tests {
+		if p.Requires(money.MustParse(test.amount), test.currency) != test.requires {
+			t.Fatalf("Expecting %v %v to require approval: %v", test.amount, test.currency, test.requires)
+		}
+	}
+
+	var none *Policy
+	if none.Requires(money.MustParse("1000000"), "USD") {
+		t.Fatal("Expecting no approval without a policy")
+	}
+}
+
+// end-of-file
@@ -0,0 +1,164 @@
+// Implements the API keys authenticating the requests to the REST API.
+//
+// The keys are loaded from a json file holding the sha256 hash of each key, in
+// hex, never the key itself:
+//
+//	{
+//	    "keys": [
+//	        {"name": "ops", "sha256": "9f86d08...", "scopes": ["admin"]},
+//	        {"name": "merchant-1", "sha256": "60303ae...", "scopes": ["read:accounts", "write:transfers"], "accounts": ["m-1"]}
+//	    ]
+//	}
+//
+// A key grants its scopes, the admin scope granting all of them. A key with
+// accounts can access only those accounts, e.g. a merchant key debiting only
+// the accounts of the merchant. The name of a key identifies the principal
+// making the requests signed with it.
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// scopes granted by API keys
+const (
+	ScopeReadAccounts     = "read:accounts"     // read accounts, transactions, holds, schedules and pending transfers
+	ScopeWriteTransfers   = "write:transfers"   // transfer, hold, refund and schedule funds, reject pending transfers
+	ScopeApproveTransfers = "approve:transfers" // approve transfers held for approval
+	ScopeAdmin            = "admin"             // every scope, create and update accounts, snapshots and the ledger
+)
+
+// structure of a key in the API keys file
+type Key struct {
+	Name     string   `json:"name"`               // name of the key, the principal of its requests
+	Hash     string   `json:"sha256"`             // sha256 hash of the key, in hex
+	Scopes   []string `json:"scopes"`             // scopes granted by the key
+	Accounts []string `json:"accounts,omitempty"` // accounts the key can access, all when empty
+}
+
+// structure of the API keys file contents
+type config struct {
+	Keys []Key `json:"keys"`
+}
+
+// structure representing the API keys in effect
+type Keys struct {
+	byHash map[string]*Key // keys by the hash of the key
+}
+
+// Returns the sha256 hash of the key, in hex, as stored in the API keys file.
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Load the API keys from a json file.
+func Load(filename string) (*Keys, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	ks, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid api keys file: %v - %v", filename, err)
+	}
+	return ks, nil
+}
+
+// Parse and validate the API keys in json.
+func Parse(data []byte) (*Keys, error) {
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return New(cfg.Keys)
+}
+
+// Construct the API keys.
+//
+// Returns error if there are no keys, a key has no name, no scopes, an unknown
+// scope or an invalid hash, or two keys have the same name or hash.
+func New(keys []Key) (*Keys, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys")
+	}
+	ks := &Keys{byHash: make(map[string]*Key, len(keys))}
+	names := make(map[string]bool, len(keys))
+	for i := range keys {
+		k := keys[i]
+		if k.Name == "" {
+			return nil, fmt.Errorf("key %v has no name", i)
+		}
+		if names[k.Name] {
+			return nil, fmt.Errorf("duplicate key name: %v", k.Name)
+		}
+		names[k.Name] = true
+		b, err := hex.DecodeString(k.Hash)
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid sha256 of key %v, expecting %v hex digits", k.Name, 2*sha256.Size)
+		}
+		k.Hash = hex.EncodeToString(b)
+		if _, ok := ks.byHash[k.Hash]; ok {
+			return nil, fmt.Errorf("key %v has the sha256 of another key", k.Name)
+		}
+		if len(k.Scopes) == 0 {
+			return nil, fmt.Errorf("key %v has no scopes", k.Name)
+		}
+		for _, scope := range k.Scopes {
+			switch scope {
+			case ScopeReadAccounts, ScopeWriteTransfers, ScopeApproveTransfers, ScopeAdmin:
+			default:
+				return nil, fmt.Errorf("unknown scope: %q of key %v", scope, k.Name)
+			}
+		}
+		for _, id := range k.Accounts {
+			if id == "" {
+				return nil, fmt.Errorf("empty account id of key %v", k.Name)
+			}
+		}
+		ks.byHash[k.Hash] = &k
+	}
+	return ks, nil
+}
+
+// Returns the key matching the key presented by a client, false if none does.
+//
+// Only the hash of the key presented is compared, the keys are never held.
+func (ks *Keys) Authenticate(key string) (*Key, bool) {
+	k, ok := ks.byHash[Hash(key)]
+	return k, ok
+}
+
+// Returns true if the key grants the scope, the admin scope grants every scope.
+func (k *Key) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the key can access the account.
+func (k *Key) CanAccess(id string) bool {
+	if len(k.Accounts) == 0 {
+		return true
+	}
+	for _, a := range k.Accounts {
+		if a == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the key can access only some accounts.
+func (k *Key) Restricted() bool {
+	return len(k.Accounts) > 0
+}
+
+// end-of-file
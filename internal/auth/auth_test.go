@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	js := fmt.Sprintf(`{"keys": [
+		{"name": "ops", "sha256": %q, "scopes": ["admin"]},
+		{"name": "merchant", "sha256": %q, "scopes": ["read:accounts", "write:transfers"], "accounts": ["m-1", "m-2"]}
+	]}`, Hash("ops-secret"), strings.ToUpper(Hash("merchant-secret")))
+	ks, err := Parse([]byte(js))
+	if err != nil {
+		t.Fatalf("Unexpected error - %v", err)
+	}
+
+	// keys are matched by their hash
+	if _, ok := ks.Authenticate("wrong"); ok {
+		t.Fatal("Expecting an unknown key to fail")
+	}
+	ops, ok := ks.Authenticate("ops-secret")
+	if !ok || ops.Name != "ops" || ops.Restricted() || !ops.CanAccess("m-3") {
+		t.Fatalf("Unexpected key %+v", ops)
+	}
+	for _, scope := range []string{ScopeReadAccounts, ScopeWriteTransfers, ScopeApproveTransfers, ScopeAdmin} {
+		if !ops.HasScope(scope) {
+			t.Fatalf("Expecting the admin scope to grant %v", scope)
+		}
+	}
+	merchant, ok := ks.Authenticate("merchant-secret")
+	if !ok || merchant.Name != "merchant" || !merchant.Restricted() || !merchant.CanAccess("m-2") || merchant.CanAccess("m-3") {
+		t.Fatalf("Unexpected key %+v", merchant)
+	}
+	if !merchant.HasScope(ScopeWriteTransfers) || merchant.HasScope(ScopeApproveTransfers) || merchant.HasScope(ScopeAdmin) {
+		t.Fatalf("Unexpected scopes %v", merchant.Scopes)
+	}
+
+	hash := Hash("secret")
+	invalid := []string{
+		`{"keys": []}`,
+		fmt.Sprintf(`{"keys": [{"sha256": %q, "scopes": ["admin"]}]}`, hash),
+		fmt.Sprintf(`{"keys": [{"name": "a", "sha256": %q, "scopes": []}]}`, hash),
+		fmt.Sprintf(`{"keys": [{"name": "a", "sha256": %q, "scopes": ["root"]}]}`, hash),
+		`{"keys": [{"name": "a", "sha256": "secret", "scopes": ["admin"]}]}`,
+		fmt.Sprintf(`{"keys": [{"name": "a", "sha256": %q, "scopes": ["admin"]}, {"name": "a", "sha256": %q, "scopes": ["admin"]}]}`, hash, Hash("other")),
+		fmt.Sprintf(`{"keys": [{"name": "a", "sha256": %q, "scopes": ["admin"]}, {"name": "b", "sha256": %q, "scopes": ["admin"]}]}`, hash, hash),
+		fmt.Sprintf(`{"keys": [{"name": "a", "sha256": %q, "scopes": ["admin"], "accounts": [""]}]}`, hash),
+	}
+	for _, js := range invalid {
+		if _, err := Parse([]byte(js)); err == nil {
+			t.Fatalf("Expecting error for %v", js)
+		}
+	}
+}
+
+// end-of-file
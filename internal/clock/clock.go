@@ -0,0 +1,59 @@
+// Implements the source of the current time.
+//
+// Code that acts on the passage of time, such as the accrual of interest,
+// asks a Clock for the current time instead of calling time.Now, so that tests
+// can use a Fake clock and move it forward by days or years without waiting.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Provides the current time
+type Clock interface {
+	// Returns the current time
+	Now() time.Time
+}
+
+// Clock returning the system time
+type Real struct{}
+
+// Returns the system time.
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// Clock returning a time set by its owner, safe for concurrent use
+type Fake struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// Construct a fake clock set to the given time.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Returns the time the clock is set to.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Set the clock to the given time.
+func (f *Fake) Set(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = now
+}
+
+// Move the clock forward by the given duration.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+// end-of-file
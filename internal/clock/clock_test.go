@@ -0,0 +1,34 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	var c Clock = NewFake(start)
+	if !c.Now().Equal(start) {
+		t.Fatalf("Expecting %v, received %v", start, c.Now())
+	}
+
+	f := c.(*Fake)
+	f.Advance(36 * time.Hour)
+	if expected := start.Add(36 * time.Hour); !c.Now().Equal(expected) {
+		t.Fatalf("Expecting %v, received %v", expected, c.Now())
+	}
+	f.Set(start)
+	if !c.Now().Equal(start) {
+		t.Fatalf("Expecting %v, received %v", start, c.Now())
+	}
+}
+
+func TestReal(t *testing.T) {
+	before := time.Now()
+	now := Real{}.Now()
+	if now.Before(before) || now.After(time.Now()) {
+		t.Fatalf("Unexpected time %v", now)
+	}
+}
+
+// end-of-file
@@ -2,16 +2,330 @@
 //
 package ds
 
+import (
+	"time"
+
+	"paytabs/internal/ledger"
+	"paytabs/internal/money"
+)
+
 type Account struct {
-	Id      string  `json:"id"`
-	Name    string  `json:"name"`
-	Balance float64 `json:"balance,string"`
+	Id             string      `json:"id"`
+	Name           string      `json:"name"`
+	Balance        money.Money `json:"balance"`           // ledger balance
+	Available      money.Money `json:"available_balance"` // ledger balance less the active holds
+	OverdraftLimit money.Money `json:"overdraft_limit"`   // how far below zero the balance can go
+	Currency       string      `json:"currency"`          // ISO 4217 currency code
+	Status         string      `json:"status"`            // one of StatusActive, StatusFrozen or StatusClosed
+	Type           string      `json:"type"`              // TypeChecking or TypeSavings
+	InterestRate   money.Rate  `json:"interest_rate"`     // annual interest rate of a savings account, e.g. 0.045 for 4.5%
+}
+
+// status of an account
+//
+// Transfers are allowed only between active accounts. A frozen account can be
+// made active again, a closed account can never be used again.
+const (
+	StatusActive = "active"
+	StatusFrozen = "frozen"
+	StatusClosed = "closed"
+)
+
+// type of an account
+//
+// Savings accounts earn interest at their annual rate, see internal/interest.
+const (
+	TypeChecking = "checking"
+	TypeSavings  = "savings"
+)
+
+// Details of an account to create
+type NewAccount struct {
+	Id             string      // account id, generated when empty
+	Name           string      // name of the account holder
+	Currency       string      // ISO 4217 currency code, the datastore default when empty
+	Balance        money.Money // opening balance
+	OverdraftLimit money.Money // how far below zero the balance can go, zero when not allowed
+	Type           string      // TypeChecking or TypeSavings, TypeChecking when empty
+	InterestRate   money.Rate  // annual interest rate, only for savings accounts
+}
+
+// Changes to an account, nil fields are left unchanged
+type AccountUpdate struct {
+	Name           *string      // new name of the account holder
+	Status         *string      // new status of the account
+	OverdraftLimit *money.Money // new overdraft limit
+	InterestRate   *money.Rate  // new annual interest rate, only for savings accounts
+}
+
+// kind of an overdraft event
+const (
+	OverdraftEntered = "entered" // the balance went below zero
+	OverdraftLeft    = "left"    // the balance went back to zero or above
+)
+
+// Details of an account entering or leaving overdraft
+type OverdraftEvent struct {
+	AccountId string      `json:"account_id"`
+	Event     string      `json:"event"`   // OverdraftEntered or OverdraftLeft
+	Balance   money.Money `json:"balance"` // balance after the transaction
+	Currency  string      `json:"currency"`
+	Limit     money.Money `json:"overdraft_limit"` // overdraft limit at the time of the transaction
+	Tid       uint64      `json:"transaction_id"`  // transaction that moved the balance across zero
+	Date      time.Time   `json:"date"`
+}
+
+// Interest of a savings account
+type InterestStatus struct {
+	AccountId      string      `json:"account_id"`
+	Rate           money.Rate  `json:"interest_rate"`   // annual interest rate
+	DayCount       string      `json:"day_count"`       // day count convention of the accrual
+	Accrued        money.Money `json:"accrued"`         // interest accrued and not yet posted, with more decimals than the currency
+	Currency       string      `json:"currency"`        // currency of the account
+	AccruedThrough time.Time   `json:"accrued_through"` // last day accrued, zero when no day has been accrued yet
+	Posted         money.Money `json:"posted"`          // sum of the interest posted to the account
+}
+
+// Details of a fund transfer
+type TransferRequest struct {
+	From    string      // account to transfer from
+	To      string      // account to transfer to
+	Amount  money.Money // amount in the currency of the from account
+	Convert bool        // allow conversion when the accounts are in different currencies
+
+	IdempotencyKey string // optional key making retries of the same transfer return the original result
+	RequestHash    string // hash of the request, a key reused with a different hash is rejected
+
+	RequireApproval bool   // hold the transfer for approval when its amount is above the approval threshold
+	Principal       string // who requested the transfer, required when it is held for approval
+}
+
+// Result of a successful fund transfer
+type TransferResult struct {
+	Tid        uint64      // transaction id
+	Balance    money.Money // balance of the from account after the transfer
+	Currency   string      // currency of the from account
+	Amount     money.Money // amount debited from the from account
+	ToAmount   money.Money // amount credited to the to account
+	ToCurrency string      // currency of the to account
+	Rate       money.Rate  // exchange rate applied, zero when no conversion was needed
+	Fee        money.Money // fee debited from the from account on top of the amount, zero when no fee was charged
+	Replayed   bool        // true when this is the stored result of an earlier transfer with the same idempotency key
+
+	Pending *PendingTransfer // the transfer held for approval, nil when the transfer was executed
+}
+
+// status of a pending transfer
+//
+// A pending transfer holds its funds until it is approved, rejected or expires.
+const (
+	PendingAwaiting = "pending"
+	PendingApproved = "approved"
+	PendingRejected = "rejected"
+	PendingExpired  = "expired"
+)
+
+// Details of a transfer held for approval, and who requested and decided it
+type PendingTransfer struct {
+	Id          uint64      `json:"pending_id"`
+	FromId      string      `json:"from_id"`
+	ToId        string      `json:"to_id"`
+	Amount      money.Money `json:"amount"`   // amount in the currency of the from account
+	Currency    string      `json:"currency"` // currency of the from account
+	Convert     bool        `json:"convert,omitempty"`
+	HoldId      uint64      `json:"hold_id"`                  // hold reserving the amount and the fee while pending
+	Status      string      `json:"status"`                   // one of PendingAwaiting, PendingApproved, PendingRejected or PendingExpired
+	RequestedBy string      `json:"requested_by"`             // principal who requested the transfer
+	Requested   time.Time   `json:"requested"`                // date and time the transfer was requested
+	Expires     time.Time   `json:"expires"`                  // date and time the transfer expires unless approved or rejected
+	DecidedBy   string      `json:"decided_by,omitempty"`     // principal who approved or rejected the transfer
+	Decided     *time.Time  `json:"decided,omitempty"`        // date and time the transfer was approved, rejected or expired
+	Reason      string      `json:"reason,omitempty"`         // reason given for the rejection
+	Tid         uint64      `json:"transaction_id,omitempty"` // transaction of the approved transfer
+}
+
+// status of a hold
+//
+// A hold is active until it is captured, voided or expires. Only an active
+// hold reduces the available balance of its account.
+const (
+	HoldActive   = "active"
+	HoldCaptured = "captured"
+	HoldVoided   = "voided"
+	HoldExpired  = "expired"
+)
+
+// Details of a hold to place
+type HoldRequest struct {
+	AccountId string        // account to reserve the funds in
+	ToId      string        // account the funds are transferred to on capture
+	Amount    money.Money   // amount reserved, in the currency of the account
+	Expiry    time.Duration // time until the hold expires, the datastore default when zero
+}
+
+// Details of a hold on the funds of an account
+type Hold struct {
+	Id        uint64       `json:"hold_id"`
+	AccountId string       `json:"account_id"`               // account the funds are reserved in
+	ToId      string       `json:"to_id"`                    // account the funds are transferred to on capture
+	Amount    money.Money  `json:"amount"`                   // amount reserved
+	Fee       *money.Money `json:"fee,omitempty"`            // fee reserved on top of the amount, charged on capture
+	Currency  string       `json:"currency"`                 // currency of the account
+	Status    string       `json:"status"`                   // one of HoldActive, HoldCaptured, HoldVoided or HoldExpired
+	Created   time.Time    `json:"created"`                  // date and time the hold was placed
+	Expires   time.Time    `json:"expires"`                  // date and time the hold expires unless captured or voided
+	Closed    *time.Time   `json:"closed,omitempty"`         // date and time the hold was captured, voided or expired
+	Captured  *money.Money `json:"captured,omitempty"`       // amount captured, the rest of the hold is released
+	Tid       uint64       `json:"transaction_id,omitempty"` // transaction of the capture
+	PendingId uint64       `json:"pending_id,omitempty"`     // pending transfer the funds are held for, released only by its approval or rejection
+}
+
+// limit on the number of legs of a batch transfer
+const MaxBatchLegs = 1000
+
+// Result of a successful batch transfer
+type BatchResult struct {
+	Id           uint64        `json:"batch_id"`
+	Transactions []Transaction `json:"transactions"` // transaction of each leg, in the order of the legs
+}
+
+// Details of a completed transaction
+type Transaction struct {
+	Id           uint64           `json:"transaction_id"`
+	Date         time.Time        `json:"date"`
+	FromId       string           `json:"from_id"`
+	ToId         string           `json:"to_id"`
+	Amount       money.Money      `json:"amount"`                   // amount debited in the currency of the from account
+	Currency     string           `json:"currency"`                 // currency of the from account
+	ToAmount     money.Money      `json:"to_amount"`                // amount credited in the currency of the to account
+	ToCurrency   string           `json:"to_currency"`              // currency of the to account
+	Rate         *money.Rate      `json:"rate,omitempty"`           // exchange rate applied for cross-currency transfers
+	RefundOf     uint64           `json:"refund_of,omitempty"`      // id of the transaction refunded, for refunds
+	Refunded     *money.Money     `json:"refunded,omitempty"`       // amount refunded so far in the currency of the to account
+	BatchId      uint64           `json:"batch_id,omitempty"`       // id of the batch, for legs of a batch transfer
+	Fee          *money.Money     `json:"fee,omitempty"`            // fee debited from the from account in its currency
+	FeeAccountId string           `json:"fee_account_id,omitempty"` // revenue account credited with the fee
+	InterestFor  string           `json:"interest_for,omitempty"`   // month of the interest posted, e.g. "2026-01", for interest postings
+	Postings     []ledger.Posting `json:"postings,omitempty"`       // debits and credits of the transaction, only for a single transaction
+}
+
+// direction of the transactions returned by a history query
+const (
+	DirectionAll = ""    // both debits and credits
+	DirectionIn  = "in"  // credits, the account is the to account
+	DirectionOut = "out" // debits, the account is the from account
+)
+
+// limits on the number of transactions returned in a history page
+const (
+	DefaultHistoryLimit = 50
+	MaxHistoryLimit     = 500
+)
+
+// Query for the transaction history of an account
+type HistoryQuery struct {
+	Since     time.Time // only transactions at or after this time, zero for no limit
+	Until     time.Time // only transactions before this time, zero for no limit
+	Direction string    // one of DirectionAll, DirectionIn or DirectionOut
+	Cursor    string    // opaque cursor from the previous page, empty for the first page
+	Limit     int       // maximum number of transactions in the page, zero for DefaultHistoryLimit
+}
+
+// A page of the transaction history, newest transaction first
+type HistoryPage struct {
+	Transactions []Transaction `json:"transactions"`
+	NextCursor   string        `json:"next_cursor,omitempty"` // empty when there are no more transactions
+}
+
+// sort orders of the accounts returned by a list query, prefixed with "-"
+// for descending order, accounts with equal keys are ordered by id
+const (
+	SortById      = "id"
+	SortByName    = "name"
+	SortByBalance = "balance"
+)
+
+// limits on the number of accounts returned in a list page
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// Query for a page of the accounts
+type ListQuery struct {
+	NamePrefix string       // only accounts with a name starting with the prefix, ignoring case
+	Currency   string       // only accounts in the currency, any currency when empty
+	MinBalance *money.Money // only accounts with at least this balance, nil for no limit
+	MaxBalance *money.Money // only accounts with at most this balance, nil for no limit
+	Sort       string       // one of the SortBy* orders, SortById when empty
+	Cursor     string       // opaque cursor from the previous page, empty for the first page
+	Limit      int          // maximum number of accounts in the page, zero for DefaultListLimit
+}
+
+// A page of the accounts
+type AccountPage struct {
+	Accounts   []Account `json:"accounts"`
+	NextCursor string    `json:"next_cursor,omitempty"` // empty when there are no more accounts
+}
+
+// Iterator over the accounts of a datastore, at a consistent point in time
+//
+// Next advances to the next account, returning false when there are no more
+// accounts. Close releases the iterator, and needs to be called once done with
+// it, even when Next returned false.
+type AccountIterator interface {
+	Next() bool
+	Account() Account
+	Close()
+}
+
+// Provides the exchange rates for transfers between accounts in different currencies
+type FXRateProvider interface {
+	// Returns the rate to convert an amount in currency from to currency to
+	Rate(from string, to string) (money.Rate, error)
 }
 
 type Datastore interface {
 	List() []Account
+	Accounts() AccountIterator
+	Query(ListQuery) (AccountPage, error)
 	Get(string) (Account, error)
-	Transfer(from string, to string, amount float64) (uint64, float64, error)
+	Create(NewAccount) (Account, error)
+	Update(id string, update AccountUpdate) (Account, error)
+	Transfer(TransferRequest) (TransferResult, error)
+	TransferBatch([]TransferRequest) (BatchResult, error)
+	GetTransaction(uint64) (Transaction, error)
+	History(id string, query HistoryQuery) (HistoryPage, error)
+	CreateHold(HoldRequest) (Hold, error)
+	GetHold(uint64) (Hold, error)
+	CaptureHold(id uint64, amount *money.Money) (Hold, error)
+	VoidHold(uint64) (Hold, error)
+	Refund(tid uint64, amount *money.Money) (Transaction, error)
+	OverdraftEvents(id string) ([]OverdraftEvent, error)
+	Interest(id string) (InterestStatus, error)
+	ListPending(status string) ([]PendingTransfer, error)
+	GetPending(uint64) (PendingTransfer, error)
+	ApprovePending(id uint64, principal string) (PendingTransfer, error)
+	RejectPending(id uint64, principal string, reason string) (PendingTransfer, error)
+}
+
+// Details of a snapshot written by a Snapshotter
+type SnapshotInfo struct {
+	Lsn          uint64    `json:"lsn"`          // sequence number of the last change included
+	File         string    `json:"file"`         // file the snapshot was written to
+	Date         time.Time `json:"date"`         // date and time the snapshot was taken
+	Accounts     int       `json:"accounts"`     // number of accounts in the snapshot
+	Transactions int       `json:"transactions"` // number of transactions in the snapshot
+}
+
+// Implemented by a Datastore that can write point-in-time snapshots of its state
+type Snapshotter interface {
+	Snapshot() (SnapshotInfo, error)
+}
+
+// Implemented by a Datastore that keeps a double-entry ledger of its balances
+type LedgerVerifier interface {
+	VerifyLedger() ledger.Report
 }
 
 // end-of-file
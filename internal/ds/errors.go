@@ -0,0 +1,79 @@
+// Defines the errors returned by a Datastore.
+//
+// Datastore operations return errors wrapping one of the Err* kinds below, so
+// callers can tell the kind of failure using errors.Is while the message keeps
+// the details, e.g. the id of the account that does not exist.
+package ds
+
+import (
+	"errors"
+	"fmt"
+)
+
+// kinds of datastore errors
+var (
+	ErrAccountNotFound          = errors.New("account not found")
+	ErrAccountExists            = errors.New("account already exists")
+	ErrAccountInactive          = errors.New("account is frozen or closed")
+	ErrInvalidAccount           = errors.New("invalid account details")
+	ErrInvalidStatusTransition  = errors.New("invalid account status transition")
+	ErrTransactionNotFound      = errors.New("transaction not found")
+	ErrNotRefundable            = errors.New("transaction cannot be refunded")
+	ErrRefundExceeded           = errors.New("refunds exceed the transaction amount")
+	ErrHoldNotFound             = errors.New("hold not found")
+	ErrHoldInactive             = errors.New("hold is captured, voided or expired")
+	ErrInvalidHold              = errors.New("invalid hold details")
+	ErrPendingNotFound          = errors.New("pending transfer not found")
+	ErrPendingInactive          = errors.New("pending transfer is approved, rejected or expired")
+	ErrSelfApproval             = errors.New("transfer cannot be approved by the principal who requested it")
+	ErrPrincipalRequired        = errors.New("principal required")
+	ErrSameAccount              = errors.New("from and to accounts are the same")
+	ErrInvalidAmount            = errors.New("invalid amount")
+	ErrInvalidBatch             = errors.New("invalid batch transfer")
+	ErrInsufficientFunds        = errors.New("insufficient funds")
+	ErrRuleViolation            = errors.New("transfer violates a rule")
+	ErrCurrencyMismatch         = errors.New("accounts are in different currencies")
+	ErrRateUnavailable          = errors.New("exchange rate unavailable")
+	ErrInvalidQuery             = errors.New("invalid query")
+	ErrIdempotencyKeyReused     = errors.New("idempotency key was already used with a different request")
+	ErrIdempotencyKeyInProgress = errors.New("a transfer with this idempotency key is in progress")
+)
+
+// Error returned by a failed datastore operation
+type Error struct {
+	Kind    error  // one of the Err* kinds
+	Message string // description of the failure
+}
+
+// Returns the description of the failure.
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Returns the kind of the error, used by errors.Is.
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+// Error returned when a transfer violates a transfer limit or velocity rule
+type RuleError struct {
+	Rule    string // name of the rule violated
+	Message string // description of the violation
+}
+
+// Returns the description of the violation.
+func (e *RuleError) Error() string {
+	return e.Message
+}
+
+// Returns ErrRuleViolation, used by errors.Is.
+func (e *RuleError) Unwrap() error {
+	return ErrRuleViolation
+}
+
+// Returns an Error of the given kind with a formatted description.
+func Errorf(kind error, format string, a ...interface{}) error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, a...)}
+}
+
+// end-of-file
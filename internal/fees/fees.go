@@ -0,0 +1,227 @@
+// Implements the fee schedule of transfers.
+//
+// The schedule is loaded from a json file:
+//
+//	{
+//	    "revenue_account": "bank-revenue-usd",
+//	    "fees": [
+//	        {"currency": "USD", "flat": "0.30", "percent": "2.9", "min": "0.50", "max": "25.00"},
+//	        {"currency": "EUR", "revenue_account": "bank-revenue-eur", "tiers": [
+//	            {"up_to": "100.00", "flat": "1.00"},
+//	            {"up_to": "1000.00", "percent": "1"},
+//	            {"percent": "0.5"}
+//	        ], "min": "1.00"}
+//	    ]
+//	}
+//
+// A fee applies to the transfers debiting accounts in its currency and is
+// charged in that currency, on top of the amount transfered. The fee is the flat
+// amount plus the percent of the amount transfered, rounded half away from zero
+// to the minor units of the currency, then raised to the min and lowered to the
+// max when given. With tiers, the flat amount and percent are those of the first
+// tier the amount is up to, inclusive, the last tier taking the amounts above
+// the others. Fees are credited to the revenue account of the fee, the
+// revenue_account of the schedule when the fee has none. Transfers debiting
+// accounts in a currency without a fee are free.
+package fees
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"paytabs/internal/money"
+)
+
+// structure representing a tier of a fee
+type Tier struct {
+	UpTo    *money.Money `json:"up_to,omitempty"` // largest amount of the tier, nil for the last tier
+	Flat    money.Money  `json:"flat"`            // flat amount charged
+	Percent money.Money  `json:"percent"`         // percent of the amount charged
+}
+
+// structure representing the fee of transfers in a currency
+type Fee struct {
+	Currency string       `json:"currency"`                  // currency of the accounts debited
+	Account  string       `json:"revenue_account,omitempty"` // account credited with the fee, the default when empty
+	Flat     money.Money  `json:"flat"`                      // flat amount charged, without tiers
+	Percent  money.Money  `json:"percent"`                   // percent of the amount charged, without tiers
+	Tiers    []Tier       `json:"tiers,omitempty"`           // tiers of the amounts, in ascending order of up_to
+	Min      *money.Money `json:"min,omitempty"`             // smallest fee, nil when not limited
+	Max      *money.Money `json:"max,omitempty"`             // largest fee, nil when not limited
+}
+
+// structure of the fee schedule file contents
+type config struct {
+	RevenueAccount string `json:"revenue_account"` // default account credited with the fees
+	Fees           []Fee  `json:"fees"`
+}
+
+// structure representing the fee schedule in effect
+type Schedule struct {
+	fees map[string]*Fee // fees by currency
+}
+
+// Load the fee schedule from a json file.
+func Load(filename string) (*Schedule, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	s, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fee schedule file: %v - %v", filename, err)
+	}
+	return s, nil
+}
+
+// Parse and validate the fee schedule in json.
+func Parse(data []byte) (*Schedule, error) {
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	s := &Schedule{fees: make(map[string]*Fee, len(cfg.Fees))}
+	for i := range cfg.Fees {
+		f := &cfg.Fees[i]
+		if f.Account == "" {
+			f.Account = cfg.RevenueAccount
+		}
+		if err := f.validate(); err != nil {
+			return nil, fmt.Errorf("fee %v: %v", i, err)
+		}
+		if _, ok := s.fees[f.Currency]; ok {
+			return nil, fmt.Errorf("fee %v: duplicate currency: %v", i, f.Currency)
+		}
+		s.fees[f.Currency] = f
+	}
+	return s, nil
+}
+
+// Validate the fee and rescale its amounts to the minor units of its currency.
+func (f *Fee) validate() error {
+	c, err := money.LookupCurrency(f.Currency)
+	if err != nil {
+		return err
+	}
+	f.Currency = c.Code
+	if f.Account == "" {
+		return fmt.Errorf("%v fee has no revenue account", f.Currency)
+	}
+
+	// amounts are charged in the minor units of the currency
+	amount := func(name string, m *money.Money) error {
+		if m.Sign() < 0 {
+			return fmt.Errorf("%v of %v fee cannot be a negative value", name, f.Currency)
+		}
+		r, err := m.Rescale(c.Exponent)
+		if err != nil {
+			return fmt.Errorf("invalid %v of %v fee - %v", name, f.Currency, err)
+		}
+		*m = r
+		return nil
+	}
+	if len(f.Tiers) > 0 {
+		if !f.Flat.IsZero() || !f.Percent.IsZero() {
+			return fmt.Errorf("%v fee has both tiers and a flat amount or percent", f.Currency)
+		}
+		for i := range f.Tiers {
+			t := &f.Tiers[i]
+			if err := amount("flat amount", &t.Flat); err != nil {
+				return fmt.Errorf("tier %v: %v", i, err)
+			}
+			if t.Percent.Sign() < 0 {
+				return fmt.Errorf("tier %v: percent of %v fee cannot be a negative value", i, f.Currency)
+			}
+			if t.UpTo == nil {
+				if i != len(f.Tiers)-1 {
+					return fmt.Errorf("tier %v: only the last tier can have no up_to", i)
+				}
+				continue
+			}
+			if err := amount("up_to", t.UpTo); err != nil {
+				return fmt.Errorf("tier %v: %v", i, err)
+			}
+			if i > 0 && t.UpTo.Cmp(*f.Tiers[i-1].UpTo) <= 0 {
+				return fmt.Errorf("tier %v: up_to %v is not above the tier before it", i, t.UpTo)
+			}
+		}
+	} else {
+		if err := amount("flat amount", &f.Flat); err != nil {
+			return err
+		}
+		if f.Percent.Sign() < 0 {
+			return fmt.Errorf("percent of %v fee cannot be a negative value", f.Currency)
+		}
+	}
+	if f.Min != nil {
+		if err := amount("min", f.Min); err != nil {
+			return err
+		}
+	}
+	if f.Max != nil {
+		if err := amount("max", f.Max); err != nil {
+			return err
+		}
+	}
+	if f.Min != nil && f.Max != nil && f.Min.Cmp(*f.Max) > 0 {
+		return fmt.Errorf("min %v of %v fee is above the max %v", f.Min, f.Currency, f.Max)
+	}
+	return nil
+}
+
+// Returns the revenue accounts of the schedule by currency.
+func (s *Schedule) Accounts() map[string]string {
+	accounts := make(map[string]string)
+	if s == nil {
+		return accounts
+	}
+	for currency, f := range s.fees {
+		accounts[currency] = f.Account
+	}
+	return accounts
+}
+
+// Returns the fee of a transfer of the amount debiting an account in the currency.
+//
+// Returns the fee in the minor units of the currency and the revenue account
+// credited with it. The fee is zero and the account empty when the currency
+// has no fee. The amount is expected in the minor units of the currency. A nil
+// Schedule charges no fees.
+func (s *Schedule) Fee(amount money.Money, currency string) (money.Money, string, error) {
+	if s == nil {
+		return money.Money{}, "", nil
+	}
+	f, ok := s.fees[currency]
+	if !ok {
+		return money.Money{}, "", nil
+	}
+
+	flat, percent := f.Flat, f.Percent
+	for i, t := range f.Tiers {
+		// amounts above every tier are charged as the last tier
+		if t.UpTo == nil || amount.Cmp(*t.UpTo) <= 0 || i == len(f.Tiers)-1 {
+			flat, percent = t.Flat, t.Percent
+			break
+		}
+	}
+	fee := flat
+	if !percent.IsZero() {
+		p, err := amount.Prorate(percent, money.New(100, 0))
+		if err != nil {
+			return money.Money{}, "", fmt.Errorf("failed to compute the fee of %v %v - %v", amount, currency, err)
+		}
+		if fee, err = fee.CheckedAdd(p); err != nil {
+			return money.Money{}, "", fmt.Errorf("failed to compute the fee of %v %v - %v", amount, currency, err)
+		}
+	}
+	if f.Min != nil && fee.Cmp(*f.Min) < 0 {
+		fee = *f.Min
+	}
+	if f.Max != nil && fee.Cmp(*f.Max) > 0 {
+		fee = *f.Max
+	}
+	return fee, f.Account, nil
+}
+
+// end-of-file
@@ -0,0 +1,103 @@
+package fees
+
+import (
+	"testing"
+
+	"paytabs/internal/money"
+)
+
+const testSchedule = `{
+    "revenue_account": "revenue-usd",
+    "fees": [
+        {"currency": "usd", "flat": "0.30", "percent": "2.9", "min": "0.50", "max": "25.00"},
+        {"currency": "EUR", "revenue_account": "revenue-eur", "tiers": [
+            {"up_to": "100.00", "flat": "1.00"},
+            {"up_to": "1000.00", "percent": "1"},
+            {"percent": "0.5"}
+        ]},
+        {"currency": "JPY", "revenue_account": "revenue-jpy", "percent": "0.25"}
+    ]
+}`
+
+func TestParse(t *testing.T) {
+	s, err := Parse([]byte(testSchedule))
+	if err != nil {
+		t.Fatalf("Unexpected error - %v", err)
+	}
+	accounts := s.Accounts()
+	if len(accounts) != 3 || accounts["USD"] != "revenue-usd" || accounts["EUR"] != "revenue-eur" {
+		t.Fatalf("Unexpected revenue accounts %v", accounts)
+	}
+	if len((*Schedule)(nil).Accounts()) != 0 {
+		t.Fatal("Expecting no revenue accounts for a nil schedule")
+	}
+
+	invalid := []string{
+		`{"fees": [{"currency": "USD", "flat": "1.00"}]}`,
+		`{"revenue_account": "r", "fees": [{"currency": "XXX", "flat": "1.00"}]}`,
+		`{"revenue_account": "r", "fees": [{"currency": "USD", "flat": "-1.00"}]}`,
+		`{"revenue_account": "r", "fees": [{"currency": "USD", "flat": "0.001"}]}`,
+		`{"revenue_account": "r", "fees": [{"currency": "USD", "percent": "-1"}]}`,
+		`{"revenue_account": "r", "fees": [{"currency": "USD", "min": "2.00", "max": "1.00"}]}`,
+		`{"revenue_account": "r", "fees": [{"currency": "USD"}, {"currency": "usd"}]}`,
+		`{"revenue_account": "r", "fees": [{"currency": "USD", "flat": "1.00", "tiers": [{"percent": "1"}]}]}`,
+		`{"revenue_account": "r", "fees": [{"currency": "USD", "tiers": [{"percent": "1"}, {"up_to": "10.00"}]}]}`,
+		`{"revenue_account": "r", "fees": [{"currency": "USD", "tiers": [{"up_to": "10.00"}, {"up_to": "10.00"}]}]}`,
+	}
+	for _, js := range invalid {
+		if _, err := Parse([]byte(js)); err == nil {
+			t.Fatalf("Expecting error for %v", js)
+		}
+	}
+}
+
+func TestFee(t *testing.T) {
+	s, err := Parse([]byte(testSchedule))
+	if err != nil {
+		t.Fatalf("Unexpected error - %v", err)
+	}
+
+	var tests = []struct {
+		amount   string
+		currency string
+		fee      string
+		account  string
+	}{
+		{"100.00", "USD", "3.20", "revenue-usd"},     // flat plus percent
+		{"10.55", "USD", "0.61", "revenue-usd"},      // 0.30 + 0.30595 rounded
+		{"5.00", "USD", "0.50", "revenue-usd"},       // raised to the min
+		{"10000.00", "USD", "25.00", "revenue-usd"},  // lowered to the max
+		{"0.00", "USD", "0.50", "revenue-usd"},       // min of a zero amount
+		{"100.00", "EUR", "1.00", "revenue-eur"},     // first tier, inclusive
+		{"100.01", "EUR", "1.00", "revenue-eur"},     // second tier
+		{"1000.00", "EUR", "10.00", "revenue-eur"},   // second tier, inclusive
+		{"20000.00", "EUR", "100.00", "revenue-eur"}, // last tier
+		{"1002", "JPY", "3", "revenue-jpy"},          // 2.505 rounded half away from zero
+		{"100.00", "GBP", "0", ""},                   // no fee
+	}
+	for _, test := range tests {
+		fee, account, err := s.Fee(money.MustParse(test.amount), test.currency)
+		if err != nil {
+			t.Fatalf("Unexpected error for %v %v - %v", test.amount, test.currency, err)
+		}
+		if fee.String() != test.fee || account != test.account {
+			t.Fatalf("Expecting fee %v to %q for %v %v, received %v to %q", test.fee, test.account, test.amount, test.currency, fee, account)
+		}
+	}
+
+	// amounts above the last tier with up_to are charged as the last tier
+	s, err = Parse([]byte(`{"revenue_account": "r", "fees": [{"currency": "USD", "tiers": [{"up_to": "10.00", "flat": "1.00"}, {"up_to": "100.00", "flat": "2.00"}]}]}`))
+	if err != nil {
+		t.Fatalf("Unexpected error - %v", err)
+	}
+	if fee, _, _ := s.Fee(money.MustParse("500.00"), "USD"); fee.String() != "2.00" {
+		t.Fatalf("Expecting fee 2.00, received %v", fee)
+	}
+
+	// a nil schedule charges no fees
+	if fee, account, err := (*Schedule)(nil).Fee(money.MustParse("100.00"), "USD"); err != nil || !fee.IsZero() || account != "" {
+		t.Fatalf("Expecting no fee, received %v to %q - %v", fee, account, err)
+	}
+}
+
+// end-of-file
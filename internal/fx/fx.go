@@ -0,0 +1,167 @@
+// Implements a file backed exchange rate provider. Supports ds.FXRateProvider interface
+//
+// Rates are read from a json file mapping currency pairs to rates:
+//
+//	{
+//	    "USD/EUR": "0.9215",
+//	    "EUR/USD": "1.0852"
+//	}
+//
+// A rate is the amount of the second currency for one unit of the first.
+// Rates are never inverted, each direction needs its own entry. The file is
+// watched and reloaded when it changes. When a reload fails the previously
+// loaded rates remain in use.
+package fx
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"paytabs/internal/money"
+)
+
+// default interval between checks of the rates file for changes
+const DefaultReloadInterval = 5 * time.Second
+
+// structure for the file backed rate provider
+type FileProvider struct {
+	path    string                // path to the rates file
+	lock    sync.RWMutex          // guards rates, modTime and size
+	rates   map[string]money.Rate // rates keyed by "FROM/TO"
+	modTime time.Time             // modification time of the loaded file
+	size    int64                 // size of the loaded file
+	stop    chan struct{}         // closed to stop watching the file
+	wg      sync.WaitGroup        // tracks the watcher goroutine
+}
+
+// Load the rates from the file and watch it for changes.
+//
+// The file is checked for changes every interval, zero uses DefaultReloadInterval.
+func NewFileProvider(path string, interval time.Duration) (*FileProvider, error) {
+	log.Printf("[fx]loading rates from file: %v\n", path)
+
+	p := &FileProvider{path: path, stop: make(chan struct{})}
+	if err := p.reload(); err != nil {
+		log.Printf("[fx]failed to load rates from file: %s - %s\n", path, err)
+		return nil, err
+	}
+
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+	p.wg.Add(1)
+	go p.watch(interval)
+
+	return p, nil
+}
+
+// Returns the rate to convert an amount in currency from to currency to.
+//
+// Returns error if the file has no rate for the currency pair.
+func (p *FileProvider) Rate(from string, to string) (money.Rate, error) {
+	key := strings.ToUpper(from) + "/" + strings.ToUpper(to)
+
+	p.lock.RLock()
+	r, ok := p.rates[key]
+	p.lock.RUnlock()
+
+	if !ok {
+		return money.Rate{}, fmt.Errorf("no exchange rate available to convert %v to %v", from, to)
+	}
+	return r, nil
+}
+
+// Stop watching the rates file.
+func (p *FileProvider) Close() error {
+	close(p.stop)
+	p.wg.Wait()
+	return nil
+}
+
+// Check the rates file periodically, reload when it changes.
+func (p *FileProvider) watch(interval time.Duration) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if !p.changed() {
+				continue
+			}
+			log.Printf("[fx]rates file changed, reloading: %v\n", p.path)
+			if err := p.reload(); err != nil {
+				log.Printf("[fx]failed to reload rates, keeping the previous rates - %v\n", err)
+			}
+		}
+	}
+}
+
+// Returns true if the rates file changed since it was loaded.
+func (p *FileProvider) changed() bool {
+	fi, err := os.Stat(p.path)
+	if err != nil {
+		return false
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return !fi.ModTime().Equal(p.modTime) || fi.Size() != p.size
+}
+
+// Read and validate the rates file, replacing the current rates.
+func (p *FileProvider) reload() error {
+	fi, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	bytes, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+
+	var raw map[string]money.Rate
+	if err := json.Unmarshal(bytes, &raw); err != nil {
+		return fmt.Errorf("failed to parse rates file: %v - %v", p.path, err)
+	}
+
+	// validate the currency pairs
+	rates := make(map[string]money.Rate, len(raw))
+	for pair, r := range raw {
+		parts := strings.Split(pair, "/")
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid currency pair: %q, expecting FROM/TO", pair)
+		}
+		from, err := money.LookupCurrency(parts[0])
+		if err != nil {
+			return fmt.Errorf("invalid currency pair: %q - %v", pair, err)
+		}
+		to, err := money.LookupCurrency(parts[1])
+		if err != nil {
+			return fmt.Errorf("invalid currency pair: %q - %v", pair, err)
+		}
+		if r.IsZero() {
+			return fmt.Errorf("missing rate for currency pair: %q", pair)
+		}
+		rates[from.Code+"/"+to.Code] = r
+	}
+
+	p.lock.Lock()
+	p.rates = rates
+	p.modTime = fi.ModTime()
+	p.size = fi.Size()
+	p.lock.Unlock()
+	log.Printf("[fx]loaded %v rates\n", len(rates))
+
+	return nil
+}
+
+// end-of-file
@@ -0,0 +1,78 @@
+package fx
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"paytabs/internal/money"
+)
+
+// Test Setup
+func TestMain(m *testing.M) {
+	// disable logging when tests are run
+	log.SetOutput(ioutil.Discard)
+
+	// run the tests
+	os.Exit(m.Run())
+}
+
+func TestFileProvider(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rates.json")
+	os.WriteFile(file, []byte(`{"USD/EUR": "0.9215", "eur/usd": 1.0852}`), 0644)
+
+	p, err := NewFileProvider(file, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to load rates file - %v", err)
+	}
+	defer p.Close()
+
+	if r, err := p.Rate("USD", "EUR"); err != nil || r.String() != "0.9215" {
+		t.Fatalf("Expecting USD/EUR rate 0.9215, received %v, %v", r, err)
+	}
+	if r, err := p.Rate("EUR", "usd"); err != nil || r.String() != "1.0852" {
+		t.Fatalf("Expecting EUR/USD rate 1.0852, received %v, %v", r, err)
+	}
+	if _, err := p.Rate("USD", "JPY"); err == nil {
+		t.Fatal("Expecting an error for a missing rate")
+	}
+
+	// an invalid file keeps the previous rates
+	os.WriteFile(file, []byte(`{"USD/EUR": "-1"}`), 0644)
+	time.Sleep(50 * time.Millisecond)
+	if r, _ := p.Rate("USD", "EUR"); r.String() != "0.9215" {
+		t.Fatalf("Expecting previous USD/EUR rate 0.9215 to be kept, received %v", r)
+	}
+
+	// a valid change is picked up
+	os.WriteFile(file, []byte(`{"USD/EUR": "0.93", "USD/JPY": "151.2"}`), 0644)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		r, err := p.Rate("USD", "JPY")
+		if err == nil && r == money.MustParseRate("151.2") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Rates file change was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := p.Rate("EUR", "USD"); err == nil {
+		t.Fatal("Expecting EUR/USD rate to be removed after reload")
+	}
+}
+
+func TestFileProviderInvalid(t *testing.T) {
+	for _, data := range []string{`{"USD-EUR": "1"}`, `{"USD/XYZ": "1"}`, `{"USD/EUR": "0"}`, `[1]`} {
+		file := filepath.Join(t.TempDir(), "rates.json")
+		os.WriteFile(file, []byte(data), 0644)
+		if _, err := NewFileProvider(file, 0); err == nil {
+			t.Fatalf("Expecting an error loading %v", data)
+		}
+	}
+}
+
+// end-of-file
@@ -0,0 +1,196 @@
+// Implements the accrual of interest on savings accounts.
+//
+// The interest policy is loaded from a json file:
+//
+//	{
+//	    "day_count": "actual/365",
+//	    "rounding": "half_even",
+//	    "expense_accounts": {"USD": "bank-interest-usd", "EUR": "bank-interest-eur"}
+//	}
+//
+// Interest accrues every day on the positive balance of a savings account at
+// its annual rate, e.g. "0.045" for 4.5%. The interest of a day is the annual
+// interest on the balance times the fraction of the year the day counts for
+// under the day count convention:
+//
+//	actual/365    - every day counts 1/365
+//	actual/360    - every day counts 1/360
+//	actual/actual - every day counts 1/365, or 1/366 in leap years
+//	30/360        - every month counts 30/360: the 31st counts nothing, the
+//	                last day of February counts the days missing up to 30
+//
+// Accrued interest is held with AccrualScale decimals. It is rounded to the
+// minor unit of the currency with the rounding mode when it is posted from the
+// expense account of the currency, the part rounded off carried to the next
+// posting. Rounding modes are "half_even", "half_up" and "down". The day count
+// defaults to actual/365 and the rounding to half_even.
+package interest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"paytabs/internal/money"
+)
+
+// day count conventions
+const (
+	Actual365    = "actual/365"
+	Actual360    = "actual/360"
+	ActualActual = "actual/actual"
+	Thirty360    = "30/360"
+)
+
+// number of decimals of the accrued interest
+const AccrualScale = 8
+
+// structure of the interest policy file contents
+type config struct {
+	DayCount        string             `json:"day_count"`
+	Rounding        money.RoundingMode `json:"rounding"`
+	ExpenseAccounts map[string]string  `json:"expense_accounts"` // account paying the interest, by currency
+}
+
+// structure representing the interest policy in effect
+type Policy struct {
+	dayCount string
+	rounding money.RoundingMode
+	accounts map[string]string // expense accounts by currency
+}
+
+// Load the interest policy from a json file.
+func Load(filename string) (*Policy, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	p, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interest file: %v - %v", filename, err)
+	}
+	return p, nil
+}
+
+// Parse and validate the interest policy in json.
+func Parse(data []byte) (*Policy, error) {
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.DayCount == "" {
+		cfg.DayCount = Actual365
+	}
+	if cfg.Rounding == "" {
+		cfg.Rounding = money.RoundHalfEven
+	}
+	return New(cfg.DayCount, cfg.Rounding, cfg.ExpenseAccounts)
+}
+
+// Construct an interest policy.
+//
+// Returns error if the day count convention or the rounding mode is not valid,
+// or an expense account is given for an unknown currency.
+func New(dayCount string, rounding money.RoundingMode, expenseAccounts map[string]string) (*Policy, error) {
+	switch dayCount {
+	case Actual365, Actual360, ActualActual, Thirty360:
+	default:
+		return nil, fmt.Errorf("invalid day count: %q, expecting %q, %q, %q or %q", dayCount, Actual365, Actual360, ActualActual, Thirty360)
+	}
+	if !rounding.Valid() {
+		return nil, fmt.Errorf("invalid rounding: %q, expecting %q, %q or %q", rounding, money.RoundHalfEven, money.RoundHalfUp, money.RoundDown)
+	}
+	p := &Policy{dayCount: dayCount, rounding: rounding, accounts: make(map[string]string, len(expenseAccounts))}
+	for currency, id := range expenseAccounts {
+		c, err := money.LookupCurrency(currency)
+		if err != nil {
+			return nil, err
+		}
+		if id == "" {
+			return nil, fmt.Errorf("expense account of %v cannot be empty", c.Code)
+		}
+		p.accounts[c.Code] = id
+	}
+	return p, nil
+}
+
+// Returns the day count convention.
+func (p *Policy) DayCount() string {
+	return p.dayCount
+}
+
+// Returns the expense account paying the interest of accounts in the currency.
+func (p *Policy) ExpenseAccount(currency string) (string, bool) {
+	id, ok := p.accounts[currency]
+	return id, ok
+}
+
+// Returns the expense accounts by currency.
+func (p *Policy) Accounts() map[string]string {
+	accounts := make(map[string]string, len(p.accounts))
+	for currency, id := range p.accounts {
+		accounts[currency] = id
+	}
+	return accounts
+}
+
+// Returns the day of the time, midnight UTC.
+func Day(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// Returns true if the day is the last day of its month.
+func EndOfMonth(day time.Time) bool {
+	return day.AddDate(0, 0, 1).Day() == 1
+}
+
+// Returns the fraction of the year the day counts for, as numerator and denominator.
+func (p *Policy) fraction(day time.Time) (int64, int64) {
+	switch p.dayCount {
+	case Actual360:
+		return 1, 360
+	case ActualActual:
+		if y := day.Year(); y%4 == 0 && (y%100 != 0 || y%400 == 0) {
+			return 1, 366
+		}
+		return 1, 365
+	case Thirty360:
+		switch {
+		case day.Day() == 31:
+			return 0, 360
+		case day.Month() == time.February && EndOfMonth(day):
+			return int64(30 - day.Day() + 1), 360
+		}
+		return 1, 360
+	}
+	return 1, 365
+}
+
+// Returns the interest accrued for the day on the balance at the annual rate.
+//
+// The interest has AccrualScale decimals, rounded half away from zero. There is
+// no interest on a balance that is zero or below.
+func (p *Policy) Daily(balance money.Money, rate money.Rate, day time.Time) (money.Money, error) {
+	num, den := p.fraction(day)
+	if balance.Sign() <= 0 || rate.IsZero() || num == 0 {
+		return money.New(0, AccrualScale), nil
+	}
+	annual, err := balance.Convert(rate, AccrualScale)
+	if err != nil {
+		return money.Money{}, fmt.Errorf("failed to compute the interest on %v - %v", balance, err)
+	}
+	daily, err := annual.Prorate(money.New(num, 0), money.New(den, 0))
+	if err != nil {
+		return money.Money{}, fmt.Errorf("failed to compute the interest on %v - %v", balance, err)
+	}
+	return daily, nil
+}
+
+// Returns the part of the accrued interest posted, rounded to the decimals of the currency.
+func (p *Policy) Round(accrued money.Money, exponent uint8) money.Money {
+	return accrued.Round(exponent, p.rounding)
+}
+
+// end-of-file
@@ -0,0 +1,106 @@
+package interest
+
+import (
+	"testing"
+	"time"
+
+	"paytabs/internal/money"
+)
+
+func TestParse(t *testing.T) {
+	p, err := Parse([]byte(`{"expense_accounts": {"usd": "interest-usd"}}`))
+	if err != nil {
+		t.Fatalf("Unexpected error - %v", err)
+	}
+	if p.DayCount() != Actual365 || p.rounding != money.RoundHalfEven {
+		t.Fatalf("Expecting the default day count and rounding, received %v, %v", p.DayCount(), p.rounding)
+	}
+	if id, ok := p.ExpenseAccount("USD"); !ok || id != "interest-usd" {
+		t.Fatalf("Expecting expense account interest-usd, received %q", id)
+	}
+	if _, ok := p.ExpenseAccount("EUR"); ok {
+		t.Fatal("Expecting no EUR expense account")
+	}
+
+	invalid := []string{
+		`{"day_count": "actual/364"}`,
+		`{"rounding": "up"}`,
+		`{"expense_accounts": {"XXX": "interest"}}`,
+		`{"expense_accounts": {"USD": ""}}`,
+	}
+	for _, js := range invalid {
+		if _, err := Parse([]byte(js)); err == nil {
+			t.Fatalf("Expecting error for %v", js)
+		}
+	}
+}
+
+func TestDayCount(t *testing.T) {
+	// the days of a month count 30/360 under 30/360, whatever its length
+	p, _ := New(Thirty360, money.RoundHalfEven, nil)
+	for _, month := range []time.Time{
+		time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2028, 2, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		var days int64
+		for day := month; day.Month() == month.Month(); day = day.AddDate(0, 0, 1) {
+			num, den := p.fraction(day)
+			if den != 360 {
+				t.Fatalf("Expecting denominator 360, received %v", den)
+			}
+			days += num
+		}
+		if days != 30 {
+			t.Fatalf("Expecting 30 days in %v, received %v", month.Format("2006-01"), days)
+		}
+	}
+
+	// leap years have 366 days under actual/actual
+	p, _ = New(ActualActual, money.RoundHalfEven, nil)
+	if _, den := p.fraction(time.Date(2028, 7, 1, 0, 0, 0, 0, time.UTC)); den != 366 {
+		t.Fatalf("Expecting denominator 366, received %v", den)
+	}
+	if _, den := p.fraction(time.Date(2100, 7, 1, 0, 0, 0, 0, time.UTC)); den != 365 {
+		t.Fatalf("Expecting denominator 365, received %v", den)
+	}
+	if !EndOfMonth(time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)) || EndOfMonth(time.Date(2028, 2, 28, 0, 0, 0, 0, time.UTC)) {
+		t.Fatal("Unexpected end of month")
+	}
+	if d := Day(time.Date(2026, 3, 1, 1, 30, 0, 0, time.FixedZone("CET", 3600))); !d.Equal(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected day %v", d)
+	}
+}
+
+func TestDaily(t *testing.T) {
+	day := time.Date(2028, 3, 15, 0, 0, 0, 0, time.UTC)
+	rate := money.MustParseRate("0.05")
+	var tests = []struct {
+		dayCount string
+		balance  string
+		interest string
+	}{
+		{Actual365, "10000.00", "1.36986301"},
+		{Actual360, "10000.00", "1.38888889"},
+		{ActualActual, "10000.00", "1.36612022"},
+		{Thirty360, "10000.00", "1.38888889"},
+		{Actual365, "0.00", "0.00000000"},
+		{Actual365, "-10.00", "0.00000000"},
+	}
+	for _, test := range tests {
+		p, _ := New(test.dayCount, money.RoundHalfEven, nil)
+		interest, err := p.Daily(money.MustParse(test.balance), rate, day)
+		if err != nil || interest.String() != test.interest {
+			t.Fatalf("Expecting %v interest %v on %v, received %v - %v", test.dayCount, test.interest, test.balance, interest, err)
+		}
+	}
+
+	// the interest is rounded to the currency when posted
+	p, _ := New(Actual365, money.RoundDown, nil)
+	if posted := p.Round(money.MustParse("41.09589039"), 2); posted.String() != "41.09" {
+		t.Fatalf("Expecting 41.09, received %v", posted)
+	}
+}
+
+// end-of-file
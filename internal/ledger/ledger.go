@@ -0,0 +1,299 @@
+// Implements a double-entry ledger of the movements of money between accounts.
+//
+// Every movement is recorded as an entry of postings, each posting a debit or
+// a credit of an amount to one account. The debits and credits of an entry are
+// equal in every currency, so money is never created or destroyed by an entry.
+// Money enters the ledger through the opening account, the counterpart of the
+// opening balances of the accounts. A cross-currency transfer goes through the
+// exchange clearing account of each currency: the from account is debited and
+// the clearing account of its currency credited, the clearing account of the
+// other currency is debited and the to account credited.
+//
+// The balance of an account is its credits less its debits, the accounts hold
+// money owed to their owners. The balances of all the accounts in the ledger,
+// including the opening and clearing accounts, therefore sum to zero in every
+// currency. Verify recomputes the balances from the postings and proves this.
+//
+// A Ledger is not safe for concurrent use, the owner serializes access.
+package ledger
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"paytabs/internal/money"
+)
+
+// side of a posting
+type Side string
+
+const (
+	Debit  Side = "debit"
+	Credit Side = "credit"
+)
+
+// prefix of the ids of the accounts kept by the ledger itself
+const SystemPrefix = "ledger:"
+
+// counterpart of the opening balances of the accounts
+const OpeningAccount = SystemPrefix + "opening"
+
+// Returns the id of the exchange clearing account of the currency.
+func ClearingAccount(currency string) string {
+	return SystemPrefix + "fx-clearing:" + currency
+}
+
+// Returns true for the accounts kept by the ledger itself.
+func IsSystem(account string) bool {
+	return strings.HasPrefix(account, SystemPrefix)
+}
+
+// structure representing a debit or credit of one account
+type Posting struct {
+	Account  string      `json:"account_id"`
+	Side     Side        `json:"side"`
+	Amount   money.Money `json:"amount"`
+	Currency string      `json:"currency"`
+}
+
+// structure representing the postings of one movement of money
+type Entry struct {
+	Tid      uint64    `json:"transaction_id,omitempty"` // transaction posted, zero for opening balances
+	Postings []Posting `json:"postings"`
+}
+
+// Returns the entry of a transfer between two accounts.
+//
+// When the currencies differ the transfer goes through the clearing accounts
+// of both currencies, otherwise toAmount is equal to amount.
+func Transfer(tid uint64, from string, to string, amount money.Money, currency string, toAmount money.Money, toCurrency string) Entry {
+	if currency == toCurrency {
+		return Entry{Tid: tid, Postings: []Posting{
+			{from, Debit, amount, currency},
+			{to, Credit, amount, currency},
+		}}
+	}
+	return Entry{Tid: tid, Postings: []Posting{
+		{from, Debit, amount, currency},
+		{ClearingAccount(currency), Credit, amount, currency},
+		{ClearingAccount(toCurrency), Debit, toAmount, toCurrency},
+		{to, Credit, toAmount, toCurrency},
+	}}
+}
+
+// Returns the entry of the opening balance of an account.
+func Opening(account string, amount money.Money, currency string) Entry {
+	return Entry{Postings: []Posting{
+		{OpeningAccount, Debit, amount, currency},
+		{account, Credit, amount, currency},
+	}}
+}
+
+// Check the debits and credits of the entry are equal in every currency.
+func (e *Entry) Check() error {
+	net := make(map[string]money.Money)
+	for _, p := range e.Postings {
+		if p.Amount.Sign() < 0 {
+			return fmt.Errorf("negative %v of %v %v to account id: %v", p.Side, p.Amount, p.Currency, p.Account)
+		}
+		var err error
+		switch p.Side {
+		case Debit:
+			net[p.Currency], err = net[p.Currency].CheckedSub(p.Amount)
+		case Credit:
+			net[p.Currency], err = net[p.Currency].CheckedAdd(p.Amount)
+		default:
+			return fmt.Errorf("invalid side: %q of posting to account id: %v", p.Side, p.Account)
+		}
+		if err != nil {
+			return fmt.Errorf("%v postings are out of range - %v", p.Currency, err)
+		}
+	}
+	for currency, m := range net {
+		if !m.IsZero() {
+			return fmt.Errorf("credits exceed debits by %v %v", m, currency)
+		}
+	}
+	return nil
+}
+
+// key of the balance of an account in a currency
+type balanceKey struct {
+	account  string
+	currency string
+}
+
+// structure representing the ledger
+type Ledger struct {
+	entries  []Entry                    // entries in the order they were posted
+	tidIndex map[uint64]int             // position of the entry of each transaction
+	balances map[balanceKey]money.Money // balances kept up to date as entries are posted
+}
+
+// Construct an empty ledger.
+func New() *Ledger {
+	return &Ledger{tidIndex: make(map[uint64]int), balances: make(map[balanceKey]money.Money)}
+}
+
+// Post the entry, updating the balances of its accounts.
+//
+// The entry is recorded even if it does not balance, Verify reports it.
+func (l *Ledger) Post(e Entry) {
+	if e.Tid != 0 {
+		l.tidIndex[e.Tid] = len(l.entries)
+	}
+	l.entries = append(l.entries, e)
+	for _, p := range e.Postings {
+		k := balanceKey{p.Account, p.Currency}
+		if p.Side == Debit {
+			l.balances[k] = l.balances[k].Sub(p.Amount)
+		} else {
+			l.balances[k] = l.balances[k].Add(p.Amount)
+		}
+	}
+}
+
+// Returns the entry of the transaction with the given id.
+func (l *Ledger) Entry(tid uint64) (Entry, bool) {
+	i, ok := l.tidIndex[tid]
+	if !ok {
+		return Entry{}, false
+	}
+	return l.entries[i], true
+}
+
+// Returns the balance of the account in the currency, its credits less its debits.
+func (l *Ledger) Balance(account string, currency string) money.Money {
+	return l.balances[balanceKey{account, currency}]
+}
+
+// structure representing the balance of an account held outside the ledger
+type Balance struct {
+	Account  string
+	Amount   money.Money
+	Currency string
+}
+
+// totals of one currency in the verification report
+type Totals struct {
+	Currency string      `json:"currency"`
+	Debits   money.Money `json:"debits"`   // sum of all the debits
+	Credits  money.Money `json:"credits"`  // sum of all the credits
+	Opening  money.Money `json:"opening"`  // sum of the opening balances
+	Clearing money.Money `json:"clearing"` // balance of the exchange clearing account
+	Balances money.Money `json:"balances"` // sum of the balances of the accounts
+}
+
+// structure representing the result of a verification
+type Report struct {
+	Entries  int      `json:"entries"`
+	Postings int      `json:"postings"`
+	Accounts int      `json:"accounts"`           // accounts with postings, including the system accounts
+	Totals   []Totals `json:"totals"`             // in the order of the currency codes
+	Balanced bool     `json:"balanced"`           // true when no problem was found
+	Problems []string `json:"problems,omitempty"` // description of each problem found
+}
+
+// Verify the ledger against the balances of the accounts held outside it.
+//
+// Recomputes the balances of all the accounts from the postings and checks
+// that every entry balances, total debits equal total credits and the balances
+// of all the accounts sum to zero in every currency, i.e. the balances of the
+// accounts and the clearing accounts sum to the opening balances. Checks the
+// recomputed balances match the given balances and the balances kept as the
+// entries were posted, and that no account other than the given accounts and
+// the system accounts has a balance.
+func (l *Ledger) Verify(accounts []Balance) Report {
+	r := Report{Entries: len(l.entries)}
+	problem := func(format string, v ...interface{}) {
+		r.Problems = append(r.Problems, fmt.Sprintf(format, v...))
+	}
+
+	// recompute the balances from the postings
+	totals := make(map[string]*Totals)
+	total := func(currency string) *Totals {
+		t, ok := totals[currency]
+		if !ok {
+			t = &Totals{Currency: currency}
+			totals[currency] = t
+		}
+		return t
+	}
+	// sums out of range cannot be verified, they are reported once per currency
+	overflow := make(map[string]bool)
+	add := func(sum money.Money, m money.Money, currency string) money.Money {
+		s, err := sum.CheckedAdd(m)
+		if err != nil {
+			if !overflow[currency] {
+				overflow[currency] = true
+				problem("%v sums are out of range - %v", currency, err)
+			}
+			return sum
+		}
+		return s
+	}
+
+	balances := make(map[balanceKey]money.Money)
+	for i := range l.entries {
+		e := &l.entries[i]
+		if err := e.Check(); err != nil {
+			problem("entry of transaction id: %v does not balance - %v", e.Tid, err)
+		}
+		for _, p := range e.Postings {
+			r.Postings++
+			t := total(p.Currency)
+			k := balanceKey{p.Account, p.Currency}
+			if p.Side == Debit {
+				t.Debits = add(t.Debits, p.Amount, p.Currency)
+				balances[k] = add(balances[k], p.Amount.Neg(), p.Currency)
+			} else {
+				t.Credits = add(t.Credits, p.Amount, p.Currency)
+				balances[k] = add(balances[k], p.Amount, p.Currency)
+			}
+		}
+	}
+	r.Accounts = len(balances)
+
+	// the balances held outside the ledger are derived from the postings
+	given := make(map[balanceKey]bool, len(accounts))
+	for _, a := range accounts {
+		k := balanceKey{a.Account, a.Currency}
+		given[k] = true
+		if b := balances[k]; b.Cmp(a.Amount) != 0 {
+			problem("account id: %v has a balance of %v %v, postings sum to %v", a.Account, a.Amount, a.Currency, b)
+		}
+		t := total(a.Currency)
+		t.Balances = add(t.Balances, a.Amount, a.Currency)
+	}
+	for k, b := range balances {
+		if kept := l.balances[k]; kept.Cmp(b) != 0 {
+			problem("account id: %v has a ledger balance of %v %v, postings sum to %v", k.account, kept, k.currency, b)
+		}
+		switch {
+		case k.account == OpeningAccount:
+			total(k.currency).Opening = b.Neg()
+		case k.account == ClearingAccount(k.currency):
+			total(k.currency).Clearing = b
+		case !given[k] && !b.IsZero():
+			problem("unknown account id: %v has a balance of %v %v", k.account, b, k.currency)
+		}
+	}
+
+	// money is conserved in every currency
+	for _, t := range totals {
+		if t.Debits.Cmp(t.Credits) != 0 {
+			problem("%v debits of %v do not equal credits of %v", t.Currency, t.Debits, t.Credits)
+		}
+		if sum := add(t.Balances, t.Clearing, t.Currency); sum.Cmp(t.Opening) != 0 {
+			problem("%v balances and clearing sum to %v, opening balances sum to %v", t.Currency, sum, t.Opening)
+		}
+		r.Totals = append(r.Totals, *t)
+	}
+	sort.Slice(r.Totals, func(i, j int) bool { return r.Totals[i].Currency < r.Totals[j].Currency })
+	sort.Strings(r.Problems)
+	r.Balanced = len(r.Problems) == 0
+	return r
+}
+
+// end-of-file
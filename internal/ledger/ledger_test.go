@@ -0,0 +1,115 @@
+package ledger
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"paytabs/internal/money"
+)
+
+// Returns a ledger with two USD accounts and a JPY account, and some transfers between them.
+func testLedger() (*Ledger, []Balance) {
+	l := New()
+	l.Post(Opening("a", money.MustParse("100.00"), "USD"))
+	l.Post(Opening("b", money.MustParse("50.00"), "USD"))
+	l.Post(Opening("c", money.MustParse("1000"), "JPY"))
+	l.Post(Transfer(1, "a", "b", money.MustParse("25.50"), "USD", money.MustParse("25.50"), "USD"))
+	l.Post(Transfer(2, "b", "c", money.MustParse("10.00"), "USD", money.MustParse("1512"), "JPY"))
+	return l, []Balance{
+		{"a", money.MustParse("74.50"), "USD"},
+		{"b", money.MustParse("65.50"), "USD"},
+		{"c", money.MustParse("2512"), "JPY"},
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	e := Transfer(1, "a", "b", money.MustParse("10.00"), "USD", money.MustParse("10.00"), "USD")
+	if len(e.Postings) != 2 || e.Check() != nil {
+		t.Fatalf("Unexpected entry %+v", e)
+	}
+	e = Transfer(2, "a", "c", money.MustParse("10.00"), "USD", money.MustParse("1512"), "JPY")
+	if len(e.Postings) != 4 || e.Check() != nil {
+		t.Fatalf("Unexpected entry %+v", e)
+	}
+	if e.Postings[1].Account != ClearingAccount("USD") || e.Postings[2].Account != ClearingAccount("JPY") {
+		t.Fatalf("Expecting clearing accounts, received %+v", e.Postings)
+	}
+	if !IsSystem(ClearingAccount("USD")) || !IsSystem(OpeningAccount) || IsSystem("a") {
+		t.Fatal("Unexpected system accounts")
+	}
+
+	// entries that do not balance are rejected by Check
+	e.Postings[3].Amount = money.MustParse("1513")
+	if err := e.Check(); err == nil {
+		t.Fatal("Expecting error for entry that does not balance")
+	}
+}
+
+func TestBalance(t *testing.T) {
+	l, balances := testLedger()
+	for _, b := range balances {
+		if l.Balance(b.Account, b.Currency).Cmp(b.Amount) != 0 {
+			t.Fatalf("Expecting balance %v for account %v, received %v", b.Amount, b.Account, l.Balance(b.Account, b.Currency))
+		}
+	}
+	if b := l.Balance(ClearingAccount("USD"), "USD"); b.String() != "10.00" {
+		t.Fatalf("Expecting USD clearing balance 10.00, received %v", b)
+	}
+	if e, ok := l.Entry(2); !ok || e.Tid != 2 || len(e.Postings) != 4 {
+		t.Fatalf("Unexpected entry %+v", e)
+	}
+	if _, ok := l.Entry(3); ok {
+		t.Fatal("Expecting no entry for transaction 3")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	l, balances := testLedger()
+	r := l.Verify(balances)
+	if !r.Balanced || len(r.Problems) != 0 {
+		t.Fatalf("Expecting balanced ledger, received %+v", r)
+	}
+	if r.Entries != 5 || r.Postings != 12 || r.Accounts != 7 || len(r.Totals) != 2 {
+		t.Fatalf("Unexpected report %+v", r)
+	}
+	usd := r.Totals[1]
+	if usd.Currency != "USD" || usd.Debits.String() != "185.50" || usd.Credits.String() != "185.50" ||
+		usd.Opening.String() != "150.00" || usd.Balances.String() != "140.00" || usd.Clearing.String() != "10.00" {
+		t.Fatalf("Unexpected USD totals %+v", usd)
+	}
+
+	// a balance changed outside the ledger
+	balances[0].Amount = money.MustParse("74.51")
+	if r := l.Verify(balances); r.Balanced || len(r.Problems) != 2 || !strings.Contains(strings.Join(r.Problems, "\n"), "account id: a has a balance of 74.51") {
+		t.Fatalf("Expecting mismatch for account a, received %+v", r)
+	}
+	balances[0].Amount = money.MustParse("74.50")
+
+	// an entry that does not balance
+	l.Post(Entry{Tid: 3, Postings: []Posting{{"a", Debit, money.MustParse("1.00"), "USD"}}})
+	balances[0].Amount = money.MustParse("73.50")
+	r = l.Verify(balances)
+	if r.Balanced || !strings.Contains(strings.Join(r.Problems, "\n"), "transaction id: 3 does not balance") {
+		t.Fatalf("Expecting unbalanced entry, received %+v", r)
+	}
+
+	// postings to an account not given
+	l, balances = testLedger()
+	if r := l.Verify(balances[1:]); r.Balanced || !strings.Contains(strings.Join(r.Problems, "\n"), "unknown account id: a") {
+		t.Fatalf("Expecting unknown account, received %+v", r)
+	}
+
+	// sums out of range are reported instead of wrapping around
+	max := money.New(math.MaxInt64, 2)
+	l = New()
+	l.Post(Opening("a", max, "USD"))
+	l.Post(Entry{Tid: 1, Postings: []Posting{{"a", Debit, max, "USD"}, {"b", Credit, max, "USD"}}})
+	l.Post(Entry{Tid: 2, Postings: []Posting{{"b", Debit, max, "USD"}, {"a", Credit, max, "USD"}}})
+	r = l.Verify([]Balance{{"a", max, "USD"}, {"b", money.New(0, 2), "USD"}})
+	if r.Balanced || len(r.Problems) != 1 || !strings.Contains(r.Problems[0], "USD sums are out of range") {
+		t.Fatalf("Expecting the sums out of range, received %+v", r)
+	}
+}
+
+// end-of-file
@@ -0,0 +1,261 @@
+// Implements the account lifecycle for the in-memory datastore.
+//
+// Accounts are created active. An active account can be frozen and made active
+// again, and an account with a zero balance can be closed. Accounts are never
+// removed, a closed account keeps its transaction history.
+//
+// Creating an account grows the accounts, locks and index. Transfers hold the
+// positions of their accounts in these, so they hold alock shared while a new
+// account is appended holding it exclusively.
+package memds
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"paytabs/internal/ds"
+	"paytabs/internal/ledger"
+	"paytabs/internal/money"
+)
+
+// maximum length of an account id
+const maxAccountIdLength = 64
+
+// Returns true if the status is a valid account status.
+func validStatus(status string) bool {
+	switch status {
+	case ds.StatusActive, ds.StatusFrozen, ds.StatusClosed:
+		return true
+	}
+	return false
+}
+
+// Validate the type of an account and its interest rate.
+//
+// Returns the type, TypeChecking when empty. Only savings accounts have an
+// interest rate, and every savings account has one.
+func checkAccountType(typ string, rate money.Rate) (string, error) {
+	switch typ {
+	case "", ds.TypeChecking:
+		if !rate.IsZero() {
+			return "", ds.Errorf(ds.ErrInvalidAccount, "only %v accounts have an interest rate", ds.TypeSavings)
+		}
+		return ds.TypeChecking, nil
+	case ds.TypeSavings:
+		if rate.IsZero() {
+			return "", ds.Errorf(ds.ErrInvalidAccount, "%v account needs an interest rate", ds.TypeSavings)
+		}
+		return ds.TypeSavings, nil
+	}
+	return "", ds.Errorf(ds.ErrInvalidAccount, "invalid type: %q, expecting %q or %q", typ, ds.TypeChecking, ds.TypeSavings)
+}
+
+// Generate a random (version 4) uuid for a new account.
+func newAccountId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// Append the account to the table and the index, posting its opening balance.
+//
+// Caller must hold alock exclusively and tlock, unless the datastore is not yet in use.
+func (d *datastore) appendAccount(a ds.Account) {
+	d.index[a.Id] = len(d.accounts)
+	d.accounts = append(d.accounts, a)
+	d.locks = append(d.locks, sync.Mutex{})
+	d.postOpening(a)
+}
+
+// Validate the details of a new account, filling in the defaults.
+func (d *datastore) checkNewAccount(na ds.NewAccount) (ds.Account, error) {
+	if na.Id == "" {
+		id, err := newAccountId()
+		if err != nil {
+			return ds.Account{}, fmt.Errorf("failed to generate account id - %v", err)
+		}
+		na.Id = id
+	}
+	if len(na.Id) > maxAccountIdLength || strings.ContainsAny(na.Id, "/ \t\r\n") {
+		return ds.Account{}, ds.Errorf(ds.ErrInvalidAccount, "invalid account id: %q, expecting at most %v characters without '/' or spaces", na.Id, maxAccountIdLength)
+	}
+	if ledger.IsSystem(na.Id) {
+		return ds.Account{}, ds.Errorf(ds.ErrInvalidAccount, "invalid account id: %q, ids starting with %q are reserved", na.Id, ledger.SystemPrefix)
+	}
+	if strings.TrimSpace(na.Name) == "" {
+		return ds.Account{}, ds.Errorf(ds.ErrInvalidAccount, "account name cannot be empty")
+	}
+	if na.Currency == "" {
+		na.Currency = d.currency
+	}
+	c, err := money.LookupCurrency(na.Currency)
+	if err != nil {
+		return ds.Account{}, ds.Errorf(ds.ErrInvalidAccount, "%v", err)
+	}
+	if na.Balance.Sign() < 0 {
+		return ds.Account{}, ds.Errorf(ds.ErrInvalidAmount, "opening balance cannot be a negative value")
+	}
+	balance, err := na.Balance.Rescale(c.Exponent)
+	if err != nil {
+		return ds.Account{}, ds.Errorf(ds.ErrInvalidAmount, "invalid opening balance for currency %v - %v", c.Code, err)
+	}
+
+	limit, err := checkOverdraftLimit(na.OverdraftLimit, c.Code)
+	if err != nil {
+		return ds.Account{}, err
+	}
+
+	typ, err := checkAccountType(na.Type, na.InterestRate)
+	if err != nil {
+		return ds.Account{}, err
+	}
+	if typ == ds.TypeSavings {
+		if err := d.checkSavings(c.Code); err != nil {
+			return ds.Account{}, err
+		}
+	}
+
+	return ds.Account{Id: na.Id, Name: na.Name, Balance: balance, Available: balance, OverdraftLimit: limit, Currency: c.Code, Status: ds.StatusActive, Type: typ, InterestRate: na.InterestRate}, nil
+}
+
+// Create a new active account.
+//
+// Returns the account created. Returns error if the details are invalid or
+// an account with the same id already exists.
+func (d *datastore) Create(na ds.NewAccount) (ds.Account, error) {
+	log.Printf("[memds]Create() called with id: %v, name: %v, currency: %v\n", na.Id, na.Name, na.Currency)
+
+	a, err := d.checkNewAccount(na)
+	if err != nil {
+		log.Printf("[memds]Create: %v\n", err)
+		return ds.Account{}, err
+	}
+
+	// no transfer can hold an index position while the table grows
+	d.alock.Lock()
+	defer d.alock.Unlock()
+
+	if _, ok := d.index[a.Id]; ok {
+		log.Printf("[memds]Create: account with id: %v already exists\n", a.Id)
+		return ds.Account{}, ds.Errorf(ds.ErrAccountExists, "account with id: %v already exists", a.Id)
+	}
+
+	d.tlock.Lock()
+	defer d.tlock.Unlock()
+	if err := d.checkOpening(a); err != nil {
+		log.Printf("[memds]Create: %v\n", err)
+		return ds.Account{}, err
+	}
+	if d.journal != nil {
+		e := journalEntry{Lsn: d.lsn + 1, Op: opCreateAccount, Date: d.clock.Now(), Account: &a}
+		if err := d.journal.append(&e); err != nil {
+			log.Printf("[memds]Create: failed to write journal - %v\n", err)
+			return ds.Account{}, fmt.Errorf("failed to write journal - %v", err)
+		}
+	}
+	d.lsn += 1
+	d.appendAccount(a)
+	d.commitVersions(len(d.accounts) - 1)
+
+	log.Printf("[memds]returning from Create() with id: %v\n", a.Id)
+	return a, nil
+}
+
+// Check the status of the account can be changed to the given status.
+func checkStatusTransition(a ds.Account, status string) error {
+	if !validStatus(status) {
+		return ds.Errorf(ds.ErrInvalidAccount, "invalid status: %q, expecting %q, %q or %q", status, ds.StatusActive, ds.StatusFrozen, ds.StatusClosed)
+	}
+	if status == ds.StatusClosed && !a.Balance.IsZero() {
+		return ds.Errorf(ds.ErrInvalidStatusTransition, "account id: %v has a balance of %v, only an account with a zero balance can be closed", a.Id, a.Balance)
+	}
+	if status == ds.StatusClosed && a.Available.Cmp(a.Balance) != 0 {
+		return ds.Errorf(ds.ErrInvalidStatusTransition, "account id: %v has active holds, only an account without holds can be closed", a.Id)
+	}
+	return nil
+}
+
+// Update the name, status, overdraft limit and/or interest rate of the account with the given account-id.
+//
+// Returns the updated account. Returns error if an Account with such id does
+// not exist, the account is closed, the status transition is not allowed or
+// an interest rate is given for an account other than a savings account.
+func (d *datastore) Update(id string, u ds.AccountUpdate) (ds.Account, error) {
+	log.Printf("[memds]Update() called with id: %v\n", id)
+
+	d.alock.RLock()
+	defer d.alock.RUnlock()
+
+	i, ok := d.index[id]
+	if !ok {
+		log.Printf("[memds]Update: account with id: %v does not exist\n", id)
+		return ds.Account{}, ds.Errorf(ds.ErrAccountNotFound, "account with id: %v does not exist", id)
+	}
+
+	// lock the account, transfers see either the old or the new status
+	d.locks[i].Lock()
+	defer d.locks[i].Unlock()
+
+	a := d.accounts[i]
+	if a.Status == ds.StatusClosed {
+		log.Printf("[memds]Update: account id: %v is closed\n", id)
+		return ds.Account{}, ds.Errorf(ds.ErrAccountInactive, "account id: %v is closed", id)
+	}
+	if u.Name != nil {
+		if strings.TrimSpace(*u.Name) == "" {
+			return ds.Account{}, ds.Errorf(ds.ErrInvalidAccount, "account name cannot be empty")
+		}
+		a.Name = *u.Name
+	}
+	if u.Status != nil {
+		if err := checkStatusTransition(a, *u.Status); err != nil {
+			log.Printf("[memds]Update: %v\n", err)
+			return ds.Account{}, err
+		}
+		a.Status = *u.Status
+	}
+	if u.OverdraftLimit != nil {
+		limit, err := checkOverdraftLimit(*u.OverdraftLimit, a.Currency)
+		if err != nil {
+			log.Printf("[memds]Update: %v\n", err)
+			return ds.Account{}, err
+		}
+		a.OverdraftLimit = limit
+	}
+	if u.InterestRate != nil {
+		if a.Type != ds.TypeSavings {
+			log.Printf("[memds]Update: account id: %v is a %v account, only %v accounts have an interest rate\n", id, a.Type, ds.TypeSavings)
+			return ds.Account{}, ds.Errorf(ds.ErrInvalidAccount, "account id: %v is a %v account, only %v accounts have an interest rate", id, a.Type, ds.TypeSavings)
+		}
+		if u.InterestRate.IsZero() {
+			return ds.Account{}, ds.Errorf(ds.ErrInvalidAccount, "%v account needs an interest rate", ds.TypeSavings)
+		}
+		a.InterestRate = *u.InterestRate
+	}
+
+	d.tlock.Lock()
+	if d.journal != nil {
+		e := journalEntry{Lsn: d.lsn + 1, Op: opUpdateAccount, Date: d.clock.Now(), Account: &ds.Account{Id: a.Id, Name: a.Name, Status: a.Status, OverdraftLimit: a.OverdraftLimit, InterestRate: a.InterestRate}}
+		if err := d.journal.append(&e); err != nil {
+			d.tlock.Unlock()
+			log.Printf("[memds]Update: failed to write journal - %v\n", err)
+			return ds.Account{}, fmt.Errorf("failed to write journal - %v", err)
+		}
+	}
+	d.lsn += 1
+	d.accounts[i] = a
+	d.commitVersions(i)
+	d.tlock.Unlock()
+
+	log.Printf("[memds]returning from Update() with id: %v, status: %v\n", a.Id, a.Status)
+	return a, nil
+}
+
+// end-of-file
@@ -0,0 +1,310 @@
+// Implements maker-checker approval of large transfers for the in-memory datastore.
+//
+// A transfer requiring approval, of an amount above the threshold of the
+// approval policy for the currency of the from account, is validated and
+// checked like any transfer but not executed. Its amount and fee are held on
+// the from account instead, by a hold tied to the pending transfer, and the
+// transfer waits for a principal other than the one who requested it. Approving
+// it executes the transfer, releasing the hold, rejecting it voids the hold and
+// a transfer not decided before the expiry of its hold expires with it.
+//
+// Pending transfers are changed holding the row lock of the from account and
+// tlock, like their holds, and every change is journaled as its own operation.
+package memds
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"paytabs/internal/ds"
+	"paytabs/internal/money"
+)
+
+// Add the pending transfer to the pending transfers.
+//
+// Caller must hold tlock.
+func (d *datastore) addPending(p ds.PendingTransfer) {
+	d.pending[p.Id] = &p
+	if p.Id >= d.nextPending {
+		d.nextPending = p.Id + 1
+	}
+}
+
+// Place the hold of the pending transfer and add the pending transfer.
+//
+// Caller must hold the row lock of the from account and tlock.
+func (d *datastore) applyPending(si int, h ds.Hold, p ds.PendingTransfer) {
+	d.applyHold(si, h)
+	d.addPending(p)
+}
+
+// Approve the pending transfer executed by the transaction, releasing its hold.
+//
+// The funds held are captured by the transaction applied next. Caller must hold
+// the row locks of the accounts of the transfer and tlock.
+func (d *datastore) applyApproval(si int, p *ds.PendingTransfer, t transaction, principal string) {
+	h := d.holds[p.HoldId]
+	d.accounts[si].Available = d.accounts[si].Available.Add(held(h))
+
+	captured := t.amount.Add(t.fee)
+	date := t.date
+	h.Status = ds.HoldCaptured
+	h.Captured = &captured
+	h.Tid = t.tid
+	h.Closed = &date
+	delete(d.activeHolds, h.Id)
+
+	p.Status = ds.PendingApproved
+	p.DecidedBy = principal
+	p.Decided = &date
+	p.Tid = t.tid
+}
+
+// Reject the pending transfer, voiding its hold.
+//
+// Caller must hold the row lock of the from account and tlock.
+func (d *datastore) applyRejection(si int, p *ds.PendingTransfer, principal string, reason string, date time.Time) {
+	d.applyRelease(si, d.holds[p.HoldId], ds.HoldVoided, date)
+	p.Status = ds.PendingRejected
+	p.DecidedBy = principal
+	p.Decided = &date
+	p.Reason = reason
+}
+
+// Expire the pending transfer of the expired hold.
+//
+// Caller must hold the row lock of the account of the hold and tlock.
+func (d *datastore) expirePending(h *ds.Hold, date time.Time) {
+	if p, ok := d.pending[h.PendingId]; ok {
+		p.Status = ds.PendingExpired
+		p.Decided = &date
+	}
+}
+
+// Hold the funds of the transfer and record it as pending approval.
+//
+// Returns the result of the transfer with the pending transfer. Returns error
+// if the transfer has no principal. Caller must hold the row locks of the
+// accounts of the transfer and tlock.
+func (d *datastore) placePending(req ds.TransferRequest, leg *transferLeg, date time.Time) (ds.TransferResult, error) {
+	if req.Principal == "" {
+		log.Printf("[memds]Transfer: transfer of %v %v needs approval, principal missing\n", leg.amount, leg.currency)
+		return ds.TransferResult{}, ds.Errorf(ds.ErrPrincipalRequired, "transfer of %v %v needs approval, the principal requesting it is required", leg.amount, leg.currency)
+	}
+
+	expires := date.Add(d.approvals.Expiry())
+	h := ds.Hold{
+		Id:        d.nextHold,
+		AccountId: req.From,
+		ToId:      req.To,
+		Amount:    leg.debit(),
+		Currency:  leg.currency,
+		Status:    ds.HoldActive,
+		Created:   date,
+		Expires:   expires,
+		PendingId: d.nextPending,
+	}
+	p := ds.PendingTransfer{
+		Id:          d.nextPending,
+		FromId:      req.From,
+		ToId:        req.To,
+		Amount:      leg.amount,
+		Currency:    leg.currency,
+		Convert:     req.Convert,
+		HoldId:      h.Id,
+		Status:      ds.PendingAwaiting,
+		RequestedBy: req.Principal,
+		Requested:   date,
+		Expires:     expires,
+	}
+	if d.journal != nil {
+		e := journalEntry{Lsn: d.lsn + 1, Op: opCreatePending, PendingId: p.Id, HoldId: h.Id, Date: date, From: p.FromId, To: p.ToId, Amount: p.Amount, Currency: p.Currency, Expires: &expires, Principal: p.RequestedBy, Convert: p.Convert}
+		if !leg.fee.IsZero() {
+			e.Fee = &leg.fee
+		}
+		e.IdempotencyKey = req.IdempotencyKey
+		e.RequestHash = req.RequestHash
+		if err := d.journal.append(&e); err != nil {
+			log.Printf("[memds]Transfer: failed to write journal - %v\n", err)
+			return ds.TransferResult{}, fmt.Errorf("failed to write journal - %v", err)
+		}
+	}
+	d.lsn += 1
+	d.applyPending(leg.si, h, p)
+
+	log.Printf("[memds]Transfer: pending id: %v awaits approval, hold id: %v, available balance: %v\n", p.Id, h.Id, d.accounts[leg.si].Available)
+	return pendingResult(d.accounts[leg.si].Balance, p, leg.fee), nil
+}
+
+// Returns the result of a transfer held for approval.
+func pendingResult(balance money.Money, p ds.PendingTransfer, fee money.Money) ds.TransferResult {
+	return ds.TransferResult{Balance: balance, Currency: p.Currency, Amount: p.Amount, Fee: fee, Pending: &p}
+}
+
+// Check the pending transfer can still be approved or rejected.
+//
+// Returns the hold of the pending transfer. A pending transfer past its expiry
+// is expired on the spot, with its hold. Caller must hold the row lock of the
+// from account.
+func (d *datastore) checkPendingActive(si int, p *ds.PendingTransfer) (*ds.Hold, error) {
+	h, err := d.findHold(p.HoldId)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.checkHoldActive(si, h, d.clock.Now()); err != nil {
+		d.tlock.Lock()
+		defer d.tlock.Unlock()
+		return nil, ds.Errorf(ds.ErrPendingInactive, "pending transfer id: %v is %v", p.Id, p.Status)
+	}
+	return h, nil
+}
+
+// Find the pending transfer with the given id.
+//
+// The pending transfer record is never removed, its fields are changed holding
+// the row lock of its from account and tlock.
+func (d *datastore) findPending(id uint64) (*ds.PendingTransfer, error) {
+	d.tlock.Lock()
+	defer d.tlock.Unlock()
+
+	p, ok := d.pending[id]
+	if !ok {
+		return nil, ds.Errorf(ds.ErrPendingNotFound, "pending transfer with id: %v does not exist", id)
+	}
+	return p, nil
+}
+
+// List the transfers held for approval, in the order they were requested.
+//
+// An empty status lists all of them, otherwise only those with the status.
+// Returns error if the status is invalid.
+func (d *datastore) ListPending(status string) ([]ds.PendingTransfer, error) {
+	log.Printf("[memds]ListPending() called with status: %v\n", status)
+
+	switch status {
+	case "", ds.PendingAwaiting, ds.PendingApproved, ds.PendingRejected, ds.PendingExpired:
+	default:
+		log.Printf("[memds]ListPending: invalid status: %v\n", status)
+		return nil, ds.Errorf(ds.ErrInvalidQuery, "invalid status: %v, expecting one of %v, %v, %v or %v", status, ds.PendingAwaiting, ds.PendingApproved, ds.PendingRejected, ds.PendingExpired)
+	}
+
+	d.tlock.Lock()
+	list := make([]ds.PendingTransfer, 0, len(d.pending))
+	for _, p := range d.pending {
+		if status == "" || p.Status == status {
+			list = append(list, *p)
+		}
+	}
+	d.tlock.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list, nil
+}
+
+// Get the details of the transfer held for approval with the given id.
+//
+// Returns error if a pending transfer with such id does not exist.
+func (d *datastore) GetPending(id uint64) (ds.PendingTransfer, error) {
+	log.Printf("[memds]GetPending() called with id: %v\n", id)
+
+	p, err := d.findPending(id)
+	if err != nil {
+		log.Printf("[memds]GetPending: %v\n", err)
+		return ds.PendingTransfer{}, err
+	}
+
+	d.tlock.Lock()
+	defer d.tlock.Unlock()
+	return *p, nil
+}
+
+// Approve the pending transfer with the given id, executing the transfer.
+//
+// Returns the approved pending transfer, with the id of the transaction.
+// Returns error if the principal is missing or requested the transfer, a
+// pending transfer with such id does not exist, it is no longer pending, or
+// the transfer fails for the reasons a transfer fails.
+func (d *datastore) ApprovePending(id uint64, principal string) (ds.PendingTransfer, error) {
+	log.Printf("[memds]ApprovePending() called with id: %v, principal: %v\n", id, principal)
+
+	if principal == "" {
+		log.Println("[memds]ApprovePending: principal missing")
+		return ds.PendingTransfer{}, ds.Errorf(ds.ErrPrincipalRequired, "the principal approving the transfer is required")
+	}
+	p, err := d.findPending(id)
+	if err != nil {
+		log.Printf("[memds]ApprovePending: %v\n", err)
+		return ds.PendingTransfer{}, err
+	}
+
+	// accounts and requester of a pending transfer never change
+	if p.RequestedBy == principal {
+		log.Printf("[memds]ApprovePending: pending id: %v requested by the approver: %v\n", id, principal)
+		return ds.PendingTransfer{}, ds.Errorf(ds.ErrSelfApproval, "pending transfer id: %v was requested by %v, it needs the approval of another principal", id, principal)
+	}
+
+	res, err := d.transfer(ds.TransferRequest{From: p.FromId, To: p.ToId, Amount: p.Amount, Convert: p.Convert, Principal: principal}, p)
+	if err != nil {
+		log.Printf("[memds]ApprovePending: %v\n", err)
+		return ds.PendingTransfer{}, err
+	}
+
+	log.Printf("[memds]returning from ApprovePending() with pending id: %v, tid: %v\n", id, res.Tid)
+	return *res.Pending, nil
+}
+
+// Reject the pending transfer with the given id, releasing the funds held.
+//
+// The principal who requested the transfer can reject it, withdrawing it.
+// Returns the rejected pending transfer. Returns error if the principal is
+// missing, a pending transfer with such id does not exist or it is no longer
+// pending.
+func (d *datastore) RejectPending(id uint64, principal string, reason string) (ds.PendingTransfer, error) {
+	log.Printf("[memds]RejectPending() called with id: %v, principal: %v\n", id, principal)
+
+	if principal == "" {
+		log.Println("[memds]RejectPending: principal missing")
+		return ds.PendingTransfer{}, ds.Errorf(ds.ErrPrincipalRequired, "the principal rejecting the transfer is required")
+	}
+
+	d.alock.RLock()
+	defer d.alock.RUnlock()
+
+	p, err := d.findPending(id)
+	if err != nil {
+		log.Printf("[memds]RejectPending: %v\n", err)
+		return ds.PendingTransfer{}, err
+	}
+
+	// a transfer can be rejected even if the accounts are no longer active
+	si := d.index[p.FromId]
+	d.locks[si].Lock()
+	defer d.locks[si].Unlock()
+
+	h, err := d.checkPendingActive(si, p)
+	if err != nil {
+		log.Printf("[memds]RejectPending: %v\n", err)
+		return ds.PendingTransfer{}, err
+	}
+
+	d.tlock.Lock()
+	defer d.tlock.Unlock()
+
+	now := d.clock.Now()
+	if d.journal != nil {
+		e := journalEntry{Lsn: d.lsn + 1, Op: opRejectPending, PendingId: p.Id, HoldId: h.Id, Date: now, Principal: principal, Reason: reason}
+		if err := d.journal.append(&e); err != nil {
+			log.Printf("[memds]RejectPending: failed to write journal - %v\n", err)
+			return ds.PendingTransfer{}, fmt.Errorf("failed to write journal - %v", err)
+		}
+	}
+	d.lsn += 1
+	d.applyRejection(si, p, principal, reason, now)
+	d.commitVersions(si)
+
+	log.Printf("[memds]returning from RejectPending() with pending id: %v, available balance: %v\n", id, d.accounts[si].Available)
+	return *p, nil
+}
+
+// end-of-file
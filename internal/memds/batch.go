@@ -0,0 +1,155 @@
+// Implements atomic batch transfers for the in-memory datastore.
+//
+// A batch is a list of transfers, the legs, that succeed or fail together. The
+// legs are validated and converted like single transfers, then the rows of all
+// the accounts involved are locked in ascending order of indexes, like a single
+// transfer locks its two rows, and every leg is checked against the balances
+// left by the legs before it. A leg can therefore spend what an earlier leg of
+// the batch credited. The legs are journaled as one record and applied at once,
+// each leg recorded as a transaction of its own tagged with the batch id. The
+// fee of each leg is charged like the fee of a single transfer. A leg that would
+// wait for approval as a single transfer fails the batch.
+package memds
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"paytabs/internal/ds"
+	"paytabs/internal/money"
+)
+
+// Prefix the error of a leg with the position of the leg, keeping its kind.
+func legError(i int, err error) error {
+	var e *ds.Error
+	if errors.As(err, &e) {
+		return ds.Errorf(e.Kind, "leg %v: %v", i, e.Message)
+	}
+	return fmt.Errorf("leg %v: %v", i, err)
+}
+
+// Transfer all the legs of the batch, or none of them.
+//
+// Returns the batch id and the transaction of each leg. Returns error if the
+// batch is empty or has more than ds.MaxBatchLegs legs, or any leg fails for
+// the reasons a single transfer fails, the error naming the leg at fault.
+// Idempotency keys of the legs are ignored.
+func (d *datastore) TransferBatch(reqs []ds.TransferRequest) (ds.BatchResult, error) {
+	log.Printf("[memds]TransferBatch() called with %v legs\n", len(reqs))
+
+	if len(reqs) == 0 || len(reqs) > ds.MaxBatchLegs {
+		log.Printf("[memds]TransferBatch: invalid number of legs: %v\n", len(reqs))
+		return ds.BatchResult{}, ds.Errorf(ds.ErrInvalidBatch, "invalid number of legs: %v, expecting between 1 and %v", len(reqs), ds.MaxBatchLegs)
+	}
+
+	// accounts cannot be added while the batch holds the index positions
+	d.alock.RLock()
+	defer d.alock.RUnlock()
+
+	legs := make([]transferLeg, len(reqs))
+	rows := make([]int, 0, 2*len(reqs))
+	for i, req := range reqs {
+		leg, err := d.checkTransfer(req)
+		if err != nil {
+			return ds.BatchResult{}, legError(i, err)
+		}
+		if req.RequireApproval && d.approvals.Requires(leg.amount, leg.currency) {
+			log.Printf("[memds]TransferBatch: leg %v: transfer of %v %v needs approval\n", i, leg.amount, leg.currency)
+			return ds.BatchResult{}, ds.Errorf(ds.ErrInvalidBatch, "leg %v: transfer of %v %v needs approval, it cannot be part of a batch", i, leg.amount, leg.currency)
+		}
+		legs[i] = leg
+		rows = append(rows, leg.rows()...)
+	}
+
+	// lock all the accounts of the batch
+	locked := d.lockRows(rows...)
+	defer d.unlockRows(locked)
+
+	// check the legs in order against the balances left by the legs before them
+	available := make(map[int]money.Money, len(locked))
+	balances := make(map[int]money.Money, len(locked))
+	for _, row := range locked {
+		available[row] = d.accounts[row].Available
+		balances[row] = d.accounts[row].Balance
+	}
+	for i, leg := range legs {
+		for _, row := range leg.rows() {
+			if d.accounts[row].Status != ds.StatusActive {
+				log.Printf("[memds]TransferBatch: leg %v: account id: %v is %v\n", i, d.accounts[row].Id, d.accounts[row].Status)
+				return ds.BatchResult{}, ds.Errorf(ds.ErrAccountInactive, "leg %v: account id: %v is %v", i, d.accounts[row].Id, d.accounts[row].Status)
+			}
+		}
+		limit := d.accounts[leg.si].OverdraftLimit
+		if capped(available[leg.si], limit).Cmp(leg.debit()) < 0 {
+			log.Printf("[memds]TransferBatch: leg %v: account id: %s does not have sufficient funds, available balance: %v, overdraft limit: %v\n", i, d.accounts[leg.si].Id, available[leg.si], limit)
+			return ds.BatchResult{}, ds.Errorf(ds.ErrInsufficientFunds, "leg %v: account id: %v does not have sufficient funds, available balance: %v, overdraft limit: %v", i, d.accounts[leg.si].Id, available[leg.si], limit)
+		}
+		var err error
+		if balances[leg.di], err = checkCredit(&d.accounts[leg.di], balances[leg.di], leg.toAmount); err != nil {
+			return ds.BatchResult{}, legError(i, err)
+		}
+		balances[leg.si] = balances[leg.si].Sub(leg.debit())
+		available[leg.si] = available[leg.si].Sub(leg.debit())
+		available[leg.di] = available[leg.di].Add(leg.toAmount)
+		if leg.feeTo != "" {
+			if balances[leg.fi], err = checkCredit(&d.accounts[leg.fi], balances[leg.fi], leg.fee); err != nil {
+				return ds.BatchResult{}, legError(i, err)
+			}
+			available[leg.fi] = available[leg.fi].Add(leg.fee)
+		}
+	}
+
+	d.tlock.Lock()
+	defer d.tlock.Unlock()
+
+	batch := d.nextBatch
+	date := d.transactionDate()
+
+	// the rules see the debits of the earlier legs
+	pending := make(map[int][]money.Money)
+	for i, leg := range legs {
+		if err := d.checkRules(leg.si, leg.amount, date, pending[leg.si]); err != nil {
+			err.Message = fmt.Sprintf("leg %v: %v", i, err.Message)
+			return ds.BatchResult{}, err
+		}
+		pending[leg.si] = append(pending[leg.si], leg.amount)
+	}
+	ts := make([]transaction, len(legs))
+	for i := range legs {
+		ts[i] = legs[i].transaction(d, d.nextTid+uint64(i), date)
+		ts[i].batch = batch
+	}
+
+	// persist all the legs in one record before applying them
+	if d.journal != nil {
+		e := journalEntry{Lsn: d.lsn + 1, Op: opBatch, Batch: batch, Date: date, Legs: make([]journalLeg, len(ts))}
+		for i, t := range ts {
+			e.Legs[i] = journalLeg{Tid: t.tid, From: t.from, To: t.to, Amount: t.amount, Currency: t.currency, ToAmount: t.toAmount, ToCurrency: t.toCurrency, Rate: t.rate}
+			if t.feeTo != "" {
+				fee := t.fee
+				e.Legs[i].Fee = &fee
+				e.Legs[i].FeeTo = t.feeTo
+			}
+		}
+		if err := d.journal.append(&e); err != nil {
+			log.Printf("[memds]TransferBatch: failed to write journal - %v\n", err)
+			return ds.BatchResult{}, fmt.Errorf("failed to write journal - %v", err)
+		}
+	}
+	d.lsn += 1
+	d.nextTid += uint64(len(ts))
+
+	// readers see all the accounts of the batch change at once
+	res := ds.BatchResult{Id: batch, Transactions: make([]ds.Transaction, len(ts))}
+	for i := range ts {
+		d.applyTransfer(legs[i].si, legs[i].di, ts[i])
+		res.Transactions[i] = ts[i].export()
+	}
+	d.commitVersions(locked...)
+
+	log.Printf("[memds]returning from TransferBatch() with batch id: %v, %v transactions\n", batch, len(ts))
+	return res, nil
+}
+
+// end-of-file
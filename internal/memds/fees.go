@@ -0,0 +1,73 @@
+// Charges the fees of transfers for the in-memory datastore.
+//
+// The fee of a transfer is computed from the fee schedule when the transfer is
+// validated, in the currency of the from account. The revenue account credited
+// with the fee is locked with the from and to accounts, so the fee is debited,
+// credited and journaled with the transfer it belongs to, and the from account
+// needs to have the amount and the fee available. A transfer from the revenue
+// account itself is free. The fee of a hold is reserved with its amount when
+// the hold is placed and charged when it is captured, the fee of the amount
+// captured and at most the fee reserved. Refunds are not charged fees.
+package memds
+
+import (
+	"fmt"
+
+	"paytabs/internal/ds"
+)
+
+// Compute the fee of the validated transfer and find its revenue account.
+//
+// Caller must hold alock shared.
+func (d *datastore) chargeFee(leg *transferLeg) error {
+	fee, account, err := d.fees.Fee(leg.amount, leg.currency)
+	if err != nil {
+		return ds.Errorf(ds.ErrInvalidAmount, "%v", err)
+	}
+	if fee.IsZero() || account == d.accounts[leg.si].Id {
+		return nil
+	}
+	fi, ok := d.index[account]
+	if !ok {
+		return fmt.Errorf("revenue account id: %v of %v fees does not exist", account, leg.currency)
+	}
+	if _, err := leg.amount.CheckedAdd(fee); err != nil {
+		return ds.Errorf(ds.ErrInvalidAmount, "amount %v %v with the fee is out of range - %v", leg.amount, leg.currency, err)
+	}
+	leg.fee, leg.fi, leg.feeTo = fee, fi, account
+	return nil
+}
+
+// Compute the fee of capturing the amount of the hold, at most the fee reserved by the hold.
+//
+// Caller must hold alock shared.
+func (d *datastore) chargeCaptureFee(leg *transferLeg, h *ds.Hold) error {
+	if h.Fee == nil {
+		return nil
+	}
+	if err := d.chargeFee(leg); err != nil {
+		return err
+	}
+	if leg.fee.Cmp(*h.Fee) > 0 {
+		leg.fee = *h.Fee
+	}
+	return nil
+}
+
+// Check the revenue accounts of the fee schedule exist and are in the currency of their fees.
+//
+// Called when the datastore is opened, before it is in use.
+func (d *datastore) checkFeeAccounts() error {
+	for currency, id := range d.fees.Accounts() {
+		i, ok := d.index[id]
+		if !ok {
+			return fmt.Errorf("revenue account id: %v of %v fees does not exist", id, currency)
+		}
+		if d.accounts[i].Currency != currency {
+			return fmt.Errorf("revenue account id: %v of %v fees is in %v", id, currency, d.accounts[i].Currency)
+		}
+	}
+	return nil
+}
+
+// end-of-file
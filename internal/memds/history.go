@@ -0,0 +1,256 @@
+// Implements transaction lookup and history queries for the in-memory datastore.
+//
+// Transactions are appended to a single list in the order of their ids. Secondary
+// indexes, maintained as transactions are appended, map a transaction id to its
+// position in the list and an account to the positions of its debits and credits,
+// the fees it was credited with included.
+// Transaction dates never go backward, so with these indexes a history page is
+// found using binary searches and a merge of the debits and credits, taking
+// time proportional to the page size rather than the number of transactions.
+package memds
+
+import (
+	"encoding/base64"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"paytabs/internal/ds"
+)
+
+// Convert the transaction record to its exported form.
+func (t *transaction) export() ds.Transaction {
+	tr := ds.Transaction{
+		Id:         t.tid,
+		Date:       t.date,
+		FromId:     t.from,
+		ToId:       t.to,
+		Amount:     t.amount,
+		Currency:   t.currency,
+		ToAmount:   t.toAmount,
+		ToCurrency: t.toCurrency,
+	}
+	if !t.rate.IsZero() {
+		rate := t.rate
+		tr.Rate = &rate
+	}
+	tr.RefundOf = t.refundOf
+	tr.BatchId = t.batch
+	if t.feeTo != "" {
+		fee := t.fee
+		tr.Fee = &fee
+		tr.FeeAccountId = t.feeTo
+	}
+	tr.InterestFor = t.interestFor
+	if !t.refunded.IsZero() {
+		refunded := t.refunded
+		tr.Refunded = &refunded
+	}
+	return tr
+}
+
+// positions of the transactions of an account, in the order of their ids
+type accountTransactions struct {
+	debits  []int // transactions with the account as the from account
+	credits []int // transactions with the account as the to account or the revenue account of the fee
+}
+
+// Append a transaction to the list, update the indexes and post it to the ledger.
+//
+// Caller must hold tlock.
+func (d *datastore) appendTransaction(t transaction) {
+	i := len(d.transactions)
+	d.transactions = append(d.transactions, t)
+	d.tidIndex[t.tid] = i
+	d.accountTransactions(t.from).debits = append(d.accountTransactions(t.from).debits, i)
+	d.accountTransactions(t.to).credits = append(d.accountTransactions(t.to).credits, i)
+	if t.feeTo != "" && t.feeTo != t.to {
+		d.accountTransactions(t.feeTo).credits = append(d.accountTransactions(t.feeTo).credits, i)
+	}
+	d.ledger.Post(t.entry())
+	if t.batch >= d.nextBatch {
+		d.nextBatch = t.batch + 1
+	}
+}
+
+// Returns the transaction index entry for the account, creating it when needed.
+//
+// Caller must hold tlock.
+func (d *datastore) accountTransactions(id string) *accountTransactions {
+	at, ok := d.byAccount[id]
+	if !ok {
+		at = new(accountTransactions)
+		d.byAccount[id] = at
+	}
+	return at
+}
+
+// Returns the date for a new transaction.
+//
+// Dates never go backward, even if the clock does, so the history indexes
+// stay sorted by date. Caller must hold tlock.
+func (d *datastore) transactionDate() time.Time {
+	now := d.clock.Now()
+	if n := len(d.transactions); n > 0 && now.Before(d.transactions[n-1].date) {
+		return d.transactions[n-1].date
+	}
+	return now
+}
+
+// Find the position of the transaction with the given id.
+//
+// Caller must hold tlock.
+func (d *datastore) findTransaction(tid uint64) (int, bool) {
+	i, ok := d.tidIndex[tid]
+	return i, ok
+}
+
+// Get the details of the transaction with the given id.
+//
+// Returns error if a transaction with such id does not exist.
+func (d *datastore) GetTransaction(tid uint64) (ds.Transaction, error) {
+	log.Printf("[memds]GetTransaction() called with tid: %v\n", tid)
+
+	d.tlock.Lock()
+	defer d.tlock.Unlock()
+
+	i, ok := d.findTransaction(tid)
+	if !ok {
+		log.Printf("[memds]GetTransaction: transaction with id: %v does not exist\n", tid)
+		return ds.Transaction{}, ds.Errorf(ds.ErrTransactionNotFound, "transaction with id: %v does not exist", tid)
+	}
+	tr := d.transactions[i].export()
+	if e, ok := d.ledger.Entry(tid); ok {
+		tr.Postings = e.Postings
+	}
+	return tr, nil
+}
+
+// Encode the position in the history as an opaque cursor.
+func encodeCursor(tid uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(tid, 10)))
+}
+
+// Decode the cursor into the id of the last transaction returned.
+func decodeCursor(cursor string) (uint64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, ds.Errorf(ds.ErrInvalidQuery, "invalid cursor: %q", cursor)
+	}
+	tid, err := strconv.ParseUint(string(b), 10, 64)
+	if err != nil {
+		return 0, ds.Errorf(ds.ErrInvalidQuery, "invalid cursor: %q", cursor)
+	}
+	return tid, nil
+}
+
+// Validate the history query, filling in the defaults.
+//
+// Returns the query and the id of the transaction to continue before,
+// zero when starting from the newest transaction.
+func checkHistoryQuery(q ds.HistoryQuery) (ds.HistoryQuery, uint64, error) {
+	switch q.Direction {
+	case ds.DirectionAll, ds.DirectionIn, ds.DirectionOut:
+	default:
+		return q, 0, ds.Errorf(ds.ErrInvalidQuery, "invalid direction: %q, expecting %q or %q", q.Direction, ds.DirectionIn, ds.DirectionOut)
+	}
+	if q.Limit < 0 || q.Limit > ds.MaxHistoryLimit {
+		return q, 0, ds.Errorf(ds.ErrInvalidQuery, "invalid limit: %v, expecting a value between 1 and %v", q.Limit, ds.MaxHistoryLimit)
+	}
+	if q.Limit == 0 {
+		q.Limit = ds.DefaultHistoryLimit
+	}
+	if !q.Since.IsZero() && !q.Until.IsZero() && !q.Since.Before(q.Until) {
+		return q, 0, ds.Errorf(ds.ErrInvalidQuery, "invalid time range, since needs to be before until")
+	}
+
+	var before uint64
+	if q.Cursor != "" {
+		tid, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return q, 0, err
+		}
+		before = tid
+	}
+	return q, before, nil
+}
+
+// Returns the number of leading positions in the list with transactions
+// before the cursor transaction and before the until time.
+//
+// Caller must hold tlock.
+func (d *datastore) historyEnd(positions []int, before uint64, until time.Time) int {
+	return sort.Search(len(positions), func(k int) bool {
+		t := &d.transactions[positions[k]]
+		return (before > 0 && t.tid >= before) || (!until.IsZero() && !t.date.Before(until))
+	})
+}
+
+// Get a page of the transaction history for the given account-id.
+//
+// Transactions are returned newest first. Returns error if an Account with
+// such id does not exist or the query is invalid.
+func (d *datastore) History(id string, q ds.HistoryQuery) (ds.HistoryPage, error) {
+	log.Printf("[memds]History() called with id: %v, query: %+v\n", id, q)
+
+	d.alock.RLock()
+	_, ok := d.index[id]
+	d.alock.RUnlock()
+	if !ok {
+		log.Printf("[memds]History: account with id: %v does not exist\n", id)
+		return ds.HistoryPage{}, ds.Errorf(ds.ErrAccountNotFound, "account with id: %v does not exist", id)
+	}
+	q, before, err := checkHistoryQuery(q)
+	if err != nil {
+		log.Printf("[memds]History: %v\n", err)
+		return ds.HistoryPage{}, err
+	}
+
+	d.tlock.Lock()
+	defer d.tlock.Unlock()
+
+	// select the debits and/or credits of the account
+	var debits, credits []int
+	if at, ok := d.byAccount[id]; ok {
+		if q.Direction != ds.DirectionIn {
+			debits = at.debits
+		}
+		if q.Direction != ds.DirectionOut {
+			credits = at.credits
+		}
+	}
+
+	// skip the transactions after the cursor and the until time
+	di := d.historyEnd(debits, before, q.Until) - 1
+	ci := d.historyEnd(credits, before, q.Until) - 1
+
+	// merge debits and credits newest first until the page is full
+	page := ds.HistoryPage{Transactions: []ds.Transaction{}}
+	for di >= 0 || ci >= 0 {
+		var pos int
+		if ci < 0 || (di >= 0 && debits[di] > credits[ci]) {
+			pos = debits[di]
+			di--
+		} else {
+			pos = credits[ci]
+			ci--
+		}
+
+		t := &d.transactions[pos]
+		if !q.Since.IsZero() && t.date.Before(q.Since) {
+			break
+		}
+		if len(page.Transactions) == q.Limit {
+			// there is at least one more transaction
+			page.NextCursor = encodeCursor(page.Transactions[q.Limit-1].Id)
+			break
+		}
+		page.Transactions = append(page.Transactions, t.export())
+	}
+
+	log.Printf("[memds]returning from History() with %v transactions\n", len(page.Transactions))
+	return page, nil
+}
+
+// end-of-file
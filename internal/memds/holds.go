@@ -0,0 +1,517 @@
+// Implements holds on the funds of accounts for the in-memory datastore.
+//
+// A hold reserves an amount in an account for a later transfer to another
+// account, the authorization of an auth/capture flow. It reduces the available
+// balance of the account without moving any money, so the reserved funds cannot
+// be transferred or held again. Capturing the hold transfers all or part of the
+// reserved amount and releases the rest, voiding it releases all of it. A hold
+// not captured or voided in time expires, releasing the funds; expired holds are
+// swept periodically and a hold past its expiry can no longer be captured. The
+// fee of the transfer is reserved with the amount and charged on capture, see
+// fees.go.
+//
+// Holds are changed holding the row lock of the held account and tlock, like
+// the accounts, and every change is journaled as its own operation. The rules
+// are checked for the amount of a hold when it is placed, and for the amount
+// captured when it is captured, as the capture debits the account. A hold or a
+// capture above the approval threshold is rejected, it would transfer the
+// funds without the approval a transfer of the amount waits for, see
+// approvals.go.
+package memds
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"paytabs/internal/ds"
+	"paytabs/internal/money"
+)
+
+// default time until a hold expires
+const DefaultHoldExpiry = 7 * 24 * time.Hour
+
+// maximum time until a hold expires
+const MaxHoldExpiry = 30 * 24 * time.Hour
+
+// default interval between the sweeps for expired holds
+const DefaultHoldSweepInterval = time.Second
+
+// Add the hold to the holds and the index of active holds.
+//
+// Caller must hold tlock.
+func (d *datastore) addHold(h ds.Hold) {
+	d.holds[h.Id] = &h
+	if h.Status == ds.HoldActive {
+		d.activeHolds[h.Id] = &h
+	}
+	if h.Id >= d.nextHold {
+		d.nextHold = h.Id + 1
+	}
+}
+
+// Returns the amount reserved by the hold, including the fee reserved.
+func held(h *ds.Hold) money.Money {
+	if h.Fee == nil {
+		return h.Amount
+	}
+	return h.Amount.Add(*h.Fee)
+}
+
+// Place the hold, reducing the available balance of its account.
+//
+// Caller must hold the row lock of the account and tlock.
+func (d *datastore) applyHold(si int, h ds.Hold) {
+	d.accounts[si].Available = d.accounts[si].Available.Sub(held(&h))
+	d.addHold(h)
+}
+
+// Capture the hold, transferring the captured amount and fee and releasing the rest.
+//
+// Caller must hold the row locks of both accounts and of the revenue account
+// of the fee, and tlock.
+func (d *datastore) applyCapture(si int, di int, h *ds.Hold, t transaction) {
+	d.appendTransaction(t)
+	d.moveBalances(si, di, &t)
+	d.accounts[si].Available = d.accounts[si].Available.Add(held(h)).Sub(t.amount).Sub(t.fee)
+	d.accounts[di].Available = d.accounts[di].Available.Add(t.toAmount)
+	if t.feeTo != "" {
+		fi := d.index[t.feeTo]
+		d.accounts[fi].Available = d.accounts[fi].Available.Add(t.fee)
+	}
+
+	captured := t.amount
+	date := t.date
+	h.Status = ds.HoldCaptured
+	h.Captured = &captured
+	h.Tid = t.tid
+	h.Closed = &date
+	delete(d.activeHolds, h.Id)
+}
+
+// Void or expire the hold, releasing all of the reserved amount.
+//
+// A pending transfer expires with its hold. Caller must hold the row lock of
+// the account and tlock.
+func (d *datastore) applyRelease(si int, h *ds.Hold, status string, date time.Time) {
+	d.accounts[si].Available = d.accounts[si].Available.Add(held(h))
+	h.Status = status
+	h.Closed = &date
+	delete(d.activeHolds, h.Id)
+	if h.PendingId != 0 && status == ds.HoldExpired {
+		d.expirePending(h, date)
+	}
+}
+
+// Recompute the available balances from the ledger balances and the active holds.
+//
+// Called once the datastore is loaded, before it is in use.
+func (d *datastore) recomputeAvailable() {
+	for i := range d.accounts {
+		d.accounts[i].Available = d.accounts[i].Balance
+	}
+	for _, h := range d.activeHolds {
+		if i, ok := d.index[h.AccountId]; ok {
+			d.accounts[i].Available = d.accounts[i].Available.Sub(held(h))
+		}
+	}
+}
+
+// Find the hold with the given id.
+//
+// The hold record is never removed, its fields are changed holding the row
+// lock of its account and tlock.
+func (d *datastore) findHold(id uint64) (*ds.Hold, error) {
+	d.tlock.Lock()
+	defer d.tlock.Unlock()
+
+	h, ok := d.holds[id]
+	if !ok {
+		return nil, ds.Errorf(ds.ErrHoldNotFound, "hold with id: %v does not exist", id)
+	}
+	return h, nil
+}
+
+// Place a hold on the funds of an account.
+//
+// Returns the hold placed. Returns error if any of the account ids is invalid,
+// the accounts are in different currencies, any of the accounts is not active,
+// the amount or expiry is invalid or above the approval threshold, the available
+// balance of the account is insufficient for the amount and the fee or the hold
+// violates a rule.
+func (d *datastore) CreateHold(req ds.HoldRequest) (ds.Hold, error) {
+	log.Printf("[memds]CreateHold() called with account: %v, to: %v, amount: %v\n", req.AccountId, req.ToId, req.Amount)
+
+	expiry := req.Expiry
+	if expiry == 0 {
+		expiry = d.holdExpiry
+	}
+	if expiry < 0 || expiry > MaxHoldExpiry {
+		log.Printf("[memds]CreateHold: invalid expiry: %v\n", expiry)
+		return ds.Hold{}, ds.Errorf(ds.ErrInvalidHold, "invalid expiry: %v, expecting at most %v", expiry, MaxHoldExpiry)
+	}
+
+	d.alock.RLock()
+	defer d.alock.RUnlock()
+
+	si, ok := d.index[req.AccountId]
+	if !ok {
+		log.Printf("[memds]CreateHold: account with id: %v does not exist\n", req.AccountId)
+		return ds.Hold{}, ds.Errorf(ds.ErrAccountNotFound, "account with id: %v does not exist", req.AccountId)
+	}
+	di, ok := d.index[req.ToId]
+	if !ok {
+		log.Printf("[memds]CreateHold: to account with id: %v does not exist\n", req.ToId)
+		return ds.Hold{}, ds.Errorf(ds.ErrAccountNotFound, "to account with id: %v does not exist", req.ToId)
+	}
+	if si == di {
+		log.Printf("[memds]CreateHold: account id: %s and to account id: %s are same\n", req.AccountId, req.ToId)
+		return ds.Hold{}, ds.Errorf(ds.ErrSameAccount, "account id: %s and to account id: %s are same", req.AccountId, req.ToId)
+	}
+
+	// holds are captured without conversion
+	currency := d.accounts[si].Currency
+	if d.accounts[di].Currency != currency {
+		log.Printf("[memds]CreateHold: account currency: %v and to account currency: %v differ\n", currency, d.accounts[di].Currency)
+		return ds.Hold{}, ds.Errorf(ds.ErrCurrencyMismatch, "account currency: %v and to account currency: %v differ, holds cannot be converted", currency, d.accounts[di].Currency)
+	}
+	c, err := money.LookupCurrency(currency)
+	if err != nil {
+		return ds.Hold{}, err
+	}
+	if req.Amount.Sign() <= 0 {
+		log.Printf("[memds]CreateHold: hold amount: %v needs to be positive\n", req.Amount)
+		return ds.Hold{}, ds.Errorf(ds.ErrInvalidAmount, "hold amount needs to be a positive value")
+	}
+	amount, err := req.Amount.Rescale(c.Exponent)
+	if err != nil {
+		log.Printf("[memds]CreateHold: invalid amount for currency %v - %v\n", currency, err)
+		return ds.Hold{}, ds.Errorf(ds.ErrInvalidAmount, "invalid amount for currency %v - %v", currency, err)
+	}
+	if d.approvals.Requires(amount, currency) {
+		log.Printf("[memds]CreateHold: hold of %v %v needs approval\n", amount, currency)
+		return ds.Hold{}, ds.Errorf(ds.ErrInvalidHold, "hold of %v %v is above the approval threshold, transfers of the amount need approval", amount, currency)
+	}
+
+	// the fee of the capture is reserved with the amount
+	leg := transferLeg{si: si, di: di, amount: amount, currency: currency, toAmount: amount, toCurrency: currency}
+	if err := d.chargeFee(&leg); err != nil {
+		log.Printf("[memds]CreateHold: %v\n", err)
+		return ds.Hold{}, err
+	}
+
+	defer d.unlockRows(d.lockRows(si, di))
+
+	for _, i := range []int{si, di} {
+		if d.accounts[i].Status != ds.StatusActive {
+			log.Printf("[memds]CreateHold: account id: %v is %v\n", d.accounts[i].Id, d.accounts[i].Status)
+			return ds.Hold{}, ds.Errorf(ds.ErrAccountInactive, "account id: %v is %v", d.accounts[i].Id, d.accounts[i].Status)
+		}
+	}
+	if spendable(&d.accounts[si]).Cmp(leg.debit()) < 0 {
+		log.Printf("[memds]CreateHold: account id: %s does not have sufficient funds, available balance: %v, overdraft limit: %v\n", req.AccountId, d.accounts[si].Available, d.accounts[si].OverdraftLimit)
+		return ds.Hold{}, ds.Errorf(ds.ErrInsufficientFunds, "account id: %v does not have sufficient funds, available balance: %v, overdraft limit: %v", req.AccountId, d.accounts[si].Available, d.accounts[si].OverdraftLimit)
+	}
+
+	d.tlock.Lock()
+	defer d.tlock.Unlock()
+
+	now := d.clock.Now()
+	if err := d.checkRules(si, amount, now, nil); err != nil {
+		return ds.Hold{}, err
+	}
+	h := ds.Hold{
+		Id:        d.nextHold,
+		AccountId: req.AccountId,
+		ToId:      req.ToId,
+		Amount:    amount,
+		Currency:  currency,
+		Status:    ds.HoldActive,
+		Created:   now,
+		Expires:   now.Add(expiry),
+	}
+	if leg.feeTo != "" {
+		h.Fee = &leg.fee
+	}
+	if d.journal != nil {
+		e := journalEntry{Lsn: d.lsn + 1, Op: opCreateHold, HoldId: h.Id, Date: now, From: h.AccountId, To: h.ToId, Amount: amount, Currency: currency, Expires: &h.Expires, Fee: h.Fee}
+		if err := d.journal.append(&e); err != nil {
+			log.Printf("[memds]CreateHold: failed to write journal - %v\n", err)
+			return ds.Hold{}, fmt.Errorf("failed to write journal - %v", err)
+		}
+	}
+	d.lsn += 1
+	d.applyHold(si, h)
+	d.commitVersions(si)
+
+	log.Printf("[memds]returning from CreateHold() with hold id: %v, available balance: %v\n", h.Id, d.accounts[si].Available)
+	return h, nil
+}
+
+// Get the details of the hold with the given id.
+//
+// Returns error if a hold with such id does not exist.
+func (d *datastore) GetHold(id uint64) (ds.Hold, error) {
+	log.Printf("[memds]GetHold() called with id: %v\n", id)
+
+	d.tlock.Lock()
+	defer d.tlock.Unlock()
+
+	h, ok := d.holds[id]
+	if !ok {
+		log.Printf("[memds]GetHold: hold with id: %v does not exist\n", id)
+		return ds.Hold{}, ds.Errorf(ds.ErrHoldNotFound, "hold with id: %v does not exist", id)
+	}
+	return *h, nil
+}
+
+// Check the hold can still be captured or voided at the given time.
+//
+// A hold past its expiry is expired on the spot. Caller must hold the row
+// lock of the account of the hold.
+func (d *datastore) checkHoldActive(si int, h *ds.Hold, now time.Time) error {
+	if h.Status != ds.HoldActive {
+		return ds.Errorf(ds.ErrHoldInactive, "hold id: %v is %v", h.Id, h.Status)
+	}
+	if now.Before(h.Expires) {
+		return nil
+	}
+
+	d.tlock.Lock()
+	defer d.tlock.Unlock()
+	if err := d.expireHold(si, h, now); err != nil {
+		return err
+	}
+	return ds.Errorf(ds.ErrHoldInactive, "hold id: %v is %v", h.Id, h.Status)
+}
+
+// Capture the hold with the given id, transferring the amount to its to account.
+//
+// A nil amount captures the whole hold, a smaller amount releases the rest.
+// The fee of the amount captured is charged, at most the fee reserved.
+// Returns the captured hold, with the id of the transaction. Returns error if
+// a hold with such id does not exist, the hold is not active, the amount is
+// invalid, more than the hold or above the approval threshold, any of the
+// accounts is not active or the capture violates a rule.
+func (d *datastore) CaptureHold(id uint64, amount *money.Money) (ds.Hold, error) {
+	log.Printf("[memds]CaptureHold() called with id: %v\n", id)
+
+	d.alock.RLock()
+	defer d.alock.RUnlock()
+
+	h, err := d.findHold(id)
+	if err != nil {
+		log.Printf("[memds]CaptureHold: %v\n", err)
+		return ds.Hold{}, err
+	}
+	if h.PendingId != 0 {
+		log.Printf("[memds]CaptureHold: hold id: %v is held for pending transfer id: %v\n", id, h.PendingId)
+		return ds.Hold{}, ds.Errorf(ds.ErrInvalidHold, "hold id: %v is held for pending transfer id: %v, it is captured by the approval of the transfer", id, h.PendingId)
+	}
+
+	// account ids, positions, amount and fee of a hold never change
+	si, di := d.index[h.AccountId], d.index[h.ToId]
+	captured := h.Amount
+	if amount != nil {
+		c, err := money.LookupCurrency(h.Currency)
+		if err != nil {
+			return ds.Hold{}, err
+		}
+		if captured, err = amount.Rescale(c.Exponent); err != nil {
+			log.Printf("[memds]CaptureHold: invalid amount for currency %v - %v\n", h.Currency, err)
+			return ds.Hold{}, ds.Errorf(ds.ErrInvalidAmount, "invalid amount for currency %v - %v", h.Currency, err)
+		}
+		if captured.Sign() <= 0 || captured.Cmp(h.Amount) > 0 {
+			log.Printf("[memds]CaptureHold: capture amount: %v needs to be positive and at most the hold amount: %v\n", captured, h.Amount)
+			return ds.Hold{}, ds.Errorf(ds.ErrInvalidAmount, "capture amount: %v needs to be positive and at most the hold amount: %v", captured, h.Amount)
+		}
+	}
+
+	// the threshold may have been lowered since the hold was placed
+	if d.approvals.Requires(captured, h.Currency) {
+		log.Printf("[memds]CaptureHold: capture of %v %v needs approval\n", captured, h.Currency)
+		return ds.Hold{}, ds.Errorf(ds.ErrInvalidHold, "capture of %v %v is above the approval threshold, transfers of the amount need approval", captured, h.Currency)
+	}
+	leg := transferLeg{si: si, di: di, amount: captured, currency: h.Currency, toAmount: captured, toCurrency: h.Currency}
+	if err := d.chargeCaptureFee(&leg, h); err != nil {
+		log.Printf("[memds]CaptureHold: %v\n", err)
+		return ds.Hold{}, err
+	}
+
+	// lock the accounts of the hold and the revenue account of the fee
+	locked := d.lockRows(leg.rows()...)
+	defer d.unlockRows(locked)
+
+	now := d.clock.Now()
+	if err := d.checkHoldActive(si, h, now); err != nil {
+		log.Printf("[memds]CaptureHold: %v\n", err)
+		return ds.Hold{}, err
+	}
+
+	for _, i := range leg.rows() {
+		if d.accounts[i].Status != ds.StatusActive {
+			log.Printf("[memds]CaptureHold: account id: %v is %v\n", d.accounts[i].Id, d.accounts[i].Status)
+			return ds.Hold{}, ds.Errorf(ds.ErrAccountInactive, "account id: %v is %v", d.accounts[i].Id, d.accounts[i].Status)
+		}
+	}
+	if err := d.checkCredits(&leg); err != nil {
+		return ds.Hold{}, err
+	}
+
+	d.tlock.Lock()
+	defer d.tlock.Unlock()
+
+	t := leg.transaction(d, d.nextTid, d.transactionDate())
+
+	// the rules see the debits committed before this capture
+	if err := d.checkRules(si, captured, t.date, nil); err != nil {
+		return ds.Hold{}, err
+	}
+	if d.journal != nil {
+		e := journalEntry{Lsn: d.lsn + 1, Op: opCaptureHold, HoldId: h.Id, Tid: t.tid, Date: t.date, From: t.from, To: t.to, Amount: captured, Currency: t.currency}
+		if t.feeTo != "" {
+			e.Fee = &t.fee
+			e.FeeTo = t.feeTo
+		}
+		if err := d.journal.append(&e); err != nil {
+			log.Printf("[memds]CaptureHold: failed to write journal - %v\n", err)
+			return ds.Hold{}, fmt.Errorf("failed to write journal - %v", err)
+		}
+	}
+	d.lsn += 1
+	d.nextTid += 1
+	d.applyCapture(si, di, h, t)
+	d.commitVersions(locked...)
+
+	log.Printf("[memds]returning from CaptureHold() with hold id: %v, tid: %v, captured: %v\n", h.Id, t.tid, captured)
+	return *h, nil
+}
+
+// Void the hold with the given id, releasing the reserved amount.
+//
+// Returns the voided hold. Returns error if a hold with such id does not
+// exist or the hold is not active.
+func (d *datastore) VoidHold(id uint64) (ds.Hold, error) {
+	log.Printf("[memds]VoidHold() called with id: %v\n", id)
+
+	d.alock.RLock()
+	defer d.alock.RUnlock()
+
+	h, err := d.findHold(id)
+	if err != nil {
+		log.Printf("[memds]VoidHold: %v\n", err)
+		return ds.Hold{}, err
+	}
+	if h.PendingId != 0 {
+		log.Printf("[memds]VoidHold: hold id: %v is held for pending transfer id: %v\n", id, h.PendingId)
+		return ds.Hold{}, ds.Errorf(ds.ErrInvalidHold, "hold id: %v is held for pending transfer id: %v, it is voided by the rejection of the transfer", id, h.PendingId)
+	}
+
+	// a hold can be voided even if the accounts are no longer active
+	si := d.index[h.AccountId]
+	d.locks[si].Lock()
+	defer d.locks[si].Unlock()
+
+	now := d.clock.Now()
+	if err := d.checkHoldActive(si, h, now); err != nil {
+		log.Printf("[memds]VoidHold: %v\n", err)
+		return ds.Hold{}, err
+	}
+
+	d.tlock.Lock()
+	defer d.tlock.Unlock()
+	if err := d.releaseHold(si, h, ds.HoldVoided, now); err != nil {
+		log.Printf("[memds]VoidHold: %v\n", err)
+		return ds.Hold{}, err
+	}
+
+	log.Printf("[memds]returning from VoidHold() with hold id: %v, available balance: %v\n", h.Id, d.accounts[si].Available)
+	return *h, nil
+}
+
+// Journal and apply the release of the hold with the given status.
+//
+// Caller must hold the row lock of the account of the hold and tlock.
+func (d *datastore) releaseHold(si int, h *ds.Hold, status string, now time.Time) error {
+	if d.journal != nil {
+		op := opVoidHold
+		if status == ds.HoldExpired {
+			op = opExpireHold
+		}
+		e := journalEntry{Lsn: d.lsn + 1, Op: op, HoldId: h.Id, Date: now}
+		if err := d.journal.append(&e); err != nil {
+			return fmt.Errorf("failed to write journal - %v", err)
+		}
+	}
+	d.lsn += 1
+	d.applyRelease(si, h, status, now)
+	d.commitVersions(si)
+	return nil
+}
+
+// Expire the hold, releasing the reserved amount.
+//
+// Caller must hold the row lock of the account of the hold and tlock.
+func (d *datastore) expireHold(si int, h *ds.Hold, now time.Time) error {
+	if err := d.releaseHold(si, h, ds.HoldExpired, now); err != nil {
+		log.Printf("[memds]failed to expire hold id: %v - %v\n", h.Id, err)
+		return err
+	}
+	log.Printf("[memds]hold id: %v expired, available balance: %v\n", h.Id, d.accounts[si].Available)
+	return nil
+}
+
+// Expire the active holds past their expiry at the given time.
+//
+// Returns the number of holds expired.
+func (d *datastore) expireHolds(now time.Time) int {
+	d.alock.RLock()
+	defer d.alock.RUnlock()
+
+	// find the expired holds, in the order they were placed
+	d.tlock.Lock()
+	var expired []*ds.Hold
+	for _, h := range d.activeHolds {
+		if !now.Before(h.Expires) {
+			expired = append(expired, h)
+		}
+	}
+	d.tlock.Unlock()
+	sort.Slice(expired, func(i, j int) bool { return expired[i].Id < expired[j].Id })
+
+	n := 0
+	for _, h := range expired {
+		si := d.index[h.AccountId]
+		d.locks[si].Lock()
+
+		// the hold may have been captured or voided meanwhile
+		d.tlock.Lock()
+		if h.Status == ds.HoldActive && d.expireHold(si, h, now) == nil {
+			n++
+		}
+		d.tlock.Unlock()
+		d.locks[si].Unlock()
+	}
+	return n
+}
+
+// Expire holds periodically until the datastore is closed.
+func (d *datastore) holdLoop(interval time.Duration) {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			if n := d.expireHolds(d.clock.Now()); n > 0 {
+				log.Printf("[memds]%v holds expired\n", n)
+			}
+		}
+	}
+}
+
+// end-of-file
@@ -0,0 +1,103 @@
+// Implements idempotency keys for transfers in the in-memory datastore.
+//
+// A transfer carrying an idempotency key is executed at most once. The key is
+// stored with a hash of the request and the result of the transfer, and a retry
+// with the same key and hash returns the stored result without moving money again.
+// Keys are journaled and included in snapshots with the transfer, so they survive
+// restarts, and expire after the configured window.
+package memds
+
+import (
+	"log"
+	"time"
+
+	"paytabs/internal/ds"
+)
+
+// default time an idempotency key is remembered
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// structure representing a stored idempotency key
+type idempotencyRecord struct {
+	key     string            // idempotency key
+	hash    string            // hash of the request that used the key
+	pending bool              // true while the transfer is in progress
+	expires time.Time         // time after which the key is forgotten
+	result  ds.TransferResult // result of the transfer
+}
+
+// Reserve the idempotency key for a new transfer.
+//
+// Returns the stored result with replayed set when the key was already used
+// by the same request. Returns error when the key was used by a different
+// request or a transfer with the key is still in progress.
+func (d *datastore) reserveIdempotencyKey(key string, hash string) (ds.TransferResult, bool, error) {
+	d.tlock.Lock()
+	defer d.tlock.Unlock()
+
+	d.expireIdempotencyKeys(d.clock.Now())
+	if r, ok := d.idempotency[key]; ok {
+		if r.hash != hash {
+			log.Printf("[memds]Transfer: idempotency key: %q reused with a different request\n", key)
+			return ds.TransferResult{}, false, ds.ErrIdempotencyKeyReused
+		}
+		if r.pending {
+			log.Printf("[memds]Transfer: transfer with idempotency key: %q is in progress\n", key)
+			return ds.TransferResult{}, false, ds.ErrIdempotencyKeyInProgress
+		}
+		log.Printf("[memds]Transfer: replaying result of idempotency key: %q, tid: %v\n", key, r.result.Tid)
+		res := r.result
+		res.Replayed = true
+		return res, true, nil
+	}
+
+	d.idempotency[key] = &idempotencyRecord{key: key, hash: hash, pending: true}
+	return ds.TransferResult{}, false, nil
+}
+
+// Release a reserved idempotency key after the transfer failed,
+// so the request can be retried.
+func (d *datastore) releaseIdempotencyKey(key string) {
+	d.tlock.Lock()
+	defer d.tlock.Unlock()
+
+	if r, ok := d.idempotency[key]; ok && r.pending {
+		delete(d.idempotency, key)
+	}
+}
+
+// Store the result of the transfer for the idempotency key.
+//
+// Caller must hold tlock.
+func (d *datastore) storeIdempotencyKey(key string, hash string, date time.Time, result ds.TransferResult) {
+	d.idempotency[key] = &idempotencyRecord{
+		key:     key,
+		hash:    hash,
+		expires: date.Add(d.idempotencyWindow),
+		result:  result,
+	}
+	d.idempotencyOrder = append(d.idempotencyOrder, key)
+}
+
+// Forget the idempotency keys expired at the given time.
+//
+// Keys are stored in the order they were used, so expired keys are always
+// at the front of the order. Caller must hold tlock.
+func (d *datastore) expireIdempotencyKeys(now time.Time) {
+	n := 0
+	for _, key := range d.idempotencyOrder {
+		r, ok := d.idempotency[key]
+		if ok && (r.pending || now.Before(r.expires)) {
+			break
+		}
+		if ok {
+			delete(d.idempotency, key)
+		}
+		n++
+	}
+	if n > 0 {
+		d.idempotencyOrder = d.idempotencyOrder[n:]
+	}
+}
+
+// end-of-file
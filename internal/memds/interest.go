@@ -0,0 +1,314 @@
+// Accrues and posts the interest of savings accounts for the in-memory datastore.
+//
+// The datastore accrues the days one at a time, in order, from the day after
+// the last day accrued up to yesterday, as reported by the clock. Each day is
+// accrued on the balances of the savings accounts holding the table lock, so
+// every account is seen at the same point, and is journaled as one record
+// with the interest of every account. On the last day of a month the interest
+// accrued during the month, plus what was rounded off at the month before, is
+// rounded to the currency and posted as a transaction from the expense account
+// of the currency to the savings account. The interest of the following days
+// accrues on the balance including the posting, so interest compounds monthly.
+//
+// When interest is first configured the days before today are not accrued.
+// Days passed while the datastore was stopped are accrued when it is opened,
+// on the balances at that time. Closed savings accounts accrue no interest and
+// interest accrued before an account is closed is not posted. Interest is not
+// posted while the expense account of the currency is frozen or closed, or
+// while the posting would take a balance out of range, it stays accrued and is
+// posted on the last day of a month it can be posted.
+package memds
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"paytabs/internal/ds"
+	"paytabs/internal/interest"
+	"paytabs/internal/money"
+)
+
+// default interval between the checks for days to accrue
+const DefaultInterestInterval = time.Hour
+
+// interest of a savings account
+type accrual struct {
+	accrued money.Money // accrued and not yet posted, with interest.AccrualScale decimals
+	posted  money.Money // sum of the interest posted
+}
+
+// Returns the interest of the account, creating it when needed.
+//
+// Caller must hold tlock.
+func (d *datastore) accrual(id string) *accrual {
+	ac, ok := d.accruals[id]
+	if !ok {
+		ac = &accrual{accrued: money.New(0, interest.AccrualScale)}
+		d.accruals[id] = ac
+	}
+	return ac
+}
+
+// Check a savings account can be created in the currency.
+func (d *datastore) checkSavings(currency string) error {
+	if d.interest == nil {
+		return ds.Errorf(ds.ErrInvalidAccount, "interest is not configured, %v accounts cannot be created", ds.TypeSavings)
+	}
+	if _, ok := d.interest.ExpenseAccount(currency); !ok {
+		return ds.Errorf(ds.ErrInvalidAccount, "no interest expense account for %v, %v accounts cannot be created in %v", currency, ds.TypeSavings, currency)
+	}
+	return nil
+}
+
+// Check the expense accounts of the interest policy exist, are checking
+// accounts in the currency they pay, and every savings account has one.
+//
+// Called when the datastore is opened, before it is in use.
+func (d *datastore) checkInterestAccounts() error {
+	if d.interest != nil {
+		for currency, id := range d.interest.Accounts() {
+			i, ok := d.index[id]
+			if !ok {
+				return fmt.Errorf("interest expense account id: %v of %v does not exist", id, currency)
+			}
+			if d.accounts[i].Currency != currency || d.accounts[i].Type != ds.TypeChecking {
+				return fmt.Errorf("interest expense account id: %v of %v is a %v %v account", id, currency, d.accounts[i].Currency, d.accounts[i].Type)
+			}
+		}
+	}
+	for i := range d.accounts {
+		if d.accounts[i].Type != ds.TypeSavings {
+			continue
+		}
+		if err := d.checkSavings(d.accounts[i].Currency); err != nil {
+			return fmt.Errorf("account id: %v - %v", d.accounts[i].Id, err)
+		}
+	}
+	return nil
+}
+
+// Accrue the interest of the days completed since the last day accrued.
+//
+// Locks the table for one day at a time, so transfers run in between the days.
+func (d *datastore) accrueInterest() error {
+	today := interest.Day(d.clock.Now())
+	for {
+		d.lockTable()
+		d.tlock.Lock()
+		done, err := d.accrueNextDay(today)
+		d.tlock.Unlock()
+		d.unlockTable()
+		if done || err != nil {
+			return err
+		}
+	}
+}
+
+// Accrue the day after the last day accrued, when it is before today.
+//
+// Returns true when there is no day left to accrue. Caller must hold the
+// table lock and tlock.
+func (d *datastore) accrueNextDay(today time.Time) (bool, error) {
+	first := d.accruedThrough.IsZero()
+	day := d.accruedThrough.AddDate(0, 0, 1)
+	if first {
+		// interest starts accruing today, the days before are not accrued
+		day = today.AddDate(0, 0, -1)
+	} else if !day.Before(today) {
+		return true, nil
+	}
+
+	e := journalEntry{Lsn: d.lsn + 1, Op: opInterest, Date: d.transactionDate(), Day: &day}
+	if !first {
+		// interest of the day on the balance of every savings account
+		daily := make(map[string]money.Money)
+		for i := range d.accounts {
+			a := &d.accounts[i]
+			if a.Type != ds.TypeSavings || a.Status == ds.StatusClosed {
+				continue
+			}
+			amount, err := d.interest.Daily(a.Balance, a.InterestRate, day)
+			if err != nil {
+				return true, fmt.Errorf("account id: %v - %v", a.Id, err)
+			}
+			daily[a.Id] = amount
+			if !amount.IsZero() {
+				e.Accruals = append(e.Accruals, journalAccrual{a.Id, amount})
+			}
+		}
+
+		// the interest of the month is posted on its last day
+		if interest.EndOfMonth(day) {
+			expenses := make(map[string]money.Money) // balances of the expense accounts less the postings
+			for i := range d.accounts {
+				a := &d.accounts[i]
+				amount, ok := daily[a.Id]
+				if !ok {
+					continue
+				}
+				c, err := money.LookupCurrency(a.Currency)
+				if err != nil {
+					return true, err
+				}
+				posted := d.interest.Round(d.accrual(a.Id).accrued.Add(amount), c.Exponent)
+				if posted.Sign() <= 0 {
+					continue
+				}
+				expense, _ := d.interest.ExpenseAccount(a.Currency)
+				if ei := d.index[expense]; d.accounts[ei].Status != ds.StatusActive {
+					log.Printf("[memds]accrueInterest: interest of account id: %v not posted, expense account id: %v is %v\n", a.Id, expense, d.accounts[ei].Status)
+					continue
+				}
+				balance, ok := expenses[expense]
+				if !ok {
+					balance = d.accounts[d.index[expense]].Balance
+				}
+				balance, err = balance.CheckedSub(posted)
+				if err != nil {
+					log.Printf("[memds]accrueInterest: interest of account id: %v not posted, expense account id: %v balance is out of range\n", a.Id, expense)
+					continue
+				}
+				if _, err := checkCredit(a, a.Balance, posted); err != nil {
+					continue
+				}
+				expenses[expense] = balance
+				e.Legs = append(e.Legs, journalLeg{Tid: d.nextTid + uint64(len(e.Legs)), From: expense, To: a.Id, Amount: posted, Currency: a.Currency, ToAmount: posted, ToCurrency: a.Currency})
+			}
+		}
+	}
+
+	// persist the day before applying it
+	if d.journal != nil {
+		if err := d.journal.append(&e); err != nil {
+			log.Printf("[memds]accrueInterest: failed to write journal - %v\n", err)
+			return true, fmt.Errorf("failed to write journal - %v", err)
+		}
+	}
+	d.lsn += 1
+	rows, err := d.applyInterest(&e)
+	if err != nil {
+		return true, err
+	}
+	d.commitVersions(rows...)
+
+	log.Printf("[memds]interest accrued for %v, %v accounts, %v postings\n", day.Format("2006-01-02"), len(e.Accruals), len(e.Legs))
+	return false, nil
+}
+
+// Apply the interest of a day: add the accruals and post the interest.
+//
+// Returns the rows of the accounts changed by the postings. Caller must hold
+// the row locks of the accounts posted to and tlock.
+func (d *datastore) applyInterest(e *journalEntry) ([]int, error) {
+	for _, a := range e.Accruals {
+		ac := d.accrual(a.Account)
+		ac.accrued = ac.accrued.Add(a.Amount)
+	}
+
+	var rows []int
+	changed := make(map[int]bool)
+	for _, leg := range e.Legs {
+		si, ok := d.index[leg.From]
+		if !ok {
+			return nil, fmt.Errorf("unknown account id: %v", leg.From)
+		}
+		di, ok := d.index[leg.To]
+		if !ok {
+			return nil, fmt.Errorf("unknown account id: %v", leg.To)
+		}
+		ac := d.accrual(leg.To)
+		ac.accrued = ac.accrued.Sub(leg.Amount)
+		ac.posted = ac.posted.Add(leg.Amount)
+		d.applyTransfer(si, di, transaction{
+			tid:         leg.Tid,
+			date:        e.Date,
+			from:        leg.From,
+			to:          leg.To,
+			amount:      leg.Amount,
+			currency:    leg.Currency,
+			toAmount:    leg.ToAmount,
+			toCurrency:  leg.ToCurrency,
+			interestFor: e.Day.Format("2006-01"),
+		})
+		if leg.Tid >= d.nextTid {
+			d.nextTid = leg.Tid + 1
+		}
+		for _, row := range []int{si, di} {
+			if !changed[row] {
+				changed[row] = true
+				rows = append(rows, row)
+			}
+		}
+	}
+	d.accruedThrough = *e.Day
+	return rows, nil
+}
+
+// Get the interest of the savings account with the given id.
+//
+// Returns error if an account with such id does not exist or it is not a
+// savings account.
+func (d *datastore) Interest(id string) (ds.InterestStatus, error) {
+	log.Printf("[memds]Interest() called with id: %v\n", id)
+
+	d.alock.RLock()
+	i, ok := d.index[id]
+	if !ok {
+		d.alock.RUnlock()
+		log.Printf("[memds]Interest: account with id: %v does not exist\n", id)
+		return ds.InterestStatus{}, ds.Errorf(ds.ErrAccountNotFound, "account with id: %v does not exist", id)
+	}
+	d.locks[i].Lock()
+	a := d.accounts[i]
+	d.locks[i].Unlock()
+	d.alock.RUnlock()
+
+	if a.Type != ds.TypeSavings {
+		log.Printf("[memds]Interest: account id: %v is a %v account\n", id, a.Type)
+		return ds.InterestStatus{}, ds.Errorf(ds.ErrInvalidAccount, "account id: %v is a %v account, only %v accounts earn interest", id, a.Type, ds.TypeSavings)
+	}
+	c, err := money.LookupCurrency(a.Currency)
+	if err != nil {
+		return ds.InterestStatus{}, err
+	}
+
+	d.tlock.Lock()
+	defer d.tlock.Unlock()
+	s := ds.InterestStatus{
+		AccountId:      id,
+		Rate:           a.InterestRate,
+		DayCount:       d.interest.DayCount(),
+		Accrued:        money.New(0, interest.AccrualScale),
+		Currency:       a.Currency,
+		AccruedThrough: d.accruedThrough,
+		Posted:         money.New(0, c.Exponent),
+	}
+	if ac, ok := d.accruals[id]; ok {
+		s.Accrued = s.Accrued.Add(ac.accrued)
+		s.Posted = s.Posted.Add(ac.posted)
+	}
+
+	log.Printf("[memds]returning from Interest() with accrued: %v, posted: %v\n", s.Accrued, s.Posted)
+	return s, nil
+}
+
+// Accrue the interest of the days completed, periodically until the datastore is closed.
+func (d *datastore) interestLoop(interval time.Duration) {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			if err := d.accrueInterest(); err != nil {
+				log.Printf("[memds]failed to accrue interest - %v\n", err)
+			}
+		}
+	}
+}
+
+// end-of-file
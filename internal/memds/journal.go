@@ -0,0 +1,356 @@
+// Implements an append-only write-ahead journal for the in-memory datastore.
+//
+// Every change to the datastore, transfers, account changes and holds, is
+// appended to the journal and fsync'd before it is applied in memory. On
+// startup the journal is replayed on top of the initial data file to rebuild
+// the state.
+//
+// Record layout on disk:
+//
+//	[4 bytes payload length][4 bytes crc32c of payload][payload]
+//
+// All integers are little endian, payload is a json encoded journalEntry.
+package memds
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"paytabs/internal/ds"
+	"paytabs/internal/money"
+)
+
+const (
+	journalHeaderSize = 8                // length + checksum
+	journalMaxRecord  = 16 * 1024 * 1024 // sanity limit for a single record
+)
+
+// journal operations
+const (
+	opTransfer      = "transfer"
+	opCreateAccount = "create_account"
+	opUpdateAccount = "update_account"
+	opCreateHold    = "create_hold"
+	opCaptureHold   = "capture_hold"
+	opVoidHold      = "void_hold"
+	opExpireHold    = "expire_hold"
+	opRefund        = "refund"
+	opBatch         = "batch"
+	opInterest      = "interest"
+	opCreatePending = "create_pending"
+	opRejectPending = "reject_pending"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// structure representing a single journal record
+type journalEntry struct {
+	Lsn            uint64           `json:"lsn"`                       // log sequence number
+	Op             string           `json:"op"`                        // operation recorded
+	Tid            uint64           `json:"tid,omitempty"`             // transaction id
+	Date           time.Time        `json:"date"`                      // date and time of the operation
+	From           string           `json:"from,omitempty"`            // transfered from
+	To             string           `json:"to,omitempty"`              // transfered to
+	Amount         money.Money      `json:"amount"`                    // amount transfered
+	Currency       string           `json:"currency,omitempty"`        // currency of the amount
+	ToAmount       money.Money      `json:"to_amount"`                 // amount credited, for cross-currency transfers
+	ToCurrency     string           `json:"to_currency,omitempty"`     // currency credited, for cross-currency transfers
+	Rate           money.Rate       `json:"rate"`                      // exchange rate, for cross-currency transfers
+	IdempotencyKey string           `json:"idempotency_key,omitempty"` // idempotency key of the transfer
+	RequestHash    string           `json:"request_hash,omitempty"`    // hash of the request that used the key
+	Account        *ds.Account      `json:"account,omitempty"`         // account details, for account changes
+	HoldId         uint64           `json:"hold_id,omitempty"`         // hold id, for hold changes
+	Expires        *time.Time       `json:"expires,omitempty"`         // expiry of a new hold
+	RefundOf       uint64           `json:"refund_of,omitempty"`       // transaction refunded, for refunds
+	Batch          uint64           `json:"batch_id,omitempty"`        // batch id, for batch transfers
+	Fee            *money.Money     `json:"fee,omitempty"`             // fee charged, for transfers with a fee
+	FeeTo          string           `json:"fee_to,omitempty"`          // revenue account credited with the fee
+	Day            *time.Time       `json:"day,omitempty"`             // day accrued, for interest
+	Accruals       []journalAccrual `json:"accruals,omitempty"`        // interest accrued for the day, for interest
+	Legs           []journalLeg     `json:"legs,omitempty"`            // transfers of a batch, applied in order
+	PendingId      uint64           `json:"pending_id,omitempty"`      // pending transfer, for pending transfers and their approval
+	Principal      string           `json:"principal,omitempty"`       // principal who requested, approved or rejected a pending transfer
+	Reason         string           `json:"reason,omitempty"`          // reason of the rejection of a pending transfer
+	Convert        bool             `json:"convert,omitempty"`         // conversion allowed, for pending transfers
+}
+
+// structure representing a transfer of a batch in a journal record
+type journalLeg struct {
+	Tid        uint64       `json:"tid"`
+	From       string       `json:"from"`
+	To         string       `json:"to"`
+	Amount     money.Money  `json:"amount"`
+	Currency   string       `json:"currency"`
+	ToAmount   money.Money  `json:"to_amount"`
+	ToCurrency string       `json:"to_currency"`
+	Rate       money.Rate   `json:"rate"`
+	Fee        *money.Money `json:"fee,omitempty"`
+	FeeTo      string       `json:"fee_to,omitempty"`
+}
+
+// structure representing the interest accrued on a savings account in a journal record
+type journalAccrual struct {
+	Account string      `json:"account"`
+	Amount  money.Money `json:"amount"`
+}
+
+// structure for the write-ahead journal
+type journal struct {
+	path string   // path to the journal file
+	f    *os.File // journal file opened for append
+	size int64    // size of the valid journal data
+}
+
+// Open the journal file and read all the records in it.
+//
+// Creates the journal file if it does not exist. A torn final record, left
+// behind by a crash in the middle of a write, is truncated. Any other
+// corruption, an invalid length or a checksum mismatch in a record followed
+// by other records, is reported as an error and the file is left as it is.
+func openJournal(path string) (*journal, []journalEntry, error) {
+	log.Printf("[memds]opening journal: %v\n", path)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		log.Printf("[memds]failed to open journal: %s - %s\n", path, err)
+		return nil, nil, err
+	}
+
+	entries, size, err := readJournal(f)
+	if err != nil {
+		f.Close()
+		log.Printf("[memds]failed to read journal: %s - %s\n", path, err)
+		return nil, nil, err
+	}
+
+	// drop the torn record, if any, and position at the end of the valid data
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if fi.Size() != size {
+		log.Printf("[memds]truncating torn journal record at offset %v, file size %v\n", size, fi.Size())
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	j := &journal{path: path, f: f, size: size}
+	log.Printf("[memds]journal opened, %v records\n", len(entries))
+
+	return j, entries, nil
+}
+
+// Read all the valid records from the journal.
+//
+// Returns the records and the size of the valid data in the file.
+func readJournal(f *os.File) ([]journalEntry, int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	total := fi.Size()
+
+	var entries []journalEntry
+	var offset int64
+	header := make([]byte, journalHeaderSize)
+	for offset < total {
+		// a short header can only be a torn final record
+		if total-offset < journalHeaderSize {
+			break
+		}
+		if _, err := f.ReadAt(header, offset); err != nil {
+			return nil, 0, err
+		}
+		length := int64(binary.LittleEndian.Uint32(header[0:4]))
+		sum := binary.LittleEndian.Uint32(header[4:8])
+		if length > journalMaxRecord {
+			return nil, 0, fmt.Errorf("journal corrupted at offset %v, invalid record length %v", offset, length)
+		}
+
+		// a record extending past the end of file is a torn final record,
+		// unless a valid record follows it and its length is corrupted
+		end := offset + journalHeaderSize + length
+		if end > total {
+			follows, err := recordFollows(f, offset, total)
+			if err != nil {
+				return nil, 0, err
+			}
+			if follows {
+				return nil, 0, fmt.Errorf("journal corrupted at offset %v, invalid record length %v", offset, length)
+			}
+			break
+		}
+
+		payload := make([]byte, length)
+		if _, err := f.ReadAt(payload, offset+journalHeaderSize); err != nil {
+			return nil, 0, err
+		}
+		if crc32.Checksum(payload, crcTable) != sum {
+			// only the final record may be torn
+			if end == total {
+				break
+			}
+			return nil, 0, fmt.Errorf("journal corrupted at offset %v, checksum mismatch", offset)
+		}
+
+		var e journalEntry
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return nil, 0, fmt.Errorf("journal corrupted at offset %v - %v", offset, err)
+		}
+		entries = append(entries, e)
+		offset = end
+	}
+
+	return entries, offset, nil
+}
+
+// Returns true if a valid record starts in the journal after offset.
+//
+// The data from offset to the end of file is less than a record, as it holds
+// the header of a record extending past the end of file.
+func recordFollows(f *os.File, offset int64, total int64) (bool, error) {
+	data := make([]byte, total-offset)
+	if _, err := f.ReadAt(data, offset); err != nil {
+		return false, err
+	}
+	for i := 1; i+journalHeaderSize <= len(data); i++ {
+		length := int(binary.LittleEndian.Uint32(data[i : i+4]))
+		if length > len(data)-i-journalHeaderSize {
+			continue
+		}
+		payload := data[i+journalHeaderSize : i+journalHeaderSize+length]
+		if crc32.Checksum(payload, crcTable) == binary.LittleEndian.Uint32(data[i+4:i+8]) && json.Valid(payload) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Frame the payload with its length and checksum.
+func encodeRecord(payload []byte) []byte {
+	record := make([]byte, journalHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	copy(record[journalHeaderSize:], payload)
+	return record
+}
+
+// Append a record to the journal.
+//
+// The caller assigns the lsn. Returns only after the record
+// is written and synced to the disk.
+func (j *journal) append(e *journalEntry) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	record := encodeRecord(payload)
+
+	if _, err := j.f.Write(record); err != nil {
+		j.rollback()
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		j.rollback()
+		return err
+	}
+
+	j.size += int64(len(record))
+	return nil
+}
+
+// Discard a partially written record so the next append starts at a record boundary.
+func (j *journal) rollback() {
+	if err := j.f.Truncate(j.size); err != nil {
+		log.Printf("[memds]failed to truncate journal: %s - %s\n", j.path, err)
+	}
+	if _, err := j.f.Seek(j.size, io.SeekStart); err != nil {
+		log.Printf("[memds]failed to seek journal: %s - %s\n", j.path, err)
+	}
+}
+
+// Drop all the records with lsn up to and including the given lsn.
+//
+// Used after a snapshot containing those records is safely on disk.
+// The remaining records are written to a new file which then atomically
+// replaces the journal.
+func (j *journal) compact(lsn uint64) error {
+	entries, _, err := readJournal(j.f)
+	if err != nil {
+		return err
+	}
+
+	// write the records newer than lsn to a temporary file
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for i := range entries {
+		if entries[i].Lsn <= lsn {
+			continue
+		}
+		payload, err := json.Marshal(&entries[i])
+		if err != nil {
+			f.Close()
+			return err
+		}
+		n, err := f.Write(encodeRecord(payload))
+		if err != nil {
+			f.Close()
+			return err
+		}
+		size += int64(n)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	// replace the journal with the compacted file
+	if err := os.Rename(tmp, j.path); err != nil {
+		f.Close()
+		return err
+	}
+	syncDir(j.path)
+	j.f.Close()
+	j.f = f
+	j.size = size
+	return nil
+}
+
+// Sync the directory containing the given path so a rename survives a crash.
+func syncDir(path string) {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return
+	}
+	dir.Sync()
+	dir.Close()
+}
+
+// Close the journal file.
+func (j *journal) close() error {
+	return j.f.Close()
+}
+
+// end-of-file
@@ -0,0 +1,73 @@
+// Keeps the double-entry ledger of the in-memory datastore.
+//
+// Every transaction appended is posted to the ledger, see appendTransaction,
+// and every account added posts its opening balance, so the balances of the
+// accounts can be derived from the postings. The ledger is not written to
+// snapshots, it is rebuilt from the transactions they contain: the opening
+// balance of an account is its balance less what its transactions moved.
+package memds
+
+import (
+	"log"
+
+	"paytabs/internal/ds"
+	"paytabs/internal/ledger"
+)
+
+// Post the opening balance of the account.
+//
+// Caller must hold tlock, unless the datastore is not yet in use.
+func (d *datastore) postOpening(a ds.Account) {
+	if !a.Balance.IsZero() {
+		d.ledger.Post(ledger.Opening(a.Id, a.Balance, a.Currency))
+	}
+}
+
+// Check the opening balance of the account can be posted.
+//
+// Returns error if the opening balances of the currency would sum out of
+// range. Caller must hold tlock, unless the datastore is not yet in use.
+func (d *datastore) checkOpening(a ds.Account) error {
+	if _, err := d.ledger.Balance(ledger.OpeningAccount, a.Currency).CheckedSub(a.Balance); err != nil {
+		return ds.Errorf(ds.ErrInvalidAmount, "opening balance of %v %v is out of range - %v", a.Balance, a.Currency, err)
+	}
+	return nil
+}
+
+// Post the opening balances of the accounts loaded from a snapshot.
+//
+// The transactions of the snapshot must already be posted.
+func (d *datastore) postSnapshotOpenings() {
+	for _, a := range d.accounts {
+		a.Balance = a.Balance.Sub(d.ledger.Balance(a.Id, a.Currency))
+		d.postOpening(a)
+	}
+}
+
+// Verify the ledger against the balances of the accounts.
+//
+// Returns the report of the verification, with the problems found when the
+// ledger does not balance or does not match the balances of the accounts.
+func (d *datastore) VerifyLedger() ledger.Report {
+	log.Println("[memds]VerifyLedger() called")
+
+	// no balance can change while the ledger is verified
+	d.lockTable()
+	defer d.unlockTable()
+	d.tlock.Lock()
+	defer d.tlock.Unlock()
+
+	balances := make([]ledger.Balance, len(d.accounts))
+	for i, a := range d.accounts {
+		balances[i] = ledger.Balance{Account: a.Id, Amount: a.Balance, Currency: a.Currency}
+	}
+	r := d.ledger.Verify(balances)
+	for _, p := range r.Problems {
+		log.Printf("[memds]VerifyLedger: %v\n", p)
+	}
+
+	log.Printf("[memds]returning from VerifyLedger() with balanced: %v, %v entries, %v postings\n", r.Balanced, r.Entries, r.Postings)
+	return r
+}
+
+// end-of-file
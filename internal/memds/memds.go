@@ -8,36 +8,268 @@ import (
 	"io"
 	"log"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"paytabs/internal/approvals"
+	"paytabs/internal/clock"
 	"paytabs/internal/ds"
+	"paytabs/internal/fees"
+	"paytabs/internal/interest"
+	"paytabs/internal/ledger"
+	"paytabs/internal/money"
+	"paytabs/internal/rules"
 )
 
 // structure representing a transaction
 type transaction struct {
-	tid    uint64    // transaction id
-	date   time.Time // date and time of the transaction
-	from   string    // transfered from
-	to     string    // transfered to
-	amount float64   // amouont transfered
+	tid         uint64      // transaction id
+	date        time.Time   // date and time of the transaction
+	from        string      // transfered from
+	to          string      // transfered to
+	amount      money.Money // amouont transfered
+	currency    string      // currency of the amount
+	toAmount    money.Money // amount credited to the to account
+	toCurrency  string      // currency of the to account
+	rate        money.Rate  // exchange rate applied, zero when no conversion was needed
+	refundOf    uint64      // id of the transaction refunded, zero when not a refund
+	refunded    money.Money // amount refunded so far, in the currency of the to account
+	batch       uint64      // id of the batch, zero when not a leg of a batch transfer
+	fee         money.Money // fee debited from the from account, in its currency
+	feeTo       string      // revenue account credited with the fee, empty when no fee was charged
+	interestFor string      // month of the interest posted, e.g. "2026-01", empty when not an interest posting
+}
+
+// Returns the ledger entry of the transaction.
+func (t *transaction) entry() ledger.Entry {
+	// transactions recorded before accounts had a currency have no to currency
+	toAmount, toCurrency := t.toAmount, t.toCurrency
+	if toCurrency == "" {
+		toAmount, toCurrency = t.amount, t.currency
+	}
+	e := ledger.Transfer(t.tid, t.from, t.to, t.amount, t.currency, toAmount, toCurrency)
+
+	// the fee moves from the from account to the revenue account
+	if t.feeTo != "" {
+		e.Postings = append(e.Postings,
+			ledger.Posting{Account: t.from, Side: ledger.Debit, Amount: t.fee, Currency: t.currency},
+			ledger.Posting{Account: t.feeTo, Side: ledger.Credit, Amount: t.fee, Currency: t.currency})
+	}
+	return e
 }
 
 // structure for in-mempory datastore containing all the account details and
 // transactions performed
 type datastore struct {
-	accounts     []ds.Account   // list of accounts
-	locks        []sync.Mutex   // row locks
-	index        map[string]int // index for id
-	transactions []transaction  // list of transactions handled
-	tlock        sync.Mutex     // transaction lock
-	nextTid      uint64         // next transaction id
+	published         uint64                          // lsn of the newest versions readers can see, accessed atomically, first for alignment
+	chains            atomic.Value                    // []*versionChain, versions of the accounts for readers, see mvcc.go
+	registry          readerRegistry                  // snapshots of the readers in progress
+	accounts          []ds.Account                    // list of accounts
+	locks             []sync.Mutex                    // row locks
+	index             map[string]int                  // index for id
+	alock             sync.RWMutex                    // guards growing accounts, locks and index, held shared by row lock holders
+	currency          string                          // currency of new accounts without one
+	transactions      []transaction                   // list of transactions handled, in tid order
+	tidIndex          map[uint64]int                  // index for transaction id, position in transactions
+	byAccount         map[string]*accountTransactions // index for account id, positions of its transactions
+	ledger            *ledger.Ledger                  // double-entry ledger of the balances, guarded by tlock, see ledger.go
+	tlock             sync.Mutex                      // transaction lock
+	nextTid           uint64                          // next transaction id
+	nextBatch         uint64                          // next batch id, guarded by tlock
+	overdraftEvents   map[string][]ds.OverdraftEvent  // overdraft events by account id, guarded by tlock, see overdraft.go
+	lsn               uint64                          // lsn of the last change applied, guarded by tlock
+	journal           *journal                        // write-ahead journal, nil when transfers are not persisted
+	fx                ds.FXRateProvider               // exchange rates for cross-currency transfers, nil when not available
+	rules             *rules.Set                      // transfer limits and velocity rules, nil when transfers are not limited
+	fees              *fees.Schedule                  // fee schedule of transfers, nil when transfers are free
+	clock             clock.Clock                     // source of the current time
+	interest          *interest.Policy                // interest policy of the savings accounts, nil when interest is not configured
+	accruals          map[string]*accrual             // interest of the savings accounts by account id, guarded by tlock, see interest.go
+	accruedThrough    time.Time                       // last day interest was accrued, zero when never, guarded by tlock
+	idempotency       map[string]*idempotencyRecord   // idempotency keys, guarded by tlock
+	idempotencyOrder  []string                        // idempotency keys in the order they were used, guarded by tlock
+	idempotencyWindow time.Duration                   // time an idempotency key is remembered
+	holds             map[uint64]*ds.Hold             // holds by id, see holds.go
+	activeHolds       map[uint64]*ds.Hold             // active holds by id, guarded by tlock
+	nextHold          uint64                          // next hold id, guarded by tlock
+	approvals         *approvals.Policy               // approval policy of large transfers, nil when transfers never wait for approval
+	pending           map[uint64]*ds.PendingTransfer  // transfers held for approval by id, guarded by tlock, see approvals.go
+	nextPending       uint64                          // next pending transfer id, guarded by tlock
+	holdExpiry        time.Duration                   // time until a hold expires
+	snapshotDir       string                          // directory for snapshots, empty when snapshots are disabled
+	slock             sync.Mutex                      // serializes snapshot writers
+	stop              chan struct{}                   // closed to stop the background snapshots
+	wg                sync.WaitGroup                  // tracks the background snapshot goroutine
+}
+
+// Configuration for the in-memory datastore.
+type Config struct {
+	DataFile          string            // path to json file containing the initial account details
+	Journal           string            // optional path to the write-ahead journal, when empty transfers are not persisted
+	SnapshotDir       string            // optional directory for snapshots, when empty snapshots are disabled
+	SnapshotInterval  time.Duration     // interval between periodic snapshots, zero disables periodic snapshots
+	DefaultCurrency   string            // currency for accounts without one in the data file, USD when empty
+	FXRates           ds.FXRateProvider // optional exchange rates, when nil cross-currency transfers are rejected
+	Rules             *rules.Set        // optional transfer limits and velocity rules, when nil transfers are not limited
+	Fees              *fees.Schedule    // optional fee schedule of transfers, when nil transfers are free
+	Interest          *interest.Policy  // optional interest policy, when nil savings accounts cannot be created
+	InterestInterval  time.Duration     // interval between the checks for days to accrue, DefaultInterestInterval when zero
+	Clock             clock.Clock       // optional source of the current time, the system time when nil
+	IdempotencyWindow time.Duration     // time an idempotency key is remembered, DefaultIdempotencyWindow when zero
+	HoldExpiry        time.Duration     // time until a hold expires, DefaultHoldExpiry when zero
+	HoldSweepInterval time.Duration     // interval between the sweeps for expired holds, DefaultHoldSweepInterval when zero
+	Approvals         *approvals.Policy // optional approval policy, when nil transfers never wait for approval
 }
 
+// currency assumed for accounts without one in the data file
+const defaultCurrency = "USD"
+
 // Load Account data from a file.
 //
 // Account data is expected in jason format in the specified file.
+// Transfers performed on the returned datastore are not persisted. No
+// background goroutine is started, expired holds are not swept.
 func Load(filename string) (*datastore, error) {
+	return open(Config{DataFile: filename}, false)
+}
+
+// Open the datastore using the given configuration.
+//
+// Starts from the newest valid snapshot when one is available, otherwise
+// loads the Account data from the data file. When a journal is configured,
+// replays the journaled transfers not contained in the snapshot on top of it.
+// Expired holds are swept in the background until the datastore is closed.
+func Open(cfg Config) (*datastore, error) {
+	return open(cfg, true)
+}
+
+// Open the datastore, sweeping expired holds in the background when sweep is set.
+func open(cfg Config, sweep bool) (*datastore, error) {
+	// the funds of a pending transfer are held until it expires
+	if cfg.Approvals != nil && cfg.Approvals.Expiry() > MaxHoldExpiry {
+		log.Printf("[memds]invalid approval expiry: %v\n", cfg.Approvals.Expiry())
+		return nil, fmt.Errorf("invalid approval expiry: %v, expecting at most %v", cfg.Approvals.Expiry(), MaxHoldExpiry)
+	}
+
+	var d *datastore
+	if cfg.SnapshotDir != "" {
+		if err := os.MkdirAll(cfg.SnapshotDir, 0755); err != nil {
+			log.Printf("[memds]failed to create snapshot directory: %s - %s\n", cfg.SnapshotDir, err)
+			return nil, err
+		}
+		snap, err := loadLatestSnapshot(cfg.SnapshotDir)
+		if err != nil {
+			return nil, err
+		}
+		if snap != nil {
+			d = fromSnapshot(snap)
+		}
+	}
+	currency := cfg.DefaultCurrency
+	if currency == "" {
+		currency = defaultCurrency
+	}
+	if d == nil {
+		var err error
+		d, err = loadFile(cfg.DataFile, currency)
+		if err != nil {
+			return nil, err
+		}
+	}
+	d.currency = currency
+	d.snapshotDir = cfg.SnapshotDir
+	d.fx = cfg.FXRates
+	d.rules = cfg.Rules
+	d.fees = cfg.Fees
+	d.interest = cfg.Interest
+	d.approvals = cfg.Approvals
+	if cfg.Clock != nil {
+		d.clock = cfg.Clock
+	}
+	d.idempotencyWindow = cfg.IdempotencyWindow
+	if d.idempotencyWindow <= 0 {
+		d.idempotencyWindow = DefaultIdempotencyWindow
+	}
+	d.holdExpiry = cfg.HoldExpiry
+	if d.holdExpiry <= 0 {
+		d.holdExpiry = DefaultHoldExpiry
+	}
+
+	if cfg.Journal != "" {
+		j, entries, err := openJournal(cfg.Journal)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.replay(entries); err != nil {
+			j.close()
+			log.Printf("[memds]failed to replay journal: %s - %s\n", cfg.Journal, err)
+			return nil, err
+		}
+		d.journal = j
+		log.Printf("[memds]journal replay complete, next transaction id: %v\n", d.nextTid)
+	}
+
+	// the revenue accounts of the fees need to exist
+	if err := d.checkFeeAccounts(); err != nil {
+		if d.journal != nil {
+			d.journal.close()
+		}
+		log.Printf("[memds]invalid fee schedule - %s\n", err)
+		return nil, err
+	}
+
+	// the savings accounts need an expense account paying their interest
+	if err := d.checkInterestAccounts(); err != nil {
+		if d.journal != nil {
+			d.journal.close()
+		}
+		log.Printf("[memds]invalid interest policy - %s\n", err)
+		return nil, err
+	}
+
+	// readers see the loaded state
+	d.initVersions()
+
+	// start periodic snapshots
+	d.stop = make(chan struct{})
+	if d.snapshotDir != "" && cfg.SnapshotInterval > 0 {
+		d.wg.Add(1)
+		go d.snapshotLoop(cfg.SnapshotInterval)
+		log.Printf("[memds]periodic snapshots every %v\n", cfg.SnapshotInterval)
+	}
+
+	// start expiring holds
+	if sweep {
+		interval := cfg.HoldSweepInterval
+		if interval <= 0 {
+			interval = DefaultHoldSweepInterval
+		}
+		d.wg.Add(1)
+		go d.holdLoop(interval)
+	}
+
+	// start accruing interest, catching up with the days passed while stopped
+	if d.interest != nil {
+		if err := d.accrueInterest(); err != nil {
+			log.Printf("[memds]failed to accrue interest - %s\n", err)
+		}
+		interval := cfg.InterestInterval
+		if interval <= 0 {
+			interval = DefaultInterestInterval
+		}
+		d.wg.Add(1)
+		go d.interestLoop(interval)
+	}
+
+	return d, nil
+}
+
+// Load Account data from a json file and construct the datastore.
+//
+// Accounts without a currency are assigned the given default currency.
+func loadFile(filename string, currency string) (*datastore, error) {
 	log.Printf("[memds]loading data from file: %v\n", filename)
 
 	// open the json file
@@ -46,6 +278,7 @@ func Load(filename string) (*datastore, error) {
 		log.Printf("[memds]failed to open file: %s - %s\n", filename, err)
 		return nil, err
 	}
+	defer f.Close()
 
 	// read the contents of the file to an array, jbytes
 	jbytes := make([]byte, 0, 32*1024) // initial size 32K for json bytes container
@@ -75,7 +308,65 @@ func Load(filename string) (*datastore, error) {
 	}
 	log.Println("[memds]json data unmarshall complete")
 
-	// populate index and record locks
+	// validate the currency, balances are held in the minor units of the currency
+	for i := range accounts {
+		if ledger.IsSystem(accounts[i].Id) {
+			log.Printf("[memds]reserved account id: %v in file: %s\n", accounts[i].Id, filename)
+			return nil, fmt.Errorf("invalid account id: %v, ids starting with %q are reserved", accounts[i].Id, ledger.SystemPrefix)
+		}
+		if accounts[i].Currency == "" {
+			accounts[i].Currency = currency
+		}
+		c, err := money.LookupCurrency(accounts[i].Currency)
+		if err != nil {
+			log.Printf("[memds]invalid currency for account id: %v in file: %s - %s\n", accounts[i].Id, filename, err)
+			return nil, fmt.Errorf("invalid currency for account id: %v - %v", accounts[i].Id, err)
+		}
+		accounts[i].Currency = c.Code
+		b, err := accounts[i].Balance.Rescale(c.Exponent)
+		if err != nil {
+			log.Printf("[memds]invalid balance for account id: %v in file: %s - %s\n", accounts[i].Id, filename, err)
+			return nil, fmt.Errorf("invalid balance for account id: %v - %v", accounts[i].Id, err)
+		}
+		accounts[i].Balance = b
+		accounts[i].Available = b
+		limit, err := checkOverdraftLimit(accounts[i].OverdraftLimit, c.Code)
+		if err != nil {
+			log.Printf("[memds]invalid overdraft limit for account id: %v in file: %s - %s\n", accounts[i].Id, filename, err)
+			return nil, fmt.Errorf("invalid overdraft limit for account id: %v - %v", accounts[i].Id, err)
+		}
+		accounts[i].OverdraftLimit = limit
+		accounts[i].Type, err = checkAccountType(accounts[i].Type, accounts[i].InterestRate)
+		if err != nil {
+			log.Printf("[memds]invalid type for account id: %v in file: %s - %s\n", accounts[i].Id, filename, err)
+			return nil, fmt.Errorf("invalid type for account id: %v - %v", accounts[i].Id, err)
+		}
+		if accounts[i].Status == "" {
+			accounts[i].Status = ds.StatusActive
+		}
+		if !validStatus(accounts[i].Status) {
+			log.Printf("[memds]invalid status for account id: %v in file: %s - %s\n", accounts[i].Id, filename, accounts[i].Status)
+			return nil, fmt.Errorf("invalid status for account id: %v - %v", accounts[i].Id, accounts[i].Status)
+		}
+	}
+
+	// construct the in-memory datastore and return
+	d := newDatastore(accounts)
+	d.nextTid = 1 // initial transaction id
+	for i := range accounts {
+		if err := d.checkOpening(accounts[i]); err != nil {
+			log.Printf("[memds]invalid balance for account id: %v in file: %s - %s\n", accounts[i].Id, filename, err)
+			return nil, fmt.Errorf("invalid balance for account id: %v - %v", accounts[i].Id, err)
+		}
+		d.postOpening(accounts[i])
+	}
+	log.Println("[memds]datastore initialization complete")
+
+	return d, nil
+}
+
+// Construct the datastore for the given accounts, populating index and record locks.
+func newDatastore(accounts []ds.Account) *datastore {
 	n := len(accounts)
 	index := make(map[string]int, n)
 	locks := make([]sync.Mutex, n)
@@ -85,20 +376,274 @@ func Load(filename string) (*datastore, error) {
 	}
 	log.Printf("[memds]indexing complete")
 
-	// construct the in-memory datastore and return
 	d := new(datastore)
 	d.accounts = accounts
 	d.index = index
 	d.locks = locks
-	d.nextTid = 1 // initial transaction id
-	log.Println("[memds]datastore initialization complete")
+	d.tidIndex = make(map[uint64]int)
+	d.idempotency = make(map[string]*idempotencyRecord)
+	d.byAccount = make(map[string]*accountTransactions, n)
+	d.ledger = ledger.New()
+	d.overdraftEvents = make(map[string][]ds.OverdraftEvent)
+	d.holds = make(map[uint64]*ds.Hold)
+	d.activeHolds = make(map[uint64]*ds.Hold)
+	d.nextHold = 1  // initial hold id
+	d.nextBatch = 1 // initial batch id
+	d.pending = make(map[uint64]*ds.PendingTransfer)
+	d.nextPending = 1 // initial pending transfer id
+	d.accruals = make(map[string]*accrual)
+	d.clock = clock.Real{}
+	return d
+}
 
-	return d, nil
+// Apply the journaled entries on top of the loaded Account data.
+//
+// The entries were validated when they were first recorded,
+// so they are applied without checking the balances. Returns error if an
+// entry is missing from the journal or refers to unknown data.
+func (d *datastore) replay(entries []journalEntry) error {
+	for _, e := range entries {
+		// skip the entries already contained in the snapshot
+		if e.Lsn <= d.lsn {
+			continue
+		}
+		// a missing entry would leave the balances different from the committed ones
+		if e.Lsn != d.lsn+1 {
+			log.Printf("[memds]journal gap, expecting lsn: %v, found: %v\n", d.lsn+1, e.Lsn)
+			return fmt.Errorf("journal gap, expecting lsn: %v, found: %v", d.lsn+1, e.Lsn)
+		}
+
+		switch e.Op {
+		case opTransfer:
+			si, ok := d.index[e.From]
+			if !ok {
+				return fmt.Errorf("journal lsn: %v refers to unknown account id: %v", e.Lsn, e.From)
+			}
+			di, ok := d.index[e.To]
+			if !ok {
+				return fmt.Errorf("journal lsn: %v refers to unknown account id: %v", e.Lsn, e.To)
+			}
+			// same currency transfers journal only the amount
+			toAmount := e.Amount
+			if e.ToCurrency != "" {
+				toAmount = e.ToAmount
+			}
+			t := transaction{
+				tid:        e.Tid,
+				date:       e.Date,
+				from:       e.From,
+				to:         e.To,
+				amount:     e.Amount,
+				currency:   e.Currency,
+				toAmount:   toAmount,
+				toCurrency: d.accounts[di].Currency,
+				rate:       e.Rate,
+			}
+			if e.Fee != nil {
+				if _, ok := d.index[e.FeeTo]; !ok {
+					return fmt.Errorf("journal lsn: %v refers to unknown account id: %v", e.Lsn, e.FeeTo)
+				}
+				t.fee, t.feeTo = *e.Fee, e.FeeTo
+			}
+			var approved *ds.PendingTransfer
+			if e.PendingId != 0 {
+				p, ok := d.pending[e.PendingId]
+				if !ok || p.Status != ds.PendingAwaiting {
+					return fmt.Errorf("journal lsn: %v refers to unknown or inactive pending transfer id: %v", e.Lsn, e.PendingId)
+				}
+				d.applyApproval(si, p, t, e.Principal)
+				copied := *p
+				approved = &copied
+			}
+			d.applyTransfer(si, di, t)
+			if e.IdempotencyKey != "" {
+				d.storeIdempotencyKey(e.IdempotencyKey, e.RequestHash, e.Date, ds.TransferResult{
+					Tid:        e.Tid,
+					Balance:    d.accounts[si].Balance,
+					Currency:   e.Currency,
+					Amount:     e.Amount,
+					ToAmount:   toAmount,
+					ToCurrency: d.accounts[di].Currency,
+					Rate:       e.Rate,
+					Fee:        t.fee,
+					Pending:    approved,
+				})
+			}
+			if e.Tid >= d.nextTid {
+				d.nextTid = e.Tid + 1
+			}
+		case opBatch:
+			for _, leg := range e.Legs {
+				si, ok := d.index[leg.From]
+				if !ok {
+					return fmt.Errorf("journal lsn: %v refers to unknown account id: %v", e.Lsn, leg.From)
+				}
+				di, ok := d.index[leg.To]
+				if !ok {
+					return fmt.Errorf("journal lsn: %v refers to unknown account id: %v", e.Lsn, leg.To)
+				}
+				t := transaction{
+					tid:        leg.Tid,
+					date:       e.Date,
+					from:       leg.From,
+					to:         leg.To,
+					amount:     leg.Amount,
+					currency:   leg.Currency,
+					toAmount:   leg.ToAmount,
+					toCurrency: leg.ToCurrency,
+					rate:       leg.Rate,
+					batch:      e.Batch,
+				}
+				if leg.Fee != nil {
+					if _, ok := d.index[leg.FeeTo]; !ok {
+						return fmt.Errorf("journal lsn: %v refers to unknown account id: %v", e.Lsn, leg.FeeTo)
+					}
+					t.fee, t.feeTo = *leg.Fee, leg.FeeTo
+				}
+				d.applyTransfer(si, di, t)
+				if leg.Tid >= d.nextTid {
+					d.nextTid = leg.Tid + 1
+				}
+			}
+		case opInterest:
+			if e.Day == nil {
+				return fmt.Errorf("journal lsn: %v has no interest day", e.Lsn)
+			}
+			if _, err := d.applyInterest(&e); err != nil {
+				return fmt.Errorf("journal lsn: %v - %v", e.Lsn, err)
+			}
+		case opCreateAccount:
+			if e.Account == nil {
+				return fmt.Errorf("journal lsn: %v has no account details", e.Lsn)
+			}
+			if _, ok := d.index[e.Account.Id]; ok {
+				return fmt.Errorf("journal lsn: %v creates existing account id: %v", e.Lsn, e.Account.Id)
+			}
+			// a new account has no holds, accounts created before types are checking accounts
+			a := *e.Account
+			a.Available = a.Balance
+			if a.Type == "" {
+				a.Type = ds.TypeChecking
+			}
+			d.appendAccount(a)
+		case opUpdateAccount:
+			if e.Account == nil {
+				return fmt.Errorf("journal lsn: %v has no account details", e.Lsn)
+			}
+			i, ok := d.index[e.Account.Id]
+			if !ok {
+				return fmt.Errorf("journal lsn: %v refers to unknown account id: %v", e.Lsn, e.Account.Id)
+			}
+			d.accounts[i].Name = e.Account.Name
+			d.accounts[i].Status = e.Account.Status
+			d.accounts[i].OverdraftLimit = e.Account.OverdraftLimit
+			d.accounts[i].InterestRate = e.Account.InterestRate
+		case opRefund:
+			i, ok := d.tidIndex[e.RefundOf]
+			if !ok {
+				return fmt.Errorf("journal lsn: %v refers to unknown transaction id: %v", e.Lsn, e.RefundOf)
+			}
+			si, ok := d.index[e.From]
+			if !ok {
+				return fmt.Errorf("journal lsn: %v refers to unknown account id: %v", e.Lsn, e.From)
+			}
+			di, ok := d.index[e.To]
+			if !ok {
+				return fmt.Errorf("journal lsn: %v refers to unknown account id: %v", e.Lsn, e.To)
+			}
+			d.applyRefund(i, si, di, transaction{tid: e.Tid, date: e.Date, from: e.From, to: e.To, amount: e.Amount, currency: e.Currency, toAmount: e.ToAmount, toCurrency: e.ToCurrency, refundOf: e.RefundOf})
+			if e.Tid >= d.nextTid {
+				d.nextTid = e.Tid + 1
+			}
+		case opCreateHold:
+			si, ok := d.index[e.From]
+			if !ok {
+				return fmt.Errorf("journal lsn: %v refers to unknown account id: %v", e.Lsn, e.From)
+			}
+			if _, ok := d.index[e.To]; !ok {
+				return fmt.Errorf("journal lsn: %v refers to unknown account id: %v", e.Lsn, e.To)
+			}
+			if e.Expires == nil {
+				return fmt.Errorf("journal lsn: %v has no hold expiry", e.Lsn)
+			}
+			d.applyHold(si, ds.Hold{Id: e.HoldId, AccountId: e.From, ToId: e.To, Amount: e.Amount, Fee: e.Fee, Currency: e.Currency, Status: ds.HoldActive, Created: e.Date, Expires: *e.Expires})
+		case opCreatePending:
+			si, ok := d.index[e.From]
+			if !ok {
+				return fmt.Errorf("journal lsn: %v refers to unknown account id: %v", e.Lsn, e.From)
+			}
+			if _, ok := d.index[e.To]; !ok {
+				return fmt.Errorf("journal lsn: %v refers to unknown account id: %v", e.Lsn, e.To)
+			}
+			if e.Expires == nil {
+				return fmt.Errorf("journal lsn: %v has no pending transfer expiry", e.Lsn)
+			}
+			var fee money.Money
+			if e.Fee != nil {
+				fee = *e.Fee
+			}
+			h := ds.Hold{Id: e.HoldId, AccountId: e.From, ToId: e.To, Amount: e.Amount.Add(fee), Currency: e.Currency, Status: ds.HoldActive, Created: e.Date, Expires: *e.Expires, PendingId: e.PendingId}
+			p := ds.PendingTransfer{Id: e.PendingId, FromId: e.From, ToId: e.To, Amount: e.Amount, Currency: e.Currency, Convert: e.Convert, HoldId: e.HoldId, Status: ds.PendingAwaiting, RequestedBy: e.Principal, Requested: e.Date, Expires: *e.Expires}
+			d.applyPending(si, h, p)
+			if e.IdempotencyKey != "" {
+				d.storeIdempotencyKey(e.IdempotencyKey, e.RequestHash, e.Date, pendingResult(d.accounts[si].Balance, p, fee))
+			}
+		case opRejectPending:
+			p, ok := d.pending[e.PendingId]
+			if !ok || p.Status != ds.PendingAwaiting {
+				return fmt.Errorf("journal lsn: %v refers to unknown or inactive pending transfer id: %v", e.Lsn, e.PendingId)
+			}
+			d.applyRejection(d.index[p.FromId], p, e.Principal, e.Reason, e.Date)
+		case opCaptureHold, opVoidHold, opExpireHold:
+			h, ok := d.holds[e.HoldId]
+			if !ok || h.Status != ds.HoldActive {
+				return fmt.Errorf("journal lsn: %v refers to unknown or inactive hold id: %v", e.Lsn, e.HoldId)
+			}
+			si, di := d.index[h.AccountId], d.index[h.ToId]
+			switch e.Op {
+			case opCaptureHold:
+				t := transaction{tid: e.Tid, date: e.Date, from: h.AccountId, to: h.ToId, amount: e.Amount, currency: h.Currency, toAmount: e.Amount, toCurrency: h.Currency}
+				if e.Fee != nil {
+					if _, ok := d.index[e.FeeTo]; !ok {
+						return fmt.Errorf("journal lsn: %v refers to unknown account id: %v", e.Lsn, e.FeeTo)
+					}
+					t.fee, t.feeTo = *e.Fee, e.FeeTo
+				}
+				d.applyCapture(si, di, h, t)
+				if e.Tid >= d.nextTid {
+					d.nextTid = e.Tid + 1
+				}
+			case opVoidHold:
+				d.applyRelease(si, h, ds.HoldVoided, e.Date)
+			case opExpireHold:
+				d.applyRelease(si, h, ds.HoldExpired, e.Date)
+			}
+		default:
+			return fmt.Errorf("journal lsn: %v has unknown operation: %v", e.Lsn, e.Op)
+		}
+		d.lsn = e.Lsn
+	}
+	d.expireIdempotencyKeys(d.clock.Now())
+	return nil
+}
+
+// Close the datastore, stopping the periodic snapshots and releasing the journal file.
+func (d *datastore) Close() error {
+	close(d.stop)
+	d.wg.Wait()
+
+	if d.journal == nil {
+		return nil
+	}
+	return d.journal.close()
 }
 
 // Locks the whole table by acquiring all the row locks.
+//
+// No accounts can be created until the table is unlocked.
 func (d *datastore) lockTable() {
 	log.Println("[memds]attempting to lock table")
+	d.alock.RLock()
 
 	// acquire all the row locks
 	// we need to lock in ascending order to rows to prevent deadlock
@@ -117,30 +662,38 @@ func (d *datastore) unlockTable() {
 	for i := len(d.locks) - 1; i >= 0; i-- {
 		d.locks[i].Unlock()
 	}
+	d.alock.RUnlock()
 	log.Println("[memds]table unlocked")
 }
 
-// List all the Accounts in the datastore.
+// Locks the rows of the accounts at the given positions.
 //
-// Note: Expensive opertion. Datastore is locked until
-// a copy of all the accounts is completed.
-func (d *datastore) List() []ds.Account {
-	log.Printf("[memds]List() called")
-
-	// to prevent concurrent access to the accounts data
-	// lock the whole table until we are done
-	d.lockTable()
-
-	// make a copy of all the accounts
-	dst := make([]ds.Account, len(d.accounts))
-	copy(dst, d.accounts)
-	log.Println("[memds]List: copy complete")
-
-	// we are done, release the table
-	d.unlockTable()
+// Rows are locked in ascending order of indexes, like lockTable, to prevent
+// dead lock, and each row once. Returns the rows locked, to be unlocked using
+// unlockRows. Caller must hold alock shared.
+func (d *datastore) lockRows(rows ...int) []int {
+	locked := append([]int(nil), rows...)
+	sort.Ints(locked)
+	n := 0
+	for i, row := range locked {
+		if i > 0 && row == locked[n-1] {
+			continue
+		}
+		locked[n] = row
+		n++
+	}
+	locked = locked[:n]
+	for _, row := range locked {
+		d.locks[row].Lock()
+	}
+	return locked
+}
 
-	log.Println("[memds]returing from List()")
-	return dst
+// Unlocks the rows locked using lockRows, in decending order of indexes.
+func (d *datastore) unlockRows(locked []int) {
+	for i := len(locked) - 1; i >= 0; i-- {
+		d.locks[locked[i]].Unlock()
+	}
 }
 
 // Get the Account details for the given account-id.
@@ -149,11 +702,14 @@ func (d *datastore) List() []ds.Account {
 func (d *datastore) Get(id string) (ds.Account, error) {
 	log.Printf("[memds]Get() called with id: %v\n", id)
 
+	d.alock.RLock()
+	defer d.alock.RUnlock()
+
 	// find the location of the Account given its id using index
 	i, ok := d.index[id]
 	if !ok {
 		log.Printf("[memds]Get: account with id: %v does not exist\n", id)
-		return ds.Account{}, fmt.Errorf("account with id: %v does not exist", id)
+		return ds.Account{}, ds.Errorf(ds.ErrAccountNotFound, "account with id: %v does not exist", id)
 	}
 
 	// lock this Account to prevent concurrent access
@@ -164,74 +720,336 @@ func (d *datastore) Get(id string) (ds.Account, error) {
 	return ds.Account(d.accounts[i]), nil
 }
 
-// Transfer amount from and to the specified accounts.
+// validated transfer, positions of the accounts and the amounts of both legs
+type transferLeg struct {
+	si         int         // position of the from account
+	di         int         // position of the to account
+	amount     money.Money // amount debited, in the currency of the from account
+	currency   string      // currency of the from account
+	toAmount   money.Money // amount credited, in the currency of the to account
+	toCurrency string      // currency of the to account
+	rate       money.Rate  // exchange rate applied, zero when no conversion was needed
+	fee        money.Money // fee debited from the from account, in its currency
+	fi         int         // position of the revenue account credited with the fee, when feeTo is not empty
+	feeTo      string      // revenue account credited with the fee, empty when no fee is charged
+}
+
+// Returns the rows of the accounts of the transfer, including the revenue account.
+func (leg *transferLeg) rows() []int {
+	if leg.feeTo != "" {
+		return []int{leg.si, leg.di, leg.fi}
+	}
+	return []int{leg.si, leg.di}
+}
+
+// Returns the amount debited from the from account, including the fee.
+func (leg *transferLeg) debit() money.Money {
+	return leg.amount.Add(leg.fee)
+}
+
+// Check the balances of the to account and of the revenue account stay in range when credited.
 //
-// Returns transaction-id and account balance for from-account on success.
-// Returns error is any of the from/to account id is invalid or
-// the available balance in the from account is insufficient to do the transfer
-func (d *datastore) Transfer(from string, to string, amount float64) (uint64, float64, error) {
-	log.Printf("[memds]Transfer() called with from: %v, to: %v, amount: %v\n", from, to, amount)
+// Caller must hold the row locks of the accounts.
+func (d *datastore) checkCredits(leg *transferLeg) error {
+	if _, err := checkCredit(&d.accounts[leg.di], d.accounts[leg.di].Balance, leg.toAmount); err != nil {
+		return err
+	}
+	if leg.feeTo != "" {
+		if _, err := checkCredit(&d.accounts[leg.fi], d.accounts[leg.fi].Balance, leg.fee); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate the transfer, convert the amount and compute the fee, without locking the accounts.
+//
+// Returns error if any of the from/to account id is invalid, the accounts are
+// in different currencies and conversion is not possible, or the amount is
+// negative or has more decimals than the currency allows. Caller must hold
+// alock shared.
+func (d *datastore) checkTransfer(req ds.TransferRequest) (transferLeg, error) {
+	from, to, amount := req.From, req.To, req.Amount
 
 	// find the location of the from Account given its id using index
 	si, ok := d.index[from] // si - source index
 	if !ok {
 		log.Printf("[memds]Transfer: from account with id: %v does not exist\n", from)
-		return 0, 0, fmt.Errorf("from account with id: %v does not exist", from)
+		return transferLeg{}, ds.Errorf(ds.ErrAccountNotFound, "from account with id: %v does not exist", from)
 	}
 
 	// find the location of the to Account given its id using index
 	di, ok := d.index[to] // di - destination index
 	if !ok {
 		log.Printf("[memds]Transfer: to account with id: %v does not exist\n", to)
-		return 0, 0, fmt.Errorf("to account with id: %v does not exist", to)
+		return transferLeg{}, ds.Errorf(ds.ErrAccountNotFound, "to account with id: %v does not exist", to)
 	}
 
 	// both from and to accounts cannot be same
 	if si == di {
 		log.Printf("[memds]Transfer: from account id: %s and to accound id: %s are same\n", from, to)
-		return 0, 0, fmt.Errorf("from account id: %s and to accound id: %s are same", from, to)
+		return transferLeg{}, ds.Errorf(ds.ErrSameAccount, "from account id: %s and to accound id: %s are same", from, to)
+	}
+
+	// amount needs to be exact in the minor units of the currency
+	// account currency never changes, it is safe to read without the row lock
+	currency := d.accounts[si].Currency
+	c, err := money.LookupCurrency(currency)
+	if err != nil {
+		return transferLeg{}, err
+	}
+	if amount.Sign() < 0 {
+		log.Printf("[memds]Transfer: transfer amount: %v cannot be a negative value\n", amount)
+		return transferLeg{}, ds.Errorf(ds.ErrInvalidAmount, "transfer amount cannot be a negative value")
+	}
+	amount, err = amount.Rescale(c.Exponent)
+	if err != nil {
+		log.Printf("[memds]Transfer: invalid amount for currency %v - %v\n", currency, err)
+		return transferLeg{}, ds.Errorf(ds.ErrInvalidAmount, "invalid amount for currency %v - %v", currency, err)
+	}
+
+	// convert the amount when the accounts are in different currencies
+	leg := transferLeg{si: si, di: di, amount: amount, currency: currency, toAmount: amount, toCurrency: d.accounts[di].Currency}
+	if leg.toCurrency != currency {
+		leg.toAmount, leg.rate, err = d.convert(amount, currency, leg.toCurrency, req.Convert)
+		if err != nil {
+			log.Printf("[memds]Transfer: %v\n", err)
+			return transferLeg{}, err
+		}
+		log.Printf("[memds]Transfer: converted %v %v to %v %v at rate %v\n", amount, currency, leg.toAmount, leg.toCurrency, leg.rate)
 	}
+	if err := d.chargeFee(&leg); err != nil {
+		log.Printf("[memds]Transfer: %v\n", err)
+		return transferLeg{}, err
+	}
+	return leg, nil
+}
 
-	// lock both from and to accounts to prevent concurrent access
-	// lock these accounts in ascending order of indexes to prevent dead lock
-	var a1, a2 int // lock a1 account first and then a2
-	if si < di {
-		a1 = si
-		a2 = di
-	} else {
-		a1 = di
-		a2 = si
+// Returns the transaction record for the transfer.
+func (leg *transferLeg) transaction(d *datastore, tid uint64, date time.Time) transaction {
+	return transaction{
+		tid:        tid,
+		date:       date,
+		from:       d.accounts[leg.si].Id,
+		to:         d.accounts[leg.di].Id,
+		amount:     leg.amount,
+		currency:   leg.currency,
+		toAmount:   leg.toAmount,
+		toCurrency: leg.toCurrency,
+		rate:       leg.rate,
+		fee:        leg.fee,
+		feeTo:      leg.feeTo,
 	}
-	d.locks[a1].Lock()
-	d.locks[a2].Lock()
-	defer d.locks[a2].Unlock()
-	defer d.locks[a1].Unlock()
+}
 
-	// check if we have sufficient funds
-	if (d.accounts[si].Balance - amount) < 0 {
-		log.Printf("[memds]Transfer: account id: %s does not have sufficient funds, available balance: %v\n", from, d.accounts[si].Balance)
-		return 0, 0, fmt.Errorf("account id: %v does not have sufficient funds, available balance: %v", from, d.accounts[si].Balance)
+// Apply the transfer transaction to the accounts.
+//
+// Caller must hold the row locks of both accounts and of the revenue account
+// of the fee, and tlock.
+func (d *datastore) applyTransfer(si int, di int, t transaction) {
+	d.appendTransaction(t)
+	d.moveBalances(si, di, &t)
+	d.accounts[si].Available = d.accounts[si].Available.Sub(t.amount).Sub(t.fee)
+	d.accounts[di].Available = d.accounts[di].Available.Add(t.toAmount)
+	if t.feeTo != "" {
+		fi := d.index[t.feeTo]
+		d.accounts[fi].Available = d.accounts[fi].Available.Add(t.fee)
+	}
+}
+
+// Transfer amount from and to the specified accounts.
+//
+// Returns transaction-id and account balance for from-account on success.
+// A transfer requiring approval above the approval threshold is not executed,
+// its funds are held and the result has the pending transfer.
+// Returns error is any of the from/to account id is invalid,
+// the accounts are in different currencies and conversion is not requested,
+// any of the accounts is not active,
+// the amount is negative or has more decimals than the currency allows or
+// the available balance in the from account is insufficient to do the transfer
+// and pay its fee. The errors wrap one of the ds.Err* kinds.
+func (d *datastore) Transfer(req ds.TransferRequest) (ds.TransferResult, error) {
+	log.Printf("[memds]Transfer() called with from: %v, to: %v, amount: %v\n", req.From, req.To, req.Amount)
+	return d.transfer(req, nil)
+}
+
+// Transfer amount from and to the specified accounts, see Transfer.
+//
+// A transfer approving the pending transfer p releases the funds held for it
+// and records the principal of the request as the approver.
+func (d *datastore) transfer(req ds.TransferRequest, p *ds.PendingTransfer) (ds.TransferResult, error) {
+	from, to := req.From, req.To
+
+	// a transfer with an idempotency key is executed at most once
+	committed := false
+	if req.IdempotencyKey != "" {
+		res, replayed, err := d.reserveIdempotencyKey(req.IdempotencyKey, req.RequestHash)
+		if err != nil || replayed {
+			return res, err
+		}
+		// release the key if the transfer fails, after the row locks are released
+		defer func() {
+			if !committed {
+				d.releaseIdempotencyKey(req.IdempotencyKey)
+			}
+		}()
+	}
+
+	// accounts cannot be added while the transfer holds the index positions
+	d.alock.RLock()
+	defer d.alock.RUnlock()
+
+	leg, err := d.checkTransfer(req)
+	if err != nil {
+		return ds.TransferResult{}, err
+	}
+	si, di, amount := leg.si, leg.di, leg.amount
+
+	// lock both from and to accounts, and the revenue account of the fee, to prevent concurrent access
+	locked := d.lockRows(leg.rows()...)
+	defer d.unlockRows(locked)
+
+	// both accounts and the revenue account of the fee need to be active
+	for _, i := range leg.rows() {
+		if d.accounts[i].Status != ds.StatusActive {
+			log.Printf("[memds]Transfer: account id: %v is %v\n", d.accounts[i].Id, d.accounts[i].Status)
+			return ds.TransferResult{}, ds.Errorf(ds.ErrAccountInactive, "account id: %v is %v", d.accounts[i].Id, d.accounts[i].Status)
+		}
+	}
+
+	// the funds held for the pending transfer approved are available to it
+	available := spendable(&d.accounts[si])
+	if p != nil {
+		h, err := d.checkPendingActive(si, p)
+		if err != nil {
+			log.Printf("[memds]Transfer: %v\n", err)
+			return ds.TransferResult{}, err
+		}
+		available = capped(available, h.Amount)
+	}
+
+	// check if we have sufficient funds for the amount and the fee, held funds cannot be transferred
+	if available.Cmp(leg.debit()) < 0 {
+		log.Printf("[memds]Transfer: account id: %s does not have sufficient funds, available balance: %v, overdraft limit: %v\n", from, d.accounts[si].Available, d.accounts[si].OverdraftLimit)
+		return ds.TransferResult{}, ds.Errorf(ds.ErrInsufficientFunds, "account id: %v does not have sufficient funds, available balance: %v, overdraft limit: %v", from, d.accounts[si].Available, d.accounts[si].OverdraftLimit)
+	}
+	if err := d.checkCredits(&leg); err != nil {
+		return ds.TransferResult{}, err
 	}
 
 	// add a transaction entry
 	d.tlock.Lock()
-	t := transaction{
-		tid:    d.nextTid,
-		date:   time.Now(),
-		from:   from,
-		to:     to,
-		amount: amount,
+	t := leg.transaction(d, d.nextTid, d.transactionDate())
+
+	// the rules see the debits committed before this transfer
+	if err := d.checkRules(si, amount, t.date, nil); err != nil {
+		d.tlock.Unlock()
+		return ds.TransferResult{}, err
+	}
+
+	// a transfer above the approval threshold waits for approval, holding its funds,
+	// refunds are exempt as they return at most what such a transfer moved, see refunds.go
+	if p == nil && req.RequireApproval && d.approvals.Requires(amount, t.currency) {
+		res, err := d.placePending(req, &leg, t.date)
+		if err == nil {
+			d.commitVersions(locked...)
+			if req.IdempotencyKey != "" {
+				d.storeIdempotencyKey(req.IdempotencyKey, req.RequestHash, t.date, res)
+				committed = true
+			}
+		}
+		d.tlock.Unlock()
+		return res, err
+	}
+
+	// persist the transfer before applying it
+	if d.journal != nil {
+		e := journalEntry{Lsn: d.lsn + 1, Op: opTransfer, Tid: t.tid, Date: t.date, From: from, To: to, Amount: amount, Currency: t.currency}
+		if !t.rate.IsZero() {
+			e.ToAmount = t.toAmount
+			e.ToCurrency = t.toCurrency
+			e.Rate = t.rate
+		}
+		if t.feeTo != "" {
+			e.Fee = &t.fee
+			e.FeeTo = t.feeTo
+		}
+		e.IdempotencyKey = req.IdempotencyKey
+		e.RequestHash = req.RequestHash
+		if p != nil {
+			e.PendingId = p.Id
+			e.Principal = req.Principal
+		}
+		if err := d.journal.append(&e); err != nil {
+			d.tlock.Unlock()
+			log.Printf("[memds]Transfer: failed to write journal - %v\n", err)
+			return ds.TransferResult{}, fmt.Errorf("failed to write journal - %v", err)
+		}
 	}
+	d.lsn += 1
 	d.nextTid += 1
-	d.transactions = append(d.transactions, t)
+
+	// do the transfer, readers see the accounts change at once
+	if p != nil {
+		d.applyApproval(si, p, t, req.Principal)
+	}
+	d.applyTransfer(si, di, t)
+	d.commitVersions(locked...)
+	res := ds.TransferResult{
+		Tid:        t.tid,
+		Balance:    d.accounts[si].Balance,
+		Currency:   t.currency,
+		Amount:     amount,
+		ToAmount:   t.toAmount,
+		ToCurrency: t.toCurrency,
+		Rate:       t.rate,
+		Fee:        t.fee,
+	}
+	if p != nil {
+		approved := *p
+		res.Pending = &approved
+	}
+
+	// remember the result for retries with the same idempotency key
+	if req.IdempotencyKey != "" {
+		d.storeIdempotencyKey(req.IdempotencyKey, req.RequestHash, t.date, res)
+		committed = true
+	}
 	d.tlock.Unlock()
 
-	// do the transfer
-	d.accounts[si].Balance -= amount
-	d.accounts[di].Balance += amount
+	log.Printf("[memds]returning from Transfer() with tid: %v, balance: %v\n", t.tid, res.Balance)
+	return res, nil
+}
+
+// Convert the amount between the currencies using the exchange rate provider.
+//
+// Returns the converted amount and the rate applied. Returns error if conversion
+// is not requested, no rate is available or the converted amount is zero.
+func (d *datastore) convert(amount money.Money, from string, to string, requested bool) (money.Money, money.Rate, error) {
+	if !requested {
+		return money.Money{}, money.Rate{}, ds.Errorf(ds.ErrCurrencyMismatch, "from account currency: %v and to account currency: %v differ, conversion not requested", from, to)
+	}
+	if d.fx == nil {
+		return money.Money{}, money.Rate{}, ds.Errorf(ds.ErrRateUnavailable, "no exchange rates available to convert %v to %v", from, to)
+	}
+
+	rate, err := d.fx.Rate(from, to)
+	if err != nil {
+		return money.Money{}, money.Rate{}, ds.Errorf(ds.ErrRateUnavailable, "%v", err)
+	}
+	c, err := money.LookupCurrency(to)
+	if err != nil {
+		return money.Money{}, money.Rate{}, err
+	}
+	converted, err := amount.Convert(rate, c.Exponent)
+	if err != nil {
+		return money.Money{}, money.Rate{}, ds.Errorf(ds.ErrInvalidAmount, "failed to convert %v %v to %v - %v", amount, from, to, err)
+	}
+	if converted.IsZero() && !amount.IsZero() {
+		return money.Money{}, money.Rate{}, ds.Errorf(ds.ErrInvalidAmount, "amount %v %v is too small to convert to %v", amount, from, to)
+	}
 
-	log.Printf("[memds]returning from Transfer() with tid: %v, balance: %v\n", t.tid, d.accounts[si].Balance)
-	return t.tid, d.accounts[si].Balance, nil
+	return converted, rate, nil
 }
 
 // end-of-file
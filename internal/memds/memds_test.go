@@ -1,16 +1,34 @@
 package memds
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"paytabs/internal/approvals"
+	"paytabs/internal/clock"
 	"paytabs/internal/ds"
+	"paytabs/internal/fees"
+	"paytabs/internal/interest"
+	"paytabs/internal/ledger"
+	"paytabs/internal/money"
+	"paytabs/internal/rules"
 )
 
 const datafile string = "../../data/accounts-mock.json"
@@ -30,10 +48,24 @@ func TestMain(m *testing.M) {
 		fmt.Println("In-memory DataStore test setup failed. In-memory DataStore tests skipped.")
 		return
 	}
+
+	// mock data file has no currencies, statuses, holds, overdraft limits or types, accounts
+	// are loaded active with the default currency and all of their balance available
+	for i := range gAccounts {
+		gAccounts[i].Currency = "USD"
+		gAccounts[i].Status = ds.StatusActive
+		gAccounts[i].Available = gAccounts[i].Balance
+		gAccounts[i].OverdraftLimit = money.New(0, 2)
+		gAccounts[i].Type = ds.TypeChecking
+	}
+
+	// run the tests
+	os.Exit(m.Run())
 }
 
 func TestLoad(t *testing.T) {
 	// test loading the sample json accounts file paytabs/data/accounts-mock.json
+	n := runtime.NumGoroutine()
 	d, err := Load(datafile)
 	if err != nil {
 		t.Fatal("Failed to load json file")
@@ -42,6 +74,11 @@ func TestLoad(t *testing.T) {
 		t.Fatal("Failed to get datastore pointer")
 	}
 
+	// no goroutine is left running, the datastore need not be closed
+	if runtime.NumGoroutine() > n {
+		t.Fatalf("Expecting no background goroutines, %v running, %v before", runtime.NumGoroutine(), n)
+	}
+
 	// validate results
 	if !reflect.DeepEqual(gAccounts, d.accounts) {
 		t.Fatal("Loaded []Accounts data does not match with the expected")
@@ -75,43 +112,43 @@ func TestListParallel(t *testing.T) {
 
 func TestTransfer(t *testing.T) {
 	d, _ := Load(datafile)
-	amount := 1.5 // amount to transfer
+	amount := money.MustParse("1.5") // amount to transfer
 	// we know first gAccount[0] has more than 1.5 in its balance
-	_, bal, err := d.Transfer(gAccounts[0].Id, gAccounts[1].Id, amount)
+	res, err := d.Transfer(ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: amount})
 	if err != nil {
 		t.Fatalf("Failed to transfer funds")
 	}
-	expectedBalance := (gAccounts[0].Balance - amount)
-	if expectedBalance != bal {
-		t.Fatalf("Received an incorrect balance value, received: %v, expected: %v\n", bal, expectedBalance)
+	expectedBalance := gAccounts[0].Balance.Sub(amount)
+	if expectedBalance.Cmp(res.Balance) != 0 {
+		t.Fatalf("Received an incorrect balance value, received: %v, expected: %v\n", res.Balance, expectedBalance)
 	}
 }
 
 func TestTransferParallel(t *testing.T) {
 	d, _ := Load(datafile)
-	amount := 1.0
+	amount := money.MustParse("1.00")
 	for i := 0; i < 100; i++ {
 		name := fmt.Sprintf("%v", i)
 		t.Run(name, func(t *testing.T) {
 			t.Parallel()
 			// make sure there is no deadlock
-			d.Transfer(gAccounts[0].Id, gAccounts[1].Id, amount)
-			d.Transfer(gAccounts[1].Id, gAccounts[0].Id, amount)
+			d.Transfer(ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: amount})
+			d.Transfer(ds.TransferRequest{From: gAccounts[1].Id, To: gAccounts[0].Id, Amount: amount})
 		})
 	}
 }
 
 func TestListAndTransferParallel(t *testing.T) {
 	d, _ := Load(datafile)
-	amount := 1.0
+	amount := money.MustParse("1.00")
 	for i := 0; i < 100; i++ {
 		name := fmt.Sprintf("%v", i)
 		t.Run(name, func(t *testing.T) {
 			t.Parallel()
 			// make sure there is no deadlock
 			d.List()
-			d.Transfer(gAccounts[0].Id, gAccounts[1].Id, amount)
-			d.Transfer(gAccounts[1].Id, gAccounts[0].Id, amount)
+			d.Transfer(ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: amount})
+			d.Transfer(ds.TransferRequest{From: gAccounts[1].Id, To: gAccounts[0].Id, Amount: amount})
 			d.List()
 		})
 	}
@@ -133,13 +170,14 @@ func TestGet(t *testing.T) {
 func TestGetParallel(t *testing.T) {
 	d, _ := Load(datafile)
 	for i := 0; i < 100; i++ {
+		i := i
 		name := fmt.Sprintf("%v", i)
 		t.Run(name, func(t *testing.T) {
 			t.Parallel()
 			// make sure there is no deadlock
 			acct, _ := d.Get(gAccounts[i].Id)
 			// validate results
-			if acct != gAccounts[0] {
+			if acct != gAccounts[i] {
 				t.Fatal("Received account details does not match with the expected")
 			}
 		})
@@ -165,4 +203,2111 @@ func TestValidateTransferParallel(t *testing.T) {
 
 }
 
+func TestJournalReplay(t *testing.T) {
+	journal := filepath.Join(t.TempDir(), "bank.wal")
+	d, err := Open(Config{DataFile: datafile, Journal: journal})
+	if err != nil {
+		t.Fatalf("Failed to open datastore with journal - %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := d.Transfer(ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: money.MustParse("2.5")}); err != nil {
+			t.Fatalf("Failed to transfer funds - %v", err)
+		}
+	}
+	expected := d.List()
+	d.Close()
+
+	// reopen the datastore, journaled transfers should be replayed
+	d, err = Open(Config{DataFile: datafile, Journal: journal})
+	if err != nil {
+		t.Fatalf("Failed to reopen datastore with journal - %v", err)
+	}
+	defer d.Close()
+	if !reflect.DeepEqual(expected, d.List()) {
+		t.Fatal("Replayed []Accounts data does not match with the expected")
+	}
+	if len(d.transactions) != 10 || d.nextTid != 11 {
+		t.Fatalf("Expecting 10 transactions and next tid 11, got %v and %v", len(d.transactions), d.nextTid)
+	}
+
+	// transaction ids continue after the replayed ones
+	res, err := d.Transfer(ds.TransferRequest{From: gAccounts[1].Id, To: gAccounts[0].Id, Amount: money.MustParse("1")})
+	if err != nil {
+		t.Fatalf("Failed to transfer funds - %v", err)
+	}
+	if res.Tid != 11 {
+		t.Fatalf("Expecting transaction id 11, got %v", res.Tid)
+	}
+}
+
+func TestJournalTornRecord(t *testing.T) {
+	journal := filepath.Join(t.TempDir(), "bank.wal")
+	d, err := Open(Config{DataFile: datafile, Journal: journal})
+	if err != nil {
+		t.Fatalf("Failed to open datastore with journal - %v", err)
+	}
+	d.Transfer(ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: money.MustParse("1")})
+	d.Close()
+	fi, _ := os.Stat(journal)
+	size := fi.Size()
+
+	// simulate a crash in the middle of writing a record
+	f, _ := os.OpenFile(journal, os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{200, 0, 0, 0, 1, 2, 3, 4, '{', '"'})
+	f.Close()
+
+	d, err = Open(Config{DataFile: datafile, Journal: journal})
+	if err != nil {
+		t.Fatalf("Failed to open datastore with a torn journal record - %v", err)
+	}
+	defer d.Close()
+	if len(d.transactions) != 1 {
+		t.Fatalf("Expecting 1 replayed transaction, got %v", len(d.transactions))
+	}
+	fi, _ = os.Stat(journal)
+	if fi.Size() != size {
+		t.Fatalf("Expecting torn record to be truncated, journal size: %v, expected: %v", fi.Size(), size)
+	}
+}
+
+func TestJournalCorrupted(t *testing.T) {
+	journal := filepath.Join(t.TempDir(), "bank.wal")
+	d, _ := Open(Config{DataFile: datafile, Journal: journal})
+	d.Transfer(ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: money.MustParse("1")})
+	d.Transfer(ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: money.MustParse("1")})
+	d.Close()
+
+	// flip a byte in the payload of the first record
+	bytes, _ := os.ReadFile(journal)
+	bytes[journalHeaderSize+2] ^= 0xff
+	os.WriteFile(journal, bytes, 0644)
+
+	if _, err := Open(Config{DataFile: datafile, Journal: journal}); err == nil {
+		t.Fatal("Expecting an error opening a corrupted journal")
+	}
+
+	// a corrupted length reaching past the end of file is not a torn record, the records after it are kept
+	bytes[journalHeaderSize+2] ^= 0xff
+	binary.LittleEndian.PutUint32(bytes[0:4], uint32(len(bytes)))
+	os.WriteFile(journal, bytes, 0644)
+	if _, err := Open(Config{DataFile: datafile, Journal: journal}); err == nil {
+		t.Fatal("Expecting an error opening a journal with a corrupted record length")
+	}
+	if fi, _ := os.Stat(journal); fi.Size() != int64(len(bytes)) {
+		t.Fatalf("Expecting the journal not truncated, journal size: %v, expected: %v", fi.Size(), len(bytes))
+	}
+
+	// as is a length above the limit of a record
+	binary.LittleEndian.PutUint32(bytes[0:4], journalMaxRecord+1)
+	os.WriteFile(journal, bytes, 0644)
+	if _, err := Open(Config{DataFile: datafile, Journal: journal}); err == nil {
+		t.Fatal("Expecting an error opening a journal with an invalid record length")
+	}
+}
+
+func TestJournalGap(t *testing.T) {
+	journal := filepath.Join(t.TempDir(), "bank.wal")
+	d, _ := Open(Config{DataFile: datafile, Journal: journal})
+	for i := 0; i < 3; i++ {
+		d.Transfer(ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: money.MustParse("1")})
+	}
+	d.Close()
+
+	// drop the second record, the balances replayed without it would differ from the committed ones
+	bytes, _ := os.ReadFile(journal)
+	first := journalHeaderSize + int(binary.LittleEndian.Uint32(bytes[0:4]))
+	second := first + journalHeaderSize + int(binary.LittleEndian.Uint32(bytes[first:first+4]))
+	os.WriteFile(journal, append(bytes[:first:first], bytes[second:]...), 0644)
+
+	if _, err := Open(Config{DataFile: datafile, Journal: journal}); err == nil {
+		t.Fatal("Expecting an error opening a journal with a missing record")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{
+		DataFile:    datafile,
+		Journal:     filepath.Join(dir, "bank.wal"),
+		SnapshotDir: filepath.Join(dir, "snapshots"),
+	}
+	d, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Failed to open datastore - %v", err)
+	}
+	d.Transfer(ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: money.MustParse("3")})
+	d.Transfer(ds.TransferRequest{From: gAccounts[2].Id, To: gAccounts[3].Id, Amount: money.MustParse("4")})
+	info, err := d.Snapshot()
+	if err != nil {
+		t.Fatalf("Failed to take snapshot - %v", err)
+	}
+	if info.Lsn != 2 || info.Transactions != 2 || info.Accounts != len(gAccounts) {
+		t.Fatalf("Unexpected snapshot details: %+v", info)
+	}
+
+	// transfers after the snapshot are only in the journal
+	d.Transfer(ds.TransferRequest{From: gAccounts[1].Id, To: gAccounts[0].Id, Amount: money.MustParse("5")})
+	expected := d.List()
+	d.Close()
+
+	// data file is not needed once a snapshot exists
+	cfg.DataFile = filepath.Join(dir, "missing.json")
+	d, err = Open(cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen datastore from snapshot - %v", err)
+	}
+	defer d.Close()
+	if !reflect.DeepEqual(expected, d.List()) {
+		t.Fatal("Restored []Accounts data does not match with the expected")
+	}
+	if len(d.transactions) != 3 || d.nextTid != 4 || d.lsn != 3 {
+		t.Fatalf("Expecting 3 transactions, next tid 4 and lsn 3, got %v, %v and %v", len(d.transactions), d.nextTid, d.lsn)
+	}
+}
+
+func TestSnapshotInvalidSkipped(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{DataFile: datafile, Journal: filepath.Join(dir, "bank.wal"), SnapshotDir: dir}
+	d, _ := Open(cfg)
+	d.Transfer(ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: money.MustParse("3")})
+	d.Snapshot()
+	d.Transfer(ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: money.MustParse("3")})
+	info, _ := d.Snapshot()
+	d.Transfer(ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: money.MustParse("3")})
+	expected := d.List()
+	d.Close()
+
+	// corrupt the newest snapshot, the older one and the journal are used instead
+	bytes, _ := os.ReadFile(info.File)
+	bytes[len(bytes)-2] ^= 0xff
+	os.WriteFile(info.File, bytes, 0644)
+
+	d, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen datastore - %v", err)
+	}
+	defer d.Close()
+	if !reflect.DeepEqual(expected, d.List()) {
+		t.Fatal("Restored []Accounts data does not match with the expected")
+	}
+}
+
+func TestSnapshotNotConfigured(t *testing.T) {
+	d, _ := Load(datafile)
+	if _, err := d.Snapshot(); err == nil {
+		t.Fatal("Expecting an error taking a snapshot without a snapshot directory")
+	}
+}
+
+func TestTransferExact(t *testing.T) {
+	d, _ := Load(datafile)
+	// repeated transfers of 0.1 must not drift
+	for i := 0; i < 1000; i++ {
+		if _, err := d.Transfer(ds.TransferRequest{From: gAccounts[2].Id, To: gAccounts[3].Id, Amount: money.MustParse("0.1")}); err != nil {
+			t.Fatalf("Failed to transfer funds - %v", err)
+		}
+	}
+	acct, _ := d.Get(gAccounts[2].Id)
+	expectedBalance := gAccounts[2].Balance.Sub(money.MustParse("100"))
+	if acct.Balance != expectedBalance {
+		t.Fatalf("Received an incorrect balance value, received: %v, expected: %v\n", acct.Balance, expectedBalance)
+	}
+
+	// transfering the whole balance leaves exactly zero
+	acct, _ = d.Get(gAccounts[4].Id)
+	if res, err := d.Transfer(ds.TransferRequest{From: gAccounts[4].Id, To: gAccounts[5].Id, Amount: acct.Balance}); err != nil || !res.Balance.IsZero() {
+		t.Fatalf("Expecting zero balance after transfering the whole balance, received: %v, %v", res.Balance, err)
+	}
+}
+
+func TestTransferTooManyDecimals(t *testing.T) {
+	d, _ := Load(datafile)
+	if _, err := d.Transfer(ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: money.MustParse("0.001")}); err == nil {
+		t.Fatal("Expecting an error transfering an amount with more decimals than the currency allows")
+	}
+}
+
+// Write a data file with accounts in different currencies for the tests.
+func writeCurrencyDataFile(t *testing.T) string {
+	file := filepath.Join(t.TempDir(), "accounts.json")
+	data := `[
+		{"id": "usd-1", "name": "Dollar One", "balance": "100.00", "currency": "USD"},
+		{"id": "usd-2", "name": "Dollar Two", "balance": "50.00"},
+		{"id": "jpy-1", "name": "Yen One", "balance": "10000", "currency": "JPY"},
+		{"id": "bhd-1", "name": "Dinar One", "balance": "12.345", "currency": "bhd"},
+		{"id": "bhd-2", "name": "Dinar Two", "balance": "1.000", "currency": "BHD"}
+	]`
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to write data file - %v", err)
+	}
+	return file
+}
+
+func TestLoadCurrencies(t *testing.T) {
+	d, err := Load(writeCurrencyDataFile(t))
+	if err != nil {
+		t.Fatalf("Failed to load data file - %v", err)
+	}
+	expected := map[string]string{"usd-1": "USD", "usd-2": "USD", "jpy-1": "JPY", "bhd-1": "BHD", "bhd-2": "BHD"}
+	for id, currency := range expected {
+		acct, _ := d.Get(id)
+		if acct.Currency != currency {
+			t.Fatalf("Expecting currency %v for account %v, got %v", currency, id, acct.Currency)
+		}
+	}
+	acct, _ := d.Get("bhd-1")
+	if acct.Balance != money.New(12345, 3) {
+		t.Fatalf("Expecting balance 12.345 with 3 decimals, got %v", acct.Balance)
+	}
+
+	// unknown currencies and balances with too many decimals are rejected
+	for _, data := range []string{
+		`[{"id": "x", "name": "x", "balance": "1.00", "currency": "XYZ"}]`,
+		`[{"id": "x", "name": "x", "balance": "1.50", "currency": "JPY"}]`,
+	} {
+		file := filepath.Join(t.TempDir(), "accounts.json")
+		os.WriteFile(file, []byte(data), 0644)
+		if _, err := Load(file); err == nil {
+			t.Fatalf("Expecting an error loading %v", data)
+		}
+	}
+}
+
+func TestTransferCurrencies(t *testing.T) {
+	d, _ := Load(writeCurrencyDataFile(t))
+
+	// same currency, amounts follow the minor unit exponent
+	if _, err := d.Transfer(ds.TransferRequest{From: "bhd-1", To: "bhd-2", Amount: money.MustParse("0.005")}); err != nil {
+		t.Fatalf("Failed to transfer BHD 0.005 - %v", err)
+	}
+	if _, err := d.Transfer(ds.TransferRequest{From: "jpy-1", To: "usd-1", Amount: money.MustParse("1")}); err == nil {
+		t.Fatal("Expecting cross currency transfer without conversion to fail")
+	}
+	if _, err := d.Transfer(ds.TransferRequest{From: "usd-1", To: "usd-2", Amount: money.MustParse("0.005")}); err == nil {
+		t.Fatal("Expecting USD 0.005 transfer to fail")
+	}
+}
+
+// exchange rates for the tests
+type testRates map[string]money.Rate
+
+func (r testRates) Rate(from string, to string) (money.Rate, error) {
+	rate, ok := r[from+"/"+to]
+	if !ok {
+		return money.Rate{}, fmt.Errorf("no exchange rate available to convert %v to %v", from, to)
+	}
+	return rate, nil
+}
+
+func TestTransferConvert(t *testing.T) {
+	cfg := Config{
+		DataFile: writeCurrencyDataFile(t),
+		Journal:  filepath.Join(t.TempDir(), "bank.wal"),
+		FXRates:  testRates{"USD/JPY": money.MustParseRate("151.237"), "USD/BHD": money.MustParseRate("0.376")},
+	}
+	d, _ := Open(cfg)
+
+	// conversion has to be requested
+	if _, err := d.Transfer(ds.TransferRequest{From: "usd-1", To: "jpy-1", Amount: money.MustParse("10")}); err == nil {
+		t.Fatal("Expecting cross currency transfer without conversion to fail")
+	}
+	res, err := d.Transfer(ds.TransferRequest{From: "usd-1", To: "jpy-1", Amount: money.MustParse("10"), Convert: true})
+	if err != nil {
+		t.Fatalf("Failed to transfer USD to JPY - %v", err)
+	}
+	if res.ToAmount != money.New(1512, 0) || res.ToCurrency != "JPY" || res.Rate.String() != "151.237" || res.Balance != money.New(9000, 2) {
+		t.Fatalf("Unexpected transfer result %+v", res)
+	}
+	if _, err := d.Transfer(ds.TransferRequest{From: "usd-1", To: "bhd-1", Amount: money.MustParse("1"), Convert: true}); err != nil {
+		t.Fatalf("Failed to transfer USD to BHD - %v", err)
+	}
+
+	// no rate for the pair
+	if _, err := d.Transfer(ds.TransferRequest{From: "jpy-1", To: "usd-1", Amount: money.MustParse("10"), Convert: true}); err == nil {
+		t.Fatal("Expecting transfer without an exchange rate to fail")
+	}
+	expected := d.List()
+	d.Close()
+
+	// both legs are replayed from the journal
+	d, err = Open(cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen datastore - %v", err)
+	}
+	defer d.Close()
+	if !reflect.DeepEqual(expected, d.List()) {
+		t.Fatal("Replayed []Accounts data does not match with the expected")
+	}
+	jpy, _ := d.Get("jpy-1")
+	bhd, _ := d.Get("bhd-1")
+	if jpy.Balance != money.New(11512, 0) || bhd.Balance != money.New(12721, 3) {
+		t.Fatalf("Unexpected balances after replay, JPY %v, BHD %v", jpy.Balance, bhd.Balance)
+	}
+	if tr := d.transactions[0]; tr.toAmount != money.New(1512, 0) || tr.toCurrency != "JPY" || tr.rate.IsZero() {
+		t.Fatalf("Transaction record is missing the converted leg %+v", tr)
+	}
+}
+
+func TestGetTransaction(t *testing.T) {
+	d, _ := Load(datafile)
+	res, _ := d.Transfer(ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: money.MustParse("1.25")})
+
+	tr, err := d.GetTransaction(res.Tid)
+	if err != nil {
+		t.Fatalf("Failed to get transaction - %v", err)
+	}
+	if tr.Id != res.Tid || tr.FromId != gAccounts[0].Id || tr.ToId != gAccounts[1].Id || tr.Amount != money.New(125, 2) || tr.Rate != nil {
+		t.Fatalf("Unexpected transaction details %+v", tr)
+	}
+	if _, err := d.GetTransaction(res.Tid + 1); err == nil {
+		t.Fatal("Expecting an error getting an unknown transaction")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	d, _ := Load(datafile)
+	a, b, c := gAccounts[0].Id, gAccounts[1].Id, gAccounts[2].Id
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		d.Transfer(ds.TransferRequest{From: a, To: b, Amount: money.MustParse("1")})
+		d.Transfer(ds.TransferRequest{From: c, To: a, Amount: money.MustParse("2")})
+		d.Transfer(ds.TransferRequest{From: b, To: c, Amount: money.MustParse("3")})
+	}
+
+	// all transactions of the account, newest first, in pages of 3
+	var tids []uint64
+	q := ds.HistoryQuery{Limit: 3}
+	for {
+		page, err := d.History(a, q)
+		if err != nil {
+			t.Fatalf("Failed to get history - %v", err)
+		}
+		for _, tr := range page.Transactions {
+			tids = append(tids, tr.Id)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+	expected := []uint64{14, 13, 11, 10, 8, 7, 5, 4, 2, 1}
+	if !reflect.DeepEqual(expected, tids) {
+		t.Fatalf("Expecting transactions %v, received %v", expected, tids)
+	}
+
+	// direction filters
+	page, _ := d.History(a, ds.HistoryQuery{Direction: ds.DirectionOut})
+	if len(page.Transactions) != 5 || page.Transactions[0].FromId != a {
+		t.Fatalf("Expecting 5 debits, received %+v", page.Transactions)
+	}
+	page, _ = d.History(a, ds.HistoryQuery{Direction: ds.DirectionIn, Limit: 2})
+	if len(page.Transactions) != 2 || page.Transactions[0].ToId != a || page.NextCursor == "" {
+		t.Fatalf("Expecting 2 credits with a next page, received %+v", page)
+	}
+
+	// time range
+	page, _ = d.History(a, ds.HistoryQuery{Until: start})
+	if len(page.Transactions) != 0 {
+		t.Fatalf("Expecting no transactions before the start, received %v", len(page.Transactions))
+	}
+	page, _ = d.History(a, ds.HistoryQuery{Since: start})
+	if len(page.Transactions) != 10 {
+		t.Fatalf("Expecting 10 transactions after the start, received %v", len(page.Transactions))
+	}
+
+	// invalid queries
+	for _, q := range []ds.HistoryQuery{{Direction: "sideways"}, {Cursor: "not a cursor"}, {Limit: ds.MaxHistoryLimit + 1}, {Since: start, Until: start}} {
+		if _, err := d.History(a, q); err == nil {
+			t.Fatalf("Expecting an error for query %+v", q)
+		}
+	}
+	if _, err := d.History("unknown", ds.HistoryQuery{}); err == nil {
+		t.Fatal("Expecting an error for an unknown account")
+	}
+}
+
+// Append n transactions between random accounts directly to the datastore,
+// bypassing Transfer to build large histories quickly.
+func fillTransactions(d *datastore, n int, seed int64) {
+	r := rand.New(rand.NewSource(seed))
+	date := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		from := gAccounts[r.Intn(len(gAccounts))].Id
+		to := gAccounts[r.Intn(len(gAccounts))].Id
+		if from == to {
+			continue
+		}
+		date = date.Add(time.Duration(r.Intn(60)) * time.Second)
+		d.appendTransaction(transaction{tid: d.nextTid, date: date, from: from, to: to, amount: money.New(1, 2)})
+		d.nextTid++
+	}
+}
+
+func TestHistoryIndex(t *testing.T) {
+	d, _ := Load(datafile)
+	fillTransactions(d, 20000, 1)
+	id := gAccounts[7].Id
+	mid := d.transactions[len(d.transactions)/2].date
+
+	queries := []ds.HistoryQuery{
+		{Limit: 7},
+		{Direction: ds.DirectionIn, Limit: 5},
+		{Direction: ds.DirectionOut, Limit: 9},
+		{Since: mid, Limit: 11},
+		{Until: mid, Direction: ds.DirectionIn, Limit: 3},
+	}
+	for _, q := range queries {
+		// expected results using a full scan
+		var expected []uint64
+		for i := len(d.transactions) - 1; i >= 0; i-- {
+			tr := d.transactions[i]
+			in, out := tr.to == id, tr.from == id
+			switch {
+			case q.Direction == ds.DirectionIn && !in, q.Direction == ds.DirectionOut && !out, !in && !out:
+				continue
+			case !q.Since.IsZero() && tr.date.Before(q.Since), !q.Until.IsZero() && !tr.date.Before(q.Until):
+				continue
+			}
+			expected = append(expected, tr.tid)
+		}
+
+		// page through the history using the indexes
+		var received []uint64
+		for {
+			page, err := d.History(id, q)
+			if err != nil {
+				t.Fatalf("Failed to get history - %v", err)
+			}
+			for _, tr := range page.Transactions {
+				received = append(received, tr.Id)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			q.Cursor = page.NextCursor
+		}
+		if !reflect.DeepEqual(expected, received) {
+			t.Fatalf("History for query %+v does not match the full scan, expected %v transactions, received %v", q, len(expected), len(received))
+		}
+	}
+}
+
+// History queries take time proportional to the page size,
+func TestTransferErrors(t *testing.T) {
+	d, _ := Load(datafile)
+	tests := []struct {
+		req  ds.TransferRequest
+		kind error
+	}{
+		{ds.TransferRequest{From: "missing", To: gAccounts[1].Id, Amount: money.MustParse("1")}, ds.ErrAccountNotFound},
+		{ds.TransferRequest{From: gAccounts[0].Id, To: "missing", Amount: money.MustParse("1")}, ds.ErrAccountNotFound},
+		{ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[0].Id, Amount: money.MustParse("1")}, ds.ErrSameAccount},
+		{ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: money.MustParse("-1")}, ds.ErrInvalidAmount},
+		{ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: money.MustParse("0.001")}, ds.ErrInvalidAmount},
+		{ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: gAccounts[0].Balance.Add(money.MustParse("0.01"))}, ds.ErrInsufficientFunds},
+	}
+	for _, tc := range tests {
+		_, err := d.Transfer(tc.req)
+		if !errors.Is(err, tc.kind) {
+			t.Fatalf("%+v: expecting %v, received %v", tc.req, tc.kind, err)
+		}
+		var e *ds.Error
+		if !errors.As(err, &e) || e.Message == "" {
+			t.Fatalf("%+v: expecting a ds.Error with a message, received %#v", tc.req, err)
+		}
+	}
+	if _, err := d.Get("missing"); !errors.Is(err, ds.ErrAccountNotFound) {
+		t.Fatalf("expecting ErrAccountNotFound, received %v", err)
+	}
+	if _, err := d.GetTransaction(1000); !errors.Is(err, ds.ErrTransactionNotFound) {
+		t.Fatalf("expecting ErrTransactionNotFound, received %v", err)
+	}
+	if _, err := d.History(gAccounts[0].Id, ds.HistoryQuery{Direction: "sideways"}); !errors.Is(err, ds.ErrInvalidQuery) {
+		t.Fatalf("expecting ErrInvalidQuery, received %v", err)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	d, _ := Load(datafile)
+	req := ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: money.MustParse("7"), IdempotencyKey: "key-1", RequestHash: "hash-1"}
+	first, err := d.Transfer(req)
+	if err != nil || first.Replayed {
+		t.Fatalf("Failed to transfer funds - %+v, %v", first, err)
+	}
+
+	// a retry returns the original result without moving money again
+	second, err := d.Transfer(req)
+	if err != nil || !second.Replayed {
+		t.Fatalf("Expecting a replayed result, received %+v, %v", second, err)
+	}
+	if second.Tid != first.Tid || second.Balance.Cmp(first.Balance) != 0 {
+		t.Fatalf("Expecting tid %v and balance %v, received %v and %v", first.Tid, first.Balance, second.Tid, second.Balance)
+	}
+	if a, _ := d.Get(gAccounts[0].Id); a.Balance.Cmp(first.Balance) != 0 || len(d.transactions) != 1 {
+		t.Fatalf("Expecting a single transfer, balance %v and %v transactions", a.Balance, len(d.transactions))
+	}
+
+	// the same key with a different request is rejected
+	req.RequestHash = "hash-2"
+	if _, err := d.Transfer(req); !errors.Is(err, ds.ErrIdempotencyKeyReused) {
+		t.Fatalf("Expecting ErrIdempotencyKeyReused, received %v", err)
+	}
+
+	// a failed transfer does not use up the key
+	failed := ds.TransferRequest{From: gAccounts[0].Id, To: "missing", Amount: money.MustParse("1"), IdempotencyKey: "key-2", RequestHash: "hash-3"}
+	if _, err := d.Transfer(failed); err == nil {
+		t.Fatal("Expecting transfer to a missing account to fail")
+	}
+	failed.To = gAccounts[1].Id
+	if res, err := d.Transfer(failed); err != nil || res.Replayed {
+		t.Fatalf("Expecting the retried transfer to be performed, received %+v, %v", res, err)
+	}
+}
+
+func TestIdempotencyKeyRestart(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{DataFile: datafile, Journal: filepath.Join(dir, "bank.wal"), SnapshotDir: filepath.Join(dir, "snapshots")}
+	d, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Failed to open datastore - %v", err)
+	}
+	first, _ := d.Transfer(ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: money.MustParse("1"), IdempotencyKey: "snap", RequestHash: "h"})
+	if _, err := d.Snapshot(); err != nil {
+		t.Fatalf("Failed to take snapshot - %v", err)
+	}
+	second, _ := d.Transfer(ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: money.MustParse("2"), IdempotencyKey: "wal", RequestHash: "h"})
+	d.Close()
+
+	// keys are restored from the snapshot and the journal
+	d, err = Open(cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen datastore - %v", err)
+	}
+	defer d.Close()
+	for key, expected := range map[string]ds.TransferResult{"snap": first, "wal": second} {
+		res, err := d.Transfer(ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: expected.Amount, IdempotencyKey: key, RequestHash: "h"})
+		if err != nil || !res.Replayed || res.Tid != expected.Tid || res.Balance.Cmp(expected.Balance) != 0 {
+			t.Fatalf("%v: expecting replay of %+v, received %+v, %v", key, expected, res, err)
+		}
+	}
+	if d.nextTid != 3 {
+		t.Fatalf("Expecting next tid 3, got %v", d.nextTid)
+	}
+}
+
+func TestIdempotencyKeyExpiry(t *testing.T) {
+	d, err := Open(Config{DataFile: datafile, IdempotencyWindow: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to open datastore - %v", err)
+	}
+	defer d.Close()
+	req := ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: money.MustParse("1"), IdempotencyKey: "key", RequestHash: "h"}
+	first, _ := d.Transfer(req)
+	time.Sleep(5 * time.Millisecond)
+
+	// an expired key is treated as a new request
+	res, err := d.Transfer(req)
+	if err != nil || res.Replayed || res.Tid == first.Tid {
+		t.Fatalf("Expecting a new transfer after the key expired, received %+v, %v", res, err)
+	}
+	if len(d.idempotency) != 1 || len(d.idempotencyOrder) != 1 {
+		t.Fatalf("Expecting the expired key to be forgotten, have %v keys", len(d.idempotency))
+	}
+}
+
+func TestAccountsIterator(t *testing.T) {
+	d, _ := Load(datafile)
+	it := d.Accounts()
+
+	// changes after the iterator is created are not seen
+	amount := money.MustParse("1")
+	if _, err := d.Transfer(ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: amount}); err != nil {
+		t.Fatalf("Failed to transfer - %v", err)
+	}
+	if _, err := d.Create(ds.NewAccount{Name: "Iterator"}); err != nil {
+		t.Fatalf("Failed to create account - %v", err)
+	}
+
+	var accts []ds.Account
+	for it.Next() {
+		accts = append(accts, it.Account())
+	}
+	it.Close()
+	it.Close()
+	if it.Next() {
+		t.Fatal("Expecting no accounts after Close")
+	}
+	if !reflect.DeepEqual(gAccounts, accts) {
+		t.Fatal("Received []Accounts data does not match with the expected")
+	}
+
+	// closing releases the snapshot
+	d.registry.lock.Lock()
+	readers := len(d.registry.readers)
+	d.registry.lock.Unlock()
+	if readers != 0 {
+		t.Fatalf("Expecting no readers after Close, found %v", readers)
+	}
+	if n := len(d.List()); n != len(gAccounts)+1 {
+		t.Fatalf("Expecting %v accounts, received %v", len(gAccounts)+1, n)
+	}
+}
+
+func TestListConsistent(t *testing.T) {
+	d, _ := Load(datafile)
+	total := money.New(0, 2)
+	for _, a := range gAccounts {
+		total = total.Add(a.Balance)
+	}
+
+	// every List sees either all or none of the changes of a transfer,
+	// so the total balance never changes
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				from, to := r.Intn(len(gAccounts)), r.Intn(len(gAccounts))
+				d.Transfer(ds.TransferRequest{From: gAccounts[from].Id, To: gAccounts[to].Id, Amount: money.New(int64(r.Intn(1000)), 2)})
+			}
+		}(g)
+	}
+	for i := 0; i < 200; i++ {
+		sum := money.New(0, 2)
+		for _, a := range d.List() {
+			sum = sum.Add(a.Balance)
+		}
+		if sum.Cmp(total) != 0 {
+			close(stop)
+			wg.Wait()
+			t.Fatalf("Expecting total balance %v, received %v", total, sum)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestVersions(t *testing.T) {
+	d, _ := Load(datafile)
+	chain := d.chains.Load().([]*versionChain)[0]
+	length := func() int {
+		n := 0
+		for v := chain.head.Load().(*version); v != nil; v = v.prev.Load().(*version) {
+			n++
+		}
+		return n
+	}
+
+	// a reader keeps seeing the versions as of its snapshot
+	snapshot := d.beginRead()
+	for i := 0; i < 10; i++ {
+		d.Transfer(ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: money.MustParse("1")})
+	}
+	if v := chain.at(snapshot); v == nil || v.account.Balance.Cmp(gAccounts[0].Balance) != 0 {
+		t.Fatalf("Expecting balance %v at lsn %v, received %+v", gAccounts[0].Balance, snapshot, v)
+	}
+	if n := length(); n != 11 {
+		t.Fatalf("Expecting 11 versions while the reader is in progress, have %v", n)
+	}
+
+	// versions no reader needs are trimmed on the next commit
+	d.endRead(snapshot)
+	d.Transfer(ds.TransferRequest{From: gAccounts[0].Id, To: gAccounts[1].Id, Amount: money.MustParse("1")})
+	if n := length(); n != 2 {
+		t.Fatalf("Expecting 2 versions without readers, have %v", n)
+	}
+	if a, _ := d.Get(gAccounts[0].Id); d.List()[0] != a {
+		t.Fatalf("Expecting List to see the latest version %+v", a)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	d, _ := Load(datafile)
+
+	// walking the pages returns every account once, in order
+	for _, order := range []string{"", "name", "-balance"} {
+		expected := append([]ds.Account(nil), gAccounts...)
+		cmp, _ := orderFor(order)
+		sort.Slice(expected, func(i, j int) bool { return cmp(&expected[i], &expected[j]) < 0 })
+
+		var accts []ds.Account
+		q := ds.ListQuery{Sort: order, Limit: 7}
+		for {
+			page, err := d.Query(q)
+			if err != nil {
+				t.Fatalf("%v: failed to query accounts - %v", order, err)
+			}
+			if len(page.Accounts) > 7 {
+				t.Fatalf("%v: expecting at most 7 accounts, received %v", order, len(page.Accounts))
+			}
+			accts = append(accts, page.Accounts...)
+			if page.NextCursor == "" {
+				break
+			}
+			q.Cursor = page.NextCursor
+		}
+		if !reflect.DeepEqual(expected, accts) {
+			t.Fatalf("%v: Received []Accounts data does not match with the expected", order)
+		}
+	}
+
+	// filters
+	min, max := money.MustParse("100"), money.MustParse("1000")
+	prefix := strings.ToLower(gAccounts[0].Name[:1])
+	page, err := d.Query(ds.ListQuery{NamePrefix: strings.ToUpper(prefix), MinBalance: &min, MaxBalance: &max, Currency: "usd", Limit: ds.MaxListLimit})
+	if err != nil {
+		t.Fatalf("Failed to query accounts - %v", err)
+	}
+	n := 0
+	for _, a := range gAccounts {
+		if strings.HasPrefix(strings.ToLower(a.Name), prefix) && a.Balance.Cmp(min) >= 0 && a.Balance.Cmp(max) <= 0 {
+			n++
+		}
+	}
+	if len(page.Accounts) != n || page.NextCursor != "" {
+		t.Fatalf("Expecting %v accounts, received %v", n, len(page.Accounts))
+	}
+
+	// invalid queries
+	first, _ := d.Query(ds.ListQuery{Sort: "name", Limit: 1})
+	for _, q := range []ds.ListQuery{
+		{Sort: "date"},
+		{Limit: ds.MaxListLimit + 1},
+		{MinBalance: &max, MaxBalance: &min},
+		{Currency: "XYZ"},
+		{Cursor: "not a cursor"},
+		{Sort: "balance", Cursor: first.NextCursor},
+	} {
+		if _, err := d.Query(q); !errors.Is(err, ds.ErrInvalidQuery) {
+			t.Fatalf("%+v: expecting ErrInvalidQuery, received %v", q, err)
+		}
+	}
+}
+
+func TestCreateAccount(t *testing.T) {
+	d, _ := Load(datafile)
+	a, err := d.Create(ds.NewAccount{Id: "new-1", Name: "New", Currency: "eur", Balance: money.MustParse("10")})
+	if err != nil {
+		t.Fatalf("Failed to create account - %v", err)
+	}
+	expected := ds.Account{Id: "new-1", Name: "New", Balance: money.MustParse("10.00"), Available: money.MustParse("10.00"), OverdraftLimit: money.MustParse("0.00"), Currency: "EUR", Status: ds.StatusActive, Type: ds.TypeChecking}
+	if a != expected {
+		t.Fatalf("Expecting %+v, received %+v", expected, a)
+	}
+	if got, err := d.Get("new-1"); err != nil || got != expected {
+		t.Fatalf("Expecting %+v, received %+v, %v", expected, got, err)
+	}
+	if n := len(d.List()); n != len(gAccounts)+1 {
+		t.Fatalf("Expecting %v accounts, received %v", len(gAccounts)+1, n)
+	}
+
+	// an id and the default currency are assigned when omitted
+	a, err = d.Create(ds.NewAccount{Name: "Generated"})
+	if err != nil || len(a.Id) != 36 || a.Currency != "USD" || !a.Balance.IsZero() {
+		t.Fatalf("Unexpected account %+v, %v", a, err)
+	}
+	if _, err := d.Transfer(ds.TransferRequest{From: gAccounts[0].Id, To: a.Id, Amount: money.MustParse("1")}); err != nil {
+		t.Fatalf("Failed to transfer to the new account - %v", err)
+	}
+
+	tests := []struct {
+		na   ds.NewAccount
+		kind error
+	}{
+		{ds.NewAccount{Id: "new-1", Name: "Again"}, ds.ErrAccountExists},
+		{ds.NewAccount{Id: "new-2"}, ds.ErrInvalidAccount},
+		{ds.NewAccount{Id: "new/2", Name: "Slash"}, ds.ErrInvalidAccount},
+		{ds.NewAccount{Id: "new-2", Name: "Currency", Currency: "XYZ"}, ds.ErrInvalidAccount},
+		{ds.NewAccount{Id: "new-2", Name: "Negative", Balance: money.MustParse("-1")}, ds.ErrInvalidAmount},
+		{ds.NewAccount{Id: "new-2", Name: "Decimals", Currency: "JPY", Balance: money.MustParse("1.5")}, ds.ErrInvalidAmount},
+	}
+	for _, tc := range tests {
+		if _, err := d.Create(tc.na); !errors.Is(err, tc.kind) {
+			t.Fatalf("%+v: expecting %v, received %v", tc.na, tc.kind, err)
+		}
+	}
+}
+
+func TestAccountStatus(t *testing.T) {
+	d, _ := Load(datafile)
+	status := func(s string) ds.AccountUpdate {
+		return ds.AccountUpdate{Status: &s}
+	}
+	from, to := gAccounts[0].Id, gAccounts[1].Id
+
+	// transfers from and to a frozen account are refused
+	if a, err := d.Update(from, status(ds.StatusFrozen)); err != nil || a.Status != ds.StatusFrozen {
+		t.Fatalf("Failed to freeze account - %+v, %v", a, err)
+	}
+	if _, err := d.Transfer(ds.TransferRequest{From: from, To: to, Amount: money.MustParse("1")}); !errors.Is(err, ds.ErrAccountInactive) {
+		t.Fatalf("Expecting ErrAccountInactive, received %v", err)
+	}
+	if _, err := d.Transfer(ds.TransferRequest{From: to, To: from, Amount: money.MustParse("1")}); !errors.Is(err, ds.ErrAccountInactive) {
+		t.Fatalf("Expecting ErrAccountInactive, received %v", err)
+	}
+	if _, err := d.Update(from, status(ds.StatusActive)); err != nil {
+		t.Fatalf("Failed to unfreeze account - %v", err)
+	}
+
+	// only an account with a zero balance can be closed
+	if _, err := d.Update(from, status(ds.StatusClosed)); !errors.Is(err, ds.ErrInvalidStatusTransition) {
+		t.Fatalf("Expecting ErrInvalidStatusTransition, received %v", err)
+	}
+	if _, err := d.Transfer(ds.TransferRequest{From: from, To: to, Amount: gAccounts[0].Balance}); err != nil {
+		t.Fatalf("Failed to transfer funds - %v", err)
+	}
+	name := "Renamed"
+	a, err := d.Update(from, ds.AccountUpdate{Name: &name, Status: status(ds.StatusClosed).Status})
+	if err != nil || a.Name != name || a.Status != ds.StatusClosed {
+		t.Fatalf("Failed to close account - %+v, %v", a, err)
+	}
+
+	// a closed account cannot be changed or used
+	if _, err := d.Update(from, status(ds.StatusActive)); !errors.Is(err, ds.ErrAccountInactive) {
+		t.Fatalf("Expecting ErrAccountInactive, received %v", err)
+	}
+	if _, err := d.Transfer(ds.TransferRequest{From: to, To: from, Amount: money.MustParse("1")}); !errors.Is(err, ds.ErrAccountInactive) {
+		t.Fatalf("Expecting ErrAccountInactive, received %v", err)
+	}
+	if _, err := d.Update(to, status("deleted")); !errors.Is(err, ds.ErrInvalidAccount) {
+		t.Fatalf("Expecting ErrInvalidAccount, received %v", err)
+	}
+	if _, err := d.Update("missing", status(ds.StatusFrozen)); !errors.Is(err, ds.ErrAccountNotFound) {
+		t.Fatalf("Expecting ErrAccountNotFound, received %v", err)
+	}
+}
+
+func TestAccountJournalReplay(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{DataFile: datafile, Journal: filepath.Join(dir, "bank.wal"), SnapshotDir: filepath.Join(dir, "snapshots")}
+	d, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Failed to open datastore - %v", err)
+	}
+	frozen := ds.StatusFrozen
+	d.Create(ds.NewAccount{Id: "snap", Name: "Snapshot", Balance: money.MustParse("5")})
+	d.Update(gAccounts[2].Id, ds.AccountUpdate{Status: &frozen})
+	if _, err := d.Snapshot(); err != nil {
+		t.Fatalf("Failed to take snapshot - %v", err)
+	}
+	d.Create(ds.NewAccount{Id: "wal", Name: "Journal", Currency: "JPY"})
+	d.Transfer(ds.TransferRequest{From: "snap", To: gAccounts[0].Id, Amount: money.MustParse("2")})
+	d.Update("snap", ds.AccountUpdate{Status: &frozen})
+	expected := d.List()
+	d.Close()
+
+	d, err = Open(cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen datastore - %v", err)
+	}
+	defer d.Close()
+	if !reflect.DeepEqual(expected, d.List()) {
+		t.Fatal("Restored []Accounts data does not match with the expected")
+	}
+}
+
+func TestHolds(t *testing.T) {
+	d, _ := Load(datafile)
+	d.Create(ds.NewAccount{Id: "payer", Name: "Payer", Balance: money.MustParse("100")})
+	d.Create(ds.NewAccount{Id: "merchant", Name: "Merchant"})
+
+	// a hold reduces the available balance only
+	h, err := d.CreateHold(ds.HoldRequest{AccountId: "payer", ToId: "merchant", Amount: money.MustParse("60")})
+	if err != nil {
+		t.Fatalf("Failed to place hold - %v", err)
+	}
+	if h.Status != ds.HoldActive || h.Currency != "USD" || !h.Expires.After(h.Created) {
+		t.Fatalf("Unexpected hold: %+v", h)
+	}
+	a, _ := d.Get("payer")
+	if a.Balance.String() != "100.00" || a.Available.String() != "40.00" {
+		t.Fatalf("Expecting balance 100.00 and available 40.00, received %v and %v", a.Balance, a.Available)
+	}
+
+	// held funds cannot be transferred or held again
+	if _, err := d.Transfer(ds.TransferRequest{From: "payer", To: "merchant", Amount: money.MustParse("50")}); !errors.Is(err, ds.ErrInsufficientFunds) {
+		t.Fatalf("Expecting ErrInsufficientFunds, received %v", err)
+	}
+	if _, err := d.CreateHold(ds.HoldRequest{AccountId: "payer", ToId: "merchant", Amount: money.MustParse("50")}); !errors.Is(err, ds.ErrInsufficientFunds) {
+		t.Fatalf("Expecting ErrInsufficientFunds, received %v", err)
+	}
+	if _, err := d.Transfer(ds.TransferRequest{From: "payer", To: "merchant", Amount: money.MustParse("10")}); err != nil {
+		t.Fatalf("Failed to transfer available funds - %v", err)
+	}
+
+	// a partial capture transfers part of the hold and releases the rest
+	partial := money.MustParse("45.5")
+	if _, err := d.CaptureHold(h.Id, &money.Money{}); !errors.Is(err, ds.ErrInvalidAmount) {
+		t.Fatalf("Expecting ErrInvalidAmount, received %v", err)
+	}
+	over := money.MustParse("60.01")
+	if _, err := d.CaptureHold(h.Id, &over); !errors.Is(err, ds.ErrInvalidAmount) {
+		t.Fatalf("Expecting ErrInvalidAmount, received %v", err)
+	}
+	h, err = d.CaptureHold(h.Id, &partial)
+	if err != nil {
+		t.Fatalf("Failed to capture hold - %v", err)
+	}
+	if h.Status != ds.HoldCaptured || h.Captured == nil || h.Captured.String() != "45.50" || h.Closed == nil {
+		t.Fatalf("Unexpected captured hold: %+v", h)
+	}
+	payer, _ := d.Get("payer")
+	merchant, _ := d.Get("merchant")
+	if payer.Balance.String() != "44.50" || payer.Available.String() != "44.50" {
+		t.Fatalf("Expecting payer balance and available 44.50, received %v and %v", payer.Balance, payer.Available)
+	}
+	if merchant.Balance.String() != "55.50" || merchant.Available.String() != "55.50" {
+		t.Fatalf("Expecting merchant balance and available 55.50, received %v and %v", merchant.Balance, merchant.Available)
+	}
+	tr, err := d.GetTransaction(h.Tid)
+	if err != nil || tr.FromId != "payer" || tr.ToId != "merchant" || tr.Amount.String() != "45.50" {
+		t.Fatalf("Unexpected capture transaction: %+v, %v", tr, err)
+	}
+
+	// a hold is captured or voided once
+	if _, err := d.CaptureHold(h.Id, nil); !errors.Is(err, ds.ErrHoldInactive) {
+		t.Fatalf("Expecting ErrHoldInactive, received %v", err)
+	}
+	if _, err := d.VoidHold(h.Id); !errors.Is(err, ds.ErrHoldInactive) {
+		t.Fatalf("Expecting ErrHoldInactive, received %v", err)
+	}
+
+	// voiding releases the whole hold, even for a frozen account
+	h, _ = d.CreateHold(ds.HoldRequest{AccountId: "payer", ToId: "merchant", Amount: money.MustParse("44.5")})
+	closed := ds.StatusClosed
+	if _, err := d.Update("payer", ds.AccountUpdate{Status: &closed}); !errors.Is(err, ds.ErrInvalidStatusTransition) {
+		t.Fatalf("Expecting ErrInvalidStatusTransition, received %v", err)
+	}
+	frozen := ds.StatusFrozen
+	d.Update("payer", ds.AccountUpdate{Status: &frozen})
+	if _, err := d.CaptureHold(h.Id, nil); !errors.Is(err, ds.ErrAccountInactive) {
+		t.Fatalf("Expecting ErrAccountInactive, received %v", err)
+	}
+	if h, err = d.VoidHold(h.Id); err != nil || h.Status != ds.HoldVoided {
+		t.Fatalf("Failed to void hold - %v", err)
+	}
+	if payer, _ = d.Get("payer"); payer.Available.String() != "44.50" {
+		t.Fatalf("Expecting payer available 44.50, received %v", payer.Available)
+	}
+
+	// invalid holds
+	d.Create(ds.NewAccount{Id: "euro", Name: "Euro", Currency: "EUR"})
+	for _, tc := range []struct {
+		req  ds.HoldRequest
+		kind error
+	}{
+		{ds.HoldRequest{AccountId: "nobody", ToId: "merchant", Amount: money.MustParse("1")}, ds.ErrAccountNotFound},
+		{ds.HoldRequest{AccountId: "merchant", ToId: "merchant", Amount: money.MustParse("1")}, ds.ErrSameAccount},
+		{ds.HoldRequest{AccountId: "merchant", ToId: "euro", Amount: money.MustParse("1")}, ds.ErrCurrencyMismatch},
+		{ds.HoldRequest{AccountId: "merchant", ToId: "payer", Amount: money.MustParse("1")}, ds.ErrAccountInactive},
+		{ds.HoldRequest{AccountId: "merchant", ToId: gAccounts[0].Id, Amount: money.MustParse("0")}, ds.ErrInvalidAmount},
+		{ds.HoldRequest{AccountId: "merchant", ToId: gAccounts[0].Id, Amount: money.MustParse("0.001")}, ds.ErrInvalidAmount},
+		{ds.HoldRequest{AccountId: "merchant", ToId: gAccounts[0].Id, Amount: money.MustParse("1"), Expiry: MaxHoldExpiry + 1}, ds.ErrInvalidHold},
+	} {
+		if _, err := d.CreateHold(tc.req); !errors.Is(err, tc.kind) {
+			t.Fatalf("%+v: expecting %v, received %v", tc.req, tc.kind, err)
+		}
+	}
+	if _, err := d.GetHold(1000); !errors.Is(err, ds.ErrHoldNotFound) {
+		t.Fatalf("Expecting ErrHoldNotFound, received %v", err)
+	}
+}
+
+func TestHoldExpiry(t *testing.T) {
+	d, _ := Load(datafile)
+	from, to := gAccounts[0].Id, gAccounts[1].Id
+
+	// a hold past its expiry cannot be captured
+	h, err := d.CreateHold(ds.HoldRequest{AccountId: from, ToId: to, Amount: money.MustParse("1"), Expiry: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to place hold - %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if _, err := d.CaptureHold(h.Id, nil); !errors.Is(err, ds.ErrHoldInactive) {
+		t.Fatalf("Expecting ErrHoldInactive, received %v", err)
+	}
+	if h, _ = d.GetHold(h.Id); h.Status != ds.HoldExpired {
+		t.Fatalf("Expecting hold to be expired, received %v", h.Status)
+	}
+
+	// expired holds are swept, releasing the funds
+	h, _ = d.CreateHold(ds.HoldRequest{AccountId: from, ToId: to, Amount: money.MustParse("1"), Expiry: time.Hour})
+	if n := d.expireHolds(time.Now()); n != 0 {
+		t.Fatalf("Expecting no holds to expire, %v expired", n)
+	}
+	if n := d.expireHolds(time.Now().Add(2 * time.Hour)); n != 1 {
+		t.Fatalf("Expecting 1 hold to expire, %v expired", n)
+	}
+	if h, _ = d.GetHold(h.Id); h.Status != ds.HoldExpired || h.Closed == nil {
+		t.Fatalf("Expecting hold to be expired, received %+v", h)
+	}
+	if a, _ := d.Get(from); a.Available != gAccounts[0].Balance || a.Balance != gAccounts[0].Balance {
+		t.Fatalf("Expecting available %v, received %v", gAccounts[0].Balance, a.Available)
+	}
+}
+
+func TestHoldJournalReplay(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{DataFile: datafile, Journal: filepath.Join(dir, "bank.wal"), SnapshotDir: filepath.Join(dir, "snapshots")}
+	d, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Failed to open datastore - %v", err)
+	}
+	req := ds.HoldRequest{AccountId: gAccounts[0].Id, ToId: gAccounts[1].Id, Amount: money.MustParse("2")}
+	h1, _ := d.CreateHold(req)
+	h2, _ := d.CreateHold(req)
+	if _, err := d.Snapshot(); err != nil {
+		t.Fatalf("Failed to take snapshot - %v", err)
+	}
+	h3, _ := d.CreateHold(req)
+	h4, _ := d.CreateHold(req)
+	partial := money.MustParse("1.25")
+	d.CaptureHold(h1.Id, &partial)
+	d.VoidHold(h3.Id)
+	d.expireHolds(h4.Expires)
+	expected := d.List()
+	var holds []ds.Hold
+	for _, id := range []uint64{h1.Id, h2.Id, h3.Id, h4.Id} {
+		h, _ := d.GetHold(id)
+		holds = append(holds, h)
+	}
+	d.Close()
+
+	d, err = Open(cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen datastore - %v", err)
+	}
+	defer d.Close()
+	if !reflect.DeepEqual(expected, d.List()) {
+		t.Fatal("Restored []Accounts data does not match with the expected")
+	}
+	for _, expected := range holds {
+		h, err := d.GetHold(expected.Id)
+		if err != nil || h.Status != expected.Status || h.Tid != expected.Tid || !reflect.DeepEqual(h.Captured, expected.Captured) {
+			t.Fatalf("Restored hold %+v does not match with the expected %+v", h, expected)
+		}
+	}
+	if h, _ := d.CreateHold(req); h.Id != h4.Id+1 {
+		t.Fatalf("Expecting hold id %v, received %v", h4.Id+1, h.Id)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	cfg := Config{DataFile: datafile, Journal: filepath.Join(t.TempDir(), "bank.wal")}
+	d, _ := Open(cfg)
+	from, to := gAccounts[0].Id, gAccounts[1].Id
+	res, _ := d.Transfer(ds.TransferRequest{From: from, To: to, Amount: money.MustParse("10")})
+
+	// a partial refund is a linked transaction in the other direction
+	partial := money.MustParse("4")
+	refund, err := d.Refund(res.Tid, &partial)
+	if err != nil {
+		t.Fatalf("Failed to refund transaction - %v", err)
+	}
+	if refund.RefundOf != res.Tid || refund.FromId != to || refund.ToId != from || refund.Amount.String() != "4.00" || refund.ToAmount.String() != "4.00" {
+		t.Fatalf("Unexpected refund transaction %+v", refund)
+	}
+	tr, _ := d.GetTransaction(res.Tid)
+	if tr.Refunded == nil || tr.Refunded.String() != "4.00" {
+		t.Fatalf("Expecting 4.00 refunded, received %v", tr.Refunded)
+	}
+
+	// refunds cannot exceed the transaction, or be refunded themselves
+	over := money.MustParse("6.01")
+	if _, err := d.Refund(res.Tid, &over); !errors.Is(err, ds.ErrRefundExceeded) {
+		t.Fatalf("Expecting ErrRefundExceeded, received %v", err)
+	}
+	if _, err := d.Refund(refund.Id, nil); !errors.Is(err, ds.ErrNotRefundable) {
+		t.Fatalf("Expecting ErrNotRefundable, received %v", err)
+	}
+	if _, err := d.Refund(res.Tid, &money.Money{}); !errors.Is(err, ds.ErrInvalidAmount) {
+		t.Fatalf("Expecting ErrInvalidAmount, received %v", err)
+	}
+	if _, err := d.Refund(1000, nil); !errors.Is(err, ds.ErrTransactionNotFound) {
+		t.Fatalf("Expecting ErrTransactionNotFound, received %v", err)
+	}
+
+	// the rest is refunded without an amount, then nothing is left
+	if refund, err = d.Refund(res.Tid, nil); err != nil || refund.Amount.String() != "6.00" {
+		t.Fatalf("Failed to refund the rest of the transaction %+v, %v", refund, err)
+	}
+	if _, err := d.Refund(res.Tid, nil); !errors.Is(err, ds.ErrRefundExceeded) {
+		t.Fatalf("Expecting ErrRefundExceeded, received %v", err)
+	}
+	for i, id := range []string{from, to} {
+		if a, _ := d.Get(id); a.Balance != gAccounts[i].Balance || a.Available != gAccounts[i].Balance {
+			t.Fatalf("Expecting balance %v for account %v, received %v", gAccounts[i].Balance, id, a.Balance)
+		}
+	}
+	expected, _ := d.GetTransaction(res.Tid)
+	d.Close()
+
+	// refunds are replayed from the journal
+	d, err = Open(cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen datastore - %v", err)
+	}
+	defer d.Close()
+	if tr, _ := d.GetTransaction(res.Tid); !reflect.DeepEqual(expected.Refunded, tr.Refunded) {
+		t.Fatalf("Replayed transaction %+v does not match with the expected %+v", tr, expected)
+	}
+	if tr, _ := d.GetTransaction(refund.Id); tr.RefundOf != res.Tid {
+		t.Fatalf("Replayed refund %+v is not linked to the transaction", tr)
+	}
+}
+
+func TestRefundConvert(t *testing.T) {
+	d, _ := Open(Config{DataFile: writeCurrencyDataFile(t), FXRates: testRates{"USD/JPY": money.MustParseRate("151.237")}})
+	res, _ := d.Transfer(ds.TransferRequest{From: "usd-1", To: "jpy-1", Amount: money.MustParse("10"), Convert: true})
+
+	// refunds are in the currency of the to account, and credit the share of the original amount
+	partial := money.MustParse("500")
+	refund, err := d.Refund(res.Tid, &partial)
+	if err != nil {
+		t.Fatalf("Failed to refund transaction - %v", err)
+	}
+	if refund.Currency != "JPY" || refund.ToCurrency != "USD" || refund.ToAmount.String() != "3.31" {
+		t.Fatalf("Unexpected refund transaction %+v", refund)
+	}
+	if refund, err = d.Refund(res.Tid, nil); err != nil || refund.Amount.String() != "1012" || refund.ToAmount.String() != "6.69" {
+		t.Fatalf("Unexpected refund transaction %+v, %v", refund, err)
+	}
+
+	// refunding all of the transaction returns exactly the original amount
+	usd, _ := d.Get("usd-1")
+	jpy, _ := d.Get("jpy-1")
+	if usd.Balance.String() != "100.00" || jpy.Balance.String() != "10000" {
+		t.Fatalf("Unexpected balances after refunds, USD %v, JPY %v", usd.Balance, jpy.Balance)
+	}
+}
+
+func TestTransferBatch(t *testing.T) {
+	cfg := Config{DataFile: datafile, Journal: filepath.Join(t.TempDir(), "bank.wal")}
+	d, _ := Open(cfg)
+	a, b, c := gAccounts[0].Id, gAccounts[1].Id, gAccounts[2].Id
+
+	// a leg can spend the funds credited by an earlier leg
+	legs := []ds.TransferRequest{
+		{From: a, To: b, Amount: money.MustParse("87.11")},
+		{From: b, To: c, Amount: money.MustParse("1033.26")},
+	}
+	res, err := d.TransferBatch(legs)
+	if err != nil {
+		t.Fatalf("Failed to transfer batch - %v", err)
+	}
+	if len(res.Transactions) != 2 || res.Transactions[1].Id != res.Transactions[0].Id+1 {
+		t.Fatalf("Unexpected batch transactions %+v", res.Transactions)
+	}
+	for i, tr := range res.Transactions {
+		if tr.BatchId != res.Id || tr.FromId != legs[i].From || tr.ToId != legs[i].To {
+			t.Fatalf("Unexpected transaction %+v for leg %v", tr, i)
+		}
+		if stored, _ := d.GetTransaction(tr.Id); stored.BatchId != res.Id {
+			t.Fatalf("Expecting batch id %v, received %v", res.Id, stored.BatchId)
+		}
+	}
+	expected := d.List()
+	if expected[0].Balance.String() != "0.00" || expected[1].Balance.String() != "0.00" || expected[2].Balance.String() != "4741.37" {
+		t.Fatalf("Unexpected balances after batch %v, %v, %v", expected[0].Balance, expected[1].Balance, expected[2].Balance)
+	}
+
+	// nothing is transferred when a later leg fails
+	_, err = d.TransferBatch([]ds.TransferRequest{
+		{From: c, To: a, Amount: money.MustParse("100")},
+		{From: a, To: b, Amount: money.MustParse("100.01")},
+	})
+	if !errors.Is(err, ds.ErrInsufficientFunds) || !strings.HasPrefix(err.Error(), "leg 1:") {
+		t.Fatalf("Expecting ErrInsufficientFunds for leg 1, received %v", err)
+	}
+	_, err = d.TransferBatch([]ds.TransferRequest{{From: "none", To: a, Amount: money.MustParse("1")}})
+	if !errors.Is(err, ds.ErrAccountNotFound) || !strings.HasPrefix(err.Error(), "leg 0:") {
+		t.Fatalf("Expecting ErrAccountNotFound for leg 0, received %v", err)
+	}
+	if _, err = d.TransferBatch(nil); !errors.Is(err, ds.ErrInvalidBatch) {
+		t.Fatalf("Expecting ErrInvalidBatch, received %v", err)
+	}
+	if _, err = d.TransferBatch(make([]ds.TransferRequest, ds.MaxBatchLegs+1)); !errors.Is(err, ds.ErrInvalidBatch) {
+		t.Fatalf("Expecting ErrInvalidBatch, received %v", err)
+	}
+	if !reflect.DeepEqual(expected, d.List()) {
+		t.Fatal("Failed batch changed []Accounts data")
+	}
+	d.Close()
+
+	// the batch is replayed from the journal
+	d, err = Open(cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen datastore - %v", err)
+	}
+	defer d.Close()
+	if !reflect.DeepEqual(expected, d.List()) {
+		t.Fatal("Restored []Accounts data does not match with the expected")
+	}
+	if tr, _ := d.GetTransaction(res.Transactions[1].Id); tr.BatchId != res.Id {
+		t.Fatalf("Expecting batch id %v, received %v", res.Id, tr.BatchId)
+	}
+	next, err := d.TransferBatch([]ds.TransferRequest{{From: c, To: a, Amount: money.MustParse("1")}})
+	if err != nil || next.Id != res.Id+1 || next.Transactions[0].Id != res.Transactions[1].Id+1 {
+		t.Fatalf("Unexpected batch %+v after replay, %v", next, err)
+	}
+}
+
+func TestLedger(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{
+		DataFile:    writeCurrencyDataFile(t),
+		Journal:     filepath.Join(dir, "bank.wal"),
+		SnapshotDir: filepath.Join(dir, "snapshots"),
+		FXRates:     testRates{"USD/JPY": money.MustParseRate("151.237")},
+	}
+	d, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Failed to open datastore - %v", err)
+	}
+
+	// every kind of movement posts to the ledger
+	res, _ := d.Transfer(ds.TransferRequest{From: "usd-1", To: "usd-2", Amount: money.MustParse("10")})
+	conv, _ := d.Transfer(ds.TransferRequest{From: "usd-1", To: "jpy-1", Amount: money.MustParse("10"), Convert: true})
+	h, _ := d.CreateHold(ds.HoldRequest{AccountId: "usd-2", ToId: "usd-1", Amount: money.MustParse("5")})
+	partial := money.MustParse("3")
+	d.CaptureHold(h.Id, &partial)
+	d.Create(ds.NewAccount{Id: "usd-3", Name: "Dollar Three", Balance: money.MustParse("7"), Currency: "USD"})
+	if _, err := d.Snapshot(); err != nil {
+		t.Fatalf("Failed to take snapshot - %v", err)
+	}
+	refund := money.MustParse("4")
+	d.Refund(res.Tid, &refund)
+	d.TransferBatch([]ds.TransferRequest{{From: "usd-3", To: "usd-1", Amount: money.MustParse("2")}, {From: "usd-1", To: "usd-2", Amount: money.MustParse("1")}})
+
+	r := d.VerifyLedger()
+	if !r.Balanced {
+		t.Fatalf("Expecting balanced ledger, received %+v", r)
+	}
+	if r.Entries != 6+6 || len(r.Totals) != 3 {
+		t.Fatalf("Unexpected report %+v", r)
+	}
+
+	// the postings of a cross-currency transfer go through the clearing accounts
+	tr, _ := d.GetTransaction(conv.Tid)
+	if len(tr.Postings) != 4 || tr.Postings[1].Account != ledger.ClearingAccount("USD") || tr.Postings[3].Amount.String() != "1512" {
+		t.Fatalf("Unexpected postings %+v", tr.Postings)
+	}
+	d.Close()
+
+	// the ledger is rebuilt from the snapshot and the journal
+	d, err = Open(cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen datastore - %v", err)
+	}
+	defer d.Close()
+	restored := d.VerifyLedger()
+	if !restored.Balanced || restored.Postings != r.Postings || !reflect.DeepEqual(restored.Totals, r.Totals) {
+		t.Fatalf("Restored ledger %+v does not match with the expected %+v", restored, r)
+	}
+
+	// a balance changed outside the ledger is found
+	d.accounts[d.index["usd-1"]].Balance = d.accounts[d.index["usd-1"]].Balance.Add(money.MustParse("0.01"))
+	if r := d.VerifyLedger(); r.Balanced || !strings.Contains(strings.Join(r.Problems, "\n"), "account id: usd-1") {
+		t.Fatalf("Expecting mismatch for account usd-1, received %+v", r)
+	}
+	if _, err := d.Create(ds.NewAccount{Id: ledger.OpeningAccount, Name: "Opening"}); !errors.Is(err, ds.ErrInvalidAccount) {
+		t.Fatalf("Expecting ErrInvalidAccount for a reserved id, received %v", err)
+	}
+}
+
+func TestOverdraft(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{DataFile: datafile, Journal: filepath.Join(dir, "bank.wal"), SnapshotDir: filepath.Join(dir, "snapshots")}
+	d, _ := Open(cfg)
+	biz, err := d.Create(ds.NewAccount{Id: "biz", Name: "Business", Balance: money.MustParse("10"), OverdraftLimit: money.MustParse("50")})
+	if err != nil || biz.OverdraftLimit.String() != "50.00" {
+		t.Fatalf("Unexpected account %+v, %v", biz, err)
+	}
+	other := gAccounts[0].Id
+
+	// the balance can go below zero down to the negated limit
+	res, err := d.Transfer(ds.TransferRequest{From: "biz", To: other, Amount: money.MustParse("40")})
+	if err != nil || res.Balance.String() != "-30.00" {
+		t.Fatalf("Expecting balance -30.00, received %v, %v", res.Balance, err)
+	}
+	if _, err := d.Transfer(ds.TransferRequest{From: "biz", To: other, Amount: money.MustParse("20.01")}); !errors.Is(err, ds.ErrInsufficientFunds) {
+		t.Fatalf("Expecting ErrInsufficientFunds, received %v", err)
+	}
+	h, err := d.CreateHold(ds.HoldRequest{AccountId: "biz", ToId: other, Amount: money.MustParse("20")})
+	if err != nil {
+		t.Fatalf("Failed to create hold - %v", err)
+	}
+	if _, err := d.TransferBatch([]ds.TransferRequest{{From: "biz", To: other, Amount: money.MustParse("0.01")}}); !errors.Is(err, ds.ErrInsufficientFunds) {
+		t.Fatalf("Expecting ErrInsufficientFunds, received %v", err)
+	}
+	d.VoidHold(h.Id)
+	if _, err := d.Snapshot(); err != nil {
+		t.Fatalf("Failed to take snapshot - %v", err)
+	}
+
+	// coming back to zero leaves overdraft, a lower limit stops further spending
+	back, _ := d.Transfer(ds.TransferRequest{From: other, To: "biz", Amount: money.MustParse("30")})
+	limit := money.MustParse("5")
+	if a, err := d.Update("biz", ds.AccountUpdate{OverdraftLimit: &limit}); err != nil || a.OverdraftLimit.String() != "5.00" {
+		t.Fatalf("Unexpected account %+v, %v", a, err)
+	}
+	if _, err := d.Transfer(ds.TransferRequest{From: "biz", To: other, Amount: money.MustParse("5.01")}); !errors.Is(err, ds.ErrInsufficientFunds) {
+		t.Fatalf("Expecting ErrInsufficientFunds, received %v", err)
+	}
+	negative := money.MustParse("-1")
+	if _, err := d.Update("biz", ds.AccountUpdate{OverdraftLimit: &negative}); !errors.Is(err, ds.ErrInvalidAmount) {
+		t.Fatalf("Expecting ErrInvalidAmount, received %v", err)
+	}
+
+	events, err := d.OverdraftEvents("biz")
+	if err != nil || len(events) != 2 {
+		t.Fatalf("Expecting 2 overdraft events, received %+v, %v", events, err)
+	}
+	if events[0].Event != ds.OverdraftEntered || events[0].Tid != res.Tid || events[0].Balance.String() != "-30.00" || events[0].Limit.String() != "50.00" {
+		t.Fatalf("Unexpected overdraft event %+v", events[0])
+	}
+	if events[1].Event != ds.OverdraftLeft || events[1].Tid != back.Tid || events[1].Balance.String() != "0.00" {
+		t.Fatalf("Unexpected overdraft event %+v", events[1])
+	}
+	if _, err := d.OverdraftEvents("none"); !errors.Is(err, ds.ErrAccountNotFound) {
+		t.Fatalf("Expecting ErrAccountNotFound, received %v", err)
+	}
+	expected := d.List()
+	d.Close()
+
+	// limits and events are restored from the snapshot and the journal
+	d, err = Open(cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen datastore - %v", err)
+	}
+	defer d.Close()
+	if !reflect.DeepEqual(expected, d.List()) {
+		t.Fatal("Restored []Accounts data does not match with the expected")
+	}
+	restored, _ := d.OverdraftEvents("biz")
+	if len(restored) != 2 || restored[0].Tid != res.Tid || restored[1].Tid != back.Tid {
+		t.Fatalf("Restored overdraft events %+v do not match with the expected %+v", restored, events)
+	}
+}
+
+func TestOutOfRange(t *testing.T) {
+	d, _ := Load(datafile)
+
+	// balances are compared to a filter with more decimals without overflowing
+	tiny := money.MustParse("0.000000000000000001")
+	n := 0
+	for _, a := range gAccounts {
+		if a.Balance.Sign() > 0 {
+			n++
+		}
+	}
+	page, err := d.Query(ds.ListQuery{MinBalance: &tiny, Limit: ds.MaxListLimit})
+	if err != nil || len(page.Accounts) != n {
+		t.Fatalf("Expecting %v accounts with a positive balance, received %v - %v", n, len(page.Accounts), err)
+	}
+
+	// the opening balances of a currency cannot sum out of range
+	opening := d.ledger.Balance(ledger.OpeningAccount, "USD")
+	rich, err := d.Create(ds.NewAccount{Id: "rich", Name: "Rich", Currency: "USD", Balance: money.New(math.MaxInt64+opening.Units(), 2)})
+	if err != nil {
+		t.Fatalf("Failed to create account - %v", err)
+	}
+	if _, err := d.Create(ds.NewAccount{Id: "richer", Name: "Richer", Currency: "USD", Balance: money.MustParse("0.02")}); !errors.Is(err, ds.ErrInvalidAmount) {
+		t.Fatalf("Expecting ErrInvalidAmount, received %v", err)
+	}
+
+	// credits cannot take a balance out of range, money borrowed in overdraft would
+	beyond := money.New(1-opening.Units(), 2)
+	d.Create(ds.NewAccount{Id: "borrower", Name: "Borrower", Currency: "USD", OverdraftLimit: beyond})
+	req := ds.TransferRequest{From: "borrower", To: "rich", Amount: beyond}
+	if _, err := d.Transfer(req); !errors.Is(err, ds.ErrInvalidAmount) {
+		t.Fatalf("Expecting ErrInvalidAmount, received %v", err)
+	}
+	if _, err := d.TransferBatch([]ds.TransferRequest{req}); !errors.Is(err, ds.ErrInvalidAmount) {
+		t.Fatalf("Expecting ErrInvalidAmount, received %v", err)
+	}
+	h, err := d.CreateHold(ds.HoldRequest{AccountId: "borrower", ToId: "rich", Amount: beyond})
+	if err != nil {
+		t.Fatalf("Failed to create hold - %v", err)
+	}
+	if _, err := d.CaptureHold(h.Id, nil); !errors.Is(err, ds.ErrInvalidAmount) {
+		t.Fatalf("Expecting ErrInvalidAmount, received %v", err)
+	}
+	if a, _ := d.Get("rich"); a != rich {
+		t.Fatalf("Expecting the balance unchanged, received %+v", a)
+	}
+	if r := d.VerifyLedger(); !r.Balanced {
+		t.Fatalf("Expecting balanced ledger, received %+v", r)
+	}
+}
+
+func TestRules(t *testing.T) {
+	set, err := rules.Parse([]byte(`{"rules": [
+		{"name": "single", "type": "max_amount", "limit": "50", "currency": "USD"},
+		{"name": "daily", "type": "max_outflow", "limit": "80", "currency": "USD", "window": "24h"},
+		{"name": "hourly", "type": "max_count", "count": 3, "window": "1h"}
+	]}`))
+	if err != nil {
+		t.Fatalf("Failed to parse rules - %v", err)
+	}
+	d, _ := Open(Config{DataFile: datafile, Rules: set})
+	a, b, c := gAccounts[1].Id, gAccounts[2].Id, gAccounts[3].Id
+
+	// a rejection names the rule and changes nothing
+	_, err = d.Transfer(ds.TransferRequest{From: a, To: b, Amount: money.MustParse("50.01")})
+	var re *ds.RuleError
+	if !errors.Is(err, ds.ErrRuleViolation) || !errors.As(err, &re) || re.Rule != "single" {
+		t.Fatalf("Expecting violation of rule single, received %v", err)
+	}
+	if acct, _ := d.Get(a); acct.Balance != gAccounts[1].Balance {
+		t.Fatalf("Expecting balance %v, received %v", gAccounts[1].Balance, acct.Balance)
+	}
+
+	// the outflow and count include the earlier debits of the account
+	if _, err := d.Transfer(ds.TransferRequest{From: a, To: b, Amount: money.MustParse("50")}); err != nil {
+		t.Fatalf("Failed to transfer - %v", err)
+	}
+	_, err = d.Transfer(ds.TransferRequest{From: a, To: b, Amount: money.MustParse("30.01")})
+	if !errors.As(err, &re) || re.Rule != "daily" {
+		t.Fatalf("Expecting violation of rule daily, received %v", err)
+	}
+	d.Transfer(ds.TransferRequest{From: a, To: b, Amount: money.MustParse("1")})
+	d.Transfer(ds.TransferRequest{From: a, To: b, Amount: money.MustParse("1")})
+	_, err = d.Transfer(ds.TransferRequest{From: a, To: b, Amount: money.MustParse("1")})
+	if !errors.As(err, &re) || re.Rule != "hourly" {
+		t.Fatalf("Expecting violation of rule hourly, received %v", err)
+	}
+
+	// the legs of a batch see the debits of the earlier legs
+	_, err = d.TransferBatch([]ds.TransferRequest{
+		{From: c, To: b, Amount: money.MustParse("50")},
+		{From: b, To: c, Amount: money.MustParse("1")},
+		{From: c, To: b, Amount: money.MustParse("30.01")},
+	})
+	if !errors.As(err, &re) || re.Rule != "daily" || !strings.HasPrefix(err.Error(), "leg 2:") {
+		t.Fatalf("Expecting violation of rule daily by leg 2, received %v", err)
+	}
+	if _, err := d.TransferBatch([]ds.TransferRequest{{From: c, To: b, Amount: money.MustParse("50")}, {From: c, To: b, Amount: money.MustParse("30")}}); err != nil {
+		t.Fatalf("Failed to transfer batch - %v", err)
+	}
+
+	// a hold is checked when placed and when captured, the capture debits the account
+	e := gAccounts[4].Id
+	_, err = d.CreateHold(ds.HoldRequest{AccountId: e, ToId: b, Amount: money.MustParse("50.01")})
+	if !errors.As(err, &re) || re.Rule != "single" {
+		t.Fatalf("Expecting violation of rule single by the hold, received %v", err)
+	}
+	journal := filepath.Join(t.TempDir(), "bank.wal")
+	d2, _ := Open(Config{DataFile: datafile, Journal: journal})
+	h, err := d2.CreateHold(ds.HoldRequest{AccountId: e, ToId: b, Amount: money.MustParse("60")})
+	if err != nil {
+		t.Fatalf("Failed to place hold - %v", err)
+	}
+	d2.Close()
+
+	// the rules in effect when the hold is captured apply, e.g. after a restart with new rules
+	d2, _ = Open(Config{DataFile: datafile, Journal: journal, Rules: set})
+	defer d2.Close()
+	_, err = d2.CaptureHold(h.Id, nil)
+	if !errors.As(err, &re) || re.Rule != "single" {
+		t.Fatalf("Expecting violation of rule single by the capture, received %v", err)
+	}
+	amount := money.MustParse("50")
+	if h, err = d2.CaptureHold(h.Id, &amount); err != nil || h.Status != ds.HoldCaptured {
+		t.Fatalf("Failed to capture hold within the rules - %+v, %v", h, err)
+	}
+
+	// a refund debits the to account of the transaction and is checked as well
+	if _, err := d2.Transfer(ds.TransferRequest{From: b, To: c, Amount: money.MustParse("40")}); err != nil {
+		t.Fatalf("Failed to transfer - %v", err)
+	}
+	_, err = d2.Refund(h.Tid, nil)
+	if !errors.As(err, &re) || re.Rule != "daily" {
+		t.Fatalf("Expecting violation of rule daily by the refund, received %v", err)
+	}
+	refund := money.MustParse("40")
+	if _, err := d2.Refund(h.Tid, &refund); err != nil {
+		t.Fatalf("Failed to refund within the rules - %v", err)
+	}
+}
+
+func TestFees(t *testing.T) {
+	schedule, err := fees.Parse([]byte(`{"revenue_account": "usd-2", "fees": [{"currency": "USD", "flat": "1.00", "percent": "1"}]}`))
+	if err != nil {
+		t.Fatalf("Failed to parse fee schedule - %v", err)
+	}
+	dir := t.TempDir()
+	cfg := Config{
+		DataFile:    writeCurrencyDataFile(t),
+		Journal:     filepath.Join(dir, "bank.wal"),
+		SnapshotDir: filepath.Join(dir, "snapshots"),
+		FXRates:     testRates{"USD/JPY": money.MustParseRate("151.237")},
+		Fees:        schedule,
+	}
+	d, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Failed to open datastore - %v", err)
+	}
+
+	// the fee is debited on top of the amount and credited to the revenue account
+	res, err := d.Transfer(ds.TransferRequest{From: "usd-1", To: "jpy-1", Amount: money.MustParse("10"), Convert: true})
+	if err != nil {
+		t.Fatalf("Failed to transfer - %v", err)
+	}
+	if res.Fee.String() != "1.10" || res.Balance.String() != "88.90" || res.ToAmount.String() != "1512" {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+	if acct, _ := d.Get("usd-2"); acct.Balance.String() != "51.10" || acct.Available.String() != "51.10" {
+		t.Fatalf("Expecting revenue account balance 51.10, received %+v", acct)
+	}
+	tr, _ := d.GetTransaction(res.Tid)
+	if tr.Fee == nil || tr.Fee.String() != "1.10" || tr.FeeAccountId != "usd-2" || len(tr.Postings) != 6 {
+		t.Fatalf("Unexpected transaction %+v", tr)
+	}
+	page, err := d.History("usd-2", ds.HistoryQuery{Direction: ds.DirectionIn})
+	if err != nil || len(page.Transactions) != 1 || page.Transactions[0].Id != res.Tid {
+		t.Fatalf("Expecting the fee in the history of the revenue account, received %+v, %v", page, err)
+	}
+
+	// the amount and the fee need to be available
+	_, err = d.Transfer(ds.TransferRequest{From: "usd-1", To: "usd-2", Amount: money.MustParse("88.00")})
+	if !errors.Is(err, ds.ErrInsufficientFunds) {
+		t.Fatalf("Expecting ErrInsufficientFunds, received %v", err)
+	}
+	if acct, _ := d.Get("usd-1"); acct.Balance.String() != "88.90" {
+		t.Fatalf("Expecting balance 88.90, received %v", acct.Balance)
+	}
+
+	// transfers from the revenue account are free
+	res, _ = d.Transfer(ds.TransferRequest{From: "usd-2", To: "usd-1", Amount: money.MustParse("5")})
+	if !res.Fee.IsZero() || res.Balance.String() != "46.10" {
+		t.Fatalf("Expecting no fee, received %+v", res)
+	}
+
+	// every leg of a batch is charged
+	b, err := d.TransferBatch([]ds.TransferRequest{{From: "usd-1", To: "usd-2", Amount: money.MustParse("20")}, {From: "usd-1", To: "usd-2", Amount: money.MustParse("30")}})
+	if err != nil {
+		t.Fatalf("Failed to transfer batch - %v", err)
+	}
+	if b.Transactions[0].Fee.String() != "1.20" || b.Transactions[1].Fee.String() != "1.30" {
+		t.Fatalf("Unexpected batch %+v", b)
+	}
+	if acct, _ := d.Get("usd-1"); acct.Balance.String() != "41.40" {
+		t.Fatalf("Expecting balance 41.40, received %v", acct.Balance)
+	}
+
+	// a transfer to the revenue account is in its history once
+	if page, err = d.History("usd-2", ds.HistoryQuery{}); err != nil || len(page.Transactions) != 4 {
+		t.Fatalf("Expecting 4 transactions in the history of the revenue account, received %+v, %v", page, err)
+	}
+
+	// the fee of a hold is reserved with the amount and the fee of the amount captured is charged
+	h, err := d.CreateHold(ds.HoldRequest{AccountId: "usd-1", ToId: "usd-2", Amount: money.MustParse("10")})
+	if err != nil || h.Fee == nil || h.Fee.String() != "1.10" {
+		t.Fatalf("Expecting hold with fee 1.10, received %+v, %v", h, err)
+	}
+	if acct, _ := d.Get("usd-1"); acct.Available.String() != "30.30" {
+		t.Fatalf("Expecting available balance 30.30, received %v", acct.Available)
+	}
+	captured := money.MustParse("5")
+	if h, err = d.CaptureHold(h.Id, &captured); err != nil {
+		t.Fatalf("Failed to capture hold - %v", err)
+	}
+	if tr, _ := d.GetTransaction(h.Tid); tr.Fee == nil || tr.Fee.String() != "1.05" || tr.FeeAccountId != "usd-2" {
+		t.Fatalf("Expecting capture with fee 1.05, received %+v", tr)
+	}
+	if acct, _ := d.Get("usd-1"); acct.Balance.String() != "35.35" || acct.Available.String() != "35.35" {
+		t.Fatalf("Expecting balance 35.35, received %+v", acct)
+	}
+	if r := d.VerifyLedger(); !r.Balanced {
+		t.Fatalf("Expecting balanced ledger, received %+v", r)
+	}
+	expected := d.List()
+	d.Close()
+
+	// the fees are restored from the journal
+	d, err = Open(cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen datastore - %v", err)
+	}
+	if !reflect.DeepEqual(d.List(), expected) {
+		t.Fatalf("Restored accounts %+v do not match with the expected %+v", d.List(), expected)
+	}
+	if tr, _ := d.GetTransaction(b.Transactions[1].Id); tr.Fee == nil || tr.Fee.String() != "1.30" {
+		t.Fatalf("Unexpected transaction %+v", tr)
+	}
+	if r := d.VerifyLedger(); !r.Balanced {
+		t.Fatalf("Expecting balanced ledger, received %+v", r)
+	}
+
+	// fees are not credited to a revenue account that is not active
+	frozen := ds.StatusFrozen
+	if _, err := d.Update("usd-2", ds.AccountUpdate{Status: &frozen}); err != nil {
+		t.Fatalf("Failed to freeze revenue account - %v", err)
+	}
+	_, err = d.Transfer(ds.TransferRequest{From: "usd-1", To: "jpy-1", Amount: money.MustParse("10"), Convert: true})
+	if !errors.Is(err, ds.ErrAccountInactive) {
+		t.Fatalf("Expecting ErrAccountInactive, received %v", err)
+	}
+	_, err = d.TransferBatch([]ds.TransferRequest{{From: "usd-1", To: "jpy-1", Amount: money.MustParse("10"), Convert: true}})
+	if !errors.Is(err, ds.ErrAccountInactive) {
+		t.Fatalf("Expecting ErrAccountInactive, received %v", err)
+	}
+	d.Close()
+
+	// the revenue account needs to exist in the currency of its fees
+	for _, js := range []string{
+		`{"revenue_account": "usd-9", "fees": [{"currency": "USD", "flat": "1.00"}]}`,
+		`{"revenue_account": "jpy-1", "fees": [{"currency": "USD", "flat": "1.00"}]}`,
+	} {
+		schedule, _ := fees.Parse([]byte(js))
+		if _, err := Open(Config{DataFile: cfg.DataFile, Fees: schedule}); err == nil {
+			t.Fatalf("Expecting error for fee schedule %v", js)
+		}
+	}
+}
+
+func TestInterest(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "accounts.json")
+	data := `[
+		{"id": "savings-1", "name": "Savings One", "balance": "10000.00", "type": "savings", "interest_rate": "0.05"},
+		{"id": "interest-usd", "name": "Interest Expense", "balance": "0.00", "overdraft_limit": "1000000.00"},
+		{"id": "usd-1", "name": "Dollar One", "balance": "100.00"}
+	]`
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to write data file - %v", err)
+	}
+	policy, err := interest.New(interest.Actual365, money.RoundHalfEven, map[string]string{"USD": "interest-usd"})
+	if err != nil {
+		t.Fatalf("Failed to create interest policy - %v", err)
+	}
+	clk := clock.NewFake(time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC))
+	cfg := Config{
+		DataFile:    file,
+		Journal:     filepath.Join(dir, "bank.wal"),
+		SnapshotDir: filepath.Join(dir, "snapshots"),
+		Interest:    policy,
+		Clock:       clk,
+	}
+	d, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Failed to open datastore - %v", err)
+	}
+
+	// a month accrues daily and is posted on its last day
+	clk.Set(time.Date(2026, 2, 1, 9, 0, 0, 0, time.UTC))
+	if err := d.accrueInterest(); err != nil {
+		t.Fatalf("Failed to accrue interest - %v", err)
+	}
+	acct, _ := d.Get("savings-1")
+	if acct.Balance.String() != "10042.47" {
+		t.Fatalf("Expecting balance 10042.47 after January, received %v", acct.Balance)
+	}
+	if _, err := d.Snapshot(); err != nil {
+		t.Fatalf("Failed to take snapshot - %v", err)
+	}
+
+	// a year compounds monthly, the rounding remainder carried to the next month
+	clk.Set(time.Date(2027, 1, 1, 9, 0, 0, 0, time.UTC))
+	if err := d.accrueInterest(); err != nil {
+		t.Fatalf("Failed to accrue interest - %v", err)
+	}
+	s, err := d.Interest("savings-1")
+	if err != nil {
+		t.Fatalf("Failed to get interest - %v", err)
+	}
+	if s.Posted.String() != "511.62" || s.Accrued.String() != "-0.00190021" || !s.AccruedThrough.Equal(time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected interest %+v", s)
+	}
+	if acct, _ := d.Get("savings-1"); acct.Balance.String() != "10511.62" {
+		t.Fatalf("Expecting balance 10511.62 after a year, received %v", acct.Balance)
+	}
+	if acct, _ := d.Get("interest-usd"); acct.Balance.String() != "-511.62" {
+		t.Fatalf("Expecting expense balance -511.62, received %v", acct.Balance)
+	}
+	page, _ := d.History("savings-1", ds.HistoryQuery{})
+	if len(page.Transactions) != 12 || page.Transactions[0].InterestFor != "2026-12" || page.Transactions[11].InterestFor != "2026-01" {
+		t.Fatalf("Expecting 12 interest postings, received %+v", page.Transactions)
+	}
+	if r := d.VerifyLedger(); !r.Balanced {
+		t.Fatalf("Expecting balanced ledger, received %+v", r)
+	}
+
+	// accruing again the same day changes nothing
+	if err := d.accrueInterest(); err != nil {
+		t.Fatalf("Failed to accrue interest - %v", err)
+	}
+	if again, _ := d.Interest("savings-1"); again.Accrued.Cmp(s.Accrued) != 0 {
+		t.Fatalf("Expecting accrued %v, received %v", s.Accrued, again.Accrued)
+	}
+	expected := d.List()
+	d.Close()
+
+	// the interest is restored from the snapshot and the journal
+	d, err = Open(cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen datastore - %v", err)
+	}
+	defer d.Close()
+	if !reflect.DeepEqual(d.List(), expected) {
+		t.Fatalf("Restored accounts %+v do not match with the expected %+v", d.List(), expected)
+	}
+	if restored, _ := d.Interest("savings-1"); restored.Accrued.Cmp(s.Accrued) != 0 || restored.Posted.Cmp(s.Posted) != 0 || !restored.AccruedThrough.Equal(s.AccruedThrough) {
+		t.Fatalf("Restored interest %+v does not match with the expected %+v", restored, s)
+	}
+
+	// only savings accounts have an interest rate
+	rate := money.MustParseRate("0.04")
+	if _, err := d.Interest("usd-1"); !errors.Is(err, ds.ErrInvalidAccount) {
+		t.Fatalf("Expecting ErrInvalidAccount, received %v", err)
+	}
+	if _, err := d.Update("usd-1", ds.AccountUpdate{InterestRate: &rate}); !errors.Is(err, ds.ErrInvalidAccount) {
+		t.Fatalf("Expecting ErrInvalidAccount, received %v", err)
+	}
+	if acct, err := d.Update("savings-1", ds.AccountUpdate{InterestRate: &rate}); err != nil || acct.InterestRate.String() != "0.04" {
+		t.Fatalf("Failed to update interest rate - %v", err)
+	}
+	if _, err := d.Create(ds.NewAccount{Id: "savings-2", Name: "Savings Two", Type: ds.TypeSavings}); !errors.Is(err, ds.ErrInvalidAccount) {
+		t.Fatalf("Expecting ErrInvalidAccount for savings account without a rate, received %v", err)
+	}
+	if _, err := d.Create(ds.NewAccount{Id: "savings-2", Name: "Savings Two", Currency: "EUR", Type: ds.TypeSavings, InterestRate: rate}); !errors.Is(err, ds.ErrInvalidAccount) {
+		t.Fatalf("Expecting ErrInvalidAccount for savings account without an expense account, received %v", err)
+	}
+	if acct, err := d.Create(ds.NewAccount{Id: "savings-2", Name: "Savings Two", Type: ds.TypeSavings, InterestRate: rate}); err != nil || acct.Type != ds.TypeSavings {
+		t.Fatalf("Failed to create savings account - %v", err)
+	}
+
+	// savings accounts need interest to be configured
+	if _, err := Open(Config{DataFile: file}); err == nil {
+		t.Fatal("Expecting error for savings accounts without an interest policy")
+	}
+}
+
+func TestInterestExpenseInactive(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "accounts.json")
+	data := `[
+		{"id": "savings-1", "name": "Savings One", "balance": "10000.00", "type": "savings", "interest_rate": "0.05"},
+		{"id": "interest-usd", "name": "Interest Expense", "balance": "0.00", "overdraft_limit": "1000000.00"}
+	]`
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to write data file - %v", err)
+	}
+	policy, _ := interest.New(interest.Actual365, money.RoundHalfEven, map[string]string{"USD": "interest-usd"})
+	status := func(s string) ds.AccountUpdate {
+		return ds.AccountUpdate{Status: &s}
+	}
+	for _, test := range []struct {
+		status string
+		posted string // posted once the expense account is active again, empty when it cannot be
+	}{
+		{ds.StatusFrozen, "80.82"},
+		{ds.StatusClosed, ""},
+	} {
+		clk := clock.NewFake(time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC))
+		d, err := Open(Config{DataFile: file, Interest: policy, Clock: clk})
+		if err != nil {
+			t.Fatalf("Failed to open datastore - %v", err)
+		}
+
+		// the interest is not posted from an expense account that is not active
+		if _, err := d.Update("interest-usd", status(test.status)); err != nil {
+			t.Fatalf("Failed to change the status of the expense account to %v - %v", test.status, err)
+		}
+		clk.Set(time.Date(2026, 2, 1, 9, 0, 0, 0, time.UTC))
+		if err := d.accrueInterest(); err != nil {
+			t.Fatalf("Failed to accrue interest - %v", err)
+		}
+		if acct, _ := d.Get("interest-usd"); acct.Balance.String() != "0.00" {
+			t.Fatalf("%v: expecting expense balance 0.00, received %v", test.status, acct.Balance)
+		}
+		if s, _ := d.Interest("savings-1"); !s.Posted.IsZero() || s.Accrued.Sign() <= 0 {
+			t.Fatalf("%v: expecting the interest accrued and not posted, received %+v", test.status, s)
+		}
+
+		// the interest accrued is posted at the end of a month the expense account is active
+		if test.posted != "" {
+			if _, err := d.Update("interest-usd", status(ds.StatusActive)); err != nil {
+				t.Fatalf("Failed to activate the expense account - %v", err)
+			}
+			clk.Set(time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC))
+			if err := d.accrueInterest(); err != nil {
+				t.Fatalf("Failed to accrue interest - %v", err)
+			}
+			if s, _ := d.Interest("savings-1"); s.Posted.String() != test.posted {
+				t.Fatalf("Expecting posted %v, received %+v", test.posted, s)
+			}
+			if r := d.VerifyLedger(); !r.Balanced {
+				t.Fatalf("Expecting balanced ledger, received %+v", r)
+			}
+		}
+		d.Close()
+	}
+}
+
+func TestApprovals(t *testing.T) {
+	dir := t.TempDir()
+	policy, err := approvals.New(map[string]money.Money{"USD": money.MustParse("100")}, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create approval policy - %v", err)
+	}
+	clk := clock.NewFake(time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC))
+	cfg := Config{
+		DataFile:    datafile,
+		Journal:     filepath.Join(dir, "bank.wal"),
+		SnapshotDir: filepath.Join(dir, "snapshots"),
+		Approvals:   policy,
+		Clock:       clk,
+	}
+	d, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Failed to open datastore - %v", err)
+	}
+	d.Create(ds.NewAccount{Id: "maker", Name: "Maker", Balance: money.MustParse("1000")})
+	d.Create(ds.NewAccount{Id: "payee", Name: "Payee"})
+
+	// transfers up to the threshold, or not requiring approval, are executed
+	req := ds.TransferRequest{From: "maker", To: "payee", Amount: money.MustParse("100"), RequireApproval: true}
+	if res, err := d.Transfer(req); err != nil || res.Tid == 0 || res.Pending != nil {
+		t.Fatalf("Expecting the transfer executed, received %+v - %v", res, err)
+	}
+
+	// transfers above the threshold hold their funds until approved
+	req.Amount = money.MustParse("500")
+	if _, err := d.Transfer(req); !errors.Is(err, ds.ErrPrincipalRequired) {
+		t.Fatalf("Expecting ErrPrincipalRequired, received %v", err)
+	}
+	req.Principal = "alice"
+	res, err := d.Transfer(req)
+	if err != nil || res.Tid != 0 || res.Pending == nil {
+		t.Fatalf("Expecting the transfer pending, received %+v - %v", res, err)
+	}
+	p := *res.Pending
+	if p.Status != ds.PendingAwaiting || p.RequestedBy != "alice" || p.Amount.String() != "500.00" || !p.Expires.Equal(p.Requested.Add(24*time.Hour)) {
+		t.Fatalf("Unexpected pending transfer %+v", p)
+	}
+	if a, _ := d.Get("maker"); a.Balance.String() != "900.00" || a.Available.String() != "400.00" {
+		t.Fatalf("Expecting balance 900.00 and available 400.00, received %v and %v", a.Balance, a.Available)
+	}
+	if _, err := d.CaptureHold(p.HoldId, nil); !errors.Is(err, ds.ErrInvalidHold) {
+		t.Fatalf("Expecting ErrInvalidHold, received %v", err)
+	}
+	if _, err := d.VoidHold(p.HoldId); !errors.Is(err, ds.ErrInvalidHold) {
+		t.Fatalf("Expecting ErrInvalidHold, received %v", err)
+	}
+
+	// the requester cannot approve the transfer
+	if _, err := d.ApprovePending(p.Id, "alice"); !errors.Is(err, ds.ErrSelfApproval) {
+		t.Fatalf("Expecting ErrSelfApproval, received %v", err)
+	}
+	if _, err := d.ApprovePending(p.Id, ""); !errors.Is(err, ds.ErrPrincipalRequired) {
+		t.Fatalf("Expecting ErrPrincipalRequired, received %v", err)
+	}
+	if _, err := d.ApprovePending(99, "bob"); !errors.Is(err, ds.ErrPendingNotFound) {
+		t.Fatalf("Expecting ErrPendingNotFound, received %v", err)
+	}
+	clk.Advance(time.Hour)
+	p, err = d.ApprovePending(p.Id, "bob")
+	if err != nil || p.Status != ds.PendingApproved || p.DecidedBy != "bob" || p.Tid == 0 || p.Decided == nil {
+		t.Fatalf("Expecting the transfer approved, received %+v - %v", p, err)
+	}
+	if a, _ := d.Get("maker"); a.Balance.String() != "400.00" || a.Available.String() != "400.00" {
+		t.Fatalf("Expecting balance and available 400.00, received %v and %v", a.Balance, a.Available)
+	}
+	if h, _ := d.GetHold(p.HoldId); h.Status != ds.HoldCaptured || h.Tid != p.Tid {
+		t.Fatalf("Expecting the hold captured, received %+v", h)
+	}
+	if tr, err := d.GetTransaction(p.Tid); err != nil || tr.ToId != "payee" || tr.Amount.String() != "500.00" {
+		t.Fatalf("Unexpected approved transaction: %+v, %v", tr, err)
+	}
+	if _, err := d.ApprovePending(p.Id, "carol"); !errors.Is(err, ds.ErrPendingInactive) {
+		t.Fatalf("Expecting ErrPendingInactive, received %v", err)
+	}
+
+	// the requester can withdraw the transfer
+	req.Amount = money.MustParse("200")
+	res, _ = d.Transfer(req)
+	p, err = d.RejectPending(res.Pending.Id, "alice", "wrong payee")
+	if err != nil || p.Status != ds.PendingRejected || p.Reason != "wrong payee" {
+		t.Fatalf("Expecting the transfer rejected, received %+v - %v", p, err)
+	}
+	if a, _ := d.Get("maker"); a.Available.String() != "400.00" {
+		t.Fatalf("Expecting available 400.00, received %v", a.Available)
+	}
+
+	// transfers not decided in time expire
+	req.Amount = money.MustParse("100.01")
+	res, _ = d.Transfer(req)
+	if _, err := d.Snapshot(); err != nil {
+		t.Fatalf("Failed to take snapshot - %v", err)
+	}
+	clk.Advance(25 * time.Hour)
+	if n := d.expireHolds(clk.Now()); n != 1 {
+		t.Fatalf("Expecting 1 hold to expire, %v expired", n)
+	}
+	if p, _ = d.GetPending(res.Pending.Id); p.Status != ds.PendingExpired || p.Decided == nil {
+		t.Fatalf("Expecting the transfer expired, received %+v", p)
+	}
+	if _, err := d.RejectPending(p.Id, "bob", ""); !errors.Is(err, ds.ErrPendingInactive) {
+		t.Fatalf("Expecting ErrPendingInactive, received %v", err)
+	}
+
+	// batches cannot hold legs waiting for approval
+	if _, err := d.TransferBatch([]ds.TransferRequest{req}); !errors.Is(err, ds.ErrInvalidBatch) {
+		t.Fatalf("Expecting ErrInvalidBatch, received %v", err)
+	}
+
+	if list, err := d.ListPending(ds.PendingAwaiting); err != nil || len(list) != 0 {
+		t.Fatalf("Expecting no transfer pending, received %v - %v", list, err)
+	}
+	if _, err := d.ListPending("open"); !errors.Is(err, ds.ErrInvalidQuery) {
+		t.Fatalf("Expecting ErrInvalidQuery, received %v", err)
+	}
+	expected, _ := d.ListPending("")
+	if len(expected) != 3 {
+		t.Fatalf("Expecting 3 pending transfers, received %v", len(expected))
+	}
+	accounts := d.List()
+	d.Close()
+
+	// the pending transfers are restored from the snapshot and the journal
+	d, err = Open(cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen datastore - %v", err)
+	}
+	defer d.Close()
+	if list, _ := d.ListPending(""); !reflect.DeepEqual(list, expected) {
+		t.Fatalf("Expecting %+v, received %+v", expected, list)
+	}
+	if !reflect.DeepEqual(accounts, d.List()) {
+		t.Fatal("Restored []Accounts data does not match with the expected")
+	}
+
+	// holds and captures above the threshold are rejected, they would skip the approval
+	if _, err := d.CreateHold(ds.HoldRequest{AccountId: "maker", ToId: "payee", Amount: money.MustParse("100.01")}); !errors.Is(err, ds.ErrInvalidHold) {
+		t.Fatalf("Expecting ErrInvalidHold, received %v", err)
+	}
+	d.approvals = nil
+	h, err := d.CreateHold(ds.HoldRequest{AccountId: "maker", ToId: "payee", Amount: money.MustParse("150")})
+	if err != nil {
+		t.Fatalf("Failed to place hold - %v", err)
+	}
+	d.approvals = cfg.Approvals // as after a restart with the threshold lowered
+	if _, err := d.CaptureHold(h.Id, nil); !errors.Is(err, ds.ErrInvalidHold) {
+		t.Fatalf("Expecting ErrInvalidHold, received %v", err)
+	}
+	captured := money.MustParse("100")
+	if h, err = d.CaptureHold(h.Id, &captured); err != nil || h.Status != ds.HoldCaptured {
+		t.Fatalf("Expecting the hold captured up to the threshold, received %+v - %v", h, err)
+	}
+
+	// the expiry cannot exceed the expiry of holds
+	policy, _ = approvals.New(nil, MaxHoldExpiry+time.Hour)
+	if _, err := Open(Config{DataFile: datafile, Approvals: policy}); err == nil {
+		t.Fatal("Expecting error for an expiry above the maximum hold expiry")
+	}
+}
+
+func TestCreateAndTransferParallel(t *testing.T) {
+	d, _ := Load(datafile)
+	t.Run("group", func(t *testing.T) {
+		for i := 0; i < 50; i++ {
+			i := i
+			t.Run(fmt.Sprintf("Create/%v", i), func(t *testing.T) {
+				t.Parallel()
+				if _, err := d.Create(ds.NewAccount{Id: fmt.Sprintf("parallel-%v", i), Name: "Parallel"}); err != nil {
+					t.Errorf("Failed to create account - %v", err)
+				}
+			})
+			t.Run(fmt.Sprintf("Transfer/%v", i), func(t *testing.T) {
+				t.Parallel()
+				if _, err := d.Transfer(ds.TransferRequest{From: gAccounts[i].Id, To: gAccounts[i+1].Id, Amount: money.MustParse("0.01")}); err != nil {
+					t.Errorf("Failed to transfer funds - %v", err)
+				}
+			})
+			t.Run(fmt.Sprintf("List/%v", i), func(t *testing.T) {
+				t.Parallel()
+				d.List()
+			})
+		}
+	})
+	if n := len(d.List()); n != len(gAccounts)+50 {
+		t.Fatalf("Expecting %v accounts, received %v", len(gAccounts)+50, n)
+	}
+}
+
+// List all the accounts by locking every row, the implementation
+// List had before versions, for comparison in the benchmarks.
+func (d *datastore) lockingList() []ds.Account {
+	d.lockTable()
+	defer d.unlockTable()
+	dst := make([]ds.Account, len(d.accounts))
+	copy(dst, d.accounts)
+	return dst
+}
+
+// compare the throughput of concurrent transfers with one in every 10
+// operations listing the accounts, using versions and locking every row.
+func BenchmarkListAndTransfer(b *testing.B) {
+	for _, impl := range []string{"versions", "locking"} {
+		impl := impl
+		b.Run(impl, func(b *testing.B) {
+			d, _ := Load(datafile)
+			list := d.List
+			if impl == "locking" {
+				list = d.lockingList
+			}
+			var seed int64
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+				for i := 0; pb.Next(); i++ {
+					if i%10 == 0 {
+						list()
+						continue
+					}
+					from, to := r.Intn(len(gAccounts)), r.Intn(len(gAccounts))
+					d.Transfer(ds.TransferRequest{From: gAccounts[from].Id, To: gAccounts[to].Id, Amount: money.New(1, 2)})
+				}
+			})
+		})
+	}
+}
+
+// compare the ns/op for 10 thousand and 1 million transactions.
+func BenchmarkHistory(b *testing.B) {
+	for _, n := range []int{10000, 1000000} {
+		d, _ := Load(datafile)
+		fillTransactions(d, n, 1)
+		id := gAccounts[0].Id
+
+		// a cursor in the middle of the account history
+		at := d.byAccount[id]
+		cursor := encodeCursor(d.transactions[at.debits[len(at.debits)/2]].tid)
+
+		b.Run(fmt.Sprintf("newest/%v", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				d.History(id, ds.HistoryQuery{Limit: 50})
+			}
+		})
+		b.Run(fmt.Sprintf("cursor/%v", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				d.History(id, ds.HistoryQuery{Limit: 50, Cursor: cursor, Direction: ds.DirectionOut})
+			}
+		})
+		b.Run(fmt.Sprintf("transaction/%v", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				d.GetTransaction(uint64(i%n) + 1)
+			}
+		})
+	}
+}
+
 // end-of-file
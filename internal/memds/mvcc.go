@@ -0,0 +1,227 @@
+// Implements multi-version reads of the accounts for the in-memory datastore.
+//
+// Writers change the accounts under the row locks as before, and on commit,
+// still holding tlock, install a new version of every account they changed,
+// tagged with the lsn of the change, and then publish that lsn. A reader takes
+// the published lsn as its snapshot and, for every account, walks the version
+// chain from the newest version to the first one at or before its snapshot.
+// Readers take no row locks, so List never blocks transfers and always sees a
+// consistent point-in-time view of all the accounts.
+//
+// Versions no reader can need are trimmed on commit. Readers register their
+// snapshot lsn while they read, and every chain keeps the versions newer than
+// the oldest registered snapshot plus the newest version at or before it.
+package memds
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"paytabs/internal/ds"
+)
+
+// structure representing a committed version of an account
+type version struct {
+	lsn     uint64       // lsn of the change that created the version
+	account ds.Account   // account details as of the change
+	prev    atomic.Value // *version, the previous version, nil once trimmed
+}
+
+// versions of a single account, newest first
+type versionChain struct {
+	head atomic.Value // *version, the newest version
+}
+
+// structure tracking the snapshots of the readers in progress
+type readerRegistry struct {
+	lock    sync.Mutex
+	readers map[uint64]int // number of readers by snapshot lsn
+}
+
+// Returns the newest version at or before the snapshot lsn,
+// nil when the account did not exist yet.
+func (c *versionChain) at(snapshot uint64) *version {
+	v := c.head.Load().(*version)
+	for v != nil && v.lsn > snapshot {
+		v = v.prev.Load().(*version)
+	}
+	return v
+}
+
+// Push a new version of the account, trimming the versions older than
+// the newest version at or before floor.
+//
+// Caller must hold tlock.
+func (c *versionChain) push(lsn uint64, a ds.Account, floor uint64) {
+	v := &version{lsn: lsn, account: a}
+	v.prev.Store(c.head.Load().(*version))
+	c.head.Store(v)
+
+	// no reader needs anything older than the newest version at or before floor
+	for ; v != nil; v = v.prev.Load().(*version) {
+		if v.lsn <= floor {
+			v.prev.Store((*version)(nil))
+			break
+		}
+	}
+}
+
+// Build the version chains from the current accounts and publish them.
+//
+// Called once the datastore is loaded, before it is in use.
+func (d *datastore) initVersions() {
+	d.registry.readers = make(map[uint64]int)
+	chains := make([]*versionChain, len(d.accounts))
+	for i := range d.accounts {
+		chains[i] = newVersionChain()
+		chains[i].push(d.lsn, d.accounts[i], d.lsn)
+	}
+	d.chains.Store(chains)
+	atomic.StoreUint64(&d.published, d.lsn)
+}
+
+// Returns an empty version chain.
+func newVersionChain() *versionChain {
+	c := new(versionChain)
+	c.head.Store((*version)(nil))
+	return c
+}
+
+// Install the current state of the given accounts as versions at the current
+// lsn and publish the lsn. Accounts appended to the table get a new chain.
+//
+// Caller must hold tlock and the row locks of the accounts.
+func (d *datastore) commitVersions(rows ...int) {
+	floor := d.oldestSnapshot()
+	chains := d.chains.Load().([]*versionChain)
+	if len(chains) < len(d.accounts) {
+		// accounts were created, readers keep using the chains they loaded
+		grown := make([]*versionChain, len(d.accounts))
+		copy(grown, chains)
+		for i := len(chains); i < len(grown); i++ {
+			grown[i] = newVersionChain()
+		}
+		chains = grown
+		d.chains.Store(chains)
+	}
+	for _, i := range rows {
+		chains[i].push(d.lsn, d.accounts[i], floor)
+	}
+	atomic.StoreUint64(&d.published, d.lsn)
+}
+
+// Returns the oldest snapshot lsn a reader may be using.
+func (d *datastore) oldestSnapshot() uint64 {
+	d.registry.lock.Lock()
+	defer d.registry.lock.Unlock()
+
+	floor := atomic.LoadUint64(&d.published)
+	for lsn := range d.registry.readers {
+		if lsn < floor {
+			floor = lsn
+		}
+	}
+	return floor
+}
+
+// Register a reader, returns its snapshot lsn.
+func (d *datastore) beginRead() uint64 {
+	d.registry.lock.Lock()
+	defer d.registry.lock.Unlock()
+
+	snapshot := atomic.LoadUint64(&d.published)
+	d.registry.readers[snapshot]++
+	return snapshot
+}
+
+// Unregister a reader registered with the given snapshot lsn.
+func (d *datastore) endRead(snapshot uint64) {
+	d.registry.lock.Lock()
+	defer d.registry.lock.Unlock()
+
+	if d.registry.readers[snapshot]--; d.registry.readers[snapshot] <= 0 {
+		delete(d.registry.readers, snapshot)
+	}
+}
+
+// List all the Accounts in the datastore.
+//
+// Returns a consistent point-in-time view of the accounts without
+// taking any row locks, concurrent transfers are not blocked.
+func (d *datastore) List() []ds.Account {
+	log.Printf("[memds]List() called")
+
+	snapshot := d.beginRead()
+	defer d.endRead(snapshot)
+
+	// chains are loaded after the snapshot, so they include every account
+	// created at or before it
+	chains := d.chains.Load().([]*versionChain)
+	dst := make([]ds.Account, 0, len(chains))
+	for _, c := range chains {
+		if v := c.at(snapshot); v != nil {
+			dst = append(dst, v.account)
+		}
+	}
+
+	log.Printf("[memds]returing from List() with %v accounts at lsn: %v\n", len(dst), snapshot)
+	return dst
+}
+
+// iterator over the accounts at a snapshot
+type accountIterator struct {
+	d        *datastore
+	snapshot uint64
+	chains   []*versionChain
+	next     int         // position of the next chain to read
+	account  *ds.Account // current account
+	closed   bool
+}
+
+// Iterate over all the Accounts in the datastore.
+//
+// The iterator reads a consistent point-in-time view of the accounts, one
+// account at a time, without copying the accounts or taking any row locks.
+// Versions are kept for the snapshot of the iterator until it is closed.
+func (d *datastore) Accounts() ds.AccountIterator {
+	log.Printf("[memds]Accounts() called")
+
+	snapshot := d.beginRead()
+	return &accountIterator{d: d, snapshot: snapshot, chains: d.chains.Load().([]*versionChain)}
+}
+
+// Advance to the next account, returns false when there are no more accounts.
+func (it *accountIterator) Next() bool {
+	for !it.closed && it.next < len(it.chains) {
+		v := it.chains[it.next].at(it.snapshot)
+		it.next++
+		if v != nil {
+			it.account = &v.account
+			return true
+		}
+	}
+	it.account = nil
+	return false
+}
+
+// Returns the current account.
+func (it *accountIterator) Account() ds.Account {
+	if it.account == nil {
+		return ds.Account{}
+	}
+	return *it.account
+}
+
+// Release the snapshot of the iterator.
+func (it *accountIterator) Close() {
+	if it.closed {
+		return
+	}
+	it.closed = true
+	it.account = nil
+	it.d.endRead(it.snapshot)
+	log.Printf("[memds]Accounts: iterator at lsn: %v closed after %v accounts\n", it.snapshot, it.next)
+}
+
+// end-of-file
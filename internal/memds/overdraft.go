@@ -0,0 +1,146 @@
+// Implements overdraft limits and events for the in-memory datastore.
+//
+// An account can spend its available balance plus its overdraft limit, so its
+// ledger balance can go below zero down to the negated limit. Every time a
+// transaction moves the balance of an account across zero, below it or back to
+// zero or above, an overdraft event is recorded for the account. Lowering the
+// limit of an account in overdraft only stops further spending, the balance is
+// left as it is.
+package memds
+
+import (
+	"log"
+	"math"
+
+	"paytabs/internal/ds"
+	"paytabs/internal/money"
+)
+
+// Returns the amount the account can spend, its available balance plus its overdraft limit.
+func spendable(a *ds.Account) money.Money {
+	return capped(a.Available, a.OverdraftLimit)
+}
+
+// Returns the sum of the amount and the non negative extra amount, capped at
+// the largest amount, which is more than any amount that can be debited.
+func capped(amount money.Money, extra money.Money) money.Money {
+	sum, err := amount.CheckedAdd(extra)
+	if err != nil {
+		scale := amount.Scale()
+		if extra.Scale() > scale {
+			scale = extra.Scale()
+		}
+		return money.New(math.MaxInt64, scale)
+	}
+	return sum
+}
+
+// Returns the balance after crediting the amount to the account.
+//
+// Returns error if the balance would be out of range.
+func checkCredit(a *ds.Account, balance money.Money, amount money.Money) (money.Money, error) {
+	after, err := balance.CheckedAdd(amount)
+	if err != nil {
+		log.Printf("[memds]credit of %v %v to account id: %v is out of range\n", amount, a.Currency, a.Id)
+		return money.Money{}, ds.Errorf(ds.ErrInvalidAmount, "credit of %v %v to account id: %v is out of range - %v", amount, a.Currency, a.Id, err)
+	}
+	return after, nil
+}
+
+// Validate the overdraft limit for an account in the currency.
+//
+// Returns the limit in the minor units of the currency.
+func checkOverdraftLimit(limit money.Money, currency string) (money.Money, error) {
+	if limit.Sign() < 0 {
+		return money.Money{}, ds.Errorf(ds.ErrInvalidAmount, "overdraft limit cannot be a negative value")
+	}
+	c, err := money.LookupCurrency(currency)
+	if err != nil {
+		return money.Money{}, err
+	}
+	limit, err = limit.Rescale(c.Exponent)
+	if err != nil {
+		return money.Money{}, ds.Errorf(ds.ErrInvalidAmount, "invalid overdraft limit for currency %v - %v", currency, err)
+	}
+	return limit, nil
+}
+
+// Move the amounts of the transaction between the ledger balances of the accounts.
+//
+// The fee of the transaction moves from the from account to the revenue
+// account. Records an overdraft event for an account whose balance crosses
+// zero. Caller must hold the row locks of the accounts and tlock.
+func (d *datastore) moveBalances(si int, di int, t *transaction) {
+	before := d.accounts[si].Balance
+	d.accounts[si].Balance = before.Sub(t.amount).Sub(t.fee)
+	d.noteOverdraft(si, before, t)
+
+	before = d.accounts[di].Balance
+	d.accounts[di].Balance = before.Add(t.toAmount)
+	d.noteOverdraft(di, before, t)
+
+	if t.feeTo != "" {
+		fi := d.index[t.feeTo]
+		before = d.accounts[fi].Balance
+		d.accounts[fi].Balance = before.Add(t.fee)
+		d.noteOverdraft(fi, before, t)
+	}
+}
+
+// Record an overdraft event when the balance of the account crossed zero.
+//
+// Caller must hold the row lock of the account and tlock.
+func (d *datastore) noteOverdraft(i int, before money.Money, t *transaction) {
+	a := &d.accounts[i]
+	var event string
+	switch {
+	case before.Sign() >= 0 && a.Balance.Sign() < 0:
+		event = ds.OverdraftEntered
+	case before.Sign() < 0 && a.Balance.Sign() >= 0:
+		event = ds.OverdraftLeft
+	default:
+		return
+	}
+	d.addOverdraftEvent(ds.OverdraftEvent{
+		AccountId: a.Id,
+		Event:     event,
+		Balance:   a.Balance,
+		Currency:  a.Currency,
+		Limit:     a.OverdraftLimit,
+		Tid:       t.tid,
+		Date:      t.date,
+	})
+	log.Printf("[memds]account id: %v %v overdraft, balance: %v, overdraft limit: %v, transaction id: %v\n", a.Id, event, a.Balance, a.OverdraftLimit, t.tid)
+}
+
+// Add the overdraft event to the events of its account.
+//
+// Caller must hold tlock, unless the datastore is not yet in use.
+func (d *datastore) addOverdraftEvent(e ds.OverdraftEvent) {
+	d.overdraftEvents[e.AccountId] = append(d.overdraftEvents[e.AccountId], e)
+}
+
+// Get the overdraft events of the account with the given id, oldest first.
+//
+// Returns error if an account with such id does not exist.
+func (d *datastore) OverdraftEvents(id string) ([]ds.OverdraftEvent, error) {
+	log.Printf("[memds]OverdraftEvents() called with id: %v\n", id)
+
+	d.alock.RLock()
+	_, ok := d.index[id]
+	d.alock.RUnlock()
+	if !ok {
+		log.Printf("[memds]OverdraftEvents: account with id: %v does not exist\n", id)
+		return nil, ds.Errorf(ds.ErrAccountNotFound, "account with id: %v does not exist", id)
+	}
+
+	d.tlock.Lock()
+	defer d.tlock.Unlock()
+	events := make([]ds.OverdraftEvent, len(d.overdraftEvents[id]))
+	copy(events, d.overdraftEvents[id])
+
+	log.Printf("[memds]returning from OverdraftEvents() with %v events\n", len(events))
+	return events, nil
+}
+
+// end-of-file
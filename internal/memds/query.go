@@ -0,0 +1,222 @@
+// Implements paged, filtered and sorted account queries for the in-memory datastore.
+//
+// A query reads the account versions at a snapshot, like List, and keeps only
+// the accounts of the requested page while it scans them, so the memory used is
+// proportional to the page size rather than the number of accounts. Pages are
+// continued using a cursor holding the sort key of the last account returned,
+// so accounts created or changed between the pages do not shift the pages.
+package memds
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+
+	"paytabs/internal/ds"
+	"paytabs/internal/money"
+)
+
+// compares two accounts in the order of a query, returns -1, 0 or +1
+type accountOrder func(a *ds.Account, b *ds.Account) int
+
+// Compare two strings, returns -1, 0 or +1.
+func compareStrings(a string, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Returns the order for the sort of a query.
+//
+// Accounts with equal sort keys are ordered by id, so the order is total.
+func orderFor(s string) (accountOrder, error) {
+	desc := strings.HasPrefix(s, "-")
+	key := strings.TrimPrefix(s, "-")
+
+	var cmp accountOrder
+	switch key {
+	case ds.SortById, "":
+		cmp = func(a *ds.Account, b *ds.Account) int { return compareStrings(a.Id, b.Id) }
+	case ds.SortByName:
+		cmp = func(a *ds.Account, b *ds.Account) int {
+			if c := compareStrings(a.Name, b.Name); c != 0 {
+				return c
+			}
+			return compareStrings(a.Id, b.Id)
+		}
+	case ds.SortByBalance:
+		cmp = func(a *ds.Account, b *ds.Account) int {
+			if c := a.Balance.Cmp(b.Balance); c != 0 {
+				return c
+			}
+			return compareStrings(a.Id, b.Id)
+		}
+	default:
+		return nil, ds.Errorf(ds.ErrInvalidQuery, "invalid sort: %q, expecting %q, %q or %q, optionally prefixed with \"-\"", s, ds.SortById, ds.SortByName, ds.SortByBalance)
+	}
+	if desc {
+		return func(a *ds.Account, b *ds.Account) int { return -cmp(a, b) }, nil
+	}
+	return cmp, nil
+}
+
+// contents of a list cursor, the sort and the sort key of the last account returned
+type listCursor struct {
+	Sort    string      `json:"s"`
+	Id      string      `json:"i"`
+	Name    string      `json:"n,omitempty"`
+	Balance money.Money `json:"b"`
+}
+
+// Encode the position after the account as an opaque cursor.
+func encodeListCursor(s string, a *ds.Account) string {
+	js, _ := json.Marshal(listCursor{Sort: s, Id: a.Id, Name: a.Name, Balance: a.Balance})
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+// Decode the cursor into the last account returned.
+//
+// Returns error if the cursor is invalid or was returned for a different sort.
+func decodeListCursor(cursor string, s string) (*ds.Account, error) {
+	js, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ds.Errorf(ds.ErrInvalidQuery, "invalid cursor: %q", cursor)
+	}
+	var c listCursor
+	if err := json.Unmarshal(js, &c); err != nil {
+		return nil, ds.Errorf(ds.ErrInvalidQuery, "invalid cursor: %q", cursor)
+	}
+	if c.Sort != s {
+		return nil, ds.Errorf(ds.ErrInvalidQuery, "invalid cursor: %q, returned for sort: %q", cursor, c.Sort)
+	}
+	return &ds.Account{Id: c.Id, Name: c.Name, Balance: c.Balance}, nil
+}
+
+// Validate the list query, filling in the defaults.
+func checkListQuery(q ds.ListQuery) (ds.ListQuery, error) {
+	if q.Limit < 0 || q.Limit > ds.MaxListLimit {
+		return q, ds.Errorf(ds.ErrInvalidQuery, "invalid limit: %v, expecting a value between 1 and %v", q.Limit, ds.MaxListLimit)
+	}
+	if q.Limit == 0 {
+		q.Limit = ds.DefaultListLimit
+	}
+	if q.MinBalance != nil && q.MaxBalance != nil && q.MinBalance.Cmp(*q.MaxBalance) > 0 {
+		return q, ds.Errorf(ds.ErrInvalidQuery, "invalid balance range, min_balance needs to be at most max_balance")
+	}
+	if q.Currency != "" {
+		c, err := money.LookupCurrency(q.Currency)
+		if err != nil {
+			return q, ds.Errorf(ds.ErrInvalidQuery, "%v", err)
+		}
+		q.Currency = c.Code
+	}
+	q.NamePrefix = strings.ToLower(q.NamePrefix)
+	return q, nil
+}
+
+// Returns true if the account matches the filters of the query.
+func matchAccount(q *ds.ListQuery, a *ds.Account) bool {
+	if q.Currency != "" && a.Currency != q.Currency {
+		return false
+	}
+	if q.NamePrefix != "" && !strings.HasPrefix(strings.ToLower(a.Name), q.NamePrefix) {
+		return false
+	}
+	if q.MinBalance != nil && a.Balance.Cmp(*q.MinBalance) < 0 {
+		return false
+	}
+	if q.MaxBalance != nil && a.Balance.Cmp(*q.MaxBalance) > 0 {
+		return false
+	}
+	return true
+}
+
+// bounded max-heap keeping the first accounts in the order of a query
+type pageHeap struct {
+	accounts []ds.Account
+	cmp      accountOrder
+}
+
+func (h *pageHeap) Len() int           { return len(h.accounts) }
+func (h *pageHeap) Less(i, j int) bool { return h.cmp(&h.accounts[i], &h.accounts[j]) > 0 }
+func (h *pageHeap) Swap(i, j int)      { h.accounts[i], h.accounts[j] = h.accounts[j], h.accounts[i] }
+func (h *pageHeap) Push(x interface{}) { h.accounts = append(h.accounts, x.(ds.Account)) }
+func (h *pageHeap) Pop() interface{} {
+	n := len(h.accounts)
+	a := h.accounts[n-1]
+	h.accounts = h.accounts[:n-1]
+	return a
+}
+
+// Keep the account if it is among the first size accounts seen so far.
+func (h *pageHeap) offer(a *ds.Account, size int) {
+	if len(h.accounts) < size {
+		heap.Push(h, *a)
+		return
+	}
+	if h.cmp(a, &h.accounts[0]) < 0 {
+		h.accounts[0] = *a
+		heap.Fix(h, 0)
+	}
+}
+
+// Get a page of the accounts matching the query.
+//
+// The accounts are read at a consistent snapshot without taking any row locks.
+// Returns error if the query is invalid.
+func (d *datastore) Query(q ds.ListQuery) (ds.AccountPage, error) {
+	log.Printf("[memds]Query() called with query: %+v\n", q)
+
+	q, err := checkListQuery(q)
+	if err != nil {
+		log.Printf("[memds]Query: %v\n", err)
+		return ds.AccountPage{}, err
+	}
+	cmp, err := orderFor(q.Sort)
+	if err != nil {
+		log.Printf("[memds]Query: %v\n", err)
+		return ds.AccountPage{}, err
+	}
+	var after *ds.Account
+	if q.Cursor != "" {
+		if after, err = decodeListCursor(q.Cursor, q.Sort); err != nil {
+			log.Printf("[memds]Query: %v\n", err)
+			return ds.AccountPage{}, err
+		}
+	}
+
+	snapshot := d.beginRead()
+	defer d.endRead(snapshot)
+
+	// keep one more account than the page size to know if there is a next page
+	h := &pageHeap{accounts: make([]ds.Account, 0, q.Limit+1), cmp: cmp}
+	for _, c := range d.chains.Load().([]*versionChain) {
+		v := c.at(snapshot)
+		if v == nil || !matchAccount(&q, &v.account) {
+			continue
+		}
+		if after != nil && cmp(&v.account, after) <= 0 {
+			continue
+		}
+		h.offer(&v.account, q.Limit+1)
+	}
+
+	page := ds.AccountPage{Accounts: h.accounts}
+	sort.Slice(page.Accounts, func(i, j int) bool { return cmp(&page.Accounts[i], &page.Accounts[j]) < 0 })
+	if len(page.Accounts) > q.Limit {
+		page.Accounts = page.Accounts[:q.Limit]
+		page.NextCursor = encodeListCursor(q.Sort, &page.Accounts[q.Limit-1])
+	}
+
+	log.Printf("[memds]returning from Query() with %v accounts at lsn: %v\n", len(page.Accounts), snapshot)
+	return page, nil
+}
+
+// end-of-file
@@ -0,0 +1,173 @@
+// Implements refunds of completed transactions for the in-memory datastore.
+//
+// A refund transfers all or part of a transaction back, from its to account to
+// its from account, and is recorded as a new transaction linked to the original.
+// The amount refunded so far is tracked on the original transaction, in the
+// currency of its to account, and refunds in total can never exceed the amount
+// the transaction credited. Refunds are checked against the rules as debits of
+// the to account, and are never held for approval. A refund of a cross-currency transaction credits the
+// from account the matching share of the original amount, so refunding all of
+// the transaction, at once or in parts, returns exactly the original amount.
+package memds
+
+import (
+	"fmt"
+	"log"
+
+	"paytabs/internal/ds"
+	"paytabs/internal/money"
+)
+
+// Apply the refund transaction of the transaction at position i.
+//
+// Caller must hold the row locks of both accounts and tlock.
+func (d *datastore) applyRefund(i int, si int, di int, t transaction) {
+	d.transactions[i].refunded = d.transactions[i].refunded.Add(t.amount)
+	d.appendTransaction(t)
+	d.moveBalances(si, di, &t)
+	d.accounts[si].Available = d.accounts[si].Available.Sub(t.amount)
+	d.accounts[di].Available = d.accounts[di].Available.Add(t.toAmount)
+}
+
+// Returns the amount credited back to the from account of the original
+// transaction for refunding the given amount on top of what was refunded.
+func refundCredit(orig *transaction, amount money.Money) (money.Money, error) {
+	if orig.currency == orig.toCurrency {
+		return amount, nil
+	}
+
+	// credit the share of the original amount, less the share already credited
+	before, err := orig.amount.Prorate(orig.refunded, orig.toAmount)
+	if err != nil {
+		return money.Money{}, err
+	}
+	after, err := orig.amount.Prorate(orig.refunded.Add(amount), orig.toAmount)
+	if err != nil {
+		return money.Money{}, err
+	}
+	return after.Sub(before), nil
+}
+
+// Refund all or part of the transaction with the given id.
+//
+// The amount is in the currency of the to account of the transaction, a nil
+// amount refunds all of the transaction not yet refunded. Returns the refund
+// transaction. Returns error if a transaction with such id does not exist, the
+// transaction is itself a refund, the amount is invalid or more than the amount
+// not yet refunded, any of the accounts is not active, the available balance
+// of the to account is insufficient or the refund violates a rule. A refund is
+// not held for approval, it returns at most the amount of a transaction that
+// was approved or below the approval threshold when it was made.
+func (d *datastore) Refund(tid uint64, amount *money.Money) (ds.Transaction, error) {
+	log.Printf("[memds]Refund() called with tid: %v\n", tid)
+
+	d.alock.RLock()
+	defer d.alock.RUnlock()
+
+	d.tlock.Lock()
+	i, ok := d.findTransaction(tid)
+	var orig transaction
+	if ok {
+		orig = d.transactions[i]
+	}
+	d.tlock.Unlock()
+	if !ok {
+		log.Printf("[memds]Refund: transaction with id: %v does not exist\n", tid)
+		return ds.Transaction{}, ds.Errorf(ds.ErrTransactionNotFound, "transaction with id: %v does not exist", tid)
+	}
+	if orig.refundOf != 0 {
+		log.Printf("[memds]Refund: transaction id: %v is a refund of transaction id: %v\n", tid, orig.refundOf)
+		return ds.Transaction{}, ds.Errorf(ds.ErrNotRefundable, "transaction id: %v is a refund of transaction id: %v and cannot be refunded", tid, orig.refundOf)
+	}
+
+	// the refund is transferred from the to account back to the from account
+	c, err := money.LookupCurrency(orig.toCurrency)
+	if err != nil {
+		return ds.Transaction{}, err
+	}
+	var refund money.Money
+	if amount != nil {
+		if amount.Sign() <= 0 {
+			log.Printf("[memds]Refund: refund amount: %v needs to be positive\n", amount)
+			return ds.Transaction{}, ds.Errorf(ds.ErrInvalidAmount, "refund amount needs to be a positive value")
+		}
+		if refund, err = amount.Rescale(c.Exponent); err != nil {
+			log.Printf("[memds]Refund: invalid amount for currency %v - %v\n", c.Code, err)
+			return ds.Transaction{}, ds.Errorf(ds.ErrInvalidAmount, "invalid amount for currency %v - %v", c.Code, err)
+		}
+	}
+
+	// account positions never change
+	si, di := d.index[orig.to], d.index[orig.from]
+	defer d.unlockRows(d.lockRows(si, di))
+
+	for _, a := range []int{si, di} {
+		if d.accounts[a].Status != ds.StatusActive {
+			log.Printf("[memds]Refund: account id: %v is %v\n", d.accounts[a].Id, d.accounts[a].Status)
+			return ds.Transaction{}, ds.Errorf(ds.ErrAccountInactive, "account id: %v is %v", d.accounts[a].Id, d.accounts[a].Status)
+		}
+	}
+
+	// refunds of the transaction are serialized by the row locks
+	d.tlock.Lock()
+	defer d.tlock.Unlock()
+
+	orig = d.transactions[i]
+	remaining := orig.toAmount.Sub(orig.refunded)
+	if amount == nil {
+		refund = remaining
+	}
+	if remaining.IsZero() || refund.Cmp(remaining) > 0 {
+		log.Printf("[memds]Refund: refund amount: %v exceeds the amount not yet refunded: %v\n", refund, remaining)
+		return ds.Transaction{}, ds.Errorf(ds.ErrRefundExceeded, "refund amount: %v exceeds the amount of transaction id: %v not yet refunded: %v %v", refund, tid, remaining, orig.toCurrency)
+	}
+	if spendable(&d.accounts[si]).Cmp(refund) < 0 {
+		log.Printf("[memds]Refund: account id: %s does not have sufficient funds, available balance: %v, overdraft limit: %v\n", orig.to, d.accounts[si].Available, d.accounts[si].OverdraftLimit)
+		return ds.Transaction{}, ds.Errorf(ds.ErrInsufficientFunds, "account id: %v does not have sufficient funds, available balance: %v, overdraft limit: %v", orig.to, d.accounts[si].Available, d.accounts[si].OverdraftLimit)
+	}
+	credit, err := refundCredit(&orig, refund)
+	if err != nil {
+		return ds.Transaction{}, ds.Errorf(ds.ErrInvalidAmount, "failed to convert refund amount - %v", err)
+	}
+	if credit.IsZero() {
+		log.Printf("[memds]Refund: refund amount: %v is too small to convert to %v\n", refund, orig.currency)
+		return ds.Transaction{}, ds.Errorf(ds.ErrInvalidAmount, "refund amount: %v %v is too small to convert to %v", refund, orig.toCurrency, orig.currency)
+	}
+	if _, err := checkCredit(&d.accounts[di], d.accounts[di].Balance, credit); err != nil {
+		return ds.Transaction{}, err
+	}
+
+	// the refund is a debit of the to account, the rules apply to it
+	date := d.transactionDate()
+	if err := d.checkRules(si, refund, date, nil); err != nil {
+		return ds.Transaction{}, err
+	}
+
+	t := transaction{
+		tid:        d.nextTid,
+		date:       date,
+		from:       orig.to,
+		to:         orig.from,
+		amount:     refund,
+		currency:   orig.toCurrency,
+		toAmount:   credit,
+		toCurrency: orig.currency,
+		refundOf:   tid,
+	}
+	if d.journal != nil {
+		e := journalEntry{Lsn: d.lsn + 1, Op: opRefund, Tid: t.tid, RefundOf: tid, Date: t.date, From: t.from, To: t.to, Amount: refund, Currency: t.currency, ToAmount: credit, ToCurrency: t.toCurrency}
+		if err := d.journal.append(&e); err != nil {
+			log.Printf("[memds]Refund: failed to write journal - %v\n", err)
+			return ds.Transaction{}, fmt.Errorf("failed to write journal - %v", err)
+		}
+	}
+	d.lsn += 1
+	d.nextTid += 1
+	d.applyRefund(i, si, di, t)
+	d.commitVersions(si, di)
+
+	log.Printf("[memds]returning from Refund() with tid: %v, refunded: %v of tid: %v\n", t.tid, refund, tid)
+	return t.export(), nil
+}
+
+// end-of-file
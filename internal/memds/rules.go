@@ -0,0 +1,77 @@
+// Evaluates the transfer limits and velocity rules for the in-memory datastore.
+//
+// The rules are checked holding the row locks of the accounts and tlock, after
+// the balance check and before the transfer is journaled, so the debits they
+// see cannot change until the transfer is committed. The recent debits of an
+// account are found in its transaction history using binary searches on the
+// dates, see history.go. Holds are checked when placed and captured, see
+// holds.go, and refunds as debits of the to account of the transaction, see
+// refunds.go.
+package memds
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"paytabs/internal/ds"
+	"paytabs/internal/money"
+	"paytabs/internal/rules"
+)
+
+// activity of an account for the rules, from the debits in its transaction history
+type accountActivity struct {
+	d       *datastore
+	id      string        // account id
+	pending []money.Money // debits of the earlier legs of a batch, not yet applied
+}
+
+// Returns the positions of the debits of the account at or after the given time.
+//
+// Caller must hold tlock.
+func (a *accountActivity) debits(since time.Time) []int {
+	at, ok := a.d.byAccount[a.id]
+	if !ok {
+		return nil
+	}
+	start := sort.Search(len(at.debits), func(k int) bool {
+		return !a.d.transactions[at.debits[k]].date.Before(since)
+	})
+	return at.debits[start:]
+}
+
+// Returns the sum of the debits of the account at or after the given time.
+//
+// A sum out of range is capped at the largest amount.
+func (a *accountActivity) Outflow(since time.Time) money.Money {
+	var sum money.Money
+	for _, i := range a.debits(since) {
+		sum = capped(sum, a.d.transactions[i].amount)
+	}
+	for _, m := range a.pending {
+		sum = capped(sum, m)
+	}
+	return sum
+}
+
+// Returns the number of the debits of the account at or after the given time.
+func (a *accountActivity) Count(since time.Time) int {
+	return len(a.debits(since)) + len(a.pending)
+}
+
+// Check the rules for debiting the amount from the account at the given position.
+//
+// Pending are the amounts debited from the account by the earlier legs of a
+// batch. Returns the violation of the first rule the debit violates.
+// Caller must hold the row lock of the account and tlock.
+func (d *datastore) checkRules(si int, amount money.Money, date time.Time, pending []money.Money) *ds.RuleError {
+	a := &d.accounts[si]
+	v := d.rules.Check(rules.Transfer{Account: a.Id, Amount: amount, Currency: a.Currency, Date: date}, &accountActivity{d, a.Id, pending})
+	if v == nil {
+		return nil
+	}
+	log.Printf("[memds]transfer from account id: %v rejected - %v\n", a.Id, v.Message)
+	return &ds.RuleError{Rule: v.Rule, Message: v.Message}
+}
+
+// end-of-file
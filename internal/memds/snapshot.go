@@ -0,0 +1,369 @@
+// Implements point-in-time snapshots of the in-memory datastore.
+//
+// A snapshot contains all the accounts, the transactions performed, the holds, the
+// transfers held for approval, the unexpired idempotency keys and the lsn of the
+// last change it includes.
+// It is written as a single checksummed record, using the same framing as
+// the journal, to a file named snapshot-<lsn>.snap in the snapshot directory. The newest few snapshots
+// are retained and the journal records contained in all of them are
+// compacted away, so any retained snapshot can still be rolled forward.
+package memds
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"paytabs/internal/ds"
+	"paytabs/internal/money"
+)
+
+const (
+	snapshotPrefix = "snapshot-"
+	snapshotSuffix = ".snap"
+	snapshotRetain = 3 // number of snapshot files to keep
+)
+
+// structure of the transactions stored in a snapshot
+type snapshotTransaction struct {
+	Tid        uint64      `json:"tid"`
+	Date       time.Time   `json:"date"`
+	From       string      `json:"from"`
+	To         string      `json:"to"`
+	Amount     money.Money `json:"amount"`
+	Currency   string      `json:"currency"`
+	ToAmount   money.Money `json:"to_amount"`
+	ToCurrency string      `json:"to_currency"`
+	Rate       money.Rate  `json:"rate"`
+	RefundOf   uint64      `json:"refund_of,omitempty"`
+	Refunded   money.Money `json:"refunded"`
+	Batch      uint64      `json:"batch_id,omitempty"`
+	Fee        money.Money `json:"fee"`
+	FeeTo      string      `json:"fee_to,omitempty"`
+	Interest   string      `json:"interest_for,omitempty"`
+}
+
+// structure of the interest of a savings account stored in a snapshot
+type snapshotAccrual struct {
+	Account string      `json:"account"`
+	Accrued money.Money `json:"accrued"`
+	Posted  money.Money `json:"posted"`
+}
+
+// structure of the idempotency keys stored in a snapshot
+type snapshotIdempotencyKey struct {
+	Key     string            `json:"key"`
+	Hash    string            `json:"hash"`
+	Expires time.Time         `json:"expires"`
+	Result  ds.TransferResult `json:"result"`
+}
+
+// structure of the snapshot file contents
+type snapshot struct {
+	Lsn             uint64                   `json:"lsn"`      // lsn of the last change included
+	NextTid         uint64                   `json:"next_tid"` // next transaction id
+	Date            time.Time                `json:"date"`     // date and time the snapshot was taken
+	Accounts        []ds.Account             `json:"accounts"`
+	Transactions    []snapshotTransaction    `json:"transactions"`
+	IdempotencyKeys []snapshotIdempotencyKey `json:"idempotency_keys,omitempty"` // unexpired keys, in the order they were used
+	Holds           []ds.Hold                `json:"holds,omitempty"`            // all the holds, in id order
+	OverdraftEvents []ds.OverdraftEvent      `json:"overdraft_events,omitempty"` // overdraft events of all the accounts
+	InterestThrough time.Time                `json:"interest_through"`           // last day interest was accrued, zero when never
+	Accruals        []snapshotAccrual        `json:"accruals,omitempty"`         // interest of the savings accounts
+	Pending         []ds.PendingTransfer     `json:"pending,omitempty"`          // all the transfers held for approval, in id order
+}
+
+// Take a snapshot of the datastore and write it to the snapshot directory.
+//
+// The datastore is locked only while its state is copied, the snapshot
+// is written to disk after the locks are released. Supports ds.Snapshotter.
+func (d *datastore) Snapshot() (ds.SnapshotInfo, error) {
+	log.Println("[memds]Snapshot() called")
+
+	if d.snapshotDir == "" {
+		log.Println("[memds]Snapshot: snapshots are not configured")
+		return ds.SnapshotInfo{}, fmt.Errorf("snapshots are not configured")
+	}
+
+	// one snapshot at a time, so compaction never removes newer records
+	d.slock.Lock()
+	defer d.slock.Unlock()
+
+	// copy a consistent state, no transfer can be in progress
+	// while we hold all the row locks and the transaction lock
+	d.lockTable()
+	d.tlock.Lock()
+	snap := snapshot{
+		Lsn:          d.lsn,
+		NextTid:      d.nextTid,
+		Date:         d.clock.Now(),
+		Accounts:     make([]ds.Account, len(d.accounts)),
+		Transactions: make([]snapshotTransaction, len(d.transactions)),
+	}
+	copy(snap.Accounts, d.accounts)
+	for i, t := range d.transactions {
+		snap.Transactions[i] = snapshotTransaction{t.tid, t.date, t.from, t.to, t.amount, t.currency, t.toAmount, t.toCurrency, t.rate, t.refundOf, t.refunded, t.batch, t.fee, t.feeTo, t.interestFor}
+	}
+	d.expireIdempotencyKeys(snap.Date)
+	for _, key := range d.idempotencyOrder {
+		// pending keys belong to transfers not yet committed
+		if r, ok := d.idempotency[key]; ok && !r.pending {
+			snap.IdempotencyKeys = append(snap.IdempotencyKeys, snapshotIdempotencyKey{r.key, r.hash, r.expires, r.result})
+		}
+	}
+	for _, h := range d.holds {
+		snap.Holds = append(snap.Holds, *h)
+	}
+	sort.Slice(snap.Holds, func(i, j int) bool { return snap.Holds[i].Id < snap.Holds[j].Id })
+	for _, p := range d.pending {
+		snap.Pending = append(snap.Pending, *p)
+	}
+	sort.Slice(snap.Pending, func(i, j int) bool { return snap.Pending[i].Id < snap.Pending[j].Id })
+	for _, a := range d.accounts {
+		snap.OverdraftEvents = append(snap.OverdraftEvents, d.overdraftEvents[a.Id]...)
+		if ac, ok := d.accruals[a.Id]; ok {
+			snap.Accruals = append(snap.Accruals, snapshotAccrual{a.Id, ac.accrued, ac.posted})
+		}
+	}
+	snap.InterestThrough = d.accruedThrough
+	d.tlock.Unlock()
+	d.unlockTable()
+	log.Printf("[memds]Snapshot: state copied at lsn: %v\n", snap.Lsn)
+
+	file, err := writeSnapshot(d.snapshotDir, &snap)
+	if err != nil {
+		log.Printf("[memds]Snapshot: failed to write snapshot - %v\n", err)
+		return ds.SnapshotInfo{}, err
+	}
+	log.Printf("[memds]Snapshot: written to file: %v\n", file)
+
+	// the journal records contained in the oldest retained snapshot are no longer needed
+	oldest := removeOldSnapshots(d.snapshotDir)
+	if d.journal != nil && oldest > 0 {
+		d.tlock.Lock()
+		err := d.journal.compact(oldest)
+		d.tlock.Unlock()
+		if err != nil {
+			// the snapshot is still valid, replay skips the records it contains
+			log.Printf("[memds]Snapshot: failed to compact journal - %v\n", err)
+		}
+	}
+
+	return ds.SnapshotInfo{
+		Lsn:          snap.Lsn,
+		File:         file,
+		Date:         snap.Date,
+		Accounts:     len(snap.Accounts),
+		Transactions: len(snap.Transactions),
+	}, nil
+}
+
+// Take snapshots periodically until the datastore is closed.
+func (d *datastore) snapshotLoop(interval time.Duration) {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			if _, err := d.Snapshot(); err != nil {
+				log.Printf("[memds]periodic snapshot failed - %v\n", err)
+			}
+		}
+	}
+}
+
+// Write the snapshot to a new file in the given directory.
+//
+// The snapshot is written to a temporary file which is synced and then
+// renamed, so a crash never leaves a partially written snapshot behind.
+func writeSnapshot(dir string, snap *snapshot) (string, error) {
+	payload, err := json.Marshal(snap)
+	if err != nil {
+		return "", err
+	}
+
+	file := filepath.Join(dir, fmt.Sprintf("%s%020d%s", snapshotPrefix, snap.Lsn, snapshotSuffix))
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(encodeRecord(payload)); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	syncDir(file)
+
+	return file, nil
+}
+
+// List the snapshot files in the directory, newest first.
+func listSnapshots(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() && strings.HasPrefix(name, snapshotPrefix) && strings.HasSuffix(name, snapshotSuffix) {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+
+	// file names embed the zero padded lsn, so they sort in lsn order
+	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+	return files, nil
+}
+
+// Read and validate a snapshot file.
+func readSnapshot(file string) (*snapshot, error) {
+	bytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes) < journalHeaderSize {
+		return nil, fmt.Errorf("snapshot file: %v is truncated", file)
+	}
+	length := binary.LittleEndian.Uint32(bytes[0:4])
+	sum := binary.LittleEndian.Uint32(bytes[4:8])
+	payload := bytes[journalHeaderSize:]
+	if int(length) != len(payload) {
+		return nil, fmt.Errorf("snapshot file: %v is truncated", file)
+	}
+	if crc32.Checksum(payload, crcTable) != sum {
+		return nil, fmt.Errorf("snapshot file: %v checksum mismatch", file)
+	}
+
+	snap := new(snapshot)
+	if err := json.Unmarshal(payload, snap); err != nil {
+		return nil, fmt.Errorf("snapshot file: %v - %v", file, err)
+	}
+	return snap, nil
+}
+
+// Load the newest valid snapshot from the directory.
+//
+// Invalid snapshots are skipped. Returns nil when there is no valid snapshot.
+func loadLatestSnapshot(dir string) (*snapshot, error) {
+	files, err := listSnapshots(dir)
+	if err != nil {
+		log.Printf("[memds]failed to list snapshots: %s - %s\n", dir, err)
+		return nil, err
+	}
+
+	for _, file := range files {
+		log.Printf("[memds]loading snapshot: %v\n", file)
+		snap, err := readSnapshot(file)
+		if err != nil {
+			log.Printf("[memds]skipping invalid snapshot - %v\n", err)
+			continue
+		}
+		log.Printf("[memds]snapshot loaded, lsn: %v, %v accounts, %v transactions\n", snap.Lsn, len(snap.Accounts), len(snap.Transactions))
+		return snap, nil
+	}
+
+	log.Printf("[memds]no valid snapshot found in: %v\n", dir)
+	return nil, nil
+}
+
+// Construct the datastore from a snapshot.
+func fromSnapshot(snap *snapshot) *datastore {
+	// snapshots taken before accounts had a status or type contain only active checking accounts
+	for i := range snap.Accounts {
+		if snap.Accounts[i].Status == "" {
+			snap.Accounts[i].Status = ds.StatusActive
+		}
+		if snap.Accounts[i].Type == "" {
+			snap.Accounts[i].Type = ds.TypeChecking
+		}
+	}
+	d := newDatastore(snap.Accounts)
+	d.lsn = snap.Lsn
+	d.nextTid = snap.NextTid
+	d.transactions = make([]transaction, 0, len(snap.Transactions))
+	for _, t := range snap.Transactions {
+		d.appendTransaction(transaction{t.Tid, t.Date, t.From, t.To, t.Amount, t.Currency, t.ToAmount, t.ToCurrency, t.Rate, t.RefundOf, t.Refunded, t.Batch, t.Fee, t.FeeTo, t.Interest})
+	}
+	d.postSnapshotOpenings()
+	for _, k := range snap.IdempotencyKeys {
+		d.idempotency[k.Key] = &idempotencyRecord{key: k.Key, hash: k.Hash, expires: k.Expires, result: k.Result}
+		d.idempotencyOrder = append(d.idempotencyOrder, k.Key)
+	}
+	for _, h := range snap.Holds {
+		d.addHold(h)
+	}
+	for _, p := range snap.Pending {
+		d.addPending(p)
+	}
+	for _, e := range snap.OverdraftEvents {
+		d.addOverdraftEvent(e)
+	}
+	d.accruedThrough = snap.InterestThrough
+	for _, a := range snap.Accruals {
+		d.accruals[a.Account] = &accrual{accrued: a.Accrued, posted: a.Posted}
+	}
+
+	// snapshots taken before accounts had an available balance have none
+	d.recomputeAvailable()
+	log.Println("[memds]datastore initialization from snapshot complete")
+	return d
+}
+
+// Remove all but the newest few snapshot files.
+//
+// Returns the lsn of the oldest retained snapshot, zero if it cannot be determined.
+func removeOldSnapshots(dir string) uint64 {
+	files, err := listSnapshots(dir)
+	if err != nil {
+		return 0
+	}
+	for i := snapshotRetain; i < len(files); i++ {
+		if err := os.Remove(files[i]); err != nil {
+			log.Printf("[memds]failed to remove old snapshot: %s - %s\n", files[i], err)
+		}
+	}
+	if len(files) > snapshotRetain {
+		files = files[:snapshotRetain]
+	}
+	if len(files) == 0 {
+		return 0
+	}
+
+	// lsn is embedded in the file name
+	name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(files[len(files)-1]), snapshotPrefix), snapshotSuffix)
+	lsn, err := strconv.ParseUint(name, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return lsn
+}
+
+// end-of-file
@@ -0,0 +1,362 @@
+// Implements an exact decimal money type.
+//
+// An amount is held as an integer number of minor units together with the
+// scale, the number of decimal digits in the minor unit of the currency.
+// For example 87.11 with scale 2 is held as 8711 minor units. Amounts are
+// parsed from and formatted to their decimal text representation without
+// ever going through a floating point value.
+package money
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultScale = 2  // scale used when the currency is not known
+	MaxScale     = 18 // largest scale supported, 10^18 still fits in int64
+)
+
+// structure representing an amount of money
+type Money struct {
+	units int64 // amount in minor units
+	scale uint8 // number of decimal digits in the minor unit
+}
+
+// Construct an amount from its minor units and scale.
+func New(units int64, scale uint8) Money {
+	return Money{units: units, scale: scale}
+}
+
+// Parse a decimal amount such as "87.11", "-0.5" or "100".
+//
+// The scale of the returned amount is the number of decimals given.
+// Exponents, spaces and other non decimal notations are rejected.
+func Parse(s string) (Money, error) {
+	text := s
+	negative := false
+	if len(text) > 0 && (text[0] == '-' || text[0] == '+') {
+		negative = text[0] == '-'
+		text = text[1:]
+	}
+
+	whole, frac := text, ""
+	if i := strings.IndexByte(text, '.'); i >= 0 {
+		whole, frac = text[:i], text[i+1:]
+		if frac == "" {
+			return Money{}, fmt.Errorf("invalid amount: %q, expecting digits after the decimal point", s)
+		}
+	}
+	if whole == "" {
+		return Money{}, fmt.Errorf("invalid amount: %q, expecting digits before the decimal point", s)
+	}
+	if len(frac) > MaxScale {
+		return Money{}, fmt.Errorf("invalid amount: %q, more than %v decimals", s, MaxScale)
+	}
+
+	var units int64
+	for _, c := range whole + frac {
+		if c < '0' || c > '9' {
+			return Money{}, fmt.Errorf("invalid amount: %q, unexpected character %q", s, c)
+		}
+		if units > (math.MaxInt64-int64(c-'0'))/10 {
+			return Money{}, fmt.Errorf("invalid amount: %q, value out of range", s)
+		}
+		units = units*10 + int64(c-'0')
+	}
+	if negative {
+		units = -units
+	}
+
+	return Money{units: units, scale: uint8(len(frac))}, nil
+}
+
+// Parse a decimal amount for a currency with the given scale.
+//
+// Returns error if the amount has more decimals than the scale allows.
+func ParseScale(s string, scale uint8) (Money, error) {
+	m, err := Parse(s)
+	if err != nil {
+		return Money{}, err
+	}
+	return m.Rescale(scale)
+}
+
+// Parse a decimal amount, panics if the amount is invalid.
+//
+// Intended for constants and tests.
+func MustParse(s string) Money {
+	m, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Returns the amount in minor units.
+func (m Money) Units() int64 {
+	return m.units
+}
+
+// Returns the number of decimal digits in the minor unit.
+func (m Money) Scale() uint8 {
+	return m.scale
+}
+
+// Convert the amount to the given scale.
+//
+// Returns error if the amount cannot be represented exactly at that scale,
+// i.e. it has more significant decimals than the scale allows.
+func (m Money) Rescale(scale uint8) (Money, error) {
+	if scale > MaxScale {
+		return Money{}, fmt.Errorf("scale %v is larger than the maximum %v", scale, MaxScale)
+	}
+	if scale == m.scale {
+		return m, nil
+	}
+	if scale < m.scale {
+		f := pow10(m.scale - scale)
+		if m.units%f != 0 {
+			return Money{}, fmt.Errorf("amount %v has more than %v decimals", m, scale)
+		}
+		return Money{units: m.units / f, scale: scale}, nil
+	}
+	f := pow10(scale - m.scale)
+	if m.units > math.MaxInt64/f || m.units < math.MinInt64/f {
+		return Money{}, fmt.Errorf("amount %v is out of range at scale %v", m, scale)
+	}
+	return Money{units: m.units * f, scale: scale}, nil
+}
+
+// Returns the amount at the smallest scale representing it exactly.
+//
+// Equal amounts written with a different number of decimals, e.g. "1.0" and
+// "1.00", have the same normalized form.
+func (m Money) Normalize() Money {
+	for m.scale > 0 && m.units%10 == 0 {
+		m.units /= 10
+		m.scale--
+	}
+	return m
+}
+
+// rounding of an amount to a smaller scale
+type RoundingMode string
+
+const (
+	RoundHalfEven RoundingMode = "half_even" // to the nearest, ties to the even neighbour
+	RoundHalfUp   RoundingMode = "half_up"   // to the nearest, ties away from zero
+	RoundDown     RoundingMode = "down"      // toward zero, dropping the extra decimals
+)
+
+// Returns true if the mode is a valid rounding mode.
+func (r RoundingMode) Valid() bool {
+	switch r {
+	case RoundHalfEven, RoundHalfUp, RoundDown:
+		return true
+	}
+	return false
+}
+
+// Round the amount to the given scale using the rounding mode.
+//
+// Amounts with a scale not larger than the given scale are returned unchanged.
+func (m Money) Round(scale uint8, mode RoundingMode) Money {
+	if scale >= m.scale {
+		return m
+	}
+	f := pow10(m.scale - scale)
+	q, rem := m.units/f, m.units%f
+	if rem < 0 {
+		rem = -rem
+	}
+	up := false
+	switch mode {
+	case RoundHalfEven:
+		up = 2*rem > f || (2*rem == f && q%2 != 0)
+	case RoundHalfUp:
+		up = 2*rem >= f
+	}
+	if up {
+		if m.units < 0 {
+			q--
+		} else {
+			q++
+		}
+	}
+	return Money{units: q, scale: scale}
+}
+
+// Bring both amounts to the larger of their scales.
+//
+// Returns error if an amount is out of range at the larger scale.
+func align(a, b Money) (Money, Money, error) {
+	var err error
+	if a.scale < b.scale {
+		a, err = a.Rescale(b.scale)
+	} else if b.scale < a.scale {
+		b, err = b.Rescale(a.scale)
+	}
+	return a, b, err
+}
+
+// Returns the sum of the amounts, at the larger of their scales.
+//
+// Returns error if the sum is out of range.
+func (m Money) CheckedAdd(o Money) (Money, error) {
+	a, b, err := align(m, o)
+	if err != nil {
+		return Money{}, err
+	}
+	if (b.units > 0 && a.units > math.MaxInt64-b.units) || (b.units < 0 && a.units < math.MinInt64-b.units) {
+		return Money{}, fmt.Errorf("sum of %v and %v is out of range", m, o)
+	}
+	return Money{units: a.units + b.units, scale: a.scale}, nil
+}
+
+// Returns the difference of the amounts, at the larger of their scales.
+//
+// Returns error if the difference is out of range.
+func (m Money) CheckedSub(o Money) (Money, error) {
+	a, b, err := align(m, o)
+	if err != nil {
+		return Money{}, err
+	}
+	if (b.units < 0 && a.units > math.MaxInt64+b.units) || (b.units > 0 && a.units < math.MinInt64+b.units) {
+		return Money{}, fmt.Errorf("difference of %v and %v is out of range", m, o)
+	}
+	return Money{units: a.units - b.units, scale: a.scale}, nil
+}
+
+// Returns the sum of the amounts, at the larger of their scales.
+//
+// Intended for amounts already checked to be in range, panics if the sum is
+// out of range. Amounts from requests are added with CheckedAdd.
+func (m Money) Add(o Money) Money {
+	sum, err := m.CheckedAdd(o)
+	if err != nil {
+		panic(err)
+	}
+	return sum
+}
+
+// Returns the difference of the amounts, at the larger of their scales.
+//
+// Intended for amounts already checked to be in range, panics if the
+// difference is out of range. Amounts from requests are subtracted with
+// CheckedSub.
+func (m Money) Sub(o Money) Money {
+	diff, err := m.CheckedSub(o)
+	if err != nil {
+		panic(err)
+	}
+	return diff
+}
+
+// Returns the negated amount.
+func (m Money) Neg() Money {
+	return Money{units: -m.units, scale: m.scale}
+}
+
+// Compare the amounts, returns -1, 0 or +1.
+//
+// The amounts are compared at the smaller of their scales, which never
+// overflows, the decimals beyond it break the tie.
+func (m Money) Cmp(o Money) int {
+	if m.scale > o.scale {
+		return -o.Cmp(m)
+	}
+	f := pow10(o.scale - m.scale)
+	q, rem := o.units/f, o.units%f
+	switch {
+	case m.units < q:
+		return -1
+	case m.units > q:
+		return 1
+	case rem > 0:
+		return -1
+	case rem < 0:
+		return 1
+	}
+	return 0
+}
+
+// Returns -1, 0 or +1 depending on the sign of the amount.
+func (m Money) Sign() int {
+	switch {
+	case m.units < 0:
+		return -1
+	case m.units > 0:
+		return 1
+	}
+	return 0
+}
+
+// Returns true if the amount is zero.
+func (m Money) IsZero() bool {
+	return m.units == 0
+}
+
+// Format the amount as a decimal, e.g. "87.11".
+func (m Money) String() string {
+	var u uint64
+	sign := ""
+	if m.units < 0 {
+		sign = "-"
+		u = uint64(-(m.units + 1)) + 1 // avoids overflow for math.MinInt64
+	} else {
+		u = uint64(m.units)
+	}
+
+	digits := strconv.FormatUint(u, 10)
+	if m.scale == 0 {
+		return sign + digits
+	}
+	if n := int(m.scale) + 1 - len(digits); n > 0 {
+		digits = strings.Repeat("0", n) + digits
+	}
+	i := len(digits) - int(m.scale)
+	return sign + digits[:i] + "." + digits[i:]
+}
+
+// Encode the amount as a json string, e.g. "87.11".
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(m.String())), nil
+}
+
+// Decode the amount from a json string or number.
+//
+// The text is parsed exactly, numbers are never converted to float64.
+func (m *Money) UnmarshalJSON(b []byte) error {
+	text := string(bytes.TrimSpace(b))
+	if text == "null" {
+		return nil
+	}
+	if strings.HasPrefix(text, `"`) {
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return fmt.Errorf("invalid amount: %v", text)
+		}
+		text = s
+	}
+	v, err := Parse(text)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+// Returns 10^n.
+func pow10(n uint8) int64 {
+	p := int64(1)
+	for i := uint8(0); i < n; i++ {
+		p *= 10
+	}
+	return p
+}
+
+// end-of-file
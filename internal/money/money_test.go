@@ -0,0 +1,261 @@
+package money
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		text  string
+		units int64
+		scale uint8
+	}{
+		{"87.11", 8711, 2},
+		{"-0.5", -5, 1},
+		{"+3", 3, 0},
+		{"0.001", 1, 3},
+		{"100", 100, 0},
+	}
+	for _, tc := range tests {
+		m, err := Parse(tc.text)
+		if err != nil {
+			t.Fatalf("%v: unexpected error - %v", tc.text, err)
+		}
+		if m.Units() != tc.units || m.Scale() != tc.scale {
+			t.Fatalf("%v: expecting %v/%v, received %v/%v", tc.text, tc.units, tc.scale, m.Units(), m.Scale())
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, text := range []string{"", ".", "1.", ".5", "1e3", " 1", "1,000", "--1", "0x10", "99999999999999999999"} {
+		if _, err := Parse(text); err == nil {
+			t.Fatalf("%q: expecting an error", text)
+		}
+	}
+}
+
+func TestParseScale(t *testing.T) {
+	m, err := ParseScale("1.5", 2)
+	if err != nil || m != New(150, 2) {
+		t.Fatalf("expecting 150/2, received %v/%v, %v", m.Units(), m.Scale(), err)
+	}
+	if _, err := ParseScale("1.005", 2); err == nil {
+		t.Fatal("expecting an error parsing 3 decimals at scale 2")
+	}
+	if m, err := ParseScale("1.500", 2); err != nil || m != New(150, 2) {
+		t.Fatalf("expecting trailing zeros to be accepted, received %v, %v", m, err)
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	sum := New(0, 2)
+	for i := 0; i < 10; i++ {
+		sum = sum.Add(MustParse("0.1"))
+	}
+	if sum.Cmp(MustParse("1")) != 0 || sum.String() != "1.00" {
+		t.Fatalf("expecting 1.00, received %v", sum)
+	}
+	if d := MustParse("87.11").Sub(MustParse("87.12")); d.String() != "-0.01" || d.Sign() >= 0 {
+		t.Fatalf("expecting -0.01, received %v", d)
+	}
+	if MustParse("2").Cmp(MustParse("1.99")) != 1 {
+		t.Fatal("expecting 2 > 1.99")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	for _, tc := range []struct {
+		in, expected string
+	}{
+		{"1.0", "1"},
+		{"1.00", "1"},
+		{"1.50", "1.5"},
+		{"100", "100"},
+		{"-0.10", "-0.1"},
+		{"0.00", "0"},
+	} {
+		if m := MustParse(tc.in).Normalize(); m.String() != tc.expected {
+			t.Fatalf("%v: expecting %v, received %v", tc.in, tc.expected, m)
+		}
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	max := New(math.MaxInt64, 2)
+	if _, err := max.CheckedAdd(MustParse("0.01")); err == nil {
+		t.Fatal("expecting error adding beyond the largest amount")
+	}
+	if _, err := max.Neg().CheckedSub(MustParse("0.02")); err == nil {
+		t.Fatal("expecting error subtracting beyond the smallest amount")
+	}
+	if _, err := MustParse("1000").CheckedAdd(MustParse("0.000000000000000001")); err == nil {
+		t.Fatal("expecting error adding amounts out of range at the larger scale")
+	}
+	if sum, err := max.CheckedAdd(MustParse("-0.01")); err != nil || sum.Units() != math.MaxInt64-1 {
+		t.Fatalf("expecting the sum, received %v - %v", sum, err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expecting Add to panic beyond the largest amount")
+			}
+		}()
+		max.Add(MustParse("0.01"))
+	}()
+
+	// amounts are compared without scaling them up
+	for _, tc := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"1000.00", "0.000000000000000001", 1},
+		{"-1000.00", "0.000000000000000001", -1},
+		{"0", "0.000000000000000001", -1},
+		{"-1", "-1.000000000000000001", 1},
+		{"1.5", "1.50", 0},
+	} {
+		if c := MustParse(tc.a).Cmp(MustParse(tc.b)); c != tc.expected {
+			t.Fatalf("%v cmp %v: expecting %v, received %v", tc.a, tc.b, tc.expected, c)
+		}
+		if c := MustParse(tc.b).Cmp(MustParse(tc.a)); c != -tc.expected {
+			t.Fatalf("%v cmp %v: expecting %v, received %v", tc.b, tc.a, -tc.expected, c)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := map[string]Money{
+		"0.05":  New(5, 2),
+		"-0.05": New(-5, 2),
+		"12":    New(12, 0),
+		"1.000": New(1000, 3),
+		"0.00":  New(0, 2),
+	}
+	for expected, m := range tests {
+		if m.String() != expected {
+			t.Fatalf("expecting %v, received %v", expected, m.String())
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var v struct {
+		A Money `json:"a"`
+		B Money `json:"b"`
+	}
+	if err := json.Unmarshal([]byte(`{"a": "87.11", "b": 0.1}`), &v); err != nil {
+		t.Fatalf("unexpected error - %v", err)
+	}
+	if v.A != New(8711, 2) || v.B != New(1, 1) {
+		t.Fatalf("unexpected values %v, %v", v.A, v.B)
+	}
+	js, _ := json.Marshal(v)
+	if string(js) != `{"a":"87.11","b":"0.1"}` {
+		t.Fatalf("unexpected json %s", js)
+	}
+	if err := json.Unmarshal([]byte(`{"a": 1e2}`), &v); err == nil {
+		t.Fatal("expecting an error decoding an exponent")
+	}
+}
+
+func TestLookupCurrency(t *testing.T) {
+	tests := map[string]uint8{"USD": 2, "jpy": 0, "BHD": 3, "KWD": 3, "CLF": 4, "EUR": 2}
+	for code, exp := range tests {
+		c, err := LookupCurrency(code)
+		if err != nil || c.Exponent != exp {
+			t.Fatalf("%v: expecting exponent %v, received %v, %v", code, exp, c.Exponent, err)
+		}
+	}
+	if _, err := LookupCurrency("XYZ"); err == nil {
+		t.Fatal("expecting an error for an unknown currency")
+	}
+	jpy, _ := LookupCurrency("JPY")
+	if _, err := jpy.Parse("100.5"); err == nil {
+		t.Fatal("expecting an error parsing JPY 100.5")
+	}
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		amount string
+		rate   string
+		scale  uint8
+		result string
+	}{
+		{"100.00", "0.9215", 2, "92.15"},
+		{"10.01", "0.5", 2, "5.01"},   // 5.005 rounds up
+		{"-10.01", "0.5", 2, "-5.01"}, // away from zero
+		{"1.00", "151.237", 0, "151"},
+		{"1000", "0.0066", 2, "6.60"},
+		{"1.00", "0.376", 3, "0.376"},
+	}
+	for _, tc := range tests {
+		m, err := MustParse(tc.amount).Convert(MustParseRate(tc.rate), tc.scale)
+		if err != nil || m.String() != tc.result {
+			t.Fatalf("%v * %v: expecting %v, received %v, %v", tc.amount, tc.rate, tc.result, m, err)
+		}
+	}
+	if _, err := ParseRate("0"); err == nil {
+		t.Fatal("expecting an error parsing a zero rate")
+	}
+}
+
+func TestProrate(t *testing.T) {
+	tests := []struct {
+		amount string
+		part   string
+		whole  string
+		result string
+	}{
+		{"100.00", "46", "92", "50.00"},
+		{"10.00", "1", "3", "3.33"},
+		{"10.00", "2", "3", "6.67"},   // 6.666 rounds up
+		{"0.05", "1", "2", "0.03"},    // 0.025 rounds away from zero
+		{"-0.05", "1", "2", "-0.03"},  // away from zero
+		{"151", "0.50", "1.00", "76"}, // 75.5 rounds up
+		{"92.15", "100.00", "100", "92.15"},
+	}
+	for _, tc := range tests {
+		m, err := MustParse(tc.amount).Prorate(MustParse(tc.part), MustParse(tc.whole))
+		if err != nil || m.String() != tc.result {
+			t.Fatalf("%v * %v / %v: expecting %v, received %v, %v", tc.amount, tc.part, tc.whole, tc.result, m, err)
+		}
+	}
+	if _, err := MustParse("1").Prorate(MustParse("1"), MustParse("0")); err == nil {
+		t.Fatal("expecting an error prorating over zero")
+	}
+}
+
+func TestRound(t *testing.T) {
+	tests := []struct {
+		amount string
+		scale  uint8
+		mode   RoundingMode
+		result string
+	}{
+		{"1.005", 2, RoundHalfEven, "1.00"},
+		{"1.015", 2, RoundHalfEven, "1.02"},
+		{"1.0151", 2, RoundHalfEven, "1.02"},
+		{"-1.015", 2, RoundHalfEven, "-1.02"},
+		{"1.005", 2, RoundHalfUp, "1.01"},
+		{"-1.005", 2, RoundHalfUp, "-1.01"},
+		{"1.0049", 2, RoundHalfUp, "1.00"},
+		{"1.009", 2, RoundDown, "1.00"},
+		{"-1.009", 2, RoundDown, "-1.00"},
+		{"2.5", 0, RoundHalfEven, "2"},
+		{"1.5", 2, RoundDown, "1.5"}, // scale not larger, unchanged
+	}
+	for _, tc := range tests {
+		if m := MustParse(tc.amount).Round(tc.scale, tc.mode); m.String() != tc.result {
+			t.Fatalf("%v rounded %v to %v decimals: expecting %v, received %v", tc.amount, tc.mode, tc.scale, tc.result, m)
+		}
+	}
+	if RoundingMode("up").Valid() || !RoundHalfEven.Valid() {
+		t.Fatal("Unexpected rounding mode validity")
+	}
+}
+
+// end-of-file
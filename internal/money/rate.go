@@ -0,0 +1,151 @@
+// Exact decimal exchange rates and currency conversion.
+//
+package money
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// structure representing an exchange rate, the amount of the target
+// currency for one unit of the source currency
+type Rate struct {
+	d Money // rate held as a decimal
+}
+
+// Parse a decimal exchange rate such as "0.9215".
+//
+// Returns error if the rate is not a positive decimal.
+func ParseRate(s string) (Rate, error) {
+	d, err := Parse(s)
+	if err != nil {
+		return Rate{}, fmt.Errorf("invalid rate: %q - %v", s, err)
+	}
+	if d.Sign() <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate: %q, rate needs to be a positive value", s)
+	}
+	return Rate{d: d}, nil
+}
+
+// Parse a decimal exchange rate, panics if the rate is invalid.
+//
+// Intended for constants and tests.
+func MustParseRate(s string) Rate {
+	r, err := ParseRate(s)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// Returns true if the rate is not set.
+func (r Rate) IsZero() bool {
+	return r.d.IsZero()
+}
+
+// Format the rate as a decimal, e.g. "0.9215".
+func (r Rate) String() string {
+	return r.d.String()
+}
+
+// Encode the rate as a json string, null when the rate is not set.
+func (r Rate) MarshalJSON() ([]byte, error) {
+	if r.IsZero() {
+		return []byte("null"), nil
+	}
+	return []byte(strconv.Quote(r.String())), nil
+}
+
+// Decode the rate from a json string or number.
+func (r *Rate) UnmarshalJSON(b []byte) error {
+	text := string(bytes.TrimSpace(b))
+	if text == "null" {
+		return nil
+	}
+	if strings.HasPrefix(text, `"`) {
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return fmt.Errorf("invalid rate: %v", text)
+		}
+		text = s
+	}
+	v, err := ParseRate(text)
+	if err != nil {
+		return err
+	}
+	*r = v
+	return nil
+}
+
+// Convert the amount using the exchange rate to an amount with the given scale.
+//
+// The result is rounded half away from zero to the scale of the target currency.
+// Returns error if the converted amount is out of range.
+func (m Money) Convert(r Rate, scale uint8) (Money, error) {
+	if r.IsZero() {
+		return Money{}, fmt.Errorf("exchange rate is not set")
+	}
+
+	// units * rate.units / 10^(m.scale + rate.scale - scale)
+	num := new(big.Int).Mul(big.NewInt(m.units), big.NewInt(r.d.units))
+	shift := int(m.scale) + int(r.d.scale) - int(scale)
+	if shift < 0 {
+		num.Mul(num, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(-shift)), nil))
+		shift = 0
+	}
+	den := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(shift)), nil)
+
+	q := quoRound(num, den)
+	if !q.IsInt64() {
+		return Money{}, fmt.Errorf("converted amount is out of range")
+	}
+
+	return Money{units: q.Int64(), scale: scale}, nil
+}
+
+// Returns the share of the amount in the ratio part / whole, e.g. the part of
+// a converted amount matching part of the original amount.
+//
+// The result has the scale of the amount and is rounded half away from zero.
+// Returns error if whole is zero or the result is out of range.
+func (m Money) Prorate(part Money, whole Money) (Money, error) {
+	if whole.IsZero() {
+		return Money{}, fmt.Errorf("cannot prorate over a zero amount")
+	}
+	part, whole, err := align(part, whole)
+	if err != nil {
+		return Money{}, err
+	}
+
+	// units * part.units / whole.units
+	num := new(big.Int).Mul(big.NewInt(m.units), big.NewInt(part.units))
+	den := big.NewInt(whole.units)
+	if den.Sign() < 0 {
+		num.Neg(num)
+		den.Neg(den)
+	}
+	q := quoRound(num, den)
+	if !q.IsInt64() {
+		return Money{}, fmt.Errorf("prorated amount is out of range")
+	}
+
+	return Money{units: q.Int64(), scale: m.scale}, nil
+}
+
+// Returns num / den rounded half away from zero, den needs to be positive.
+func quoRound(num *big.Int, den *big.Int) *big.Int {
+	q, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2)).Cmp(den) >= 0 {
+		if num.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q
+}
+
+// end-of-file
@@ -0,0 +1,217 @@
+// Implements transfer limits and velocity rules.
+//
+// Rules are loaded from a json file:
+//
+//	{
+//	    "rules": [
+//	        {"name": "single-usd", "type": "max_amount", "limit": "10000", "currency": "USD"},
+//	        {"name": "daily-usd", "type": "max_outflow", "limit": "25000", "currency": "USD", "window": "24h"},
+//	        {"name": "hourly", "type": "max_count", "count": 20, "window": "1h"},
+//	        {"name": "merchant", "type": "max_amount", "limit": "500", "currency": "USD", "accounts": ["m-1"]}
+//	    ]
+//	}
+//
+// A rule limits the transfers debiting an account:
+//
+//	max_amount  - the amount of a single transfer
+//	max_outflow - the sum of the amounts debited from the account within the window,
+//	              including the transfer
+//	max_count   - the number of debits of the account within the window, including
+//	              the transfer
+//
+// The window is a duration ending at the date of the transfer, e.g. "24h". An
+// amount rule applies only to accounts in its currency, a count rule applies
+// to accounts in any currency unless a currency is given. A rule with accounts
+// applies only to those accounts, otherwise it applies to every account. The
+// first rule violated, in the order of the file, rejects the transfer.
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"paytabs/internal/money"
+)
+
+// types of rules
+const (
+	MaxAmount  = "max_amount"
+	MaxOutflow = "max_outflow"
+	MaxCount   = "max_count"
+)
+
+// structure representing a rule
+type Rule struct {
+	Name     string      `json:"name"`               // unique name, reported when the rule is violated
+	Type     string      `json:"type"`               // MaxAmount, MaxOutflow or MaxCount
+	Limit    money.Money `json:"limit"`              // limit of the amount rules
+	Count    int         `json:"count"`              // limit of the count rules
+	Currency string      `json:"currency"`           // currency of the accounts the rule applies to
+	Window   string      `json:"window"`             // duration of the window of the velocity rules, e.g. "24h"
+	Accounts []string    `json:"accounts,omitempty"` // accounts the rule applies to, all when empty
+
+	window   time.Duration   // parsed window
+	accounts map[string]bool // accounts the rule applies to, nil when all
+}
+
+// structure of the rules file contents
+type config struct {
+	Rules []Rule `json:"rules"`
+}
+
+// structure representing the rules in effect
+type Set struct {
+	rules []Rule
+}
+
+// Load the rules from a json file.
+func Load(filename string) (*Set, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	s, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rules file: %v - %v", filename, err)
+	}
+	return s, nil
+}
+
+// Parse and validate the rules in json.
+func Parse(data []byte) (*Set, error) {
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(cfg.Rules))
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("rule %v: %v", i, err)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("rule %v: duplicate name: %q", i, r.Name)
+		}
+		names[r.Name] = true
+	}
+	return &Set{rules: cfg.Rules}, nil
+}
+
+// Validate the rule and fill in its parsed fields.
+func (r *Rule) validate() error {
+	if strings.TrimSpace(r.Name) == "" {
+		return fmt.Errorf("name cannot be empty")
+	}
+	switch r.Type {
+	case MaxAmount, MaxOutflow:
+		if r.Currency == "" {
+			return fmt.Errorf("%v rule %q needs a currency", r.Type, r.Name)
+		}
+		if r.Limit.Sign() < 0 {
+			return fmt.Errorf("limit of rule %q cannot be a negative value", r.Name)
+		}
+	case MaxCount:
+		if r.Count < 0 {
+			return fmt.Errorf("count of rule %q cannot be a negative value", r.Name)
+		}
+	default:
+		return fmt.Errorf("invalid type: %q of rule %q, expecting %q, %q or %q", r.Type, r.Name, MaxAmount, MaxOutflow, MaxCount)
+	}
+	if r.Currency != "" {
+		c, err := money.LookupCurrency(r.Currency)
+		if err != nil {
+			return err
+		}
+		r.Currency = c.Code
+	}
+	if r.Type != MaxAmount {
+		d, err := time.ParseDuration(r.Window)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid window: %q of rule %q, expecting a positive duration, e.g. \"24h\"", r.Window, r.Name)
+		}
+		r.window = d
+	}
+	if len(r.Accounts) > 0 {
+		r.accounts = make(map[string]bool, len(r.Accounts))
+		for _, id := range r.Accounts {
+			r.accounts[id] = true
+		}
+	}
+	return nil
+}
+
+// Returns true if the rule applies to debits of the account in the currency.
+func (r *Rule) applies(account string, currency string) bool {
+	if r.Currency != "" && r.Currency != currency {
+		return false
+	}
+	return r.accounts == nil || r.accounts[account]
+}
+
+// Returns the number of rules.
+func (s *Set) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.rules)
+}
+
+// Details of a transfer to check against the rules
+type Transfer struct {
+	Account  string      // account debited
+	Amount   money.Money // amount debited
+	Currency string      // currency of the account debited
+	Date     time.Time   // date of the transfer
+}
+
+// Provides the recent debits of the account debited by a transfer
+type Activity interface {
+	// Returns the sum of the debits at or after the given time
+	Outflow(since time.Time) money.Money
+	// Returns the number of the debits at or after the given time
+	Count(since time.Time) int
+}
+
+// Details of a rule violated by a transfer
+type Violation struct {
+	Rule    string // name of the rule violated
+	Message string // description of the violation
+}
+
+// Check the transfer against the rules.
+//
+// Returns the first rule the transfer violates, nil when it violates none.
+// The activity is consulted only for the velocity rules that apply to the
+// account. A nil Set has no rules.
+func (s *Set) Check(t Transfer, a Activity) *Violation {
+	if s == nil {
+		return nil
+	}
+	for i := range s.rules {
+		r := &s.rules[i]
+		if !r.applies(t.Account, t.Currency) {
+			continue
+		}
+		switch r.Type {
+		case MaxAmount:
+			if t.Amount.Cmp(r.Limit) > 0 {
+				return &Violation{r.Name, fmt.Sprintf("rule %q: transfer amount %v %v exceeds the limit of %v", r.Name, t.Amount, t.Currency, r.Limit)}
+			}
+		case MaxOutflow:
+			// an outflow out of range exceeds any limit
+			if out, err := a.Outflow(t.Date.Add(-r.window)).CheckedAdd(t.Amount); err != nil || out.Cmp(r.Limit) > 0 {
+				return &Violation{r.Name, fmt.Sprintf("rule %q: account id: %v would transfer %v %v within %v, exceeding the limit of %v", r.Name, t.Account, out, t.Currency, r.window, r.Limit)}
+			}
+		case MaxCount:
+			if n := a.Count(t.Date.Add(-r.window)) + 1; n > r.Count {
+				return &Violation{r.Name, fmt.Sprintf("rule %q: account id: %v would make %v transfers within %v, exceeding the limit of %v", r.Name, t.Account, n, r.window, r.Count)}
+			}
+		}
+	}
+	return nil
+}
+
+// end-of-file
@@ -0,0 +1,115 @@
+package rules
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"paytabs/internal/money"
+)
+
+// activity with debits at fixed dates
+type testActivity map[time.Time]money.Money
+
+func (a testActivity) Outflow(since time.Time) money.Money {
+	var sum money.Money
+	for date, m := range a {
+		if !date.Before(since) {
+			sum = sum.Add(m)
+		}
+	}
+	return sum
+}
+
+func (a testActivity) Count(since time.Time) int {
+	n := 0
+	for date := range a {
+		if !date.Before(since) {
+			n++
+		}
+	}
+	return n
+}
+
+const testRules = `{"rules": [
+	{"name": "merchant", "type": "max_amount", "limit": "50", "currency": "USD", "accounts": ["m-1"]},
+	{"name": "single", "type": "max_amount", "limit": "100", "currency": "usd"},
+	{"name": "daily", "type": "max_outflow", "limit": "150", "currency": "USD", "window": "24h"},
+	{"name": "hourly", "type": "max_count", "count": 2, "window": "1h"}
+]}`
+
+func TestParse(t *testing.T) {
+	s, err := Parse([]byte(testRules))
+	if err != nil || s.Len() != 4 {
+		t.Fatalf("Failed to parse rules - %v", err)
+	}
+	if s.rules[1].Currency != "USD" || s.rules[2].window != 24*time.Hour {
+		t.Fatalf("Unexpected rules %+v", s.rules)
+	}
+
+	for _, invalid := range []string{
+		`{"rules": [{"name": "", "type": "max_amount", "limit": "1", "currency": "USD"}]}`,
+		`{"rules": [{"name": "a", "type": "max_total", "limit": "1", "currency": "USD"}]}`,
+		`{"rules": [{"name": "a", "type": "max_amount", "limit": "1"}]}`,
+		`{"rules": [{"name": "a", "type": "max_amount", "limit": "-1", "currency": "USD"}]}`,
+		`{"rules": [{"name": "a", "type": "max_amount", "limit": "1", "currency": "XXX"}]}`,
+		`{"rules": [{"name": "a", "type": "max_outflow", "limit": "1", "currency": "USD"}]}`,
+		`{"rules": [{"name": "a", "type": "max_count", "count": 1, "window": "-1h"}]}`,
+		`{"rules": [{"name": "a", "type": "max_count", "count": -1, "window": "1h"}]}`,
+		`{"rules": [{"name": "a", "type": "max_count", "count": 1, "window": "1h"}, {"name": "a", "type": "max_count", "count": 1, "window": "1h"}]}`,
+		`{"rules": {}}`,
+	} {
+		if _, err := Parse([]byte(invalid)); err == nil {
+			t.Fatalf("Expecting error for rules %v", invalid)
+		}
+	}
+
+	file := filepath.Join(t.TempDir(), "rules.json")
+	os.WriteFile(file, []byte(testRules), 0644)
+	if s, err := Load(file); err != nil || s.Len() != 4 {
+		t.Fatalf("Failed to load rules file - %v", err)
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Fatal("Expecting error for missing rules file")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	s, _ := Parse([]byte(testRules))
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	transfer := func(account string, amount string, currency string) Transfer {
+		return Transfer{Account: account, Amount: money.MustParse(amount), Currency: currency, Date: now}
+	}
+	none := testActivity{}
+	old := testActivity{now.Add(-25 * time.Hour): money.MustParse("100"), now.Add(-2 * time.Hour): money.MustParse("100")}
+	recent := testActivity{now.Add(-30 * time.Minute): money.MustParse("1"), now.Add(-10 * time.Minute): money.MustParse("1")}
+
+	for _, tc := range []struct {
+		transfer Transfer
+		activity Activity
+		rule     string
+	}{
+		{transfer("a-1", "100", "USD"), none, ""},
+		{transfer("a-1", "100.01", "USD"), none, "single"},
+		{transfer("a-1", "100.01", "EUR"), none, ""},
+		{transfer("m-1", "50.01", "USD"), none, "merchant"},
+		{transfer("a-1", "50", "USD"), old, ""},
+		{transfer("a-1", "50.01", "USD"), old, "daily"},
+		{transfer("a-1", "1", "EUR"), recent, "hourly"},
+		{transfer("a-1", "1", "EUR"), old, ""},
+	} {
+		v := s.Check(tc.transfer, tc.activity)
+		if tc.rule == "" && v != nil || tc.rule != "" && (v == nil || v.Rule != tc.rule) {
+			t.Fatalf("%+v: expecting rule %q, received %+v", tc.transfer, tc.rule, v)
+		}
+	}
+
+	// no rules without a set
+	var empty *Set
+	if v := empty.Check(transfer("a-1", "1000000", "USD"), none); v != nil || empty.Len() != 0 {
+		t.Fatalf("Expecting no violation, received %+v", v)
+	}
+}
+
+// end-of-file
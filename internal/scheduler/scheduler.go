@@ -0,0 +1,782 @@
+// Implements scheduled and recurring transfers, standing orders.
+//
+// A schedule transfers an amount from one account to another once at a future
+// time, or repeatedly every day, week or month from its start time until an
+// end date or a number of transfers. Monthly transfers keep the day of the
+// month of the start time, on the last day of shorter months.
+//
+// Transfers are executed through ds.Datastore.Transfer when they are due, as
+// reported by the clock, which is checked every interval. Each transfer carries
+// an idempotency key of the schedule and the transfer, so a transfer is never
+// executed twice. The keys start with IdempotencyKeyPrefix, which clients
+// cannot use. A transfer failing for insufficient funds is retried after
+// the retry interval, up to the maximum number of retries. A transfer failing
+// otherwise, or on its last retry, is recorded as failed and the schedule goes
+// on with the next transfer, a schedule of a single transfer fails. Transfers
+// due while the scheduler is stopped are executed, in order, when it is
+// started. Transfers due while a schedule is paused are skipped.
+//
+// Scheduled transfers are not held for approval, so a schedule of an amount
+// above the approval threshold is rejected, and a transfer of a schedule
+// above a threshold lowered after it was created fails.
+//
+// Schedules are kept in memory, and in a json file when one is configured,
+// rewritten on every change. The transfers are executed without holding the
+// lock of the schedules, so schedules can be read and changed while a long run
+// of transfers due is executed, and the outcome of a transfer is recorded on
+// the schedule as it is when the transfer completes.
+package scheduler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"paytabs/internal/approvals"
+	"paytabs/internal/clock"
+	"paytabs/internal/ds"
+	"paytabs/internal/money"
+)
+
+// frequency of the transfers of a schedule
+const (
+	FrequencyOnce    = "once"
+	FrequencyDaily   = "daily"
+	FrequencyWeekly  = "weekly"
+	FrequencyMonthly = "monthly"
+)
+
+// status of a schedule
+//
+// Only an active schedule executes transfers. An active schedule can be paused
+// and resumed, completed, failed and cancelled schedules are never active again.
+const (
+	StatusActive    = "active"
+	StatusPaused    = "paused"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+// outcome of a scheduled transfer
+const (
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+)
+
+// kinds of scheduler errors, returned wrapped in a ds.Error
+var (
+	ErrScheduleNotFound = errors.New("schedule not found")
+	ErrInvalidSchedule  = errors.New("invalid schedule details")
+	ErrScheduleInactive = errors.New("schedule is completed, failed or cancelled")
+)
+
+// defaults of the scheduler configuration
+const (
+	DefaultInterval      = time.Minute
+	DefaultRetryInterval = time.Hour
+	DefaultMaxRetries    = 3
+)
+
+// prefix of the idempotency keys of scheduled transfers, reserved for the scheduler
+const IdempotencyKeyPrefix = "schedule-"
+
+// number of transfers kept in the history of a schedule
+const maxRuns = 100
+
+// time the start of a schedule can be in the past, for the clock skew of clients
+const startTolerance = 5 * time.Minute
+
+// Details of a schedule to create
+type Request struct {
+	From      string      // account to transfer from
+	To        string      // account to transfer to
+	Amount    money.Money // amount in the currency of the from account
+	Convert   bool        // allow conversion when the accounts are in different currencies
+	Frequency string      // one of the Frequency* values, FrequencyOnce when empty
+	StartAt   time.Time   // time of the first transfer, now when zero, at most startTolerance in the past
+	EndDate   *time.Time  // optional, no transfer is due after this time
+	Count     int         // optional, number of transfers, zero for no limit
+}
+
+// Changes to a schedule, nil fields are left unchanged
+type Update struct {
+	Amount  *money.Money // new amount of the transfers
+	EndDate *time.Time   // new end date
+	Count   *int         // new number of transfers, zero for no limit
+	Status  *string      // StatusActive or StatusPaused
+}
+
+// Details of a scheduled transfer executed
+type Run struct {
+	Due      time.Time `json:"due"`                      // time the transfer was due
+	Date     time.Time `json:"date"`                     // time of the last attempt
+	Attempts int       `json:"attempts"`                 // number of attempts, more than one when retried
+	Status   string    `json:"status"`                   // RunSucceeded or RunFailed
+	Tid      uint64    `json:"transaction_id,omitempty"` // transaction of the transfer, when succeeded
+	Error    string    `json:"error,omitempty"`          // reason of the failure, when failed
+}
+
+// Details of a schedule
+type Schedule struct {
+	Id          uint64       `json:"schedule_id"`
+	FromId      string       `json:"from_id"`
+	ToId        string       `json:"to_id"`
+	Amount      money.Money  `json:"amount"`   // amount in the currency of the from account
+	Currency    string       `json:"currency"` // currency of the from account
+	Convert     bool         `json:"convert,omitempty"`
+	Frequency   string       `json:"frequency"`              // one of the Frequency* values
+	StartAt     time.Time    `json:"start_at"`               // time of the first transfer
+	EndDate     *time.Time   `json:"end_date,omitempty"`     // no transfer is due after this time
+	Count       int          `json:"count,omitempty"`        // number of transfers, zero for no limit
+	Status      string       `json:"status"`                 // one of the Status* values
+	NextRun     *time.Time   `json:"next_run,omitempty"`     // time of the next attempt, nil when no transfer is left
+	Occurrences int          `json:"occurrences"`            // number of transfers executed, succeeded or failed, or skipped
+	Attempts    int          `json:"attempts,omitempty"`     // failed attempts of the next transfer
+	RetryAmount *money.Money `json:"retry_amount,omitempty"` // amount of the next transfer while it is retried, the amount of its first attempt
+	LastError   string       `json:"last_error,omitempty"`   // reason of the last failed attempt of the next transfer
+	Created     time.Time    `json:"created"`
+	Runs        []Run        `json:"runs"` // transfers executed, oldest first, the most recent ones
+}
+
+// Configuration for the scheduler.
+type Config struct {
+	File          string            // optional json file the schedules are kept in, when empty schedules are not persisted
+	Clock         clock.Clock       // optional source of the current time, the system time when nil
+	Interval      time.Duration     // interval between the checks for transfers due, DefaultInterval when zero
+	RetryInterval time.Duration     // time until a transfer failing for insufficient funds is retried, DefaultRetryInterval when zero
+	MaxRetries    int               // number of retries of a transfer failing for insufficient funds, DefaultMaxRetries when zero
+	Approvals     *approvals.Policy // optional approval policy, schedules above its thresholds are rejected
+}
+
+// structure of the schedules file contents
+type file struct {
+	NextId    uint64      `json:"next_id"`
+	Schedules []*Schedule `json:"schedules"`
+}
+
+// structure representing the scheduler
+type Scheduler struct {
+	store         ds.Datastore         // datastore executing the transfers
+	clock         clock.Clock          // source of the current time
+	file          string               // file the schedules are kept in, empty when not persisted
+	retryInterval time.Duration        // time until a failed transfer is retried
+	maxRetries    int                  // number of retries of a failed transfer
+	approvals     *approvals.Policy    // approval policy, nil when transfers need no approval
+	runLock       sync.Mutex           // serializes the runs of the transfers due
+	lock          sync.Mutex           // guards schedules and nextId, not held while transfers are executed
+	schedules     map[uint64]*Schedule // schedules by id, replaced and never changed in place
+	nextId        uint64               // next schedule id
+	stop          chan struct{}        // closed to stop the periodic checks
+	wg            sync.WaitGroup       // tracks the periodic checks goroutine
+}
+
+// Construct a scheduler executing the transfers on the datastore.
+//
+// Loads the schedules from the file, when it exists, and starts checking for
+// transfers due every interval.
+func New(store ds.Datastore, cfg Config) (*Scheduler, error) {
+	s := &Scheduler{
+		store:         store,
+		clock:         cfg.Clock,
+		file:          cfg.File,
+		retryInterval: cfg.RetryInterval,
+		maxRetries:    cfg.MaxRetries,
+		approvals:     cfg.Approvals,
+		schedules:     make(map[uint64]*Schedule),
+		nextId:        1,
+		stop:          make(chan struct{}),
+	}
+	if s.clock == nil {
+		s.clock = clock.Real{}
+	}
+	if s.retryInterval <= 0 {
+		s.retryInterval = DefaultRetryInterval
+	}
+	if s.maxRetries <= 0 {
+		s.maxRetries = DefaultMaxRetries
+	}
+	if s.file != "" {
+		if err := s.load(); err != nil {
+			log.Printf("[scheduler]failed to load schedules from file: %v - %v\n", s.file, err)
+			return nil, fmt.Errorf("invalid schedules file: %v - %v", s.file, err)
+		}
+		log.Printf("[scheduler]loaded %v schedules from file: %v\n", len(s.schedules), s.file)
+	}
+
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	s.wg.Add(1)
+	go s.loop(interval)
+
+	return s, nil
+}
+
+// Stop checking for transfers due.
+func (s *Scheduler) Close() error {
+	close(s.stop)
+	s.wg.Wait()
+	return nil
+}
+
+// Load the schedules from the file, a file that does not exist has no schedules.
+func (s *Scheduler) load() error {
+	b, err := os.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var f file
+	if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+	for _, sc := range f.Schedules {
+		if sc.Id == 0 || sc.Id >= f.NextId {
+			return fmt.Errorf("invalid schedule id: %v", sc.Id)
+		}
+		s.schedules[sc.Id] = sc
+	}
+	if f.NextId > 0 {
+		s.nextId = f.NextId
+	}
+	return nil
+}
+
+// Write the schedules to the file, when one is configured.
+//
+// The schedules are written to a temporary file which is synced and then
+// renamed, so a crash never leaves a partially written file behind. Caller
+// must hold lock.
+func (s *Scheduler) save() error {
+	if s.file == "" {
+		return nil
+	}
+	f := file{NextId: s.nextId, Schedules: make([]*Schedule, 0, len(s.schedules))}
+	for _, id := range s.ids() {
+		f.Schedules = append(f.Schedules, s.schedules[id])
+	}
+	payload, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.file + ".tmp"
+	fp, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(payload); err != nil {
+		fp.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, s.file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Replace the schedule and write the schedules to the file.
+//
+// Restores the previous schedule, nil when there was none, when the file
+// cannot be written. Caller must hold lock.
+func (s *Scheduler) replace(prev *Schedule, sc *Schedule) error {
+	s.schedules[sc.Id] = sc
+	if err := s.save(); err != nil {
+		log.Printf("[scheduler]failed to write schedules file: %v - %v\n", s.file, err)
+		if prev == nil {
+			delete(s.schedules, sc.Id)
+		} else {
+			s.schedules[sc.Id] = prev
+		}
+		return fmt.Errorf("failed to write schedules file - %v", err)
+	}
+	return nil
+}
+
+// Returns the ids of the schedules in ascending order. Caller must hold lock.
+func (s *Scheduler) ids() []uint64 {
+	ids := make([]uint64, 0, len(s.schedules))
+	for id := range s.schedules {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Returns a copy of the schedule the caller can change.
+func (sc *Schedule) clone() *Schedule {
+	c := *sc
+	if sc.EndDate != nil {
+		end := *sc.EndDate
+		c.EndDate = &end
+	}
+	if sc.NextRun != nil {
+		next := *sc.NextRun
+		c.NextRun = &next
+	}
+	if sc.RetryAmount != nil {
+		amount := *sc.RetryAmount
+		c.RetryAmount = &amount
+	}
+	c.Runs = append([]Run{}, sc.Runs...)
+	return &c
+}
+
+// Returns the time the n-th transfer of the schedule is due, counting from zero.
+//
+// Returns false when the schedule has no n-th transfer.
+func (sc *Schedule) occurrence(n int) (time.Time, bool) {
+	var due time.Time
+	switch sc.Frequency {
+	case FrequencyOnce:
+		if n > 0 {
+			return time.Time{}, false
+		}
+		due = sc.StartAt
+	case FrequencyDaily:
+		due = sc.StartAt.AddDate(0, 0, n)
+	case FrequencyWeekly:
+		due = sc.StartAt.AddDate(0, 0, 7*n)
+	case FrequencyMonthly:
+		due = addMonths(sc.StartAt, n)
+	}
+	if sc.Count > 0 && n >= sc.Count {
+		return time.Time{}, false
+	}
+	if sc.EndDate != nil && due.After(*sc.EndDate) {
+		return time.Time{}, false
+	}
+	return due, true
+}
+
+// Returns the time n months after t, on the last day of the month when the
+// month is shorter than the day of t.
+func addMonths(t time.Time, n int) time.Time {
+	y, m, d := t.Date()
+	first := time.Date(y, m+time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	if last := first.AddDate(0, 1, -1).Day(); d > last {
+		d = last
+	}
+	return first.AddDate(0, 0, d-1)
+}
+
+// Returns the amount of the next transfer.
+//
+// A retry transfers the amount of the first attempt, as it carries the same
+// idempotency key, an updated amount applies from the transfer after it.
+func (sc *Schedule) nextAmount() money.Money {
+	if sc.RetryAmount != nil {
+		return *sc.RetryAmount
+	}
+	return sc.Amount
+}
+
+// Set the time of the next transfer, completing the schedule when no transfer is left.
+func (sc *Schedule) reschedule() {
+	due, ok := sc.occurrence(sc.Occurrences)
+	if !ok {
+		sc.NextRun = nil
+		sc.Attempts = 0
+		sc.RetryAmount = nil
+		sc.LastError = ""
+		if sc.Status == StatusActive || sc.Status == StatusPaused {
+			sc.Status = StatusCompleted
+		}
+		return
+	}
+	if sc.Attempts == 0 {
+		sc.NextRun = &due
+	}
+}
+
+// Check the details of the schedule.
+func (s *Scheduler) check(sc *Schedule) error {
+	switch sc.Frequency {
+	case FrequencyOnce:
+		if sc.EndDate != nil || sc.Count != 0 {
+			return ds.Errorf(ErrInvalidSchedule, "a %v schedule cannot have an end date or a count", FrequencyOnce)
+		}
+	case FrequencyDaily, FrequencyWeekly, FrequencyMonthly:
+	default:
+		return ds.Errorf(ErrInvalidSchedule, "invalid frequency: %q, expecting %q, %q, %q or %q", sc.Frequency, FrequencyOnce, FrequencyDaily, FrequencyWeekly, FrequencyMonthly)
+	}
+	if sc.Count < 0 {
+		return ds.Errorf(ErrInvalidSchedule, "invalid count: %v, expecting a positive number of transfers", sc.Count)
+	}
+	if sc.EndDate != nil && sc.EndDate.Before(sc.StartAt) {
+		return ds.Errorf(ErrInvalidSchedule, "end date: %v is before the start: %v", sc.EndDate.Format(time.RFC3339), sc.StartAt.Format(time.RFC3339))
+	}
+	if sc.Amount.Sign() <= 0 {
+		return ds.Errorf(ds.ErrInvalidAmount, "invalid amount: %v, expecting a positive amount", sc.Amount)
+	}
+	if s.approvals.Requires(sc.Amount, sc.Currency) {
+		return ds.Errorf(ErrInvalidSchedule, "amount: %v %v is above the approval threshold, scheduled transfers are not held for approval", sc.Amount, sc.Currency)
+	}
+	return nil
+}
+
+// Create a schedule.
+//
+// Returns error if an account does not exist, the accounts are the same,
+// the start is in the past or the details of the schedule are not valid.
+func (s *Scheduler) Create(req Request) (Schedule, error) {
+	log.Printf("[scheduler]Create() called with from: %v, to: %v, amount: %v, frequency: %v\n", req.From, req.To, req.Amount, req.Frequency)
+
+	if req.From == req.To {
+		return Schedule{}, ds.Errorf(ds.ErrSameAccount, "cannot schedule transfers from account id: %v to itself", req.From)
+	}
+	from, err := s.store.Get(req.From)
+	if err != nil {
+		return Schedule{}, err
+	}
+	if _, err := s.store.Get(req.To); err != nil {
+		return Schedule{}, err
+	}
+
+	now := s.clock.Now()
+	sc := &Schedule{
+		FromId:    req.From,
+		ToId:      req.To,
+		Amount:    req.Amount,
+		Currency:  from.Currency,
+		Convert:   req.Convert,
+		Frequency: req.Frequency,
+		StartAt:   req.StartAt,
+		EndDate:   req.EndDate,
+		Count:     req.Count,
+		Status:    StatusActive,
+		Created:   now,
+		Runs:      []Run{},
+	}
+	if sc.Frequency == "" {
+		sc.Frequency = FrequencyOnce
+	}
+	if sc.StartAt.IsZero() {
+		sc.StartAt = now
+	}
+
+	// a start in the past would execute the transfers missed at once
+	if sc.StartAt.Before(now.Add(-startTolerance)) {
+		log.Printf("[scheduler]Create: start: %v is in the past\n", sc.StartAt.Format(time.RFC3339))
+		return Schedule{}, ds.Errorf(ErrInvalidSchedule, "start: %v is in the past, expecting a time after %v", sc.StartAt.Format(time.RFC3339), now.Add(-startTolerance).Format(time.RFC3339))
+	}
+	if err := s.check(sc); err != nil {
+		log.Printf("[scheduler]Create: %v\n", err)
+		return Schedule{}, err
+	}
+	sc.reschedule()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sc.Id = s.nextId
+	s.nextId += 1
+	if err := s.replace(nil, sc); err != nil {
+		s.nextId -= 1
+		return Schedule{}, err
+	}
+
+	log.Printf("[scheduler]returning from Create() with schedule id: %v, next run: %v\n", sc.Id, sc.NextRun)
+	return *sc.clone(), nil
+}
+
+// Get the schedule with the given id.
+//
+// Returns error if a schedule with such id does not exist.
+func (s *Scheduler) Get(id uint64) (Schedule, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sc, ok := s.schedules[id]
+	if !ok {
+		return Schedule{}, ds.Errorf(ErrScheduleNotFound, "schedule with id: %v does not exist", id)
+	}
+	return *sc.clone(), nil
+}
+
+// List the schedules in id order, only the schedules from or to the account
+// when an account id is given.
+func (s *Scheduler) List(accountId string) []Schedule {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	list := []Schedule{}
+	for _, id := range s.ids() {
+		sc := s.schedules[id]
+		if accountId == "" || sc.FromId == accountId || sc.ToId == accountId {
+			list = append(list, *sc.clone())
+		}
+	}
+	return list
+}
+
+// Update the amount, end date, count and/or status of the schedule.
+//
+// Resuming a paused schedule skips the transfers due while it was paused.
+// Returns error if a schedule with such id does not exist, it is completed,
+// failed or cancelled, or the changes are not valid.
+func (s *Scheduler) Update(id uint64, update Update) (Schedule, error) {
+	log.Printf("[scheduler]Update() called with id: %v\n", id)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	prev, ok := s.schedules[id]
+	if !ok {
+		return Schedule{}, ds.Errorf(ErrScheduleNotFound, "schedule with id: %v does not exist", id)
+	}
+	if prev.Status != StatusActive && prev.Status != StatusPaused {
+		return Schedule{}, ds.Errorf(ErrScheduleInactive, "schedule id: %v is %v", id, prev.Status)
+	}
+
+	sc := prev.clone()
+	if update.Amount != nil {
+		sc.Amount = *update.Amount
+	}
+	if update.EndDate != nil {
+		end := *update.EndDate
+		sc.EndDate = &end
+	}
+	if update.Count != nil {
+		sc.Count = *update.Count
+	}
+	if err := s.check(sc); err != nil {
+		log.Printf("[scheduler]Update: %v\n", err)
+		return Schedule{}, err
+	}
+	if sc.Count > 0 && sc.Count < sc.Occurrences {
+		return Schedule{}, ds.Errorf(ErrInvalidSchedule, "invalid count: %v, %v transfers were already executed", sc.Count, sc.Occurrences)
+	}
+	if update.Status != nil {
+		switch *update.Status {
+		case StatusPaused:
+			sc.Status = StatusPaused
+		case StatusActive:
+			if sc.Status == StatusPaused {
+				// the transfers due while paused are skipped
+				now := s.clock.Now()
+				sc.Status = StatusActive
+				sc.Attempts = 0
+				sc.RetryAmount = nil
+				sc.LastError = ""
+				for {
+					due, ok := sc.occurrence(sc.Occurrences)
+					if !ok || !due.Before(now) {
+						break
+					}
+					sc.Occurrences += 1
+				}
+			}
+		default:
+			return Schedule{}, ds.Errorf(ErrInvalidSchedule, "invalid status: %q, expecting %q or %q", *update.Status, StatusActive, StatusPaused)
+		}
+	}
+	sc.reschedule()
+
+	if err := s.replace(prev, sc); err != nil {
+		return Schedule{}, err
+	}
+
+	log.Printf("[scheduler]returning from Update() with schedule id: %v, status: %v, next run: %v\n", id, sc.Status, sc.NextRun)
+	return *sc.clone(), nil
+}
+
+// Cancel the schedule, no more transfers are executed.
+//
+// Returns error if a schedule with such id does not exist or it is completed,
+// failed or already cancelled.
+func (s *Scheduler) Cancel(id uint64) (Schedule, error) {
+	log.Printf("[scheduler]Cancel() called with id: %v\n", id)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	prev, ok := s.schedules[id]
+	if !ok {
+		return Schedule{}, ds.Errorf(ErrScheduleNotFound, "schedule with id: %v does not exist", id)
+	}
+	if prev.Status != StatusActive && prev.Status != StatusPaused {
+		return Schedule{}, ds.Errorf(ErrScheduleInactive, "schedule id: %v is %v", id, prev.Status)
+	}
+
+	sc := prev.clone()
+	sc.Status = StatusCancelled
+	sc.NextRun = nil
+	if err := s.replace(prev, sc); err != nil {
+		return Schedule{}, err
+	}
+
+	log.Printf("[scheduler]returning from Cancel() with schedule id: %v\n", id)
+	return *sc.clone(), nil
+}
+
+// Execute the transfers due, oldest first.
+//
+// Each transfer is executed without holding lock, see record. Returns the
+// number of transfers attempted.
+func (s *Scheduler) Run() int {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+
+	now := s.clock.Now()
+	n := 0
+	for {
+		prev := s.nextDue(now)
+		if prev == nil {
+			break
+		}
+		due, _ := prev.occurrence(prev.Occurrences)
+		res, err := s.execute(prev, due)
+
+		s.lock.Lock()
+		s.schedules[prev.Id] = s.record(s.schedules[prev.Id], prev, due, now, res, err)
+		s.lock.Unlock()
+		n++
+	}
+
+	if n > 0 {
+		s.lock.Lock()
+		if err := s.save(); err != nil {
+			log.Printf("[scheduler]failed to write schedules file: %v - %v\n", s.file, err)
+		}
+		s.lock.Unlock()
+		log.Printf("[scheduler]%v scheduled transfers attempted\n", n)
+	}
+	return n
+}
+
+// Returns the active schedule with the earliest attempt due, nil when none is due.
+func (s *Scheduler) nextDue(now time.Time) *Schedule {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var next *Schedule
+	for _, id := range s.ids() {
+		sc := s.schedules[id]
+		if sc.Status != StatusActive || sc.NextRun == nil || sc.NextRun.After(now) {
+			continue
+		}
+		if next == nil || sc.NextRun.Before(*next.NextRun) {
+			next = sc
+		}
+	}
+	return next
+}
+
+// Hash of the transfer details, identifies the transfer an idempotency key was used with.
+func hashTransfer(req ds.TransferRequest) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v/%v/%v/%v", req.From, req.To, req.Amount, req.Convert)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Attempt the transfer of the schedule due at the given time.
+func (s *Scheduler) execute(sc *Schedule, due time.Time) (ds.TransferResult, error) {
+	// the threshold may have been lowered since the schedule was created
+	amount := sc.nextAmount()
+	if s.approvals.Requires(amount, sc.Currency) {
+		log.Printf("[scheduler]schedule id: %v transfer of %v %v needs approval\n", sc.Id, amount, sc.Currency)
+		return ds.TransferResult{}, ds.Errorf(ErrInvalidSchedule, "transfer of %v %v is above the approval threshold, scheduled transfers are not held for approval", amount, sc.Currency)
+	}
+	req := ds.TransferRequest{
+		From:           sc.FromId,
+		To:             sc.ToId,
+		Amount:         amount,
+		Convert:        sc.Convert,
+		IdempotencyKey: fmt.Sprintf("%v%v-%v", IdempotencyKeyPrefix, sc.Id, due.Unix()),
+	}
+	req.RequestHash = hashTransfer(req)
+	return s.store.Transfer(req)
+}
+
+// Record the outcome of the next transfer of prev, returning the updated schedule.
+//
+// The schedule may have been changed while the transfer was executed, the
+// outcome is recorded on cur, the schedule as it is now. A transfer skipped
+// meanwhile by resuming the schedule is only added to its runs, and a schedule
+// cancelled meanwhile is not rescheduled. Caller must hold lock.
+func (s *Scheduler) record(cur *Schedule, prev *Schedule, due time.Time, now time.Time, res ds.TransferResult, err error) *Schedule {
+	sc := cur.clone()
+	current := sc.Occurrences == prev.Occurrences
+	inactive := sc.Status != StatusActive && sc.Status != StatusPaused
+
+	run := Run{Due: due, Date: now, Attempts: prev.Attempts + 1}
+	switch {
+	case err == nil:
+		log.Printf("[scheduler]schedule id: %v transfer due: %v completed with tid: %v\n", sc.Id, due.Format(time.RFC3339), res.Tid)
+		run.Status = RunSucceeded
+		run.Tid = res.Tid
+	case errors.Is(err, ds.ErrInsufficientFunds) && prev.Attempts < s.maxRetries && current && !inactive:
+		// retried later, the transfer is not over
+		retry := now.Add(s.retryInterval)
+		log.Printf("[scheduler]schedule id: %v transfer due: %v failed, retrying at %v - %v\n", sc.Id, due.Format(time.RFC3339), retry.Format(time.RFC3339), err)
+		amount := prev.nextAmount()
+		sc.Attempts = run.Attempts
+		sc.RetryAmount = &amount
+		sc.LastError = err.Error()
+		sc.NextRun = &retry
+		return sc
+	default:
+		log.Printf("[scheduler]schedule id: %v transfer due: %v failed - %v\n", sc.Id, due.Format(time.RFC3339), err)
+		run.Status = RunFailed
+		run.Error = err.Error()
+	}
+
+	sc.Runs = append(sc.Runs, run)
+	if len(sc.Runs) > maxRuns {
+		sc.Runs = append([]Run{}, sc.Runs[len(sc.Runs)-maxRuns:]...)
+	}
+	if !current {
+		return sc
+	}
+	sc.Occurrences += 1
+	sc.Attempts = 0
+	sc.RetryAmount = nil
+	sc.LastError = ""
+	if inactive {
+		return sc
+	}
+	if run.Status == RunFailed && sc.Frequency == FrequencyOnce {
+		sc.Status = StatusFailed
+	}
+	sc.reschedule()
+	return sc
+}
+
+// Execute the transfers due every interval until the scheduler is closed.
+func (s *Scheduler) loop(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.Run()
+		}
+	}
+}
+
+// end-of-file
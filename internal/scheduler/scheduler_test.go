@@ -0,0 +1,375 @@
+package scheduler
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"paytabs/internal/approvals"
+	"paytabs/internal/clock"
+	"paytabs/internal/ds"
+	"paytabs/internal/memds"
+	"paytabs/internal/money"
+)
+
+// Test Setup
+func TestMain(m *testing.M) {
+	// disable logging when tests are run
+	log.SetOutput(ioutil.Discard)
+
+	// run the tests
+	os.Exit(m.Run())
+}
+
+// Open a datastore with three accounts on the clock.
+func openStore(t *testing.T, clk clock.Clock) ds.Datastore {
+	file := filepath.Join(t.TempDir(), "accounts.json")
+	data := `[
+		{"id": "payer", "name": "Payer", "balance": "100.00"},
+		{"id": "payee", "name": "Payee", "balance": "0.00"},
+		{"id": "funder", "name": "Funder", "balance": "1000.00"}
+	]`
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to write data file - %v", err)
+	}
+	d, err := memds.Open(memds.Config{DataFile: file, Clock: clk})
+	if err != nil {
+		t.Fatalf("Failed to open datastore - %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestRecurring(t *testing.T) {
+	clk := clock.NewFake(time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC))
+	store := openStore(t, clk)
+	file := filepath.Join(t.TempDir(), "schedules.json")
+	s, err := New(store, Config{File: file, Clock: clk})
+	if err != nil {
+		t.Fatalf("Failed to create scheduler - %v", err)
+	}
+	defer s.Close()
+
+	// monthly on the 31st, on the last day of shorter months
+	start := time.Date(2026, 1, 31, 9, 0, 0, 0, time.UTC)
+	sc, err := s.Create(Request{From: "payer", To: "payee", Amount: money.MustParse("40.00"), Frequency: FrequencyMonthly, StartAt: start, Count: 4})
+	if err != nil {
+		t.Fatalf("Failed to create schedule - %v", err)
+	}
+	if sc.Id != 1 || sc.Status != StatusActive || sc.Currency != "USD" || sc.NextRun == nil || !sc.NextRun.Equal(start) {
+		t.Fatalf("Unexpected schedule %+v", sc)
+	}
+	if n := s.Run(); n != 0 {
+		t.Fatalf("Expecting no transfer due, %v attempted", n)
+	}
+
+	// the transfers due are executed in order
+	clk.Set(time.Date(2026, 2, 28, 10, 0, 0, 0, time.UTC))
+	if n := s.Run(); n != 2 {
+		t.Fatalf("Expecting 2 transfers, %v attempted", n)
+	}
+	sc, _ = s.Get(sc.Id)
+	if sc.Occurrences != 2 || len(sc.Runs) != 2 || !sc.Runs[1].Due.Equal(time.Date(2026, 2, 28, 9, 0, 0, 0, time.UTC)) || sc.Runs[1].Status != RunSucceeded || sc.Runs[1].Tid == 0 {
+		t.Fatalf("Unexpected schedule %+v", sc)
+	}
+	if acct, _ := store.Get("payer"); acct.Balance.String() != "20.00" {
+		t.Fatalf("Expecting payer balance 20.00, received %v", acct.Balance)
+	}
+
+	// insufficient funds are retried after the retry interval
+	clk.Set(time.Date(2026, 3, 31, 9, 0, 0, 0, time.UTC))
+	s.Run()
+	sc, _ = s.Get(sc.Id)
+	if sc.Attempts != 1 || sc.LastError == "" || !sc.NextRun.Equal(time.Date(2026, 3, 31, 10, 0, 0, 0, time.UTC)) || len(sc.Runs) != 2 {
+		t.Fatalf("Expecting a retry, received %+v", sc)
+	}
+	if _, err := store.Transfer(ds.TransferRequest{From: "funder", To: "payer", Amount: money.MustParse("100.00")}); err != nil {
+		t.Fatalf("Failed to fund payer - %v", err)
+	}
+	clk.Advance(time.Hour)
+	s.Run()
+	sc, _ = s.Get(sc.Id)
+	if sc.Attempts != 0 || sc.Runs[2].Attempts != 2 || sc.Runs[2].Status != RunSucceeded || !sc.Runs[2].Due.Equal(time.Date(2026, 3, 31, 9, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Expecting the retry to succeed, received %+v", sc)
+	}
+
+	// the schedule completes after its count
+	clk.Set(time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC))
+	s.Run()
+	sc, _ = s.Get(sc.Id)
+	if sc.Status != StatusCompleted || sc.NextRun != nil || sc.Occurrences != 4 || !sc.Runs[3].Due.Equal(time.Date(2026, 4, 30, 9, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Expecting the schedule completed, received %+v", sc)
+	}
+	if acct, _ := store.Get("payee"); acct.Balance.String() != "160.00" {
+		t.Fatalf("Expecting payee balance 160.00, received %v", acct.Balance)
+	}
+	if _, err := s.Cancel(sc.Id); !errors.Is(err, ErrScheduleInactive) {
+		t.Fatalf("Expecting ErrScheduleInactive, received %v", err)
+	}
+
+	// the schedules are loaded from the file
+	s2, err := New(store, Config{File: file, Clock: clk})
+	if err != nil {
+		t.Fatalf("Failed to load scheduler - %v", err)
+	}
+	defer s2.Close()
+	if loaded, err := s2.Get(sc.Id); err != nil || !reflect.DeepEqual(loaded, sc) {
+		t.Fatalf("Expecting %+v, received %+v - %v", sc, loaded, err)
+	}
+	if next, _ := s2.Create(Request{From: "payer", To: "payee", Amount: money.MustParse("1.00")}); next.Id != 2 {
+		t.Fatalf("Expecting schedule id 2, received %v", next.Id)
+	}
+}
+
+func TestFailures(t *testing.T) {
+	clk := clock.NewFake(time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC))
+	store := openStore(t, clk)
+	s, err := New(store, Config{Clock: clk, RetryInterval: time.Minute, MaxRetries: 2})
+	if err != nil {
+		t.Fatalf("Failed to create scheduler - %v", err)
+	}
+	defer s.Close()
+
+	// a single transfer fails after its retries
+	sc, _ := s.Create(Request{From: "payer", To: "payee", Amount: money.MustParse("500.00")})
+	for i := 0; i < 3; i++ {
+		if n := s.Run(); n != 1 {
+			t.Fatalf("Expecting attempt %v, %v attempted", i+1, n)
+		}
+		clk.Advance(time.Minute)
+	}
+	sc, _ = s.Get(sc.Id)
+	if sc.Status != StatusFailed || sc.NextRun != nil || len(sc.Runs) != 1 || sc.Runs[0].Attempts != 3 || sc.Runs[0].Status != RunFailed || sc.Runs[0].Error == "" {
+		t.Fatalf("Expecting the schedule failed, received %+v", sc)
+	}
+
+	// a recurring schedule goes on after a failure, without retries when the funds are not the reason
+	sc, _ = s.Create(Request{From: "payer", To: "payee", Amount: money.MustParse("10.00"), Frequency: FrequencyDaily, StartAt: time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC), EndDate: timePtr(time.Date(2026, 1, 5, 9, 0, 0, 0, time.UTC))})
+	frozen := ds.StatusFrozen
+	store.Update("payee", ds.AccountUpdate{Status: &frozen})
+	s.Run()
+	active := ds.StatusActive
+	store.Update("payee", ds.AccountUpdate{Status: &active})
+	clk.Advance(24 * time.Hour)
+	s.Run()
+	sc, _ = s.Get(sc.Id)
+	if sc.Status != StatusActive || len(sc.Runs) != 2 || sc.Runs[0].Status != RunFailed || sc.Runs[0].Attempts != 1 || sc.Runs[1].Status != RunSucceeded {
+		t.Fatalf("Unexpected schedule %+v", sc)
+	}
+
+	// transfers due while paused are skipped
+	paused := StatusPaused
+	if sc, err = s.Update(sc.Id, Update{Status: &paused}); err != nil || sc.Status != StatusPaused {
+		t.Fatalf("Failed to pause schedule %+v - %v", sc, err)
+	}
+	clk.Advance(36 * time.Hour)
+	if n := s.Run(); n != 0 {
+		t.Fatalf("Expecting no transfer while paused, %v attempted", n)
+	}
+	resumed := StatusActive
+	sc, _ = s.Update(sc.Id, Update{Status: &resumed})
+	if sc.Occurrences != 3 || !sc.NextRun.Equal(time.Date(2026, 1, 4, 9, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Expecting the next transfer on the 4th, received %+v", sc)
+	}
+
+	// cancelled schedules execute no transfer
+	if sc, err = s.Cancel(sc.Id); err != nil || sc.Status != StatusCancelled || sc.NextRun != nil {
+		t.Fatalf("Failed to cancel schedule %+v - %v", sc, err)
+	}
+	clk.Advance(24 * time.Hour)
+	if n := s.Run(); n != 0 {
+		t.Fatalf("Expecting no transfer once cancelled, %v attempted", n)
+	}
+	if list := s.List("payee"); len(list) != 2 {
+		t.Fatalf("Expecting 2 schedules, received %v", len(list))
+	}
+	if list := s.List("funder"); len(list) != 0 {
+		t.Fatalf("Expecting no schedule, received %v", len(list))
+	}
+}
+
+func TestRetryUpdated(t *testing.T) {
+	clk := clock.NewFake(time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC))
+	store := openStore(t, clk)
+	s, err := New(store, Config{Clock: clk, RetryInterval: time.Minute, MaxRetries: 2})
+	if err != nil {
+		t.Fatalf("Failed to create scheduler - %v", err)
+	}
+	defer s.Close()
+
+	// the amount updated while a transfer is retried applies from the next transfer
+	sc, _ := s.Create(Request{From: "payer", To: "payee", Amount: money.MustParse("150.00"), Frequency: FrequencyDaily})
+	s.Run()
+	amount := money.MustParse("50.00")
+	if sc, err = s.Update(sc.Id, Update{Amount: &amount}); err != nil || sc.Attempts != 1 || sc.RetryAmount == nil || sc.RetryAmount.String() != "150.00" {
+		t.Fatalf("Expecting the transfer retried with 150.00, received %+v - %v", sc, err)
+	}
+	store.Transfer(ds.TransferRequest{From: "funder", To: "payer", Amount: money.MustParse("100.00")})
+	clk.Advance(time.Minute)
+	s.Run()
+	sc, _ = s.Get(sc.Id)
+	if len(sc.Runs) != 1 || sc.Runs[0].Status != RunSucceeded || sc.Runs[0].Attempts != 2 || sc.Attempts != 0 || sc.RetryAmount != nil {
+		t.Fatalf("Expecting the retry succeeded, received %+v", sc)
+	}
+	if acct, _ := store.Get("payee"); acct.Balance.String() != "150.00" {
+		t.Fatalf("Expecting payee balance 150.00, received %v", acct.Balance)
+	}
+	clk.Advance(24 * time.Hour)
+	s.Run()
+	if acct, _ := store.Get("payee"); acct.Balance.String() != "200.00" {
+		t.Fatalf("Expecting payee balance 200.00, received %v", acct.Balance)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	clk := clock.NewFake(time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC))
+	store := openStore(t, clk)
+	s, err := New(store, Config{Clock: clk})
+	if err != nil {
+		t.Fatalf("Failed to create scheduler - %v", err)
+	}
+	defer s.Close()
+
+	amount := money.MustParse("1.00")
+	tests := []struct {
+		req  Request
+		kind error
+	}{
+		{Request{From: "payer", To: "payer", Amount: amount}, ds.ErrSameAccount},
+		{Request{From: "payer", To: "none", Amount: amount}, ds.ErrAccountNotFound},
+		{Request{From: "payer", To: "payee", Amount: money.MustParse("0")}, ds.ErrInvalidAmount},
+		{Request{From: "payer", To: "payee", Amount: amount, Frequency: "yearly"}, ErrInvalidSchedule},
+		{Request{From: "payer", To: "payee", Amount: amount, Count: 2}, ErrInvalidSchedule},
+		{Request{From: "payer", To: "payee", Amount: amount, Frequency: FrequencyDaily, Count: -1}, ErrInvalidSchedule},
+		{Request{From: "payer", To: "payee", Amount: amount, Frequency: FrequencyDaily, EndDate: timePtr(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))}, ErrInvalidSchedule},
+		{Request{From: "payer", To: "payee", Amount: amount, Frequency: FrequencyDaily, StartAt: time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)}, ErrInvalidSchedule},
+		{Request{From: "payer", To: "payee", Amount: amount, StartAt: clk.Now().Add(-startTolerance - time.Second)}, ErrInvalidSchedule},
+	}
+	for _, test := range tests {
+		if _, err := s.Create(test.req); !errors.Is(err, test.kind) {
+			t.Fatalf("Expecting %v for %+v, received %v", test.kind, test.req, err)
+		}
+	}
+
+	if _, err := s.Get(1); !errors.Is(err, ErrScheduleNotFound) {
+		t.Fatalf("Expecting ErrScheduleNotFound, received %v", err)
+	}
+
+	// a start within the tolerance of the clock skew is accepted
+	if _, err := s.Create(Request{From: "payer", To: "payee", Amount: amount, StartAt: clk.Now().Add(-time.Minute)}); err != nil {
+		t.Fatalf("Expecting a start a minute ago accepted, received %v", err)
+	}
+	sc, _ := s.Create(Request{From: "payer", To: "payee", Amount: amount, Frequency: FrequencyWeekly})
+	status := StatusCompleted
+	if _, err := s.Update(sc.Id, Update{Status: &status}); !errors.Is(err, ErrInvalidSchedule) {
+		t.Fatalf("Expecting ErrInvalidSchedule, received %v", err)
+	}
+
+	// an invalid file fails the scheduler
+	file := filepath.Join(t.TempDir(), "schedules.json")
+	os.WriteFile(file, []byte(`{"next_id": 1, "schedules": [{"schedule_id": 5}]}`), 0644)
+	if _, err := New(store, Config{File: file, Clock: clk}); err == nil {
+		t.Fatal("Expecting error for an invalid schedules file")
+	}
+}
+
+// datastore calling a function before each transfer
+type hookStore struct {
+	ds.Datastore
+	before func()
+}
+
+func (h *hookStore) Transfer(req ds.TransferRequest) (ds.TransferResult, error) {
+	h.before()
+	return h.Datastore.Transfer(req)
+}
+
+func TestChangedDuringRun(t *testing.T) {
+	clk := clock.NewFake(time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC))
+	store := &hookStore{Datastore: openStore(t, clk), before: func() {}}
+	s, err := New(store, Config{Clock: clk})
+	if err != nil {
+		t.Fatalf("Failed to create scheduler - %v", err)
+	}
+	defer s.Close()
+
+	// the schedules can be read and changed while a transfer is executed
+	sc, _ := s.Create(Request{From: "payer", To: "payee", Amount: money.MustParse("10.00"), Frequency: FrequencyDaily})
+	store.before = func() {
+		if _, err := s.Get(sc.Id); err != nil {
+			t.Errorf("Failed to get schedule during the run - %v", err)
+		}
+		if _, err := s.Cancel(sc.Id); err != nil {
+			t.Errorf("Failed to cancel schedule during the run - %v", err)
+		}
+	}
+	if n := s.Run(); n != 1 {
+		t.Fatalf("Expecting 1 transfer attempted, %v attempted", n)
+	}
+
+	// the transfer is recorded on the cancelled schedule, which is not rescheduled
+	sc, _ = s.Get(sc.Id)
+	if sc.Status != StatusCancelled || sc.NextRun != nil || sc.Occurrences != 1 || len(sc.Runs) != 1 || sc.Runs[0].Status != RunSucceeded {
+		t.Fatalf("Expecting the transfer recorded on the cancelled schedule, received %+v", sc)
+	}
+	clk.Advance(24 * time.Hour)
+	if n := s.Run(); n != 0 {
+		t.Fatalf("Expecting no transfer attempted, %v attempted", n)
+	}
+}
+
+func TestApprovalThreshold(t *testing.T) {
+	clk := clock.NewFake(time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC))
+	store := openStore(t, clk)
+	file := filepath.Join(t.TempDir(), "schedules.json")
+	s, err := New(store, Config{File: file, Clock: clk})
+	if err != nil {
+		t.Fatalf("Failed to create scheduler - %v", err)
+	}
+	sc, err := s.Create(Request{From: "funder", To: "payee", Amount: money.MustParse("150.00"), Frequency: FrequencyDaily})
+	if err != nil {
+		t.Fatalf("Failed to create schedule - %v", err)
+	}
+	s.Close()
+
+	// scheduled transfers are not held for approval, schedules above the threshold are rejected
+	policy, _ := approvals.New(map[string]money.Money{"USD": money.MustParse("100")}, 24*time.Hour)
+	s, err = New(store, Config{File: file, Clock: clk, Approvals: policy})
+	if err != nil {
+		t.Fatalf("Failed to create scheduler - %v", err)
+	}
+	defer s.Close()
+	if _, err := s.Create(Request{From: "funder", To: "payee", Amount: money.MustParse("100.01"), Frequency: FrequencyOnce}); !errors.Is(err, ErrInvalidSchedule) {
+		t.Fatalf("Expecting ErrInvalidSchedule, received %v", err)
+	}
+	amount := money.MustParse("120.00")
+	if _, err := s.Update(sc.Id, Update{Amount: &amount}); !errors.Is(err, ErrInvalidSchedule) {
+		t.Fatalf("Expecting ErrInvalidSchedule, received %v", err)
+	}
+	if _, err := s.Create(Request{From: "funder", To: "payee", Amount: money.MustParse("100.00"), Frequency: FrequencyOnce}); err != nil {
+		t.Fatalf("Failed to create schedule up to the threshold - %v", err)
+	}
+
+	// the transfers of a schedule created before the threshold was lowered fail
+	if n := s.Run(); n != 2 {
+		t.Fatalf("Expecting 2 transfers attempted, %v attempted", n)
+	}
+	sc, _ = s.Get(sc.Id)
+	if sc.Status != StatusActive || len(sc.Runs) != 1 || sc.Runs[0].Status != RunFailed || sc.Runs[0].Tid != 0 {
+		t.Fatalf("Expecting the transfer failed, received %+v", sc)
+	}
+	if acct, _ := store.Get("payee"); acct.Balance.String() != "100.00" {
+		t.Fatalf("Expecting payee balance 100.00 from the transfer up to the threshold, received %v", acct.Balance)
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+// end-of-file
@@ -0,0 +1,188 @@
+// REST API handlers for the account lifecycle.
+//
+// POST  /accounts      : Creates an active account, returns its details
+// PATCH /account/<id>  : Updates the name, status, overdraft limit and/or interest rate of the account, returns its details
+// GET   /account/<id>/overdraft : Returns the overdraft events of the account, oldest first
+// GET   /account/<id>/interest  : Returns the interest accrued and posted of the savings account
+//
+// An account is frozen by setting its status to "frozen" and made active
+// again by setting it to "active". An account with a zero balance is closed
+// by setting its status to "closed", a closed account cannot be changed.
+//
+// An account with an overdraft limit can spend below a zero balance down to
+// the negated limit. An event is recorded each time a transaction takes the
+// balance below zero or brings it back to zero or above.
+//
+// A savings account, created with the type "savings" and an annual interest
+// rate, accrues interest daily and is paid the interest of each month on its
+// last day, see internal/interest.
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"paytabs/internal/ds"
+	"paytabs/internal/money"
+)
+
+// structure for POST data expected from client to create an account
+type NewAccountDetail struct {
+	Id             string      `json:"id,omitempty"`       // optional, generated when omitted
+	Name           string      `json:"name"`               // name of the account holder
+	Currency       string      `json:"currency,omitempty"` // optional, the default currency when omitted
+	Balance        money.Money `json:"balance"`            // optional opening balance
+	OverdraftLimit money.Money `json:"overdraft_limit"`    // optional, no overdraft when omitted
+	Type           string      `json:"type,omitempty"`     // optional, "checking" or "savings", "checking" when omitted
+	InterestRate   money.Rate  `json:"interest_rate"`      // annual interest rate, only for savings accounts
+}
+
+// structure for PATCH data expected from client to update an account
+type AccountUpdateDetail struct {
+	Name           *string      `json:"name,omitempty"`            // new name, unchanged when omitted
+	Status         *string      `json:"status,omitempty"`          // new status, unchanged when omitted
+	OverdraftLimit *money.Money `json:"overdraft_limit,omitempty"` // new overdraft limit, unchanged when omitted
+	InterestRate   *money.Rate  `json:"interest_rate,omitempty"`   // new interest rate of a savings account, unchanged when omitted
+}
+
+// Write the account details with the given status.
+func writeAccount(w http.ResponseWriter, req *http.Request, status int, acct ds.Account) {
+	js, err := json.Marshal(acct)
+	if err != nil {
+		writeProblem(w, req, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// POST /accounts Handler
+//
+func (s *DataServer) accountsHandler(w http.ResponseWriter, req *http.Request) {
+	log.Printf("[%v][%v][%v]received request\n", req.RemoteAddr, req.Method, req.URL.Path)
+
+	// /accounts/<anything> is not a resource
+	if req.URL.Path != "/accounts" && req.URL.Path != "/accounts/" {
+		log.Printf("[%v][%v][%v]unknown accounts resource\n", req.RemoteAddr, req.Method, req.URL.Path)
+		writeProblem(w, req, codeNotFound, fmt.Sprintf("unknown accounts resource: %v", req.URL.Path))
+		return
+	}
+
+	// reject if this is not a POST
+	if req.Method != http.MethodPost {
+		log.Printf("[%v][%v][%v]expecting method POST, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
+		writeMethodNotAllowed(w, req, http.MethodPost)
+		return
+	}
+
+	// extract the account details from the POST request
+	var nd NewAccountDetail
+	if !decodeRequest(w, req, &nd) {
+		return
+	}
+	log.Printf("[%v][%v][%v]id: %v, name: %v, currency: %v\n", req.RemoteAddr, req.Method, req.URL.Path, nd.Id, nd.Name, nd.Currency)
+
+	// create the account
+	acct, err := s.data.Create(ds.NewAccount{Id: nd.Id, Name: nd.Name, Currency: nd.Currency, Balance: nd.Balance, OverdraftLimit: nd.OverdraftLimit, Type: nd.Type, InterestRate: nd.InterestRate})
+	if err != nil {
+		log.Printf("[%v][%v][%v]account creation failed - %v\n", req.RemoteAddr, req.Method, req.URL.Path, err.Error())
+		writeDatastoreError(w, req, err, fmt.Sprintf("account creation failed - %v", err.Error()))
+		return
+	}
+	log.Printf("[%v][%v][%v]account created in datastore with id: %v\n", req.RemoteAddr, req.Method, req.URL.Path, acct.Id)
+
+	w.Header().Set("Location", "/account/"+acct.Id)
+	writeAccount(w, req, http.StatusCreated, acct)
+
+	log.Printf("[%v][%v][%v]reply sent\n", req.RemoteAddr, req.Method, req.URL.Path)
+}
+
+// PATCH /account/<id> Handler
+//
+func (s *DataServer) updateAccountHandler(w http.ResponseWriter, req *http.Request, id string) {
+	// extract the changes from the PATCH request
+	var ud AccountUpdateDetail
+	if !decodeRequest(w, req, &ud) {
+		return
+	}
+
+	// update the account
+	acct, err := s.data.Update(id, ds.AccountUpdate{Name: ud.Name, Status: ud.Status, OverdraftLimit: ud.OverdraftLimit, InterestRate: ud.InterestRate})
+	if err != nil {
+		log.Printf("[%v][%v][%v]account update failed - %v\n", req.RemoteAddr, req.Method, req.URL.Path, err.Error())
+		writeDatastoreError(w, req, err, fmt.Sprintf("account update failed - %v", err.Error()))
+		return
+	}
+	log.Printf("[%v][%v][%v]account id: %v updated, status: %v\n", req.RemoteAddr, req.Method, req.URL.Path, acct.Id, acct.Status)
+
+	writeAccount(w, req, http.StatusOK, acct)
+
+	log.Printf("[%v][%v][%v]reply sent\n", req.RemoteAddr, req.Method, req.URL.Path)
+}
+
+// GET /account/<id>/overdraft Handler
+//
+func (s *DataServer) overdraftHandler(w http.ResponseWriter, req *http.Request, id string) {
+	// reject if this is not a GET
+	if req.Method != http.MethodGet {
+		log.Printf("[%v][%v][%v]expecting method GET, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
+		writeMethodNotAllowed(w, req, http.MethodGet)
+		return
+	}
+
+	// get the overdraft events
+	events, err := s.data.OverdraftEvents(id)
+	if err != nil {
+		log.Printf("[%v][%v][%v]%v\n", req.RemoteAddr, req.Method, req.URL.Path, err.Error())
+		writeDatastoreError(w, req, err, err.Error())
+		return
+	}
+	log.Printf("[%v][%v][%v]got %v overdraft events for id: %v from datastore\n", req.RemoteAddr, req.Method, req.URL.Path, len(events), id)
+
+	// write the events
+	js, err := json.Marshal(events)
+	if err != nil {
+		writeProblem(w, req, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+
+	log.Printf("[%v][%v][%v]reply sent\n", req.RemoteAddr, req.Method, req.URL.Path)
+}
+
+// GET /account/<id>/interest Handler
+//
+func (s *DataServer) interestHandler(w http.ResponseWriter, req *http.Request, id string) {
+	// reject if this is not a GET
+	if req.Method != http.MethodGet {
+		log.Printf("[%v][%v][%v]expecting method GET, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
+		writeMethodNotAllowed(w, req, http.MethodGet)
+		return
+	}
+
+	// get the interest of the account
+	status, err := s.data.Interest(id)
+	if err != nil {
+		log.Printf("[%v][%v][%v]%v\n", req.RemoteAddr, req.Method, req.URL.Path, err.Error())
+		writeDatastoreError(w, req, err, err.Error())
+		return
+	}
+	log.Printf("[%v][%v][%v]got interest for id: %v from datastore, accrued: %v\n", req.RemoteAddr, req.Method, req.URL.Path, id, status.Accrued)
+
+	// write the interest
+	js, err := json.Marshal(status)
+	if err != nil {
+		writeProblem(w, req, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+
+	log.Printf("[%v][%v][%v]reply sent\n", req.RemoteAddr, req.Method, req.URL.Path)
+}
+
+// end-of-file
@@ -0,0 +1,175 @@
+// REST API handlers for transfers held for approval, maker-checker.
+//
+// GET  /transfers/pending              : Returns json array of the pending transfers, ?status=<status> for those with the status
+// GET  /transfers/pending/<id>         : Returns the details of the pending transfer with the given <id>
+// POST /transfers/pending/<id>/approve : Approves the transfer, executing it
+// POST /transfers/pending/<id>/reject  : Rejects the transfer, releasing the funds held
+//
+// A transfer of POST /transfer/ above the approval threshold of its currency is
+// not executed, it is held for approval and the reply has status 202 with the
+// pending transfer, see internal/approvals. The principal making a request is
+// the name of its API key, or named by the X-Principal header when requests are
+// not authenticated. A transfer is approved by a principal other than the one
+// who requested it, and rejected by either.
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"paytabs/internal/auth"
+	"paytabs/internal/ds"
+)
+
+// header naming the principal making the request
+const principalHeader = "X-Principal"
+
+// structure for POST data expected from client to reject a pending transfer
+type RejectDetail struct {
+	Reason string `json:"reason,omitempty"` // optional, reason of the rejection
+}
+
+// Returns the principal making the request, the name of its API key when requests are authenticated.
+func principal(req *http.Request) string {
+	if key := requestKey(req); key != nil {
+		return key.Name
+	}
+	return strings.TrimSpace(req.Header.Get(principalHeader))
+}
+
+// Write the pending transfer details with the given status.
+func writePending(w http.ResponseWriter, req *http.Request, status int, p ds.PendingTransfer) {
+	js, err := json.Marshal(p)
+	if err != nil {
+		writeProblem(w, req, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// GET /transfers/pending and GET, POST /transfers/pending/<id>[/approve|/reject] Handler
+//
+func (s *DataServer) pendingHandler(w http.ResponseWriter, req *http.Request) {
+	log.Printf("[%v][%v][%v]received request\n", req.RemoteAddr, req.Method, req.URL.Path)
+
+	// GET /transfers/pending
+	path := strings.Trim(req.URL.Path, "/")
+	pathParts := strings.Split(path, "/")
+	if len(pathParts) == 2 {
+		if req.Method != http.MethodGet {
+			log.Printf("[%v][%v][%v]expecting method GET, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
+			writeMethodNotAllowed(w, req, http.MethodGet)
+			return
+		}
+		list, err := s.data.ListPending(req.URL.Query().Get("status"))
+		if err != nil {
+			log.Printf("[%v][%v][%v]listing pending transfers failed - %v\n", req.RemoteAddr, req.Method, req.URL.Path, err.Error())
+			writeDatastoreError(w, req, err, err.Error())
+			return
+		}
+
+		// a key restricted to accounts sees only the pending transfers involving them
+		if restricted(req) {
+			allowed := list[:0]
+			for _, p := range list {
+				if canAccess(req, p.FromId, p.ToId) {
+					allowed = append(allowed, p)
+				}
+			}
+			list = allowed
+		}
+		js, err := json.Marshal(list)
+		if err != nil {
+			writeProblem(w, req, codeInternalError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+		log.Printf("[%v][%v][%v]%v pending transfers sent\n", req.RemoteAddr, req.Method, req.URL.Path, len(list))
+		return
+	}
+
+	// get the pending-id
+	id, err := strconv.ParseUint(pathParts[2], 10, 64)
+	if err != nil || len(pathParts) > 4 {
+		log.Printf("[%v][%v][%v]expecting /transfers/pending/<id>, invalid pending-id in the request\n", req.RemoteAddr, req.Method, req.URL.Path)
+		writeProblem(w, req, codeInvalidRequest, fmt.Sprintf("expecting /transfers/pending/<id>, invalid pending-id: %v", strings.Join(pathParts[2:], "/")))
+		return
+	}
+
+	// GET /transfers/pending/<id>
+	var p ds.PendingTransfer
+	if len(pathParts) == 3 {
+		if req.Method != http.MethodGet {
+			log.Printf("[%v][%v][%v]expecting method GET, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
+			writeMethodNotAllowed(w, req, http.MethodGet)
+			return
+		}
+		if p, err = s.data.GetPending(id); err == nil && !checkAccounts(w, req, p.FromId, p.ToId) {
+			return
+		}
+	} else {
+		// POST /transfers/pending/<id>/approve, POST /transfers/pending/<id>/reject
+		action := pathParts[3]
+		if action != "approve" && action != "reject" {
+			log.Printf("[%v][%v][%v]unknown pending transfer action: %v\n", req.RemoteAddr, req.Method, req.URL.Path, action)
+			writeProblem(w, req, codeNotFound, fmt.Sprintf("unknown pending transfer action: %v", action))
+			return
+		}
+		if req.Method != http.MethodPost {
+			log.Printf("[%v][%v][%v]expecting method POST, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
+			writeMethodNotAllowed(w, req, http.MethodPost)
+			return
+		}
+		scope := auth.ScopeWriteTransfers
+		if action == "approve" {
+			scope = auth.ScopeApproveTransfers
+		}
+		if !checkScope(w, req, scope) {
+			return
+		}
+
+		// a key restricted to accounts decides the pending transfers debiting them
+		if restricted(req) {
+			p, err := s.data.GetPending(id)
+			if err != nil {
+				log.Println(err.Error())
+				writeDatastoreError(w, req, err, err.Error())
+				return
+			}
+			if !checkAccounts(w, req, p.FromId) {
+				return
+			}
+		}
+		by := principal(req)
+		log.Printf("[%v][%v][%v]pending id: %v, principal: %v\n", req.RemoteAddr, req.Method, req.URL.Path, id, by)
+		if action == "approve" {
+			p, err = s.data.ApprovePending(id, by)
+		} else {
+			// the reason is optional, an empty body rejects without one
+			var rd RejectDetail
+			if req.ContentLength != 0 && !decodeRequest(w, req, &rd) {
+				return
+			}
+			p, err = s.data.RejectPending(id, by, rd.Reason)
+		}
+	}
+	if err != nil {
+		log.Printf("[%v][%v][%v]pending transfer request failed - %v\n", req.RemoteAddr, req.Method, req.URL.Path, err.Error())
+		writeDatastoreError(w, req, err, err.Error())
+		return
+	}
+	log.Printf("[%v][%v][%v]pending id: %v is %v\n", req.RemoteAddr, req.Method, req.URL.Path, p.Id, p.Status)
+
+	writePending(w, req, http.StatusOK, p)
+
+	log.Printf("[%v][%v][%v]reply sent\n", req.RemoteAddr, req.Method, req.URL.Path)
+}
+
+// end-of-file
@@ -0,0 +1,133 @@
+// Authentication and authorization of the REST API requests using API keys.
+//
+// With an API keys file every request needs the header
+//
+//	Authorization: Bearer <key>
+//
+// naming one of the keys, see internal/auth. Requests without a valid key fail
+// with status 401. GET requests need the read scope of the resource and other
+// requests its write scope, otherwise they fail with status 403:
+//
+//	read:accounts     - GET of accounts, transactions, holds, schedules and pending transfers
+//	write:transfers   - transfers, batches, holds, refunds, schedules and rejecting pending transfers
+//	approve:transfers - approving pending transfers
+//	admin             - all of the above, creating and updating accounts and /admin
+//
+// A key restricted to accounts debits only those accounts, reads only them and
+// the transactions, holds, schedules and pending transfers involving them, and
+// cannot list all the accounts. The name of the key is the principal of the
+// request, the X-Principal header is ignored. Without an API keys file requests
+// are not authenticated.
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"paytabs/internal/auth"
+)
+
+// type of the keys of the values the server adds to the request context
+type contextKey int
+
+// context key of the API key of the request
+const apiKeyContextKey contextKey = 0
+
+// Returns the API key of the request, nil when requests are not authenticated.
+func requestKey(req *http.Request) *auth.Key {
+	key, _ := req.Context().Value(apiKeyContextKey).(*auth.Key)
+	return key
+}
+
+// Returns true if the API key of the request can access only some accounts.
+func restricted(req *http.Request) bool {
+	key := requestKey(req)
+	return key != nil && key.Restricted()
+}
+
+// Returns the API key presented in the Authorization header of the request.
+func bearerToken(req *http.Request) string {
+	const prefix = "Bearer "
+	h := req.Header.Get("Authorization")
+	if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(h[len(prefix):])
+}
+
+// Wrap the handler, authenticating the request and authorizing its scope.
+//
+// GET requests need the read scope and the other requests the write scope, an
+// empty scope is checked by the handler. The handler finds the API key of the
+// request using requestKey.
+func (s *DataServer) authorize(read string, write string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s.keys == nil {
+			handler(w, req)
+			return
+		}
+
+		key, ok := s.keys.Authenticate(bearerToken(req))
+		if !ok {
+			log.Printf("[%v][%v][%v]missing or invalid API key\n", req.RemoteAddr, req.Method, req.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="bank"`)
+			writeProblem(w, req, codeUnauthorized, "missing or invalid API key, expecting Authorization: Bearer <key>")
+			return
+		}
+		req = req.WithContext(context.WithValue(req.Context(), apiKeyContextKey, key))
+
+		scope := write
+		if req.Method == http.MethodGet {
+			scope = read
+		}
+		if !checkScope(w, req, scope) {
+			return
+		}
+		handler(w, req)
+	}
+}
+
+// Check the API key of the request grants the scope.
+//
+// Writes the forbidden response and returns false if it does not.
+func checkScope(w http.ResponseWriter, req *http.Request, scope string) bool {
+	key := requestKey(req)
+	if key == nil || scope == "" || key.HasScope(scope) {
+		return true
+	}
+	log.Printf("[%v][%v][%v]API key %v does not grant scope %v\n", req.RemoteAddr, req.Method, req.URL.Path, key.Name, scope)
+	writeProblem(w, req, codeForbidden, fmt.Sprintf("API key %v does not grant the scope %v", key.Name, scope))
+	return false
+}
+
+// Check the API key of the request can access any of the accounts.
+//
+// Writes the forbidden response and returns false if it cannot.
+func checkAccounts(w http.ResponseWriter, req *http.Request, ids ...string) bool {
+	if canAccess(req, ids...) {
+		return true
+	}
+	key := requestKey(req)
+	log.Printf("[%v][%v][%v]API key %v cannot access account ids: %v\n", req.RemoteAddr, req.Method, req.URL.Path, key.Name, ids)
+	writeProblem(w, req, codeForbidden, fmt.Sprintf("API key %v cannot access account id: %v", key.Name, strings.Join(ids, ", ")))
+	return false
+}
+
+// Returns true if the API key of the request can access any of the accounts.
+func canAccess(req *http.Request, ids ...string) bool {
+	key := requestKey(req)
+	if key == nil {
+		return true
+	}
+	for _, id := range ids {
+		if key.CanAccess(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// end-of-file
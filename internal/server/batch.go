@@ -0,0 +1,75 @@
+// REST API handler for batch transfers.
+//
+// POST  /transfers/batch : Transfers all the legs of the batch or none of them, returns the batch id and transactions
+//
+// Each leg is a transfer like the post data of POST /transfer/. The legs are
+// applied in order, a leg can spend funds credited by an earlier leg of the same
+// batch. When any leg fails nothing is transferred and the error names the leg.
+// A leg above the approval threshold fails the batch, it needs to be transferred
+// on its own.
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"paytabs/internal/ds"
+)
+
+// structure for POST data expected from client for batch transfer request
+type BatchDetail struct {
+	Legs []TranferDetail `json:"legs"` // transfers of the batch, applied in order
+}
+
+// POST /transfers/batch Handler
+//
+func (s *DataServer) batchHandler(w http.ResponseWriter, req *http.Request) {
+	log.Printf("[%v][%v][%v]received request\n", req.RemoteAddr, req.Method, req.URL.Path)
+
+	// reject if this is not a POST
+	if req.Method != http.MethodPost {
+		log.Printf("[%v][%v][%v]expecting method POST, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
+		writeMethodNotAllowed(w, req, http.MethodPost)
+		return
+	}
+
+	// extract the legs from the POST request
+	var bd BatchDetail
+	if !decodeRequest(w, req, &bd) {
+		return
+	}
+	log.Printf("[%v][%v][%v]legs: %v\n", req.RemoteAddr, req.Method, req.URL.Path, len(bd.Legs))
+	for _, td := range bd.Legs {
+		if !checkAccounts(w, req, td.FromId) {
+			return
+		}
+	}
+
+	// the legs and their number are validated by the datastore
+	reqs := make([]ds.TransferRequest, len(bd.Legs))
+	for i, td := range bd.Legs {
+		reqs[i] = ds.TransferRequest{From: td.FromId, To: td.ToId, Amount: td.Amount, Convert: td.Convert, RequireApproval: true}
+	}
+	res, err := s.data.TransferBatch(reqs)
+	if err != nil {
+		log.Printf("[%v][%v][%v]batch transfer failed - %v\n", req.RemoteAddr, req.Method, req.URL.Path, err.Error())
+		writeDatastoreError(w, req, err, fmt.Sprintf("batch transfer failed - %v", err.Error()))
+		return
+	}
+	log.Printf("[%v][%v][%v]batch transfer completed in datastore with batch id: %v\n", req.RemoteAddr, req.Method, req.URL.Path, res.Id)
+
+	// write the batch id and the transaction of each leg
+	js, err := json.Marshal(res)
+	if err != nil {
+		writeProblem(w, req, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+
+	log.Printf("[%v][%v][%v]reply sent\n", req.RemoteAddr, req.Method, req.URL.Path)
+}
+
+// end-of-file
@@ -0,0 +1,229 @@
+// Error responses of the REST API, RFC 7807 problem details.
+//
+// Every failed request gets an application/problem+json body. The code is a
+// machine-readable error code, stable across releases, and type is a URI
+// reference derived from it:
+//
+//	{
+//	    "type": "/problems/insufficient-funds",
+//	    "title": "Insufficient funds",
+//	    "status": 409,
+//	    "detail": "fund transfer failed - account id: 1 does not have sufficient funds, ...",
+//	    "instance": "/transfer/",
+//	    "code": "insufficient_funds"
+//	}
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"paytabs/internal/ds"
+	"paytabs/internal/scheduler"
+)
+
+// media type of the error responses
+const problemContentType = "application/problem+json"
+
+// prefix of the problem type URI references
+const problemTypeBase = "/problems/"
+
+// error codes
+const (
+	codeAccountNotFound          = "account_not_found"
+	codeAccountExists            = "account_exists"
+	codeAccountInactive          = "account_inactive"
+	codeInvalidAccount           = "invalid_account"
+	codeInvalidStatusTransition  = "invalid_status_transition"
+	codeTransactionNotFound      = "transaction_not_found"
+	codeNotRefundable            = "not_refundable"
+	codeRefundExceeded           = "refund_exceeded"
+	codeHoldNotFound             = "hold_not_found"
+	codeHoldInactive             = "hold_inactive"
+	codeInvalidHold              = "invalid_hold"
+	codePendingNotFound          = "pending_not_found"
+	codePendingInactive          = "pending_inactive"
+	codeSelfApproval             = "self_approval"
+	codePrincipalRequired        = "principal_required"
+	codeScheduleNotFound         = "schedule_not_found"
+	codeScheduleInactive         = "schedule_inactive"
+	codeInvalidSchedule          = "invalid_schedule"
+	codeInsufficientFunds        = "insufficient_funds"
+	codeRuleViolation            = "rule_violation"
+	codeIdempotencyKeyInProgress = "idempotency_key_in_progress"
+	codeSameAccount              = "same_account"
+	codeInvalidAmount            = "invalid_amount"
+	codeInvalidBatch             = "invalid_batch"
+	codeCurrencyMismatch         = "currency_mismatch"
+	codeRateUnavailable          = "rate_unavailable"
+	codeIdempotencyKeyReused     = "idempotency_key_reused"
+	codeInvalidQuery             = "invalid_query"
+	codeInvalidRequest           = "invalid_request"
+	codeUnauthorized             = "unauthorized"
+	codeForbidden                = "forbidden"
+	codeInvalidJSON              = "invalid_json"
+	codeUnsupportedMediaType     = "unsupported_media_type"
+	codeMethodNotAllowed         = "method_not_allowed"
+	codeNotFound                 = "not_found"
+	codeNotImplemented           = "not_implemented"
+	codeInternalError            = "internal_error"
+)
+
+// response status and title for each error code
+var problemTypes = map[string]struct {
+	status int
+	title  string
+}{
+	codeAccountNotFound:          {http.StatusNotFound, "Account not found"},
+	codeAccountExists:            {http.StatusConflict, "Account already exists"},
+	codeAccountInactive:          {http.StatusConflict, "Account frozen or closed"},
+	codeInvalidAccount:           {http.StatusUnprocessableEntity, "Invalid account details"},
+	codeInvalidStatusTransition:  {http.StatusConflict, "Invalid account status transition"},
+	codeTransactionNotFound:      {http.StatusNotFound, "Transaction not found"},
+	codeNotRefundable:            {http.StatusUnprocessableEntity, "Transaction not refundable"},
+	codeRefundExceeded:           {http.StatusUnprocessableEntity, "Refund exceeds transaction"},
+	codeHoldNotFound:             {http.StatusNotFound, "Hold not found"},
+	codeHoldInactive:             {http.StatusConflict, "Hold captured, voided or expired"},
+	codeInvalidHold:              {http.StatusUnprocessableEntity, "Invalid hold details"},
+	codePendingNotFound:          {http.StatusNotFound, "Pending transfer not found"},
+	codePendingInactive:          {http.StatusConflict, "Pending transfer approved, rejected or expired"},
+	codeSelfApproval:             {http.StatusForbidden, "Transfer approved by its requester"},
+	codePrincipalRequired:        {http.StatusBadRequest, "Principal required"},
+	codeScheduleNotFound:         {http.StatusNotFound, "Schedule not found"},
+	codeScheduleInactive:         {http.StatusConflict, "Schedule completed, failed or cancelled"},
+	codeInvalidSchedule:          {http.StatusUnprocessableEntity, "Invalid schedule details"},
+	codeInsufficientFunds:        {http.StatusConflict, "Insufficient funds"},
+	codeRuleViolation:            {http.StatusUnprocessableEntity, "Transfer limit exceeded"},
+	codeIdempotencyKeyInProgress: {http.StatusConflict, "Idempotency key in progress"},
+	codeSameAccount:              {http.StatusUnprocessableEntity, "Same from and to account"},
+	codeInvalidAmount:            {http.StatusUnprocessableEntity, "Invalid amount"},
+	codeInvalidBatch:             {http.StatusUnprocessableEntity, "Invalid batch transfer"},
+	codeCurrencyMismatch:         {http.StatusUnprocessableEntity, "Currency mismatch"},
+	codeRateUnavailable:          {http.StatusUnprocessableEntity, "Exchange rate unavailable"},
+	codeIdempotencyKeyReused:     {http.StatusUnprocessableEntity, "Idempotency key reused"},
+	codeInvalidQuery:             {http.StatusBadRequest, "Invalid query"},
+	codeInvalidRequest:           {http.StatusBadRequest, "Invalid request"},
+	codeUnauthorized:             {http.StatusUnauthorized, "Unauthorized"},
+	codeForbidden:                {http.StatusForbidden, "Forbidden"},
+	codeInvalidJSON:              {http.StatusBadRequest, "Invalid JSON"},
+	codeUnsupportedMediaType:     {http.StatusUnsupportedMediaType, "Unsupported media type"},
+	codeMethodNotAllowed:         {http.StatusMethodNotAllowed, "Method not allowed"},
+	codeNotFound:                 {http.StatusNotFound, "Not found"},
+	codeNotImplemented:           {http.StatusNotImplemented, "Not implemented"},
+	codeInternalError:            {http.StatusInternalServerError, "Internal server error"},
+}
+
+// error code for each kind of datastore and scheduler error
+var datastoreErrors = []struct {
+	kind error
+	code string
+}{
+	{ds.ErrAccountNotFound, codeAccountNotFound},
+	{ds.ErrAccountExists, codeAccountExists},
+	{ds.ErrAccountInactive, codeAccountInactive},
+	{ds.ErrInvalidAccount, codeInvalidAccount},
+	{ds.ErrInvalidStatusTransition, codeInvalidStatusTransition},
+	{ds.ErrTransactionNotFound, codeTransactionNotFound},
+	{ds.ErrNotRefundable, codeNotRefundable},
+	{ds.ErrRefundExceeded, codeRefundExceeded},
+	{ds.ErrHoldNotFound, codeHoldNotFound},
+	{ds.ErrHoldInactive, codeHoldInactive},
+	{ds.ErrInvalidHold, codeInvalidHold},
+	{ds.ErrPendingNotFound, codePendingNotFound},
+	{ds.ErrPendingInactive, codePendingInactive},
+	{ds.ErrSelfApproval, codeSelfApproval},
+	{ds.ErrPrincipalRequired, codePrincipalRequired},
+	{scheduler.ErrScheduleNotFound, codeScheduleNotFound},
+	{scheduler.ErrScheduleInactive, codeScheduleInactive},
+	{scheduler.ErrInvalidSchedule, codeInvalidSchedule},
+	{ds.ErrInsufficientFunds, codeInsufficientFunds},
+	{ds.ErrRuleViolation, codeRuleViolation},
+	{ds.ErrIdempotencyKeyInProgress, codeIdempotencyKeyInProgress},
+	{ds.ErrSameAccount, codeSameAccount},
+	{ds.ErrInvalidAmount, codeInvalidAmount},
+	{ds.ErrInvalidBatch, codeInvalidBatch},
+	{ds.ErrCurrencyMismatch, codeCurrencyMismatch},
+	{ds.ErrRateUnavailable, codeRateUnavailable},
+	{ds.ErrIdempotencyKeyReused, codeIdempotencyKeyReused},
+	{ds.ErrInvalidQuery, codeInvalidQuery},
+}
+
+// response data sent to the client when a request fails
+type Problem struct {
+	Type     string `json:"type"`               // URI reference identifying the problem type
+	Title    string `json:"title"`              // short summary of the problem type
+	Status   int    `json:"status"`             // http status code
+	Detail   string `json:"detail,omitempty"`   // description of this occurrence of the problem
+	Instance string `json:"instance,omitempty"` // path of the request that failed
+	Code     string `json:"code"`               // machine-readable error code
+	Rule     string `json:"rule,omitempty"`     // name of the rule violated, for rule_violation
+}
+
+// Returns the error code for an error returned by the datastore.
+//
+// Errors of an unknown kind are internal errors.
+func errorCode(err error) string {
+	for _, e := range datastoreErrors {
+		if errors.Is(err, e.kind) {
+			return e.code
+		}
+	}
+	return codeInternalError
+}
+
+// Returns the problem details for the error code.
+func newProblem(req *http.Request, code string, detail string) Problem {
+	pt, ok := problemTypes[code]
+	if !ok {
+		code = codeInternalError
+		pt = problemTypes[code]
+	}
+	return Problem{
+		Type:     problemTypeBase + strings.ReplaceAll(code, "_", "-"),
+		Title:    pt.title,
+		Status:   pt.status,
+		Detail:   detail,
+		Instance: req.URL.Path,
+		Code:     code,
+	}
+}
+
+// Write the problem details response for the error code.
+func writeProblem(w http.ResponseWriter, req *http.Request, code string, detail string) {
+	sendProblem(w, req, newProblem(req, code, detail))
+}
+
+// Write the problem details response.
+func sendProblem(w http.ResponseWriter, req *http.Request, p Problem) {
+	js, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("[%v][%v][%v]json marshall failed - %v\n", req.RemoteAddr, req.Method, req.URL.Path, err.Error())
+	}
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	w.Write(js)
+}
+
+// Write the problem details response for an error returned by the datastore.
+//
+// A rule violation names the rule violated.
+func writeDatastoreError(w http.ResponseWriter, req *http.Request, err error, detail string) {
+	p := newProblem(req, errorCode(err), detail)
+	var re *ds.RuleError
+	if errors.As(err, &re) {
+		p.Rule = re.Rule
+	}
+	sendProblem(w, req, p)
+}
+
+// Write the problem details response for a request with an unsupported method.
+func writeMethodNotAllowed(w http.ResponseWriter, req *http.Request, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeProblem(w, req, codeMethodNotAllowed, "expecting method "+allowed+", got "+req.Method)
+}
+
+// end-of-file
@@ -0,0 +1,161 @@
+// REST API handlers for transaction lookup and account history.
+//
+// GET   /transaction/<id>                : Returns details of the transaction with the given <id>
+// POST  /transaction/<id>/refund         : Refunds all or part of the transaction, see refunds.go
+// GET   /account/<id>/transactions       : Returns a page of the transaction history of the account
+//
+// Query parameters supported by the account history:
+// since     - RFC 3339 time, only transactions at or after this time
+// until     - RFC 3339 time, only transactions before this time
+// direction - "in" for credits or "out" for debits, both when omitted
+// cursor    - next_cursor returned with the previous page
+// limit     - maximum number of transactions in the page
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"paytabs/internal/ds"
+)
+
+// GET /transaction/<id> and POST /transaction/<id>/refund Handler
+//
+func (s *DataServer) transactionHandler(w http.ResponseWriter, req *http.Request) {
+	log.Printf("[%v][%v][%v]received request\n", req.RemoteAddr, req.Method, req.URL.Path)
+
+	// get the transaction-id
+	path := strings.Trim(req.URL.Path, "/")
+	pathParts := strings.Split(path, "/")
+	if len(pathParts) < 2 || len(pathParts) > 3 {
+		log.Printf("[%v][%v][%v]expecting /transaction/<id>, unable to find transaction-id in the request\n", req.RemoteAddr, req.Method, req.URL.Path)
+		writeProblem(w, req, codeInvalidRequest, "expecting /transaction/<id>, unable to find transaction-id in the request")
+		return
+	}
+	tid, err := strconv.ParseUint(pathParts[1], 10, 64)
+	if err != nil {
+		log.Printf("[%v][%v][%v]invalid transaction-id: %v\n", req.RemoteAddr, req.Method, req.URL.Path, pathParts[1])
+		writeProblem(w, req, codeInvalidRequest, fmt.Sprintf("invalid transaction-id: %v", pathParts[1]))
+		return
+	}
+
+	// POST /transaction/<id>/refund
+	if len(pathParts) == 3 {
+		if pathParts[2] != "refund" {
+			log.Printf("[%v][%v][%v]unknown transaction resource\n", req.RemoteAddr, req.Method, req.URL.Path)
+			writeProblem(w, req, codeNotFound, fmt.Sprintf("unknown transaction resource: %v", req.URL.Path))
+			return
+		}
+		s.refundHandler(w, req, tid)
+		return
+	}
+
+	// reject if this is not a GET
+	if req.Method != http.MethodGet {
+		log.Printf("[%v][%v][%v]expecting method GET, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
+		writeMethodNotAllowed(w, req, http.MethodGet)
+		return
+	}
+
+	// get the transaction details
+	tr, err := s.data.GetTransaction(tid)
+	if err != nil {
+		log.Println(err.Error())
+		writeDatastoreError(w, req, err, err.Error())
+		return
+	}
+	log.Printf("[%v][%v][%v]got transaction details for id: %v from datastore\n", req.RemoteAddr, req.Method, req.URL.Path, tid)
+	if !checkAccounts(w, req, tr.FromId, tr.ToId) {
+		return
+	}
+
+	// write the transaction details
+	js, err := json.Marshal(tr)
+	if err != nil {
+		writeProblem(w, req, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+
+	log.Printf("[%v][%v][%v]reply sent\n", req.RemoteAddr, req.Method, req.URL.Path)
+}
+
+// Parse the history query from the request query parameters.
+func parseHistoryQuery(req *http.Request) (ds.HistoryQuery, error) {
+	values := req.URL.Query()
+	q := ds.HistoryQuery{
+		Direction: values.Get("direction"),
+		Cursor:    values.Get("cursor"),
+	}
+
+	if v := values.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, fmt.Errorf("invalid since: %q, expecting RFC 3339 time", v)
+		}
+		q.Since = t
+	}
+	if v := values.Get("until"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, fmt.Errorf("invalid until: %q, expecting RFC 3339 time", v)
+		}
+		q.Until = t
+	}
+	if v := values.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return q, fmt.Errorf("invalid limit: %q, expecting a positive number", v)
+		}
+		q.Limit = n
+	}
+
+	return q, nil
+}
+
+// GET /account/<id>/transactions Handler
+//
+func (s *DataServer) historyHandler(w http.ResponseWriter, req *http.Request, id string) {
+	// reject if this is not a GET
+	if req.Method != http.MethodGet {
+		log.Printf("[%v][%v][%v]expecting method GET, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
+		writeMethodNotAllowed(w, req, http.MethodGet)
+		return
+	}
+
+	// get the query parameters
+	q, err := parseHistoryQuery(req)
+	if err != nil {
+		log.Printf("[%v][%v][%v]%v\n", req.RemoteAddr, req.Method, req.URL.Path, err.Error())
+		writeProblem(w, req, codeInvalidQuery, err.Error())
+		return
+	}
+
+	// get the page of transactions
+	page, err := s.data.History(id, q)
+	if err != nil {
+		log.Println(err.Error())
+		writeDatastoreError(w, req, err, err.Error())
+		return
+	}
+	log.Printf("[%v][%v][%v]got %v transactions for id: %v from datastore\n", req.RemoteAddr, req.Method, req.URL.Path, len(page.Transactions), id)
+
+	// write the transactions
+	js, err := json.Marshal(page)
+	if err != nil {
+		writeProblem(w, req, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+
+	log.Printf("[%v][%v][%v]reply sent\n", req.RemoteAddr, req.Method, req.URL.Path)
+}
+
+// end-of-file
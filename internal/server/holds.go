@@ -0,0 +1,179 @@
+// REST API handlers for holds, the auth/capture flow.
+//
+// POST  /holds              : Places a hold on the funds of an account, returns the hold details
+// GET   /holds/<id>         : Returns the details of the hold with the given <id>
+// POST  /holds/<id>/capture : Transfers all or part of the held amount, releases the rest
+// POST  /holds/<id>/void    : Releases the held amount
+//
+// A hold reduces the available balance of the account without moving money,
+// and expires unless it is captured or voided in time.
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"paytabs/internal/ds"
+	"paytabs/internal/money"
+)
+
+// structure for POST data expected from client to place a hold
+type HoldDetail struct {
+	AccountId string      `json:"account_id"`           // account to reserve the funds in
+	ToId      string      `json:"to_id"`                // account the funds are transferred to on capture
+	Amount    money.Money `json:"amount"`               // amount in the currency of the account
+	ExpiresIn int64       `json:"expires_in,omitempty"` // optional, seconds until the hold expires
+}
+
+// structure for POST data expected from client to capture a hold
+type CaptureDetail struct {
+	Amount *money.Money `json:"amount,omitempty"` // optional, the whole hold when omitted
+}
+
+// Write the hold details with the given status.
+func writeHold(w http.ResponseWriter, req *http.Request, status int, h ds.Hold) {
+	js, err := json.Marshal(h)
+	if err != nil {
+		writeProblem(w, req, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// POST /holds and GET, POST /holds/<id>[/capture|/void] Handler
+//
+func (s *DataServer) holdsHandler(w http.ResponseWriter, req *http.Request) {
+	log.Printf("[%v][%v][%v]received request\n", req.RemoteAddr, req.Method, req.URL.Path)
+
+	// POST /holds
+	path := strings.Trim(req.URL.Path, "/")
+	pathParts := strings.Split(path, "/")
+	if len(pathParts) == 1 {
+		s.createHoldHandler(w, req)
+		return
+	}
+
+	// get the hold-id
+	id, err := strconv.ParseUint(pathParts[1], 10, 64)
+	if err != nil || len(pathParts) > 3 {
+		log.Printf("[%v][%v][%v]expecting /holds/<id>, invalid hold-id in the request\n", req.RemoteAddr, req.Method, req.URL.Path)
+		writeProblem(w, req, codeInvalidRequest, fmt.Sprintf("expecting /holds/<id>, invalid hold-id: %v", pathParts[1]))
+		return
+	}
+
+	// GET /holds/<id>
+	if len(pathParts) == 2 {
+		if req.Method != http.MethodGet {
+			log.Printf("[%v][%v][%v]expecting method GET, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
+			writeMethodNotAllowed(w, req, http.MethodGet)
+			return
+		}
+		h, err := s.data.GetHold(id)
+		if err != nil {
+			log.Println(err.Error())
+			writeDatastoreError(w, req, err, err.Error())
+			return
+		}
+		if !checkAccounts(w, req, h.AccountId, h.ToId) {
+			return
+		}
+		writeHold(w, req, http.StatusOK, h)
+		log.Printf("[%v][%v][%v]reply sent\n", req.RemoteAddr, req.Method, req.URL.Path)
+		return
+	}
+
+	// POST /holds/<id>/capture, POST /holds/<id>/void
+	if req.Method != http.MethodPost {
+		log.Printf("[%v][%v][%v]expecting method POST, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
+		writeMethodNotAllowed(w, req, http.MethodPost)
+		return
+	}
+
+	// either account of the hold can capture or void it
+	if restricted(req) {
+		h, err := s.data.GetHold(id)
+		if err != nil {
+			log.Println(err.Error())
+			writeDatastoreError(w, req, err, err.Error())
+			return
+		}
+		if !checkAccounts(w, req, h.AccountId, h.ToId) {
+			return
+		}
+	}
+	var h ds.Hold
+	switch pathParts[2] {
+	case "capture":
+		// the body is optional, the whole hold is captured without one
+		var cd CaptureDetail
+		if req.ContentLength != 0 && !decodeRequest(w, req, &cd) {
+			return
+		}
+		h, err = s.data.CaptureHold(id, cd.Amount)
+	case "void":
+		h, err = s.data.VoidHold(id)
+	default:
+		log.Printf("[%v][%v][%v]unknown hold action\n", req.RemoteAddr, req.Method, req.URL.Path)
+		writeProblem(w, req, codeNotFound, fmt.Sprintf("unknown hold action: %v, expecting capture or void", pathParts[2]))
+		return
+	}
+	if err != nil {
+		log.Printf("[%v][%v][%v]hold %v failed - %v\n", req.RemoteAddr, req.Method, req.URL.Path, pathParts[2], err.Error())
+		writeDatastoreError(w, req, err, fmt.Sprintf("hold %v failed - %v", pathParts[2], err.Error()))
+		return
+	}
+	log.Printf("[%v][%v][%v]hold id: %v is %v\n", req.RemoteAddr, req.Method, req.URL.Path, h.Id, h.Status)
+
+	writeHold(w, req, http.StatusOK, h)
+
+	log.Printf("[%v][%v][%v]reply sent\n", req.RemoteAddr, req.Method, req.URL.Path)
+}
+
+// POST /holds Handler
+//
+func (s *DataServer) createHoldHandler(w http.ResponseWriter, req *http.Request) {
+	// reject if this is not a POST
+	if req.Method != http.MethodPost {
+		log.Printf("[%v][%v][%v]expecting method POST, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
+		writeMethodNotAllowed(w, req, http.MethodPost)
+		return
+	}
+
+	// extract the hold details from the POST request
+	var hd HoldDetail
+	if !decodeRequest(w, req, &hd) {
+		return
+	}
+	log.Printf("[%v][%v][%v]account_id: %v, to_id: %v, amount: %v\n", req.RemoteAddr, req.Method, req.URL.Path, hd.AccountId, hd.ToId, hd.Amount)
+	if !checkAccounts(w, req, hd.AccountId) {
+		return
+	}
+	if hd.ExpiresIn < 0 {
+		log.Printf("[%v][%v][%v]invalid expires_in: %v\n", req.RemoteAddr, req.Method, req.URL.Path, hd.ExpiresIn)
+		writeProblem(w, req, codeInvalidHold, fmt.Sprintf("invalid expires_in: %v, expecting a positive number of seconds", hd.ExpiresIn))
+		return
+	}
+
+	// place the hold
+	h, err := s.data.CreateHold(ds.HoldRequest{AccountId: hd.AccountId, ToId: hd.ToId, Amount: hd.Amount, Expiry: time.Duration(hd.ExpiresIn) * time.Second})
+	if err != nil {
+		log.Printf("[%v][%v][%v]hold failed - %v\n", req.RemoteAddr, req.Method, req.URL.Path, err.Error())
+		writeDatastoreError(w, req, err, fmt.Sprintf("hold failed - %v", err.Error()))
+		return
+	}
+	log.Printf("[%v][%v][%v]hold placed in datastore with id: %v\n", req.RemoteAddr, req.Method, req.URL.Path, h.Id)
+
+	w.Header().Set("Location", fmt.Sprintf("/holds/%v", h.Id))
+	writeHold(w, req, http.StatusCreated, h)
+
+	log.Printf("[%v][%v][%v]reply sent\n", req.RemoteAddr, req.Method, req.URL.Path)
+}
+
+// end-of-file
@@ -0,0 +1,178 @@
+// REST API handlers for account lists.
+//
+// GET   /list/         : Streams all the accounts, as a json array or as NDJSON
+// GET   /list/?<query> : Returns json array of a page of the accounts
+//
+// The complete list is written while iterating the datastore, one account at a
+// time, so the memory used does not grow with the number of accounts. Requests
+// with an "Accept: application/x-ndjson" header get one json account per line.
+//
+// Query parameters supported by the account list, any of them selects a paged list:
+// name_prefix - only accounts with a name starting with the prefix, ignoring case
+// currency    - only accounts in the currency
+// min_balance - only accounts with at least this balance
+// max_balance - only accounts with at most this balance
+// sort        - "id", "name" or "balance", prefixed with "-" for descending order, default "id"
+// cursor      - cursor from the Link header of the previous page
+// limit       - maximum number of accounts in the page
+//
+// When there are more accounts, the response has a Link header with the url
+// of the next page, e.g. Link: </list/?cursor=...&limit=10>; rel="next"
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"paytabs/internal/ds"
+	"paytabs/internal/money"
+)
+
+// media type of newline delimited json
+const ndjsonMediaType = "application/x-ndjson"
+
+// size of the buffer used to write account lists
+const listBufferSize = 32 * 1024
+
+// Returns true if the request accepts NDJSON.
+func acceptsNDJSON(req *http.Request) bool {
+	for _, accept := range req.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mediaType == ndjsonMediaType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GET /list/ Handler
+//
+func (s *DataServer) streamHandler(w http.ResponseWriter, req *http.Request) {
+	ndjson := acceptsNDJSON(req)
+
+	// iterate the accounts, releasing the iterator when done
+	it := s.data.Accounts()
+	defer it.Close()
+
+	if ndjson {
+		w.Header().Set("Content-Type", ndjsonMediaType)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	// write the accounts as they are read, the status is sent with the first write
+	bw := bufio.NewWriterSize(w, listBufferSize)
+	if !ndjson {
+		bw.WriteByte('[')
+	}
+	n := 0
+	for it.Next() {
+		js, err := json.Marshal(it.Account())
+		if err != nil {
+			log.Printf("[%v][%v][%v]failed to encode account - %v\n", req.RemoteAddr, req.Method, req.URL.Path, err)
+			return
+		}
+		if !ndjson && n > 0 {
+			bw.WriteByte(',')
+		}
+		if _, err := bw.Write(js); err != nil {
+			// write errors are sticky, the client is gone
+			log.Printf("[%v][%v][%v]failed to write accounts after %v accounts - %v\n", req.RemoteAddr, req.Method, req.URL.Path, n, err)
+			return
+		}
+		if ndjson {
+			bw.WriteByte('\n')
+		}
+		n++
+	}
+	if !ndjson {
+		bw.WriteByte(']')
+	}
+	if err := bw.Flush(); err != nil {
+		log.Printf("[%v][%v][%v]failed to write accounts - %v\n", req.RemoteAddr, req.Method, req.URL.Path, err)
+		return
+	}
+
+	log.Printf("[%v][%v][%v]reply sent with %v accounts\n", req.RemoteAddr, req.Method, req.URL.Path, n)
+}
+
+// Parse the list query from the request query parameters.
+func parseListQuery(req *http.Request) (ds.ListQuery, error) {
+	values := req.URL.Query()
+	q := ds.ListQuery{
+		NamePrefix: values.Get("name_prefix"),
+		Currency:   values.Get("currency"),
+		Sort:       values.Get("sort"),
+		Cursor:     values.Get("cursor"),
+	}
+
+	if v := values.Get("min_balance"); v != "" {
+		m, err := money.Parse(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid min_balance: %q - %v", v, err)
+		}
+		q.MinBalance = &m
+	}
+	if v := values.Get("max_balance"); v != "" {
+		m, err := money.Parse(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid max_balance: %q - %v", v, err)
+		}
+		q.MaxBalance = &m
+	}
+	if v := values.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return q, fmt.Errorf("invalid limit: %q, expecting a positive number", v)
+		}
+		q.Limit = n
+	}
+
+	return q, nil
+}
+
+// GET /list/?<query> Handler
+//
+func (s *DataServer) queryHandler(w http.ResponseWriter, req *http.Request) {
+	// get the query parameters
+	q, err := parseListQuery(req)
+	if err != nil {
+		log.Printf("[%v][%v][%v]%v\n", req.RemoteAddr, req.Method, req.URL.Path, err.Error())
+		writeProblem(w, req, codeInvalidQuery, err.Error())
+		return
+	}
+
+	// get the page of accounts
+	page, err := s.data.Query(q)
+	if err != nil {
+		log.Println(err.Error())
+		writeDatastoreError(w, req, err, err.Error())
+		return
+	}
+	log.Printf("[%v][%v][%v]got %v accounts from datastore\n", req.RemoteAddr, req.Method, req.URL.Path, len(page.Accounts))
+
+	// write the accounts, with a link to the next page
+	js, err := json.Marshal(page.Accounts)
+	if err != nil {
+		writeProblem(w, req, codeInternalError, err.Error())
+		return
+	}
+	if page.NextCursor != "" {
+		values := req.URL.Query()
+		values.Set("cursor", page.NextCursor)
+		w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", req.URL.Path, values.Encode()))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+
+	log.Printf("[%v][%v][%v]reply sent\n", req.RemoteAddr, req.Method, req.URL.Path)
+}
+
+// end-of-file
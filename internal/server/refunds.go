@@ -0,0 +1,77 @@
+// REST API handler for refunds.
+//
+// POST  /transaction/<id>/refund : Refunds all or part of the transaction, returns the refund transaction
+//
+// The refund is transferred from the to account of the transaction back to its
+// from account and recorded as a new transaction, with refund_of set to the id
+// of the transaction refunded. The transaction keeps the amount refunded so far,
+// refunds in total cannot exceed the amount it credited.
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"paytabs/internal/money"
+)
+
+// structure for POST data expected from client to refund a transaction
+type RefundDetail struct {
+	Amount *money.Money `json:"amount,omitempty"` // optional, in the currency of the to account, all not yet refunded when omitted
+}
+
+// POST /transaction/<id>/refund Handler
+//
+func (s *DataServer) refundHandler(w http.ResponseWriter, req *http.Request, tid uint64) {
+	// reject if this is not a POST
+	if req.Method != http.MethodPost {
+		log.Printf("[%v][%v][%v]expecting method POST, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
+		writeMethodNotAllowed(w, req, http.MethodPost)
+		return
+	}
+
+	// the refund debits the to account of the transaction
+	if restricted(req) {
+		tr, err := s.data.GetTransaction(tid)
+		if err != nil {
+			log.Println(err.Error())
+			writeDatastoreError(w, req, err, err.Error())
+			return
+		}
+		if !checkAccounts(w, req, tr.ToId) {
+			return
+		}
+	}
+
+	// the body is optional, all of the transaction is refunded without one
+	var rd RefundDetail
+	if req.ContentLength != 0 && !decodeRequest(w, req, &rd) {
+		return
+	}
+
+	// refund the transaction
+	tr, err := s.data.Refund(tid, rd.Amount)
+	if err != nil {
+		log.Printf("[%v][%v][%v]refund failed - %v\n", req.RemoteAddr, req.Method, req.URL.Path, err.Error())
+		writeDatastoreError(w, req, err, fmt.Sprintf("refund failed - %v", err.Error()))
+		return
+	}
+	log.Printf("[%v][%v][%v]refund completed in datastore with tid: %v, amount: %v\n", req.RemoteAddr, req.Method, req.URL.Path, tr.Id, tr.Amount)
+
+	// write the refund transaction
+	js, err := json.Marshal(tr)
+	if err != nil {
+		writeProblem(w, req, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/transaction/%v", tr.Id))
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+
+	log.Printf("[%v][%v][%v]reply sent\n", req.RemoteAddr, req.Method, req.URL.Path)
+}
+
+// end-of-file
@@ -0,0 +1,184 @@
+// REST API handlers for scheduled and recurring transfers, standing orders.
+//
+// POST   /schedules      : Schedules transfers, returns the schedule details
+// GET    /schedules      : Returns json array of the schedules, ?account_id=<id> for those of an account
+// GET    /schedules/<id> : Returns the details of the schedule with the given <id>
+// PATCH  /schedules/<id> : Updates the amount, end date, count and/or status of the schedule
+// DELETE /schedules/<id> : Cancels the schedule, returns its details
+//
+// The transfers of a schedule are executed when they are due, and the outcome
+// of each is kept in the runs of the schedule, see internal/scheduler.
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"paytabs/internal/money"
+	"paytabs/internal/scheduler"
+)
+
+// structure for POST data expected from client to schedule transfers
+type ScheduleDetail struct {
+	FromId    string      `json:"from_id"`
+	ToId      string      `json:"to_id"`
+	Amount    money.Money `json:"amount"`              // amount in the currency of the from account
+	Convert   bool        `json:"convert,omitempty"`   // allow transfers between accounts in different currencies
+	Frequency string      `json:"frequency,omitempty"` // optional, "once", "daily", "weekly" or "monthly", "once" when omitted
+	StartAt   *time.Time  `json:"start_at,omitempty"`  // optional, time of the first transfer, now when omitted
+	EndDate   *time.Time  `json:"end_date,omitempty"`  // optional, no transfer after this time
+	Count     int         `json:"count,omitempty"`     // optional, number of transfers, no limit when omitted
+}
+
+// structure for PATCH data expected from client to update a schedule
+type ScheduleUpdateDetail struct {
+	Amount  *money.Money `json:"amount,omitempty"`   // new amount, unchanged when omitted
+	EndDate *time.Time   `json:"end_date,omitempty"` // new end date, unchanged when omitted
+	Count   *int         `json:"count,omitempty"`    // new number of transfers, unchanged when omitted
+	Status  *string      `json:"status,omitempty"`   // "active" or "paused", unchanged when omitted
+}
+
+// Write the schedule details with the given status.
+func writeSchedule(w http.ResponseWriter, req *http.Request, status int, sc scheduler.Schedule) {
+	js, err := json.Marshal(sc)
+	if err != nil {
+		writeProblem(w, req, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// POST, GET /schedules and GET, PATCH, DELETE /schedules/<id> Handler
+//
+func (s *DataServer) schedulesHandler(w http.ResponseWriter, req *http.Request) {
+	log.Printf("[%v][%v][%v]received request\n", req.RemoteAddr, req.Method, req.URL.Path)
+
+	// POST /schedules, GET /schedules
+	path := strings.Trim(req.URL.Path, "/")
+	pathParts := strings.Split(path, "/")
+	if len(pathParts) == 1 {
+		switch req.Method {
+		case http.MethodPost:
+			s.createScheduleHandler(w, req)
+		case http.MethodGet:
+			// a key restricted to accounts sees only the schedules involving them
+			list := s.schedules.List(req.URL.Query().Get("account_id"))
+			if restricted(req) {
+				allowed := list[:0]
+				for _, sc := range list {
+					if canAccess(req, sc.FromId, sc.ToId) {
+						allowed = append(allowed, sc)
+					}
+				}
+				list = allowed
+			}
+			js, err := json.Marshal(list)
+			if err != nil {
+				writeProblem(w, req, codeInternalError, err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(js)
+			log.Printf("[%v][%v][%v]%v schedules sent\n", req.RemoteAddr, req.Method, req.URL.Path, len(list))
+		default:
+			log.Printf("[%v][%v][%v]expecting method GET or POST, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
+			writeMethodNotAllowed(w, req, http.MethodGet+", "+http.MethodPost)
+		}
+		return
+	}
+
+	// get the schedule-id
+	id, err := strconv.ParseUint(pathParts[1], 10, 64)
+	if err != nil || len(pathParts) > 2 {
+		log.Printf("[%v][%v][%v]expecting /schedules/<id>, invalid schedule-id in the request\n", req.RemoteAddr, req.Method, req.URL.Path)
+		writeProblem(w, req, codeInvalidRequest, fmt.Sprintf("expecting /schedules/<id>, invalid schedule-id: %v", strings.Join(pathParts[1:], "/")))
+		return
+	}
+
+	// a key restricted to accounts reads the schedules involving them, and changes those debiting them
+	if restricted(req) {
+		sc, err := s.schedules.Get(id)
+		if err != nil {
+			log.Println(err.Error())
+			writeDatastoreError(w, req, err, err.Error())
+			return
+		}
+		ids := []string{sc.FromId}
+		if req.Method == http.MethodGet {
+			ids = append(ids, sc.ToId)
+		}
+		if !checkAccounts(w, req, ids...) {
+			return
+		}
+	}
+
+	// GET, PATCH, DELETE /schedules/<id>
+	var sc scheduler.Schedule
+	switch req.Method {
+	case http.MethodGet:
+		sc, err = s.schedules.Get(id)
+	case http.MethodPatch:
+		var ud ScheduleUpdateDetail
+		if !decodeRequest(w, req, &ud) {
+			return
+		}
+		sc, err = s.schedules.Update(id, scheduler.Update{Amount: ud.Amount, EndDate: ud.EndDate, Count: ud.Count, Status: ud.Status})
+	case http.MethodDelete:
+		sc, err = s.schedules.Cancel(id)
+	default:
+		log.Printf("[%v][%v][%v]expecting method GET, PATCH or DELETE, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
+		writeMethodNotAllowed(w, req, http.MethodGet+", "+http.MethodPatch+", "+http.MethodDelete)
+		return
+	}
+	if err != nil {
+		log.Printf("[%v][%v][%v]schedule request failed - %v\n", req.RemoteAddr, req.Method, req.URL.Path, err.Error())
+		writeDatastoreError(w, req, err, err.Error())
+		return
+	}
+	log.Printf("[%v][%v][%v]schedule id: %v is %v\n", req.RemoteAddr, req.Method, req.URL.Path, sc.Id, sc.Status)
+
+	writeSchedule(w, req, http.StatusOK, sc)
+
+	log.Printf("[%v][%v][%v]reply sent\n", req.RemoteAddr, req.Method, req.URL.Path)
+}
+
+// POST /schedules Handler
+//
+func (s *DataServer) createScheduleHandler(w http.ResponseWriter, req *http.Request) {
+	// extract the schedule details from the POST request
+	var sd ScheduleDetail
+	if !decodeRequest(w, req, &sd) {
+		return
+	}
+	log.Printf("[%v][%v][%v]from_id: %v, to_id: %v, amount: %v, frequency: %v\n", req.RemoteAddr, req.Method, req.URL.Path, sd.FromId, sd.ToId, sd.Amount, sd.Frequency)
+	if !checkAccounts(w, req, sd.FromId) {
+		return
+	}
+
+	// create the schedule
+	sreq := scheduler.Request{From: sd.FromId, To: sd.ToId, Amount: sd.Amount, Convert: sd.Convert, Frequency: sd.Frequency, EndDate: sd.EndDate, Count: sd.Count}
+	if sd.StartAt != nil {
+		sreq.StartAt = *sd.StartAt
+	}
+	sc, err := s.schedules.Create(sreq)
+	if err != nil {
+		log.Printf("[%v][%v][%v]schedule creation failed - %v\n", req.RemoteAddr, req.Method, req.URL.Path, err.Error())
+		writeDatastoreError(w, req, err, fmt.Sprintf("schedule creation failed - %v", err.Error()))
+		return
+	}
+	log.Printf("[%v][%v][%v]schedule created with id: %v\n", req.RemoteAddr, req.Method, req.URL.Path, sc.Id)
+
+	w.Header().Set("Location", fmt.Sprintf("/schedules/%v", sc.Id))
+	writeSchedule(w, req, http.StatusCreated, sc)
+
+	log.Printf("[%v][%v][%v]reply sent\n", req.RemoteAddr, req.Method, req.URL.Path)
+}
+
+// end-of-file
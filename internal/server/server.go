@@ -1,17 +1,70 @@
 // REST API server to transfer funds. Uses an in-memory datastore.
 //
 // Supported REST API are:
-// GET   /list/         : Returns json array of all accounts in the datastore
+// GET   /list/         : Returns json array, or NDJSON, of all accounts in the datastore, see list.go
+// GET   /list/?<query> : Returns json array of a page of the accounts, see list.go
 // POST  /transfer/     : Used to transfer amount from one account to another
+// POST  /transfers/batch : Transfers all of a list of legs or none of them, see batch.go
 // GET   /account/<id>  : Returns account details for the given <id>
+// POST  /accounts      : Creates an account, see accounts.go
+// PATCH /account/<id>  : Updates the name, status, overdraft limit and/or interest rate of the account, see accounts.go
+// GET   /account/<id>/overdraft : Returns the overdraft events of the account, see accounts.go
+// GET   /account/<id>/interest  : Returns the interest of the savings account, see accounts.go
+// POST  /holds         : Places a hold on the funds of an account, see holds.go
+// GET   /holds/<id>    : Returns the details of the hold with the given <id>
+// POST  /holds/<id>/capture : Transfers all or part of the held amount, see holds.go
+// POST  /holds/<id>/void    : Releases the held amount
+// POST  /admin/snapshot : Writes a snapshot of the datastore to the snapshot directory
+// GET   /admin/ledger   : Verifies the double-entry ledger against the account balances
+// GET   /transaction/<id>          : Returns details of the transaction with the given <id>
+// GET   /account/<id>/transactions : Returns the transaction history of the account, see history.go
+// POST  /transaction/<id>/refund   : Refunds all or part of the transaction, see refunds.go
+// POST  /schedules     : Schedules one or recurring transfers, see schedules.go
+// GET   /schedules     : Returns json array of the schedules
+// GET   /schedules/<id>    : Returns the details of the schedule with the given <id>
+// PATCH /schedules/<id>    : Updates the amount, end date, count and/or status of the schedule
+// DELETE /schedules/<id>   : Cancels the schedule
+// GET   /transfers/pending : Returns json array of the transfers held for approval, see approvals.go
+// GET   /transfers/pending/<id>         : Returns the details of the pending transfer with the given <id>
+// POST  /transfers/pending/<id>/approve : Approves the pending transfer, executing it
+// POST  /transfers/pending/<id>/reject  : Rejects the pending transfer, releasing the funds held
 //
 // Data structures used:
-// ds.Account        - used by GET /list/ and GET /account/<id>
+// ds.Account        - used by GET /list/, GET /account/<id> and response data of POST /accounts and PATCH /account/<id>
+// NewAccountDetail  - used by post data of POST /accounts
+// AccountUpdateDetail - used by patch data of PATCH /account/<id>
 // TransferDetail    - used by post data of POST /transfer/
 // TransferResponse  - used by response data of POST /transfer/
+// BatchDetail       - used by post data of POST /transfers/batch
+// ds.BatchResult    - used by response data of POST /transfers/batch
+// ds.SnapshotInfo   - used by response data of POST /admin/snapshot
+// ledger.Report     - used by response data of GET /admin/ledger
+// ds.Transaction    - used by GET /transaction/<id> and response data of POST /transaction/<id>/refund
+// RefundDetail      - used by post data of POST /transaction/<id>/refund
+// ds.HistoryPage    - used by GET /account/<id>/transactions
+// ds.OverdraftEvent - used by GET /account/<id>/overdraft
+// ds.InterestStatus - used by GET /account/<id>/interest
+// HoldDetail        - used by post data of POST /holds
+// CaptureDetail     - used by post data of POST /holds/<id>/capture
+// ds.Hold           - used by response data of the /holds API
+// ScheduleDetail    - used by post data of POST /schedules
+// ScheduleUpdateDetail - used by patch data of PATCH /schedules/<id>
+// scheduler.Schedule - used by response data of the /schedules API
+// ds.PendingTransfer - used by the /transfers/pending API and response data of POST /transfer/ held for approval
+// RejectDetail      - used by post data of POST /transfers/pending/<id>/reject
+//
+// With an API keys file every request is authenticated by its API key and
+// authorized by the scopes and accounts of the key, see auth.go.
+//
+// Retries of POST /transfer/ with the same Idempotency-Key header return the
+// result of the original transfer instead of transferring again. A transfer
+// above the approval threshold replies 202 with the pending transfer instead,
+// its requester named by the X-Principal header.
 package server
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -19,28 +72,73 @@ import (
 	"net/http"
 	"strings"
 
+	"paytabs/internal/approvals"
+	"paytabs/internal/auth"
 	"paytabs/internal/ds"
+	"paytabs/internal/fees"
+	"paytabs/internal/fx"
+	"paytabs/internal/interest"
 	"paytabs/internal/memds"
+	"paytabs/internal/money"
+	"paytabs/internal/rules"
+	"paytabs/internal/scheduler"
 )
 
 // structure to store server data
 type DataServer struct {
-	Port uint           // listening port for the server
-	mux  *http.ServeMux // url path handler mux
-	data ds.Datastore   // datastore for Accounts
+	Port      uint                 // listening port for the server
+	mux       *http.ServeMux       // url path handler mux
+	data      ds.Datastore         // datastore for Accounts
+	schedules *scheduler.Scheduler // scheduler of the scheduled transfers
+	keys      *auth.Keys           // API keys authenticating the requests, nil when requests are not authenticated
+}
+
+// server configuration
+type Config struct {
+	Port          uint             // listening port for the server
+	Datastore     memds.Config     // in-memory datastore configuration
+	Scheduler     scheduler.Config // scheduler configuration, the clock of the datastore when it has no clock
+	FXRatesFile   string           // optional json file with exchange rates for cross-currency transfers
+	RulesFile     string           // optional json file with transfer limits and velocity rules
+	FeesFile      string           // optional json file with the fee schedule of transfers
+	InterestFile  string           // optional json file with the interest policy of savings accounts
+	ApprovalsFile string           // optional json file with the approval thresholds of transfers
+	APIKeysFile   string           // optional json file with the API keys, when empty requests are not authenticated
 }
 
 // structure for POST data expected from client for transfer request
 type TranferDetail struct {
-	FromId string  `json:"from_id"`
-	ToId   string  `json:"to_id"`
-	Amount float64 `json:"amount"`
+	FromId  string      `json:"from_id"`
+	ToId    string      `json:"to_id"`
+	Amount  money.Money `json:"amount"`            // amount in the currency of the from account
+	Convert bool        `json:"convert,omitempty"` // allow transfer between accounts in different currencies
 }
 
 // response data sent to the client on successful transfer
 type TranferResponse struct {
-	TransactionId uint64  `json:"transaction_id"`
-	Balance       float64 `json:"balance"`
+	TransactionId uint64       `json:"transaction_id"`
+	Balance       money.Money  `json:"balance"`
+	Currency      string       `json:"currency"`
+	Amount        money.Money  `json:"amount"`         // amount debited in the currency of the from account
+	ToAmount      money.Money  `json:"to_amount"`      // amount credited in the currency of the to account
+	ToCurrency    string       `json:"to_currency"`    // currency of the to account
+	Rate          *money.Rate  `json:"rate,omitempty"` // exchange rate applied for cross-currency transfers
+	Fee           *money.Money `json:"fee,omitempty"`  // fee debited from the from account on top of the amount
+}
+
+// maximum length of the Idempotency-Key header
+const maxIdempotencyKeyLength = 255
+
+// Hash of the transfer details, identifies the request an idempotency key was used with.
+//
+// The decoded details are re-encoded so that formatting differences in the
+// request body do not matter, with the amount normalized so that neither do
+// trailing zero decimals.
+func hashTransferDetail(td TranferDetail) string {
+	td.Amount = td.Amount.Normalize()
+	js, _ := json.Marshal(td)
+	sum := sha256.Sum256(js)
+	return hex.EncodeToString(sum[:])
 }
 
 // GET /list/ Handler
@@ -51,53 +149,82 @@ func (s *DataServer) listHandler(w http.ResponseWriter, req *http.Request) {
 	// reject if this is not a GET
 	if req.Method != http.MethodGet {
 		log.Printf("[%v][%v][%v]expecting method GET, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
-		http.Error(w, fmt.Sprintf("expecting method GET, got %v", req.Method), http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w, req, http.MethodGet)
 		return
 	}
 
-	// get the list of all account details
-	accts := s.data.List()
-	log.Printf("[%v][%v][%v]received copy of %v accounts from the datastore\n", req.RemoteAddr, req.Method, req.URL.Path, len(accts))
+	// a key restricted to accounts cannot see the others
+	if restricted(req) {
+		log.Printf("[%v][%v][%v]API key %v is restricted to accounts\n", req.RemoteAddr, req.Method, req.URL.Path, requestKey(req).Name)
+		writeProblem(w, req, codeForbidden, fmt.Sprintf("API key %v is restricted to accounts, it cannot list all the accounts", requestKey(req).Name))
+		return
+	}
 
-	// write the acct details
-	js, err := json.Marshal(accts)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// GET /list/?<query>
+	if req.URL.RawQuery != "" {
+		s.queryHandler(w, req)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
 
-	log.Printf("[%v][%v][%v]reply sent\n", req.RemoteAddr, req.Method, req.URL.Path)
+	// stream the details of all the accounts
+	s.streamHandler(w, req)
 }
 
-// GET /account/<id> Handler
+// GET and PATCH /account/<id> Handler
 //
 func (s *DataServer) getAccountHandler(w http.ResponseWriter, req *http.Request) {
 	log.Printf("[%v][%v][%v]received request\n", req.RemoteAddr, req.Method, req.URL.Path)
 
-	// reject if this is not a GET
-	if req.Method != http.MethodGet {
-		log.Printf("[%v][%v][%v]expecting method GET, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
-		http.Error(w, fmt.Sprintf("expecting method GET, got %v", req.Method), http.StatusMethodNotAllowed)
-		return
-	}
-
 	// get the account-id
 	path := strings.Trim(req.URL.Path, "/")
 	pathParts := strings.Split(path, "/")
 	if len(pathParts) < 2 {
 		log.Printf("[%v][%v][%v]expecting /account/<id>, unable to find account-id in the request\n", req.RemoteAddr, req.Method, req.URL.Path)
-		http.Error(w, "expecting /account/<id>, unable to find account-id in the request", http.StatusBadRequest)
+		writeProblem(w, req, codeInvalidRequest, "expecting /account/<id>, unable to find account-id in the request")
 		return
 	}
 	id := pathParts[1]
+	if !checkAccounts(w, req, id) {
+		return
+	}
+
+	// GET /account/<id>/transactions, GET /account/<id>/overdraft and GET /account/<id>/interest
+	if len(pathParts) > 2 {
+		if len(pathParts) == 3 && pathParts[2] == "transactions" {
+			s.historyHandler(w, req, id)
+			return
+		}
+		if len(pathParts) == 3 && pathParts[2] == "overdraft" {
+			s.overdraftHandler(w, req, id)
+			return
+		}
+		if len(pathParts) == 3 && pathParts[2] == "interest" {
+			s.interestHandler(w, req, id)
+			return
+		}
+		log.Printf("[%v][%v][%v]unknown account resource\n", req.RemoteAddr, req.Method, req.URL.Path)
+		writeProblem(w, req, codeNotFound, fmt.Sprintf("unknown account resource: %v", req.URL.Path))
+		return
+	}
+
+	// PATCH /account/<id>
+	if req.Method == http.MethodPatch {
+		s.updateAccountHandler(w, req, id)
+		return
+	}
+
+	// reject if this is not a GET
+	if req.Method != http.MethodGet {
+		log.Printf("[%v][%v][%v]expecting method GET or PATCH, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
+		writeMethodNotAllowed(w, req, http.MethodGet+", "+http.MethodPatch)
+		return
+	}
 
 	// get the account details
 	acct, err := s.data.Get(id)
 	if err != nil {
 		log.Println(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDatastoreError(w, req, err, err.Error())
 		return
 	}
 	log.Printf("[%v][%v][%v]got account details for id: %v from datastore\n", req.RemoteAddr, req.Method, req.URL.Path, id)
@@ -105,7 +232,7 @@ func (s *DataServer) getAccountHandler(w http.ResponseWriter, req *http.Request)
 	// write the acct details
 	js, err := json.Marshal(acct)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeProblem(w, req, codeInternalError, err.Error())
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -114,66 +241,121 @@ func (s *DataServer) getAccountHandler(w http.ResponseWriter, req *http.Request)
 	log.Printf("[%v][%v][%v]reply sent\n", req.RemoteAddr, req.Method, req.URL.Path)
 }
 
-// POST /transfer/ Handler
+// Decode the json request body into v.
 //
-func (s *DataServer) transferHandler(w http.ResponseWriter, req *http.Request) {
-	log.Printf("[%v][%v][%v]received request\n", req.RemoteAddr, req.Method, req.URL.Path)
-
-	// reject if this is not a POST
-	if req.Method != http.MethodPost {
-		log.Printf("[%v][%v][%v]expecting method POST, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
-		http.Error(w, fmt.Sprintf("expecting method POST, got %v", req.Method), http.StatusMethodNotAllowed)
-		return
-	}
-
-	// extract the fund transfer details from the POST request
+// Writes the error response and returns false if the request is not json
+// or cannot be decoded.
+func decodeRequest(w http.ResponseWriter, req *http.Request, v interface{}) bool {
 	contentType := req.Header.Get("Content-Type")
 	mediatype, _, err := mime.ParseMediaType(contentType)
 	if err != nil {
 		log.Printf("[%v][%v][%v]error retrieving Content-Type\n", req.RemoteAddr, req.Method, req.URL.Path)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		writeProblem(w, req, codeInvalidRequest, fmt.Sprintf("invalid Content-Type - %v", err.Error()))
+		return false
 	}
 	if mediatype != "application/json" {
 		log.Printf("[%v][%v][%v]unexpected Content-Type %v\n", req.RemoteAddr, req.Method, req.URL.Path, mediatype)
-		http.Error(w, "require application/json Content-Type", http.StatusUnsupportedMediaType)
-		return
+		writeProblem(w, req, codeUnsupportedMediaType, "require application/json Content-Type")
+		return false
 	}
 
-	// decode the json data for fund transfer
+	// decode the json data
 	decoder := json.NewDecoder(req.Body)
 	decoder.DisallowUnknownFields()
-	var td TranferDetail
-	if err := decoder.Decode(&td); err != nil {
+	if err := decoder.Decode(v); err != nil {
 		log.Printf("[%v][%v][%v]error decoding json data - %v\n", req.RemoteAddr, req.Method, req.URL.Path, err.Error())
-		http.Error(w, fmt.Sprintf("error decoding json data - %v", err.Error()), http.StatusBadRequest)
+		writeProblem(w, req, codeInvalidJSON, fmt.Sprintf("error decoding json data - %v", err.Error()))
+		return false
+	}
+	return true
+}
+
+// POST /transfer/ Handler
+//
+func (s *DataServer) transferHandler(w http.ResponseWriter, req *http.Request) {
+	log.Printf("[%v][%v][%v]received request\n", req.RemoteAddr, req.Method, req.URL.Path)
+
+	// reject if this is not a POST
+	if req.Method != http.MethodPost {
+		log.Printf("[%v][%v][%v]expecting method POST, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
+		writeMethodNotAllowed(w, req, http.MethodPost)
 		return
 	}
-	log.Printf("[%v][%v][%v]from_id: %v, to_id: %v, amount: %v\n", req.RemoteAddr, req.Method, req.URL.Path, td.FromId, td.ToId, td.Amount)
 
-	// validate data, make sure amount is a +ve value
-	if td.Amount < 0 {
-		log.Printf("[%v][%v][%v]fund transfer failed, transfer amount cannot be a negative value\n", req.RemoteAddr, req.Method, req.URL.Path)
-		http.Error(w, "fund transfer failed, transfer amount cannot be a negative value", http.StatusBadRequest)
+	// extract the fund transfer details from the POST request
+	var td TranferDetail
+	if !decodeRequest(w, req, &td) {
 		return
 	}
+	log.Printf("[%v][%v][%v]from_id: %v, to_id: %v, amount: %v\n", req.RemoteAddr, req.Method, req.URL.Path, td.FromId, td.ToId, td.Amount)
+	if !checkAccounts(w, req, td.FromId) {
+		return
+	}
+
+	// a retried request carries the same idempotency key and body
+	treq := ds.TransferRequest{From: td.FromId, To: td.ToId, Amount: td.Amount, Convert: td.Convert, RequireApproval: true, Principal: principal(req)}
+	if key := req.Header.Get("Idempotency-Key"); key != "" {
+		if len(key) > maxIdempotencyKeyLength {
+			log.Printf("[%v][%v][%v]idempotency key too long\n", req.RemoteAddr, req.Method, req.URL.Path)
+			writeProblem(w, req, codeInvalidRequest, fmt.Sprintf("Idempotency-Key cannot be longer than %v characters", maxIdempotencyKeyLength))
+			return
+		}
+		if strings.HasPrefix(key, scheduler.IdempotencyKeyPrefix) {
+			log.Printf("[%v][%v][%v]idempotency key with reserved prefix\n", req.RemoteAddr, req.Method, req.URL.Path)
+			writeProblem(w, req, codeInvalidRequest, fmt.Sprintf("Idempotency-Key cannot start with %q, it is reserved for scheduled transfers", scheduler.IdempotencyKeyPrefix))
+			return
+		}
+		treq.IdempotencyKey = key
+		if apiKey := requestKey(req); apiKey != nil {
+			// each API key has its own idempotency keys
+			treq.IdempotencyKey = apiKey.Name + "\x00" + key
+		}
+		treq.RequestHash = hashTransferDetail(td)
+		log.Printf("[%v][%v][%v]idempotency key: %q\n", req.RemoteAddr, req.Method, req.URL.Path, key)
+	}
 
 	// perform fund transfer
-	tid, balance, err := s.data.Transfer(td.FromId, td.ToId, td.Amount)
+	// the amount is validated by the datastore
+	res, err := s.data.Transfer(treq)
 	if err != nil {
 		log.Printf("[%v][%v][%v]fund transfer failed - %v\n", req.RemoteAddr, req.Method, req.URL.Path, err.Error())
-		http.Error(w, fmt.Sprintf("fund transfer failed - %v", err.Error()), http.StatusInternalServerError)
+		writeDatastoreError(w, req, err, fmt.Sprintf("fund transfer failed - %v", err.Error()))
 		return
 	}
-	log.Printf("[%v][%v][%v]fund transfer completed in datastore with tid: %v, balance: %v\n", req.RemoteAddr, req.Method, req.URL.Path, tid, balance)
+	if res.Replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
 
-	tr := TranferResponse{tid, balance}
+	// a transfer held for approval is accepted, not executed
+	if res.Pending != nil {
+		log.Printf("[%v][%v][%v]fund transfer held for approval with pending id: %v\n", req.RemoteAddr, req.Method, req.URL.Path, res.Pending.Id)
+		w.Header().Set("Location", fmt.Sprintf("/transfers/pending/%v", res.Pending.Id))
+		writePending(w, req, http.StatusAccepted, *res.Pending)
+		log.Printf("[%v][%v][%v]reply sent\n", req.RemoteAddr, req.Method, req.URL.Path)
+		return
+	}
+	log.Printf("[%v][%v][%v]fund transfer completed in datastore with tid: %v, balance: %v\n", req.RemoteAddr, req.Method, req.URL.Path, res.Tid, res.Balance)
+
+	tr := TranferResponse{
+		TransactionId: res.Tid,
+		Balance:       res.Balance,
+		Currency:      res.Currency,
+		Amount:        res.Amount,
+		ToAmount:      res.ToAmount,
+		ToCurrency:    res.ToCurrency,
+	}
+	if !res.Rate.IsZero() {
+		tr.Rate = &res.Rate
+	}
+	if !res.Fee.IsZero() {
+		tr.Fee = &res.Fee
+	}
 
 	// write response to client
 	js, err := json.Marshal(tr)
 	if err != nil {
 		log.Printf("[%v][%v][%v]json marshall failed - %v\n", req.RemoteAddr, req.Method, req.URL.Path, err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeProblem(w, req, codeInternalError, err.Error())
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -182,34 +364,239 @@ func (s *DataServer) transferHandler(w http.ResponseWriter, req *http.Request) {
 	log.Printf("[%v][%v][%v]transfer completed successfully, reply sent\n", req.RemoteAddr, req.Method, req.URL.Path)
 }
 
+// POST /admin/snapshot Handler
+//
+func (s *DataServer) snapshotHandler(w http.ResponseWriter, req *http.Request) {
+	log.Printf("[%v][%v][%v]received request\n", req.RemoteAddr, req.Method, req.URL.Path)
+
+	// reject if this is not a POST
+	if req.Method != http.MethodPost {
+		log.Printf("[%v][%v][%v]expecting method POST, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
+		writeMethodNotAllowed(w, req, http.MethodPost)
+		return
+	}
+
+	// the datastore may not support snapshots
+	snapshotter, ok := s.data.(ds.Snapshotter)
+	if !ok {
+		log.Printf("[%v][%v][%v]datastore does not support snapshots\n", req.RemoteAddr, req.Method, req.URL.Path)
+		writeProblem(w, req, codeNotImplemented, "datastore does not support snapshots")
+		return
+	}
+
+	// write the snapshot
+	info, err := snapshotter.Snapshot()
+	if err != nil {
+		log.Printf("[%v][%v][%v]snapshot failed - %v\n", req.RemoteAddr, req.Method, req.URL.Path, err.Error())
+		writeProblem(w, req, codeInternalError, fmt.Sprintf("snapshot failed - %v", err.Error()))
+		return
+	}
+	log.Printf("[%v][%v][%v]snapshot written at lsn: %v to file: %v\n", req.RemoteAddr, req.Method, req.URL.Path, info.Lsn, info.File)
+
+	// write the snapshot details
+	js, err := json.Marshal(info)
+	if err != nil {
+		writeProblem(w, req, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+
+	log.Printf("[%v][%v][%v]reply sent\n", req.RemoteAddr, req.Method, req.URL.Path)
+}
+
+// GET /admin/ledger Handler
+//
+// Responds with the verification report, with status 500 when the ledger does
+// not balance or does not match the account balances.
+func (s *DataServer) ledgerHandler(w http.ResponseWriter, req *http.Request) {
+	log.Printf("[%v][%v][%v]received request\n", req.RemoteAddr, req.Method, req.URL.Path)
+
+	// reject if this is not a GET
+	if req.Method != http.MethodGet {
+		log.Printf("[%v][%v][%v]expecting method GET, got %v\n", req.RemoteAddr, req.Method, req.URL.Path, req.Method)
+		writeMethodNotAllowed(w, req, http.MethodGet)
+		return
+	}
+
+	// the datastore may not keep a ledger
+	verifier, ok := s.data.(ds.LedgerVerifier)
+	if !ok {
+		log.Printf("[%v][%v][%v]datastore does not keep a ledger\n", req.RemoteAddr, req.Method, req.URL.Path)
+		writeProblem(w, req, codeNotImplemented, "datastore does not keep a ledger")
+		return
+	}
+
+	// verify the ledger
+	report := verifier.VerifyLedger()
+	log.Printf("[%v][%v][%v]ledger verified, balanced: %v, problems: %v\n", req.RemoteAddr, req.Method, req.URL.Path, report.Balanced, len(report.Problems))
+
+	// write the report
+	js, err := json.Marshal(report)
+	if err != nil {
+		writeProblem(w, req, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Balanced {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.Write(js)
+
+	log.Printf("[%v][%v][%v]reply sent\n", req.RemoteAddr, req.Method, req.URL.Path)
+}
+
 // Initialize Server
 //
 func New(port uint, filename string) (*DataServer, error) {
+	return NewWithConfig(Config{Port: port, Datastore: memds.Config{DataFile: filename}})
+}
+
+// Initialize Server using the given configuration
+//
+func NewWithConfig(cfg Config) (*DataServer, error) {
+	var keys *auth.Keys
+	if cfg.APIKeysFile != "" {
+		log.Printf("[server]using API keys file: %v\n", cfg.APIKeysFile)
+		var err error
+		keys, err = auth.Load(cfg.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// initialize in-memory datastore
-	log.Printf("[server]initializing in-memory datastore using file: %v\n", filename)
-	d, err := memds.Load(filename)
+	log.Printf("[server]initializing in-memory datastore using file: %v\n", cfg.Datastore.DataFile)
+	if cfg.Datastore.Journal != "" {
+		log.Printf("[server]using journal: %v\n", cfg.Datastore.Journal)
+	}
+	if cfg.Datastore.SnapshotDir != "" {
+		log.Printf("[server]using snapshot directory: %v\n", cfg.Datastore.SnapshotDir)
+	}
+	if cfg.FXRatesFile != "" {
+		log.Printf("[server]using exchange rates file: %v\n", cfg.FXRatesFile)
+		rates, err := fx.NewFileProvider(cfg.FXRatesFile, 0)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Datastore.FXRates = rates
+	}
+	if cfg.RulesFile != "" {
+		log.Printf("[server]using rules file: %v\n", cfg.RulesFile)
+		set, err := rules.Load(cfg.RulesFile)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("[server]loaded %v rules\n", set.Len())
+		cfg.Datastore.Rules = set
+	}
+	if cfg.FeesFile != "" {
+		log.Printf("[server]using fee schedule file: %v\n", cfg.FeesFile)
+		schedule, err := fees.Load(cfg.FeesFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Datastore.Fees = schedule
+	}
+	if cfg.InterestFile != "" {
+		log.Printf("[server]using interest file: %v\n", cfg.InterestFile)
+		policy, err := interest.Load(cfg.InterestFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Datastore.Interest = policy
+	}
+	if cfg.ApprovalsFile != "" {
+		log.Printf("[server]using approvals file: %v\n", cfg.ApprovalsFile)
+		policy, err := approvals.Load(cfg.ApprovalsFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Datastore.Approvals = policy
+		cfg.Scheduler.Approvals = policy
+	}
+	d, err := memds.Open(cfg.Datastore)
 	if err != nil {
 		return nil, err
 	}
 
+	// start the scheduler on the datastore
+	if cfg.Scheduler.File != "" {
+		log.Printf("[server]using schedules file: %v\n", cfg.Scheduler.File)
+	}
+	if cfg.Scheduler.Clock == nil {
+		cfg.Scheduler.Clock = cfg.Datastore.Clock
+	}
+	schedules, err := scheduler.New(d, cfg.Scheduler)
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+
 	// instantiate DataServer
 	srv := new(DataServer)
-	srv.Port = port
+	srv.Port = cfg.Port
 	srv.data = d
+	srv.schedules = schedules
+	srv.keys = keys
 	log.Println("[server]datastore initialization complete")
 
 	// initialize ServeMux and add handlers
 	log.Println("[server]registering handlers")
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/list/", srv.listHandler)
+	read, write, admin := auth.ScopeReadAccounts, auth.ScopeWriteTransfers, auth.ScopeAdmin
+	mux.HandleFunc("/list/", srv.authorize(read, read, srv.listHandler))
 	log.Println("[server]registered handler for GET /list/")
 
-	mux.HandleFunc("/transfer/", srv.transferHandler)
+	mux.HandleFunc("/transfer/", srv.authorize(write, write, srv.transferHandler))
 	log.Println("[server]registered handler for POST /transfer/")
 
-	mux.HandleFunc("/account/", srv.getAccountHandler)
+	mux.HandleFunc("/transfers/batch", srv.authorize(write, write, srv.batchHandler))
+	log.Println("[server]registered handler for POST /transfers/batch")
+
+	mux.HandleFunc("/transfers/pending", srv.authorize(read, "", srv.pendingHandler))
+	mux.HandleFunc("/transfers/pending/", srv.authorize(read, "", srv.pendingHandler))
+	log.Println("[server]registered handler for GET /transfers/pending")
+	log.Println("[server]registered handler for GET /transfers/pending/<id>")
+	log.Println("[server]registered handler for POST /transfers/pending/<id>/approve")
+	log.Println("[server]registered handler for POST /transfers/pending/<id>/reject")
+
+	mux.HandleFunc("/accounts", srv.authorize(admin, admin, srv.accountsHandler))
+	mux.HandleFunc("/accounts/", srv.authorize(admin, admin, srv.accountsHandler))
+	log.Println("[server]registered handler for POST /accounts")
+
+	mux.HandleFunc("/account/", srv.authorize(read, admin, srv.getAccountHandler))
 	log.Println("[server]registered handler for GET /account/<id>")
+	log.Println("[server]registered handler for PATCH /account/<id>")
+	log.Println("[server]registered handler for GET /account/<id>/transactions")
+	log.Println("[server]registered handler for GET /account/<id>/overdraft")
+	log.Println("[server]registered handler for GET /account/<id>/interest")
+
+	mux.HandleFunc("/transaction/", srv.authorize(read, write, srv.transactionHandler))
+	log.Println("[server]registered handler for GET /transaction/<id>")
+	log.Println("[server]registered handler for POST /transaction/<id>/refund")
+
+	mux.HandleFunc("/holds", srv.authorize(read, write, srv.holdsHandler))
+	mux.HandleFunc("/holds/", srv.authorize(read, write, srv.holdsHandler))
+	log.Println("[server]registered handler for POST /holds")
+	log.Println("[server]registered handler for GET /holds/<id>")
+	log.Println("[server]registered handler for POST /holds/<id>/capture")
+	log.Println("[server]registered handler for POST /holds/<id>/void")
+
+	mux.HandleFunc("/schedules", srv.authorize(read, write, srv.schedulesHandler))
+	mux.HandleFunc("/schedules/", srv.authorize(read, write, srv.schedulesHandler))
+	log.Println("[server]registered handler for POST /schedules")
+	log.Println("[server]registered handler for GET /schedules")
+	log.Println("[server]registered handler for GET /schedules/<id>")
+	log.Println("[server]registered handler for PATCH /schedules/<id>")
+	log.Println("[server]registered handler for DELETE /schedules/<id>")
+
+	mux.HandleFunc("/admin/snapshot", srv.authorize(admin, admin, srv.snapshotHandler))
+	log.Println("[server]registered handler for POST /admin/snapshot")
+
+	mux.HandleFunc("/admin/ledger", srv.authorize(admin, admin, srv.ledgerHandler))
+	log.Println("[server]registered handler for GET /admin/ledger")
 
 	srv.mux = mux
 	log.Println("[server]handler registration complete")
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
@@ -10,10 +11,19 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"paytabs/internal/auth"
+	"paytabs/internal/clock"
 	"paytabs/internal/ds"
+	"paytabs/internal/ledger"
+	"paytabs/internal/memds"
+	"paytabs/internal/money"
+	"paytabs/internal/scheduler"
 )
 
 const datafile string = "../../data/accounts-mock.json"
@@ -35,6 +45,16 @@ func TestMain(m *testing.M) {
 		return
 	}
 
+	// mock data file has no currencies, statuses, holds, overdraft limits or types, accounts
+	// are loaded active with the default currency and all of their balance available
+	for i := range gAccounts {
+		gAccounts[i].Currency = "USD"
+		gAccounts[i].Status = ds.StatusActive
+		gAccounts[i].Available = gAccounts[i].Balance
+		gAccounts[i].OverdraftLimit = money.New(0, 2)
+		gAccounts[i].Type = ds.TypeChecking
+	}
+
 	// initialize server
 	s, err := New(8080, datafile)
 	if err != nil {
@@ -83,10 +103,43 @@ func TestGetList(t *testing.T) {
 	}
 }
 
+func TestGetListNDJSON(t *testing.T) {
+	// setup request
+	req := httptest.NewRequest("GET", "http://localhost:8080/list/", nil)
+	req.Header.Set("Accept", "application/x-ndjson; q=1.0, application/json; q=0.5")
+	w := httptest.NewRecorder()
+
+	// send request
+	gSrv.listHandler(w, req)
+
+	// validate response
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expecting Status  %v, received %v\n", http.StatusOK, resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("Expecting Content-Type: application/x-ndjson, received %v\n", resp.Header.Get("Content-Type"))
+	}
+
+	// decode one account per line
+	var accts []ds.Account
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var acct ds.Account
+		if err := json.Unmarshal(scanner.Bytes(), &acct); err != nil {
+			t.Fatalf("Error decoding json line %q", scanner.Text())
+		}
+		accts = append(accts, acct)
+	}
+	if !reflect.DeepEqual(gAccounts, accts) {
+		t.Fatal("Received []Accounts data does not match with the expected")
+	}
+}
+
 func TestPostTransfer(t *testing.T) {
 	// setup request
-	amount := 0.5
-	td := TranferDetail{gAccounts[0].Id, gAccounts[1].Id, amount}
+	amount := money.MustParse("0.5")
+	td := TranferDetail{FromId: gAccounts[0].Id, ToId: gAccounts[1].Id, Amount: amount}
 	jbytes, _ := json.Marshal(td)
 	req := httptest.NewRequest("POST", "http://localhost:8080/transfer/", bytes.NewReader(jbytes))
 	req.Header.Set("Content-Type", "application/json")
@@ -113,8 +166,1051 @@ func TestPostTransfer(t *testing.T) {
 		t.Fatal("Error decoding json data")
 	}
 
-	expectedBalance := gAccounts[0].Balance - amount
-	if expectedBalance != tr.Balance {
+	expectedBalance := gAccounts[0].Balance.Sub(amount)
+	if expectedBalance.Cmp(tr.Balance) != 0 {
 		t.Fatalf("Expecting balance: %v, but received %v\n", expectedBalance, tr.Balance)
 	}
 }
+
+func TestPostTransferTooManyDecimals(t *testing.T) {
+	body := fmt.Sprintf(`{"from_id": %q, "to_id": %q, "amount": 0.001}`, gAccounts[0].Id, gAccounts[1].Id)
+	req := httptest.NewRequest("POST", "http://localhost:8080/transfer/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	gSrv.transferHandler(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode == http.StatusOK {
+		t.Fatalf("Expecting transfer of 0.001 to fail, received status %v\n", resp.StatusCode)
+	}
+}
+
+func TestGetTransactionAndHistory(t *testing.T) {
+	// make a transfer to look up
+	res, err := gSrv.data.Transfer(ds.TransferRequest{From: gAccounts[5].Id, To: gAccounts[6].Id, Amount: money.MustParse("2")})
+	if err != nil {
+		t.Fatalf("Failed to transfer funds - %v", err)
+	}
+
+	// GET /transaction/<id>
+	req := httptest.NewRequest("GET", fmt.Sprintf("http://localhost:8080/transaction/%v", res.Tid), nil)
+	w := httptest.NewRecorder()
+	gSrv.transactionHandler(w, req)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusOK, resp.StatusCode)
+	}
+	var tr ds.Transaction
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		t.Fatal("Error decoding json data")
+	}
+	if tr.Id != res.Tid || tr.FromId != gAccounts[5].Id || tr.Amount.Cmp(money.MustParse("2")) != 0 {
+		t.Fatalf("Unexpected transaction details %+v", tr)
+	}
+
+	// GET /account/<id>/transactions
+	req = httptest.NewRequest("GET", fmt.Sprintf("http://localhost:8080/account/%v/transactions?direction=in&limit=10", gAccounts[6].Id), nil)
+	w = httptest.NewRecorder()
+	gSrv.getAccountHandler(w, req)
+	resp = w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusOK, resp.StatusCode)
+	}
+	var page ds.HistoryPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatal("Error decoding json data")
+	}
+	if len(page.Transactions) != 1 || page.Transactions[0].Id != res.Tid {
+		t.Fatalf("Unexpected history page %+v", page)
+	}
+
+	// invalid query parameters
+	req = httptest.NewRequest("GET", fmt.Sprintf("http://localhost:8080/account/%v/transactions?since=yesterday", gAccounts[6].Id), nil)
+	w = httptest.NewRecorder()
+	gSrv.getAccountHandler(w, req)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusBadRequest, w.Result().StatusCode)
+	}
+}
+
+func TestPostTransferIdempotencyKey(t *testing.T) {
+	post := func(key string, body string) *http.Response {
+		req := httptest.NewRequest("POST", "http://localhost:8080/transfer/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		gSrv.transferHandler(w, req)
+		return w.Result()
+	}
+	body := fmt.Sprintf(`{"from_id": %q, "to_id": %q, "amount": "1.25"}`, gAccounts[7].Id, gAccounts[8].Id)
+
+	// the first request performs the transfer
+	resp := post("retry-1", body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusOK, resp.StatusCode)
+	}
+	var first TranferResponse
+	json.NewDecoder(resp.Body).Decode(&first)
+
+	// a retry with a differently formatted but equal body returns the same result
+	resp = post("retry-1", fmt.Sprintf(`{"amount": 1.25, "to_id": %q, "from_id": %q}`, gAccounts[8].Id, gAccounts[7].Id))
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("Expecting a replayed response, received status %v\n", resp.StatusCode)
+	}
+	var second TranferResponse
+	json.NewDecoder(resp.Body).Decode(&second)
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("Expecting response %+v, received %+v", first, second)
+	}
+	expectedBalance := gAccounts[7].Balance.Sub(money.MustParse("1.25"))
+	if second.Balance.Cmp(expectedBalance) != 0 {
+		t.Fatalf("Expecting balance: %v, but received %v\n", expectedBalance, second.Balance)
+	}
+
+	// as does a retry with the amount written with other trailing zeros
+	resp = post("retry-1", fmt.Sprintf(`{"from_id": %q, "to_id": %q, "amount": "1.250"}`, gAccounts[7].Id, gAccounts[8].Id))
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("Expecting a replayed response, received status %v\n", resp.StatusCode)
+	}
+
+	// the same key with a different body is rejected
+	resp = post("retry-1", fmt.Sprintf(`{"from_id": %q, "to_id": %q, "amount": "2"}`, gAccounts[7].Id, gAccounts[8].Id))
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusUnprocessableEntity, resp.StatusCode)
+	}
+
+	// the keys of scheduled transfers are reserved
+	var p Problem
+	resp = post("schedule-1-1767258000", body)
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil || p.Code != codeInvalidRequest {
+		t.Fatalf("Expecting code %v, received %+v, %v", codeInvalidRequest, p, err)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	transfer := func(from string, to string, amount string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"from_id": %q, "to_id": %q, "amount": %q}`, from, to, amount)
+		req := httptest.NewRequest("POST", "http://localhost:8080/transfer/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		gSrv.transferHandler(w, req)
+		return w
+	}
+	get := func(url string, handler http.HandlerFunc) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+	tests := []struct {
+		w      *httptest.ResponseRecorder
+		status int
+		code   string
+	}{
+		{get("http://localhost:8080/account/missing", gSrv.getAccountHandler), http.StatusNotFound, "account_not_found"},
+		{get("http://localhost:8080/transaction/999999", gSrv.transactionHandler), http.StatusNotFound, "transaction_not_found"},
+		{get(fmt.Sprintf("http://localhost:8080/account/%v/transactions?cursor=bogus", gAccounts[0].Id), gSrv.getAccountHandler), http.StatusBadRequest, "invalid_query"},
+		{transfer("missing", gAccounts[1].Id, "1"), http.StatusNotFound, "account_not_found"},
+		{transfer(gAccounts[9].Id, gAccounts[10].Id, "1000000"), http.StatusConflict, "insufficient_funds"},
+		{transfer(gAccounts[9].Id, gAccounts[9].Id, "1"), http.StatusUnprocessableEntity, "same_account"},
+		{transfer(gAccounts[9].Id, gAccounts[10].Id, "-1"), http.StatusUnprocessableEntity, "invalid_amount"},
+	}
+	for i, tc := range tests {
+		resp := tc.w.Result()
+		var p Problem
+		if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+			t.Fatalf("%v: error decoding json data - %v", i, err)
+		}
+		if resp.StatusCode != tc.status || p.Status != tc.status || p.Code != tc.code || p.Detail == "" {
+			t.Fatalf("%v: expecting %v %v, received %v %+v", i, tc.status, tc.code, resp.StatusCode, p)
+		}
+	}
+}
+
+func TestProblemDetails(t *testing.T) {
+	send := func(method string, url string, contentType string, body string, handler http.HandlerFunc) *http.Response {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		resp := w.Result()
+		resp.Request = req
+		return resp
+	}
+	tests := []struct {
+		resp   *http.Response
+		status int
+		code   string
+	}{
+		{send("POST", "http://localhost:8080/list/", "", "", gSrv.listHandler), http.StatusMethodNotAllowed, "method_not_allowed"},
+		{send("DELETE", "http://localhost:8080/account/1", "", "", gSrv.getAccountHandler), http.StatusMethodNotAllowed, "method_not_allowed"},
+		{send("GET", "http://localhost:8080/account/1/unknown", "", "", gSrv.getAccountHandler), http.StatusNotFound, "not_found"},
+		{send("GET", "http://localhost:8080/transfer/", "", "", gSrv.transferHandler), http.StatusMethodNotAllowed, "method_not_allowed"},
+		{send("POST", "http://localhost:8080/transfer/", "text/plain", "{}", gSrv.transferHandler), http.StatusUnsupportedMediaType, "unsupported_media_type"},
+		{send("POST", "http://localhost:8080/transfer/", "application/json", `{"from_id": `, gSrv.transferHandler), http.StatusBadRequest, "invalid_json"},
+		{send("POST", "http://localhost:8080/transfer/", "application/json", `{"unknown": 1}`, gSrv.transferHandler), http.StatusBadRequest, "invalid_json"},
+	}
+	for i, tc := range tests {
+		if tc.resp.Header.Get("Content-Type") != "application/problem+json" {
+			t.Fatalf("%v: expecting Content-Type: application/problem+json, received %v", i, tc.resp.Header.Get("Content-Type"))
+		}
+		var p Problem
+		decoder := json.NewDecoder(tc.resp.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&p); err != nil {
+			t.Fatalf("%v: error decoding json data - %v", i, err)
+		}
+		if tc.resp.StatusCode != tc.status || p.Status != tc.status || p.Code != tc.code {
+			t.Fatalf("%v: expecting %v %v, received %v %+v", i, tc.status, tc.code, tc.resp.StatusCode, p)
+		}
+		if p.Type == "" || p.Title == "" || p.Detail == "" || p.Instance != tc.resp.Request.URL.Path {
+			t.Fatalf("%v: incomplete problem details %+v", i, p)
+		}
+	}
+	if allow := tests[0].resp.Header.Get("Allow"); allow != http.MethodGet {
+		t.Fatalf("Expecting Allow: GET, received %v", allow)
+	}
+}
+
+func TestAccountLifecycle(t *testing.T) {
+	// use a server of its own, the other tests expect the accounts in the data file
+	srv, err := New(8080, datafile)
+	if err != nil {
+		t.Fatalf("Failed to initialize server - %v", err)
+	}
+	send := func(method string, url string, body string) *http.Response {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	// POST /accounts
+	resp := send("POST", "http://localhost:8080/accounts", `{"name": "New", "currency": "EUR", "balance": "25"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusCreated, resp.StatusCode)
+	}
+	var acct ds.Account
+	if err := json.NewDecoder(resp.Body).Decode(&acct); err != nil {
+		t.Fatal("Error decoding json data")
+	}
+	if acct.Id == "" || acct.Currency != "EUR" || acct.Status != ds.StatusActive || acct.Balance.Cmp(money.MustParse("25")) != 0 {
+		t.Fatalf("Unexpected account details %+v", acct)
+	}
+	if resp.Header.Get("Location") != "/account/"+acct.Id {
+		t.Fatalf("Unexpected Location: %v", resp.Header.Get("Location"))
+	}
+	resp = send("POST", "http://localhost:8080/accounts", fmt.Sprintf(`{"id": %q, "name": "Again"}`, acct.Id))
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusConflict, resp.StatusCode)
+	}
+
+	// PATCH /account/<id>
+	resp = send("PATCH", "http://localhost:8080/account/"+gAccounts[0].Id, `{"status": "frozen"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusOK, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&acct); err != nil || acct.Status != ds.StatusFrozen {
+		t.Fatalf("Unexpected account details %+v, %v", acct, err)
+	}
+	resp = send("POST", "http://localhost:8080/transfer/", fmt.Sprintf(`{"from_id": %q, "to_id": %q, "amount": "1"}`, gAccounts[0].Id, gAccounts[1].Id))
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusConflict, resp.StatusCode)
+	}
+	resp = send("PATCH", "http://localhost:8080/account/"+gAccounts[1].Id, `{"status": "closed"}`)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusConflict, resp.StatusCode)
+	}
+	resp = send("PATCH", "http://localhost:8080/account/"+gAccounts[1].Id, `{"status": "gone"}`)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusUnprocessableEntity, resp.StatusCode)
+	}
+}
+
+func TestGetListQuery(t *testing.T) {
+	// follow the Link headers through all the pages
+	var accts []ds.Account
+	url := "http://localhost:8080/list/?sort=-balance&limit=60"
+	for pages := 0; url != ""; pages++ {
+		if pages > 10 {
+			t.Fatal("Too many pages")
+		}
+		req := httptest.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		gSrv.listHandler(w, req)
+		resp := w.Result()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expecting Status  %v, received %v\n", http.StatusOK, resp.StatusCode)
+		}
+		var page []ds.Account
+		if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+			t.Fatal("Error decoding json data")
+		}
+		accts = append(accts, page...)
+
+		url = ""
+		if link := resp.Header.Get("Link"); link != "" {
+			if !strings.HasPrefix(link, "</list/?") || !strings.HasSuffix(link, `>; rel="next"`) {
+				t.Fatalf("Unexpected Link header: %v", link)
+			}
+			url = "http://localhost:8080" + strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+		}
+	}
+	if len(accts) != len(gAccounts) {
+		t.Fatalf("Expecting %v accounts, received %v", len(gAccounts), len(accts))
+	}
+	for i := 1; i < len(accts); i++ {
+		if accts[i-1].Balance.Cmp(accts[i].Balance) < 0 {
+			t.Fatalf("Accounts are not sorted by descending balance at %v", i)
+		}
+	}
+
+	// invalid query parameters
+	for _, query := range []string{"limit=0", "min_balance=abc", "sort=date", "cursor=bogus"} {
+		req := httptest.NewRequest("GET", "http://localhost:8080/list/?"+query, nil)
+		w := httptest.NewRecorder()
+		gSrv.listHandler(w, req)
+		if w.Result().StatusCode != http.StatusBadRequest {
+			t.Fatalf("%v: expecting Status  %v, received %v\n", query, http.StatusBadRequest, w.Result().StatusCode)
+		}
+	}
+}
+
+func TestHolds(t *testing.T) {
+	// use a server of its own, the other tests expect the accounts in the data file
+	srv, err := New(8080, datafile)
+	if err != nil {
+		t.Fatalf("Failed to initialize server - %v", err)
+	}
+	send := func(method string, url string, body string) *http.Response {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		return w.Result()
+	}
+	from, to := gAccounts[0], gAccounts[1]
+
+	// POST /holds
+	resp := send("POST", "http://localhost:8080/holds", fmt.Sprintf(`{"account_id": %q, "to_id": %q, "amount": "10", "expires_in": 60}`, from.Id, to.Id))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusCreated, resp.StatusCode)
+	}
+	var h ds.Hold
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+		t.Fatal("Error decoding json data")
+	}
+	if h.Status != ds.HoldActive || h.Expires.Sub(h.Created) != time.Minute {
+		t.Fatalf("Unexpected hold details %+v", h)
+	}
+	if resp.Header.Get("Location") != fmt.Sprintf("/holds/%v", h.Id) {
+		t.Fatalf("Unexpected Location: %v", resp.Header.Get("Location"))
+	}
+
+	// the account exposes both balances
+	var acct ds.Account
+	json.NewDecoder(send("GET", "http://localhost:8080/account/"+from.Id, "").Body).Decode(&acct)
+	if acct.Balance != from.Balance || acct.Available != from.Balance.Sub(money.MustParse("10")) {
+		t.Fatalf("Unexpected account balances %+v", acct)
+	}
+
+	// GET /holds/<id>
+	resp = send("GET", fmt.Sprintf("http://localhost:8080/holds/%v", h.Id), "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusOK, resp.StatusCode)
+	}
+
+	// POST /holds/<id>/capture, partial
+	resp = send("POST", fmt.Sprintf("http://localhost:8080/holds/%v/capture", h.Id), `{"amount": "4"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusOK, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil || h.Status != ds.HoldCaptured || h.Tid == 0 {
+		t.Fatalf("Unexpected hold details %+v, %v", h, err)
+	}
+	json.NewDecoder(send("GET", "http://localhost:8080/account/"+from.Id, "").Body).Decode(&acct)
+	if expected := from.Balance.Sub(money.MustParse("4")); acct.Balance != expected || acct.Available != expected {
+		t.Fatalf("Unexpected account balances %+v", acct)
+	}
+
+	// POST /holds/<id>/void, after the capture and on a new hold
+	if resp = send("POST", fmt.Sprintf("http://localhost:8080/holds/%v/void", h.Id), ""); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusConflict, resp.StatusCode)
+	}
+	resp = send("POST", "http://localhost:8080/holds", fmt.Sprintf(`{"account_id": %q, "to_id": %q, "amount": "1"}`, from.Id, to.Id))
+	json.NewDecoder(resp.Body).Decode(&h)
+	resp = send("POST", fmt.Sprintf("http://localhost:8080/holds/%v/void", h.Id), "")
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil || h.Status != ds.HoldVoided {
+		t.Fatalf("Unexpected hold details %+v, %v", h, err)
+	}
+
+	// errors
+	for _, tc := range []struct {
+		method string
+		url    string
+		body   string
+		code   string
+	}{
+		{"GET", "http://localhost:8080/holds/1000", "", codeHoldNotFound},
+		{"GET", "http://localhost:8080/holds/abc", "", codeInvalidRequest},
+		{"POST", "http://localhost:8080/holds/1/refund", "", codeNotFound},
+		{"GET", "http://localhost:8080/holds", "", codeMethodNotAllowed},
+		{"POST", "http://localhost:8080/holds", fmt.Sprintf(`{"account_id": %q, "to_id": %q, "amount": "1", "expires_in": -1}`, from.Id, to.Id), codeInvalidHold},
+		{"POST", "http://localhost:8080/holds", fmt.Sprintf(`{"account_id": %q, "to_id": %q, "amount": "1000000"}`, from.Id, to.Id), codeInsufficientFunds},
+	} {
+		resp := send(tc.method, tc.url, tc.body)
+		var p Problem
+		if err := json.NewDecoder(resp.Body).Decode(&p); err != nil || p.Code != tc.code {
+			t.Fatalf("%v %v: expecting code %v, received %+v, %v", tc.method, tc.url, tc.code, p, err)
+		}
+	}
+}
+
+func TestRefund(t *testing.T) {
+	// use a server of its own, the other tests expect the accounts in the data file
+	srv, err := New(8080, datafile)
+	if err != nil {
+		t.Fatalf("Failed to initialize server - %v", err)
+	}
+	send := func(method string, url string, body string) *http.Response {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		return w.Result()
+	}
+	resp := send("POST", "http://localhost:8080/transfer/", fmt.Sprintf(`{"from_id": %q, "to_id": %q, "amount": "10"}`, gAccounts[0].Id, gAccounts[1].Id))
+	var tr TranferResponse
+	json.NewDecoder(resp.Body).Decode(&tr)
+
+	// POST /transaction/<id>/refund, partial and then the rest
+	resp = send("POST", fmt.Sprintf("http://localhost:8080/transaction/%v/refund", tr.TransactionId), `{"amount": "2.5"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusCreated, resp.StatusCode)
+	}
+	var refund ds.Transaction
+	if err := json.NewDecoder(resp.Body).Decode(&refund); err != nil || refund.RefundOf != tr.TransactionId || refund.Amount.String() != "2.50" {
+		t.Fatalf("Unexpected refund transaction %+v, %v", refund, err)
+	}
+	if resp.Header.Get("Location") != fmt.Sprintf("/transaction/%v", refund.Id) {
+		t.Fatalf("Unexpected Location: %v", resp.Header.Get("Location"))
+	}
+	resp = send("POST", fmt.Sprintf("http://localhost:8080/transaction/%v/refund", tr.TransactionId), "")
+	if err := json.NewDecoder(resp.Body).Decode(&refund); err != nil || refund.Amount.String() != "7.50" {
+		t.Fatalf("Unexpected refund transaction %+v, %v", refund, err)
+	}
+
+	// the transaction shows the amount refunded
+	var orig ds.Transaction
+	json.NewDecoder(send("GET", fmt.Sprintf("http://localhost:8080/transaction/%v", tr.TransactionId), "").Body).Decode(&orig)
+	if orig.Refunded == nil || orig.Refunded.String() != "10.00" {
+		t.Fatalf("Expecting 10.00 refunded, received %v", orig.Refunded)
+	}
+
+	// errors
+	for _, tc := range []struct {
+		method string
+		url    string
+		code   string
+	}{
+		{"POST", fmt.Sprintf("http://localhost:8080/transaction/%v/refund", tr.TransactionId), codeRefundExceeded},
+		{"POST", fmt.Sprintf("http://localhost:8080/transaction/%v/refund", refund.Id), codeNotRefundable},
+		{"POST", "http://localhost:8080/transaction/1000/refund", codeTransactionNotFound},
+		{"GET", fmt.Sprintf("http://localhost:8080/transaction/%v/refund", tr.TransactionId), codeMethodNotAllowed},
+		{"POST", fmt.Sprintf("http://localhost:8080/transaction/%v/reverse", tr.TransactionId), codeNotFound},
+	} {
+		var p Problem
+		if err := json.NewDecoder(send(tc.method, tc.url, "").Body).Decode(&p); err != nil || p.Code != tc.code {
+			t.Fatalf("%v %v: expecting code %v, received %+v, %v", tc.method, tc.url, tc.code, p, err)
+		}
+	}
+}
+
+func TestTransferBatch(t *testing.T) {
+	// use a server of its own, the other tests expect the accounts in the data file
+	srv, err := New(8080, datafile)
+	if err != nil {
+		t.Fatalf("Failed to initialize server - %v", err)
+	}
+	send := func(method string, body string) *http.Response {
+		req := httptest.NewRequest(method, "http://localhost:8080/transfers/batch", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		return w.Result()
+	}
+	a, b, c := gAccounts[0].Id, gAccounts[1].Id, gAccounts[2].Id
+
+	// POST /transfers/batch
+	resp := send("POST", fmt.Sprintf(`{"legs": [{"from_id": %q, "to_id": %q, "amount": "10"}, {"from_id": %q, "to_id": %q, "amount": "5"}]}`, a, b, b, c))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusOK, resp.StatusCode)
+	}
+	var res ds.BatchResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil || res.Id == 0 || len(res.Transactions) != 2 {
+		t.Fatalf("Unexpected batch result %+v, %v", res, err)
+	}
+	for _, tr := range res.Transactions {
+		if tr.BatchId != res.Id {
+			t.Fatalf("Expecting batch id %v, received %+v", res.Id, tr)
+		}
+	}
+
+	// errors, nothing is transferred by a failed batch
+	for _, tc := range []struct {
+		method string
+		body   string
+		code   string
+	}{
+		{"POST", fmt.Sprintf(`{"legs": [{"from_id": %q, "to_id": %q, "amount": "1"}, {"from_id": %q, "to_id": %q, "amount": "1000000"}]}`, c, a, a, b), codeInsufficientFunds},
+		{"POST", fmt.Sprintf(`{"legs": [{"from_id": %q, "to_id": %q, "amount": "1"}]}`, a, a), codeSameAccount},
+		{"POST", `{"legs": []}`, codeInvalidBatch},
+		{"POST", `{"legs": {}}`, codeInvalidJSON},
+		{"GET", "", codeMethodNotAllowed},
+	} {
+		var p Problem
+		if err := json.NewDecoder(send(tc.method, tc.body).Body).Decode(&p); err != nil || p.Code != tc.code {
+			t.Fatalf("%v %v: expecting code %v, received %+v, %v", tc.method, tc.body, tc.code, p, err)
+		}
+	}
+	acc, _ := srv.data.Get(a)
+	if acc.Balance.String() != "77.11" {
+		t.Fatalf("Expecting balance 77.11, received %v", acc.Balance)
+	}
+}
+
+func TestLedger(t *testing.T) {
+	// use a server of its own, the other tests expect the accounts in the data file
+	srv, err := New(8080, datafile)
+	if err != nil {
+		t.Fatalf("Failed to initialize server - %v", err)
+	}
+	send := func(method string, url string, body string) *http.Response {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		return w.Result()
+	}
+	resp := send("POST", "http://localhost:8080/transfer/", fmt.Sprintf(`{"from_id": %q, "to_id": %q, "amount": "10"}`, gAccounts[0].Id, gAccounts[1].Id))
+	var tr TranferResponse
+	json.NewDecoder(resp.Body).Decode(&tr)
+
+	// GET /admin/ledger
+	resp = send("GET", "http://localhost:8080/admin/ledger", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusOK, resp.StatusCode)
+	}
+	var report ledger.Report
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil || !report.Balanced || len(report.Totals) != 1 || report.Entries != len(gAccounts)+1 {
+		t.Fatalf("Unexpected ledger report %+v, %v", report, err)
+	}
+
+	// the transaction shows its postings
+	var orig ds.Transaction
+	json.NewDecoder(send("GET", fmt.Sprintf("http://localhost:8080/transaction/%v", tr.TransactionId), "").Body).Decode(&orig)
+	if len(orig.Postings) != 2 || orig.Postings[0].Side != ledger.Debit || orig.Postings[0].Account != gAccounts[0].Id {
+		t.Fatalf("Unexpected postings %+v", orig.Postings)
+	}
+
+	var p Problem
+	if err := json.NewDecoder(send("POST", "http://localhost:8080/admin/ledger", "").Body).Decode(&p); err != nil || p.Code != codeMethodNotAllowed {
+		t.Fatalf("Expecting code %v, received %+v, %v", codeMethodNotAllowed, p, err)
+	}
+}
+
+func TestOverdraft(t *testing.T) {
+	// use a server of its own, the other tests expect the accounts in the data file
+	srv, err := New(8080, datafile)
+	if err != nil {
+		t.Fatalf("Failed to initialize server - %v", err)
+	}
+	send := func(method string, url string, body string) *http.Response {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	// POST /accounts and PATCH /account/<id> with an overdraft limit
+	var acct ds.Account
+	json.NewDecoder(send("POST", "http://localhost:8080/accounts", `{"id": "biz", "name": "Business", "overdraft_limit": "100"}`).Body).Decode(&acct)
+	if acct.OverdraftLimit.String() != "100.00" {
+		t.Fatalf("Expecting overdraft limit 100.00, received %v", acct.OverdraftLimit)
+	}
+	json.NewDecoder(send("PATCH", "http://localhost:8080/account/biz", `{"overdraft_limit": "25"}`).Body).Decode(&acct)
+	if acct.OverdraftLimit.String() != "25.00" {
+		t.Fatalf("Expecting overdraft limit 25.00, received %v", acct.OverdraftLimit)
+	}
+	resp := send("POST", "http://localhost:8080/transfer/", fmt.Sprintf(`{"from_id": "biz", "to_id": %q, "amount": "25"}`, gAccounts[0].Id))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusOK, resp.StatusCode)
+	}
+
+	// GET /account/<id>/overdraft
+	var events []ds.OverdraftEvent
+	resp = send("GET", "http://localhost:8080/account/biz/overdraft", "")
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil || len(events) != 1 || events[0].Event != ds.OverdraftEntered || events[0].Balance.String() != "-25.00" {
+		t.Fatalf("Unexpected overdraft events %+v, %v", events, err)
+	}
+
+	// errors
+	for _, tc := range []struct {
+		method string
+		url    string
+		body   string
+		code   string
+	}{
+		{"POST", "http://localhost:8080/transfer/", fmt.Sprintf(`{"from_id": "biz", "to_id": %q, "amount": "0.01"}`, gAccounts[0].Id), codeInsufficientFunds},
+		{"PATCH", "http://localhost:8080/account/biz", `{"overdraft_limit": "-1"}`, codeInvalidAmount},
+		{"GET", "http://localhost:8080/account/none/overdraft", "", codeAccountNotFound},
+		{"POST", "http://localhost:8080/account/biz/overdraft", "", codeMethodNotAllowed},
+	} {
+		var p Problem
+		if err := json.NewDecoder(send(tc.method, tc.url, tc.body).Body).Decode(&p); err != nil || p.Code != tc.code {
+			t.Fatalf("%v %v: expecting code %v, received %+v, %v", tc.method, tc.url, tc.code, p, err)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rules.json")
+	os.WriteFile(file, []byte(`{"rules": [{"name": "single", "type": "max_amount", "limit": "5", "currency": "USD"}]}`), 0644)
+	srv, err := NewWithConfig(Config{Port: 8080, Datastore: memds.Config{DataFile: datafile}, RulesFile: file})
+	if err != nil {
+		t.Fatalf("Failed to initialize server - %v", err)
+	}
+	send := func(amount string) *http.Response {
+		body := fmt.Sprintf(`{"from_id": %q, "to_id": %q, "amount": %q}`, gAccounts[0].Id, gAccounts[1].Id, amount)
+		req := httptest.NewRequest("POST", "http://localhost:8080/transfer/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		return w.Result()
+	}
+	if resp := send("5"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusOK, resp.StatusCode)
+	}
+
+	// the problem names the rule violated
+	resp := send("5.01")
+	var p Problem
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil || resp.StatusCode != http.StatusUnprocessableEntity || p.Code != codeRuleViolation || p.Rule != "single" {
+		t.Fatalf("Expecting violation of rule single, received %v %+v, %v", resp.StatusCode, p, err)
+	}
+
+	// an invalid rules file fails the server
+	os.WriteFile(file, []byte(`{"rules": [{"name": "single", "type": "max_amount"}]}`), 0644)
+	if _, err := NewWithConfig(Config{Port: 8080, Datastore: memds.Config{DataFile: datafile}, RulesFile: file}); err == nil {
+		t.Fatal("Expecting error for invalid rules file")
+	}
+}
+
+func TestFees(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "fees.json")
+	os.WriteFile(file, []byte(fmt.Sprintf(`{"revenue_account": %q, "fees": [{"currency": "USD", "flat": "0.25", "percent": "2", "max": "1.00"}]}`, gAccounts[2].Id)), 0644)
+	srv, err := NewWithConfig(Config{Port: 8080, Datastore: memds.Config{DataFile: datafile}, FeesFile: file})
+	if err != nil {
+		t.Fatalf("Failed to initialize server - %v", err)
+	}
+	body := fmt.Sprintf(`{"from_id": %q, "to_id": %q, "amount": "10"}`, gAccounts[0].Id, gAccounts[1].Id)
+	req := httptest.NewRequest("POST", "http://localhost:8080/transfer/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	resp := w.Result()
+
+	// the response has the fee, the balance includes it
+	var tr TranferResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting Status  %v, received %v - %v\n", http.StatusOK, resp.StatusCode, err)
+	}
+	expected := gAccounts[0].Balance.Sub(money.MustParse("10.45"))
+	if tr.Fee == nil || tr.Fee.String() != "0.45" || tr.Balance.Cmp(expected) != 0 {
+		t.Fatalf("Unexpected response %+v", tr)
+	}
+	acct, _ := srv.data.Get(gAccounts[2].Id)
+	if acct.Balance.Cmp(gAccounts[2].Balance.Add(money.MustParse("0.45"))) != 0 {
+		t.Fatalf("Expecting revenue account credited with the fee, received %v", acct.Balance)
+	}
+
+	// a revenue account that does not exist fails the server
+	os.WriteFile(file, []byte(`{"revenue_account": "no-such-account", "fees": [{"currency": "USD", "flat": "1"}]}`), 0644)
+	if _, err := NewWithConfig(Config{Port: 8080, Datastore: memds.Config{DataFile: datafile}, FeesFile: file}); err == nil {
+		t.Fatal("Expecting error for unknown revenue account")
+	}
+}
+
+func TestInterest(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "interest.json")
+	os.WriteFile(file, []byte(fmt.Sprintf(`{"day_count": "actual/360", "expense_accounts": {"USD": %q}}`, gAccounts[2].Id)), 0644)
+	srv, err := NewWithConfig(Config{Port: 8080, Datastore: memds.Config{DataFile: datafile}, InterestFile: file})
+	if err != nil {
+		t.Fatalf("Failed to initialize server - %v", err)
+	}
+	send := func(method string, url string, body string) *http.Response {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	// POST /accounts and PATCH /account/<id> with an interest rate
+	var acct ds.Account
+	json.NewDecoder(send("POST", "http://localhost:8080/accounts", `{"id": "save", "name": "Savings", "type": "savings", "interest_rate": "0.045"}`).Body).Decode(&acct)
+	if acct.Type != ds.TypeSavings || acct.InterestRate.String() != "0.045" {
+		t.Fatalf("Unexpected savings account %+v", acct)
+	}
+	json.NewDecoder(send("PATCH", "http://localhost:8080/account/save", `{"interest_rate": "0.05"}`).Body).Decode(&acct)
+	if acct.InterestRate.String() != "0.05" {
+		t.Fatalf("Expecting interest rate 0.05, received %v", acct.InterestRate)
+	}
+
+	// GET /account/<id>/interest
+	var status ds.InterestStatus
+	resp := send("GET", "http://localhost:8080/account/save/interest", "")
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting Status  %v, received %v - %v\n", http.StatusOK, resp.StatusCode, err)
+	}
+	if status.AccountId != "save" || status.DayCount != "actual/360" || status.Rate.String() != "0.05" || !status.Accrued.IsZero() || status.Currency != "USD" {
+		t.Fatalf("Unexpected interest %+v", status)
+	}
+
+	// errors
+	for _, tc := range []struct {
+		method string
+		url    string
+		body   string
+		code   string
+	}{
+		{"GET", fmt.Sprintf("http://localhost:8080/account/%v/interest", gAccounts[0].Id), "", codeInvalidAccount},
+		{"GET", "http://localhost:8080/account/none/interest", "", codeAccountNotFound},
+		{"POST", "http://localhost:8080/account/save/interest", "", codeMethodNotAllowed},
+		{"POST", "http://localhost:8080/accounts", `{"name": "Savings", "type": "savings"}`, codeInvalidAccount},
+		{"POST", "http://localhost:8080/accounts", `{"name": "Savings", "type": "loan"}`, codeInvalidAccount},
+		{"PATCH", fmt.Sprintf("http://localhost:8080/account/%v", gAccounts[0].Id), `{"interest_rate": "0.01"}`, codeInvalidAccount},
+	} {
+		var p Problem
+		if err := json.NewDecoder(send(tc.method, tc.url, tc.body).Body).Decode(&p); err != nil || p.Code != tc.code {
+			t.Fatalf("%v %v: expecting code %v, received %+v, %v", tc.method, tc.url, tc.code, p, err)
+		}
+	}
+}
+
+func TestSchedules(t *testing.T) {
+	clk := clock.NewFake(time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC))
+	file := filepath.Join(t.TempDir(), "schedules.json")
+	srv, err := NewWithConfig(Config{Port: 8080, Datastore: memds.Config{DataFile: datafile, Clock: clk}, Scheduler: scheduler.Config{File: file}})
+	if err != nil {
+		t.Fatalf("Failed to initialize server - %v", err)
+	}
+	send := func(method string, url string, body string) *http.Response {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	// POST /schedules
+	body := fmt.Sprintf(`{"from_id": %q, "to_id": %q, "amount": "5.00", "frequency": "weekly", "start_at": "2026-01-02T09:00:00Z", "count": 2}`, gAccounts[0].Id, gAccounts[1].Id)
+	resp := send("POST", "http://localhost:8080/schedules", body)
+	var sc scheduler.Schedule
+	if err := json.NewDecoder(resp.Body).Decode(&sc); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expecting Status  %v, received %v - %v\n", http.StatusCreated, resp.StatusCode, err)
+	}
+	if resp.Header.Get("Location") != fmt.Sprintf("/schedules/%v", sc.Id) || sc.Status != scheduler.StatusActive || sc.NextRun == nil {
+		t.Fatalf("Unexpected schedule %+v", sc)
+	}
+
+	// the transfers are executed when due, on the clock of the datastore
+	clk.Set(time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC))
+	if n := srv.schedules.Run(); n != 2 {
+		t.Fatalf("Expecting 2 transfers, %v attempted", n)
+	}
+	json.NewDecoder(send("GET", fmt.Sprintf("http://localhost:8080/schedules/%v", sc.Id), "").Body).Decode(&sc)
+	if sc.Status != scheduler.StatusCompleted || len(sc.Runs) != 2 || sc.Runs[1].Status != scheduler.RunSucceeded {
+		t.Fatalf("Expecting the schedule completed, received %+v", sc)
+	}
+	if acct, _ := srv.data.Get(gAccounts[1].Id); acct.Balance.Cmp(gAccounts[1].Balance.Add(money.MustParse("10.00"))) != 0 {
+		t.Fatalf("Expecting the to account credited 10.00, received %v", acct.Balance)
+	}
+
+	// PATCH, DELETE and GET /schedules
+	body = fmt.Sprintf(`{"from_id": %q, "to_id": %q, "amount": "5.00", "frequency": "monthly"}`, gAccounts[0].Id, gAccounts[2].Id)
+	json.NewDecoder(send("POST", "http://localhost:8080/schedules", body).Body).Decode(&sc)
+	json.NewDecoder(send("PATCH", fmt.Sprintf("http://localhost:8080/schedules/%v", sc.Id), `{"amount": "7.50", "status": "paused"}`).Body).Decode(&sc)
+	if sc.Amount.String() != "7.50" || sc.Status != scheduler.StatusPaused {
+		t.Fatalf("Unexpected schedule %+v", sc)
+	}
+	json.NewDecoder(send("DELETE", fmt.Sprintf("http://localhost:8080/schedules/%v", sc.Id), "").Body).Decode(&sc)
+	if sc.Status != scheduler.StatusCancelled {
+		t.Fatalf("Expecting the schedule cancelled, received %+v", sc)
+	}
+	var list []scheduler.Schedule
+	json.NewDecoder(send("GET", "http://localhost:8080/schedules?account_id="+gAccounts[2].Id, "").Body).Decode(&list)
+	if len(list) != 1 || list[0].Id != sc.Id {
+		t.Fatalf("Expecting the schedule of the account, received %+v", list)
+	}
+
+	// errors
+	for _, tc := range []struct {
+		method string
+		url    string
+		body   string
+		code   string
+	}{
+		{"GET", "http://localhost:8080/schedules/99", "", codeScheduleNotFound},
+		{"GET", "http://localhost:8080/schedules/x", "", codeInvalidRequest},
+		{"DELETE", fmt.Sprintf("http://localhost:8080/schedules/%v", sc.Id), "", codeScheduleInactive},
+		{"PUT", "http://localhost:8080/schedules", "", codeMethodNotAllowed},
+		{"POST", "http://localhost:8080/schedules", fmt.Sprintf(`{"from_id": %q, "to_id": %q, "amount": "1", "frequency": "yearly"}`, gAccounts[0].Id, gAccounts[1].Id), codeInvalidSchedule},
+		{"POST", "http://localhost:8080/schedules", fmt.Sprintf(`{"from_id": %q, "to_id": %q, "amount": "1", "frequency": "daily", "start_at": "2024-01-01T09:00:00Z"}`, gAccounts[0].Id, gAccounts[1].Id), codeInvalidSchedule},
+		{"POST", "http://localhost:8080/schedules", fmt.Sprintf(`{"from_id": %q, "to_id": "none", "amount": "1"}`, gAccounts[0].Id), codeAccountNotFound},
+	} {
+		var p Problem
+		if err := json.NewDecoder(send(tc.method, tc.url, tc.body).Body).Decode(&p); err != nil || p.Code != tc.code {
+			t.Fatalf("%v %v: expecting code %v, received %+v, %v", tc.method, tc.url, tc.code, p, err)
+		}
+	}
+}
+
+func TestApprovals(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "approvals.json")
+	if err := os.WriteFile(file, []byte(`{"thresholds": {"USD": "500.00"}, "expiry": "24h"}`), 0644); err != nil {
+		t.Fatalf("Failed to write approvals file - %v", err)
+	}
+	srv, err := NewWithConfig(Config{Port: 8080, Datastore: memds.Config{DataFile: datafile}, ApprovalsFile: file})
+	if err != nil {
+		t.Fatalf("Failed to initialize server - %v", err)
+	}
+	send := func(method string, url string, body string, principal string) *http.Response {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if principal != "" {
+			req.Header.Set("X-Principal", principal)
+		}
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	// POST /transfer/ above the threshold is held for approval
+	from, to := gAccounts[2], gAccounts[1]
+	body := fmt.Sprintf(`{"from_id": %q, "to_id": %q, "amount": "1000.00"}`, from.Id, to.Id)
+	resp := send("POST", "http://localhost:8080/transfer/", body, "maker")
+	var p ds.PendingTransfer
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil || resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expecting Status  %v, received %v - %v\n", http.StatusAccepted, resp.StatusCode, err)
+	}
+	if resp.Header.Get("Location") != fmt.Sprintf("/transfers/pending/%v", p.Id) || p.Status != ds.PendingAwaiting || p.RequestedBy != "maker" {
+		t.Fatalf("Unexpected pending transfer %+v", p)
+	}
+	var acct ds.Account
+	json.NewDecoder(send("GET", "http://localhost:8080/account/"+from.Id, "", "").Body).Decode(&acct)
+	if acct.Balance != from.Balance || acct.Available.Cmp(from.Balance.Sub(money.MustParse("1000.00"))) != 0 {
+		t.Fatalf("Expecting the funds held, received %+v", acct)
+	}
+	var list []ds.PendingTransfer
+	json.NewDecoder(send("GET", "http://localhost:8080/transfers/pending?status=pending", "", "").Body).Decode(&list)
+	if len(list) != 1 || list[0].Id != p.Id {
+		t.Fatalf("Expecting the pending transfer, received %+v", list)
+	}
+
+	// POST /transfers/pending/<id>/approve by another principal executes the transfer
+	resp = send("POST", fmt.Sprintf("http://localhost:8080/transfers/pending/%v/approve", p.Id), "", "checker")
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting Status  %v, received %v - %v\n", http.StatusOK, resp.StatusCode, err)
+	}
+	if p.Status != ds.PendingApproved || p.DecidedBy != "checker" || p.Tid == 0 {
+		t.Fatalf("Expecting the transfer approved, received %+v", p)
+	}
+	json.NewDecoder(send("GET", "http://localhost:8080/account/"+to.Id, "", "").Body).Decode(&acct)
+	if acct.Balance.Cmp(to.Balance.Add(money.MustParse("1000.00"))) != 0 {
+		t.Fatalf("Expecting the to account credited 1000.00, received %v", acct.Balance)
+	}
+
+	// POST /transfers/pending/<id>/reject releases the funds
+	json.NewDecoder(send("POST", "http://localhost:8080/transfer/", body, "maker").Body).Decode(&p)
+	json.NewDecoder(send("POST", fmt.Sprintf("http://localhost:8080/transfers/pending/%v/reject", p.Id), `{"reason": "duplicate"}`, "checker").Body).Decode(&p)
+	if p.Status != ds.PendingRejected || p.Reason != "duplicate" || p.DecidedBy != "checker" {
+		t.Fatalf("Expecting the transfer rejected, received %+v", p)
+	}
+	json.NewDecoder(send("GET", fmt.Sprintf("http://localhost:8080/transfers/pending/%v", p.Id), "", "").Body).Decode(&p)
+	if p.Status != ds.PendingRejected {
+		t.Fatalf("Expecting the transfer rejected, received %+v", p)
+	}
+
+	// transfers up to the threshold are executed
+	resp = send("POST", "http://localhost:8080/transfer/", fmt.Sprintf(`{"from_id": %q, "to_id": %q, "amount": "500.00"}`, from.Id, to.Id), "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusOK, resp.StatusCode)
+	}
+
+	// errors
+	json.NewDecoder(send("POST", "http://localhost:8080/transfer/", body, "maker").Body).Decode(&p)
+	for _, tc := range []struct {
+		method    string
+		url       string
+		body      string
+		principal string
+		code      string
+	}{
+		{"POST", "http://localhost:8080/transfer/", body, "", codePrincipalRequired},
+		{"POST", fmt.Sprintf("http://localhost:8080/transfers/pending/%v/approve", p.Id), "", "maker", codeSelfApproval},
+		{"POST", fmt.Sprintf("http://localhost:8080/transfers/pending/%v/approve", p.Id), "", "", codePrincipalRequired},
+		{"POST", "http://localhost:8080/transfers/pending/1/approve", "", "checker", codePendingInactive},
+		{"GET", "http://localhost:8080/transfers/pending/99", "", "", codePendingNotFound},
+		{"GET", "http://localhost:8080/transfers/pending/x", "", "", codeInvalidRequest},
+		{"GET", "http://localhost:8080/transfers/pending?status=open", "", "", codeInvalidQuery},
+		{"POST", "http://localhost:8080/transfers/pending/1/cancel", "", "checker", codeNotFound},
+		{"GET", "http://localhost:8080/transfers/pending/1/approve", "", "checker", codeMethodNotAllowed},
+		{"POST", "http://localhost:8080/transfers/batch", fmt.Sprintf(`{"legs": [%v]}`, body), "maker", codeInvalidBatch},
+		{"POST", "http://localhost:8080/holds", fmt.Sprintf(`{"account_id": %q, "to_id": %q, "amount": "1000.00"}`, from.Id, to.Id), "maker", codeInvalidHold},
+		{"POST", "http://localhost:8080/schedules", fmt.Sprintf(`{"from_id": %q, "to_id": %q, "amount": "1000.00", "frequency": "once"}`, from.Id, to.Id), "maker", codeInvalidSchedule},
+	} {
+		var p Problem
+		if err := json.NewDecoder(send(tc.method, tc.url, tc.body, tc.principal).Body).Decode(&p); err != nil || p.Code != tc.code {
+			t.Fatalf("%v %v: expecting code %v, received %+v, %v", tc.method, tc.url, tc.code, p, err)
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	dir := t.TempDir()
+	keys := fmt.Sprintf(`{"keys": [
+		{"name": "ops", "sha256": %q, "scopes": ["admin"]},
+		{"name": "reader", "sha256": %q, "scopes": ["read:accounts"]},
+		{"name": "checker", "sha256": %q, "scopes": ["approve:transfers"]},
+		{"name": "merchant", "sha256": %q, "scopes": ["read:accounts", "write:transfers"], "accounts": [%q]}
+	]}`, auth.Hash("ops-key"), auth.Hash("reader-key"), auth.Hash("checker-key"), auth.Hash("merchant-key"), gAccounts[0].Id)
+	if err := os.WriteFile(filepath.Join(dir, "keys.json"), []byte(keys), 0644); err != nil {
+		t.Fatalf("Failed to write API keys file - %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "approvals.json"), []byte(`{"thresholds": {"USD": "500.00"}}`), 0644); err != nil {
+		t.Fatalf("Failed to write approvals file - %v", err)
+	}
+	srv, err := NewWithConfig(Config{Port: 8080, Datastore: memds.Config{DataFile: datafile}, ApprovalsFile: filepath.Join(dir, "approvals.json"), APIKeysFile: filepath.Join(dir, "keys.json")})
+	if err != nil {
+		t.Fatalf("Failed to initialize server - %v", err)
+	}
+	send := func(method string, url string, body string, key string) *http.Response {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		req.Header.Set("X-Principal", "spoofed")
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	// a merchant key debits its own account
+	own, other := gAccounts[0], gAccounts[1]
+	resp := send("POST", "http://localhost:8080/transfer/", fmt.Sprintf(`{"from_id": %q, "to_id": %q, "amount": "10.00"}`, own.Id, other.Id), "merchant-key")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusOK, resp.StatusCode)
+	}
+	if resp = send("GET", "http://localhost:8080/account/"+own.Id, "", "merchant-key"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusOK, resp.StatusCode)
+	}
+	if resp = send("GET", "http://localhost:8080/list/", "", "reader-key"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusOK, resp.StatusCode)
+	}
+
+	// the idempotency keys of an API key are its own, the same key of another API key is another transfer
+	idempotent := func(key string) (*http.Response, TranferResponse) {
+		req := httptest.NewRequest("POST", "http://localhost:8080/transfer/", strings.NewReader(fmt.Sprintf(`{"from_id": %q, "to_id": %q, "amount": "1.00"}`, own.Id, other.Id)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+key)
+		req.Header.Set("Idempotency-Key", "order-1")
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		var res TranferResponse
+		json.NewDecoder(w.Result().Body).Decode(&res)
+		return w.Result(), res
+	}
+	resp, first := idempotent("merchant-key")
+	if resp.StatusCode != http.StatusOK || first.TransactionId == 0 {
+		t.Fatalf("Expecting Status  %v, received %v\n", http.StatusOK, resp.StatusCode)
+	}
+	if resp, res := idempotent("merchant-key"); resp.Header.Get("Idempotent-Replayed") != "true" || res.TransactionId != first.TransactionId {
+		t.Fatalf("Expecting the transfer replayed, received status %v, %+v", resp.StatusCode, res)
+	}
+	if resp, res := idempotent("ops-key"); resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "" || res.TransactionId == first.TransactionId {
+		t.Fatalf("Expecting another transfer, received status %v, %+v", resp.StatusCode, res)
+	}
+
+	// the principal is the name of the key, not the X-Principal header
+	body := fmt.Sprintf(`{"from_id": %q, "to_id": %q, "amount": "1000.00"}`, gAccounts[2].Id, other.Id)
+	var p ds.PendingTransfer
+	json.NewDecoder(send("POST", "http://localhost:8080/transfer/", body, "ops-key").Body).Decode(&p)
+	if p.Status != ds.PendingAwaiting || p.RequestedBy != "ops" {
+		t.Fatalf("Expecting the transfer requested by ops, received %+v", p)
+	}
+	var list []ds.PendingTransfer
+	json.NewDecoder(send("GET", "http://localhost:8080/transfers/pending", "", "merchant-key").Body).Decode(&list)
+	if len(list) != 0 {
+		t.Fatalf("Expecting no pending transfers of the merchant, received %+v", list)
+	}
+	approve := fmt.Sprintf("http://localhost:8080/transfers/pending/%v/approve", p.Id)
+	json.NewDecoder(send("POST", approve, "", "checker-key").Body).Decode(&p)
+	if p.Status != ds.PendingApproved || p.DecidedBy != "checker" {
+		t.Fatalf("Expecting the transfer approved by checker, received %+v", p)
+	}
+
+	// errors
+	for _, tc := range []struct {
+		method string
+		url    string
+		body   string
+		key    string
+		code   string
+	}{
+		{"GET", "http://localhost:8080/list/", "", "", codeUnauthorized},
+		{"GET", "http://localhost:8080/list/", "", "wrong-key", codeUnauthorized},
+		{"POST", "http://localhost:8080/transfer/", body, "reader-key", codeForbidden},
+		{"POST", "http://localhost:8080/transfer/", fmt.Sprintf(`{"from_id": %q, "to_id": %q, "amount": "10.00"}`, other.Id, own.Id), "merchant-key", codeForbidden},
+		{"POST", "http://localhost:8080/transfers/batch", fmt.Sprintf(`{"legs": [{"from_id": %q, "to_id": %q, "amount": "10.00"}]}`, other.Id, own.Id), "merchant-key", codeForbidden},
+		{"POST", "http://localhost:8080/holds", fmt.Sprintf(`{"account_id": %q, "amount": "10.00"}`, other.Id), "merchant-key", codeForbidden},
+		{"GET", "http://localhost:8080/account/" + other.Id, "", "merchant-key", codeForbidden},
+		{"GET", "http://localhost:8080/list/", "", "merchant-key", codeForbidden},
+		{"GET", "http://localhost:8080/transfers/pending/1", "", "merchant-key", codeForbidden},
+		{"POST", approve, "", "reader-key", codeForbidden},
+		{"POST", "http://localhost:8080/transfers/pending/1/reject", "", "checker-key", codeForbidden},
+		{"POST", "http://localhost:8080/accounts", `{"name": "x", "balance": "1.00"}`, "merchant-key", codeForbidden},
+		{"POST", "http://localhost:8080/admin/snapshot", "", "reader-key", codeForbidden},
+	} {
+		var p Problem
+		if err := json.NewDecoder(send(tc.method, tc.url, tc.body, tc.key).Body).Decode(&p); err != nil || p.Code != tc.code {
+			t.Fatalf("%v %v: expecting code %v, received %+v, %v", tc.method, tc.url, tc.code, p, err)
+		}
+	}
+	if resp = send("GET", "http://localhost:8080/list/", "", ""); resp.Header.Get("WWW-Authenticate") == "" {
+		t.Fatal("Expecting the WWW-Authenticate header")
+	}
+}
+
+// end-of-file